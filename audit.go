@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// auditTransport is an http.RoundTripper that writes the metadata of every outbound Graph request
+// to a dedicated security log as JSON lines, for an auditable trail of Graph API interactions.
+// Credentials are redacted: the Authorization header and URL query parameters that carry tokens.
+// Request bodies are not logged, only their size.
+type auditTransport struct {
+	next http.RoundTripper
+	now  func() time.Time // clock, for tests (default: time.Now)
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// auditEntry is a single line of the security log.
+type auditEntry struct {
+	Time       time.Time           `json:"time"`
+	Method     string              `json:"method"`
+	URL        string              `json:"url"`
+	Header     map[string][]string `json:"header"`
+	BodyBytes  int64               `json:"body_bytes"`
+	Status     int                 `json:"status,omitempty"`
+	Error      string              `json:"error,omitempty"`
+	DurationMS int64               `json:"duration_ms"`
+}
+
+const redacted = "[REDACTED]"
+
+// RoundTrip performs req with the wrapped transport and logs it.
+func (t *auditTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	now := time.Now
+	if t.now != nil {
+		now = t.now
+	}
+	start := now()
+	resp, err := t.next.RoundTrip(req)
+
+	entry := auditEntry{
+		Time:       start.UTC(),
+		Method:     req.Method,
+		URL:        redactURL(req.URL),
+		Header:     redactHeader(req.Header),
+		BodyBytes:  req.ContentLength,
+		DurationMS: now().Sub(start).Milliseconds(),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	} else {
+		entry.Status = resp.StatusCode
+	}
+	line, _ := json.Marshal(entry)
+
+	t.mu.Lock()
+	_, _ = t.out.Write(append(line, '\n'))
+	t.mu.Unlock()
+	return resp, err
+}
+
+// redactHeader returns a copy of h with the Authorization header value replaced.
+func redactHeader(h http.Header) map[string][]string {
+	out := make(map[string][]string, len(h))
+	for key, values := range h {
+		if strings.EqualFold(key, "Authorization") {
+			scheme, _, _ := strings.Cut(h.Get(key), " ")
+			out[key] = []string{scheme + " " + redacted}
+			continue
+		}
+		out[key] = values
+	}
+	return out
+}
+
+// redactURL returns u with the values of query parameters that look like credentials replaced,
+// such as the authtoken of a pre-authorized upload session URL.
+func redactURL(u *url.URL) string {
+	query := u.Query()
+	if len(query) == 0 {
+		return u.String()
+	}
+	for key := range query {
+		if k := strings.ToLower(key); strings.Contains(k, "token") || strings.Contains(k, "auth") || strings.Contains(k, "sig") {
+			query[key] = []string{redacted}
+		}
+	}
+	c := *u
+	c.RawQuery = query.Encode()
+	return c.String()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	var log bytes.Buffer
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	h := newTestGraphHandler(srv, 0)
+	h.client = &http.Client{Transport: &auditTransport{
+		next: http.DefaultTransport,
+		out:  &log,
+		now:  func() time.Time { return now },
+	}}
+
+	mime := []byte("Subject: Test\r\n\r\nHello\r\n")
+	if err := h.sendRawMimeMail(t.Context(), "secret-access-token", "sender@example.com", mime); err != nil {
+		t.Fatalf("sendRawMimeMail() error: %v", err)
+	}
+
+	if strings.Contains(log.String(), "secret-access-token") {
+		t.Fatalf("audit log contains the access token: %s", log.String())
+	}
+	var entry auditEntry
+	if err := json.Unmarshal(log.Bytes(), &entry); err != nil {
+		t.Fatalf("audit log line %q: %v", log.String(), err)
+	}
+	if !entry.Time.Equal(now) {
+		t.Errorf("time = %s, want %s", entry.Time, now)
+	}
+	if entry.Method != http.MethodPost {
+		t.Errorf("method = %q, want POST", entry.Method)
+	}
+	if want := srv.URL + "/users/sender@example.com/sendMail"; entry.URL != want {
+		t.Errorf("url = %q, want %q", entry.URL, want)
+	}
+	if got := entry.Header["Authorization"]; len(got) != 1 || got[0] != "Bearer [REDACTED]" {
+		t.Errorf("Authorization = %v, want redacted bearer token", got)
+	}
+	if got := entry.Header["Content-Type"]; len(got) != 1 || got[0] != "text/plain" {
+		t.Errorf("Content-Type = %v, want text/plain", got)
+	}
+	if want := int64(len("U3ViamVjdDogVGVzdA0KDQpIZWxsbw0K")); entry.BodyBytes != want {
+		t.Errorf("body_bytes = %d, want %d", entry.BodyBytes, want)
+	}
+	if entry.Status != http.StatusAccepted {
+		t.Errorf("status = %d, want %d", entry.Status, http.StatusAccepted)
+	}
+}
+
+func TestRedactURL(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPut, "https://outlook.office.com/api/v2.0/AttachmentSessions('1')?authtoken=eyJ0eXAi&size=10", nil)
+	got := redactURL(req.URL)
+	if strings.Contains(got, "eyJ0eXAi") || !strings.Contains(got, "size=10") {
+		t.Fatalf("redactURL() = %q, want authtoken redacted and size kept", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"strings"
+)
+
+// Batch failure policies applied when a message is split across several Graph sends.
+const (
+	batchPolicyStrict  = "strict"  // succeed only if every batch is sent
+	batchPolicyPartial = "partial" // succeed if at least one batch is sent
+)
+
+// deliver passes msg to the session handler to be sent from mailbox, splitting it into batches of at most
+// config.BatchRecipients envelope recipients when splitting is enabled.
+func (s *smtpSession) deliver(ctx context.Context, mailbox string, msg *mail.Message) error {
+	size := s.config.BatchRecipients
+	if size <= 0 || len(s.recipients) <= size {
+		return s.handler.handleMessage(ctx, mailbox, msg)
+	}
+
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+
+	batches := splitRecipients(s.recipients, size)
+	var errs []error
+	for i, batch := range batches {
+		bmsg := batchMessage(msg.Header, body, batch)
+		if rb, ok := msg.Body.(*rawBody); ok {
+			bmsg.Body = &rawBody{Reader: bmsg.Body, header: rb.header}
+		}
+		if err := s.handler.handleMessage(ctx, mailbox, bmsg); err != nil {
+			log.Printf("Failed to send batch %d/%d to %d recipient(s): %v", i+1, len(batches), len(batch), err)
+			err = fmt.Errorf("batch %d/%d: %w", i+1, len(batches), err)
+			reportError(ctx, err)
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	if s.config.BatchPolicy == batchPolicyPartial && len(errs) < len(batches) {
+		log.Printf("Accepted message with %d of %d batch(es) failed", len(errs), len(batches))
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// splitRecipients splits recipients into consecutive batches of at most size entries.
+func splitRecipients(recipients []mail.Address, size int) [][]mail.Address {
+	batches := make([][]mail.Address, 0, (len(recipients)+size-1)/size)
+	for size < len(recipients) {
+		batches = append(batches, recipients[:size:size])
+		recipients = recipients[size:]
+	}
+	return append(batches, recipients)
+}
+
+// batchMessage returns a copy of the message whose To, Cc and Bcc headers only list the
+// recipients of batch. Header addresses outside the batch are dropped so that Graph
+// delivers each recipient exactly once across all batches.
+func batchMessage(header mail.Header, body []byte, batch []mail.Address) *mail.Message {
+	inBatch := make(map[string]struct{}, len(batch))
+	for _, rcpt := range batch {
+		inBatch[asciiAddressOrSelf(rcpt.Address)] = struct{}{}
+	}
+
+	h := make(mail.Header, len(header))
+	for k, v := range header {
+		h[k] = append([]string(nil), v...)
+	}
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		addrs, _ := header.AddressList(field)
+		kept := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			if _, ok := inBatch[asciiAddressOrSelf(addr.Address)]; ok {
+				kept = append(kept, addr.String())
+			}
+		}
+		if len(kept) == 0 {
+			delete(h, field)
+			continue
+		}
+		h[field] = []string{strings.Join(kept, ", ")}
+	}
+
+	return &mail.Message{Header: h, Body: bytes.NewReader(body)}
+}
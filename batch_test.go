@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/mail"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// batchHandler records each batch and fails batches containing any address in fail.
+type batchHandler struct {
+	batches [][]string
+	fail    map[string]bool
+}
+
+func (h *batchHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	var rcpts []string
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		addrs, _ := msg.Header.AddressList(field)
+		for _, addr := range addrs {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	h.batches = append(h.batches, rcpts)
+	for _, rcpt := range rcpts {
+		if h.fail[rcpt] {
+			return errors.New("send failed")
+		}
+	}
+	return nil
+}
+
+func newBatchSession(t *testing.T, policy string, h *batchHandler) *smtpSession {
+	t.Helper()
+	session := newTestSessionWithT(t)
+	session.config.BatchRecipients = 2
+	session.config.BatchPolicy = policy
+	session.handler = h
+	session.auth = true
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	for _, rcpt := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com", "e@example.com"} {
+		if err := session.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt(%s) error: %v", rcpt, err)
+		}
+	}
+	return session
+}
+
+func batchData(session *smtpSession) error {
+	return session.Data(strings.NewReader("From: sender@example.com\r\nTo: a@example.com, c@example.com\r\nSubject: Test\r\n\r\nHello\r\n"))
+}
+
+func TestDeliverBatchesAllSuccess(t *testing.T) {
+	h := &batchHandler{}
+	session := newBatchSession(t, batchPolicyStrict, h)
+
+	if err := batchData(session); err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+
+	if len(h.batches) != 3 {
+		t.Fatalf("batches = %v, want 3 batches", h.batches)
+	}
+	want := [][]string{
+		{"a@example.com", "b@example.com"},
+		{"c@example.com", "d@example.com"},
+		{"e@example.com"},
+	}
+	for i, batch := range want {
+		if len(h.batches[i]) != len(batch) {
+			t.Fatalf("batch %d = %v, want %v", i, h.batches[i], batch)
+		}
+		for _, rcpt := range batch {
+			if !slices.Contains(h.batches[i], rcpt) {
+				t.Errorf("batch %d = %v, want %s", i, h.batches[i], rcpt)
+			}
+		}
+	}
+}
+
+func TestDeliverBatchesPartialFailure(t *testing.T) {
+	tests := []struct {
+		policy  string
+		wantErr bool
+	}{
+		{policy: batchPolicyStrict, wantErr: true},
+		{policy: batchPolicyPartial, wantErr: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			h := &batchHandler{fail: map[string]bool{"c@example.com": true}}
+			session := newBatchSession(t, tt.policy, h)
+
+			err := batchData(session)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Data() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(h.batches) != 3 {
+				t.Fatalf("batches = %v, want all 3 batches attempted", h.batches)
+			}
+		})
+	}
+}
+
+func TestDeliverBatchesAllFail(t *testing.T) {
+	for _, policy := range []string{batchPolicyStrict, batchPolicyPartial} {
+		t.Run(policy, func(t *testing.T) {
+			h := &batchHandler{fail: map[string]bool{
+				"a@example.com": true,
+				"c@example.com": true,
+				"e@example.com": true,
+			}}
+			session := newBatchSession(t, policy, h)
+
+			if err := batchData(session); err == nil {
+				t.Fatal("Data() error = nil, want error when every batch fails")
+			}
+		})
+	}
+}
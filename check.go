@@ -0,0 +1,94 @@
+// Package main provides the -check startup probe for smtp2graph.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// errPermissionMissing is returned by runCheck when a token is acquired but Graph refuses to send.
+var errPermissionMissing = errors.New("token acquired but Mail.Send permission is missing or not consented")
+
+// errDraftPermissionMissing is returned by runCheck when Graph refuses to create a draft, which
+// the configuration requires for every message.
+var errDraftPermissionMissing = errors.New("Mail.ReadWrite permission, needed to send messages as drafts, is missing or not consented")
+
+// runCheck verifies that a Graph token can be acquired, that drafts can be created in the mailbox,
+// and, if config.CheckSendTo is set, that a minimal message can be sent to it, distinguishing
+// missing authorization from other failures. Progress is written to out.
+//
+// Drafts are needed for messages over GRAPH_INLINE_LIMIT_BYTES, and for every message in json
+// send mode or with SAVE_TO_SENT_ITEMS disabled. Only in the latter cases is a missing
+// Mail.ReadWrite permission an error; otherwise it is reported as a warning.
+func runCheck(ctx context.Context, config *appConfig, h messageHandler, tokens func(context.Context) (string, error), drafts func(ctx context.Context, sender string) error, out io.Writer) error {
+	if _, err := tokens(ctx); err != nil {
+		return fmt.Errorf("token acquisition failed: %w", err)
+	}
+	fmt.Fprintln(out, "ok: Graph token acquired")
+
+	mailbox := config.mailbox(config.SenderEmail)
+	if mailbox == "" {
+		fmt.Fprintln(out, "skip: draft probe requires SENDER_EMAIL or GRAPH_SEND_AS")
+	} else if err := checkDraftPermission(ctx, config, drafts, mailbox, out); err != nil {
+		return err
+	}
+
+	if config.CheckSendTo == "" {
+		fmt.Fprintln(out, "skip: send probe disabled (CHECK_SEND_TO not set)")
+		return nil
+	}
+	if mailbox == "" {
+		return errors.New("send probe requires SENDER_EMAIL or GRAPH_SEND_AS")
+	}
+
+	msg, err := checkMessage(mailbox, config.CheckSendTo)
+	if err != nil {
+		return err
+	}
+	err = h.handleMessage(ctx, mailbox, msg)
+	var gerr *graphError
+	if errors.As(err, &gerr) && (gerr.StatusCode == http.StatusForbidden || gerr.StatusCode == http.StatusUnauthorized) {
+		return fmt.Errorf("%w: %s", errPermissionMissing, gerr.Status)
+	}
+	if err != nil {
+		return fmt.Errorf("send probe failed: %w", err)
+	}
+	fmt.Fprintf(out, "ok: Mail.Send verified by sending to %s\n", config.CheckSendTo)
+	return nil
+}
+
+// checkDraftPermission runs the draft probe of runCheck for mailbox.
+func checkDraftPermission(ctx context.Context, config *appConfig, drafts func(context.Context, string) error, mailbox string, out io.Writer) error {
+	err := drafts(ctx, mailbox)
+	var gerr *graphError
+	if errors.As(err, &gerr) && (gerr.StatusCode == http.StatusForbidden || gerr.StatusCode == http.StatusUnauthorized) {
+		if config.GraphSendMode == sendModeJSON || !config.SaveToSentItems {
+			return fmt.Errorf("%w: %s", errDraftPermissionMissing, gerr.Status)
+		}
+		fmt.Fprintf(out, "warning: Mail.ReadWrite permission missing (%s); messages over GRAPH_INLINE_LIMIT_BYTES cannot be sent\n", gerr.Status)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("draft probe failed: %w", err)
+	}
+	fmt.Fprintf(out, "ok: Mail.ReadWrite verified by creating and deleting a draft in %s\n", mailbox)
+	return nil
+}
+
+// checkMessage returns the minimal probe message sent by runCheck.
+func checkMessage(from, to string) (*mail.Message, error) {
+	raw := "From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: smtp2graph permission check\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"This message confirms that smtp2graph can send mail through Microsoft Graph.\r\n"
+	return mail.ReadMessage(strings.NewReader(raw))
+}
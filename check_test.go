@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newCheckHandler(t *testing.T, calls *atomic.Int32, status int) *graphMailHandler {
+	t.Helper()
+	h := newTestGraphHandler(newTestGraphServer(t, calls, status), 0)
+	h.config.SenderEmail = "sender@example.com"
+	h.config.CheckSendTo = "sender@example.com"
+	h.token = "token"
+	h.tokenExp = time.Now().Add(time.Hour).Unix()
+	return h
+}
+
+// draftsOK is a runCheck draft probe that always succeeds.
+func draftsOK(context.Context, string) error { return nil }
+
+func TestRunCheck(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		sendTo    string
+		wantCalls int32
+		wantErr   error
+	}{
+		{name: "fully working", status: http.StatusAccepted, sendTo: "sender@example.com", wantCalls: 1},
+		{name: "permission missing", status: http.StatusForbidden, sendTo: "sender@example.com", wantCalls: 1, wantErr: errPermissionMissing},
+		{name: "send probe disabled", status: http.StatusForbidden, wantCalls: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			h := newCheckHandler(t, &calls, tt.status)
+			h.config.CheckSendTo = tt.sendTo
+
+			err := runCheck(context.Background(), h.config, h, h.getCachedToken, draftsOK, io.Discard)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("runCheck() error: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("runCheck() error = %v, want %v", err, tt.wantErr)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Fatalf("requests = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRunCheckTokenFailure(t *testing.T) {
+	var calls atomic.Int32
+	h := newCheckHandler(t, &calls, http.StatusAccepted)
+	tokens := func(context.Context) (string, error) { return "", errors.New("invalid client secret") }
+
+	err := runCheck(context.Background(), h.config, h, tokens, draftsOK, io.Discard)
+	if err == nil || errors.Is(err, errPermissionMissing) {
+		t.Fatalf("runCheck() error = %v, want token acquisition error", err)
+	}
+	if got := calls.Load(); got != 0 {
+		t.Fatalf("requests = %d, want 0", got)
+	}
+}
+
+func TestRunCheckDraftPermission(t *testing.T) {
+	forbidden := &graphError{StatusCode: http.StatusForbidden, Status: "403 Forbidden"}
+	tests := []struct {
+		name     string
+		err      error
+		sendMode string
+		noSent   bool
+		wantErr  error
+	}{
+		{name: "verified"},
+		{name: "missing, only large messages need drafts", err: forbidden},
+		{name: "missing in json mode", err: forbidden, sendMode: sendModeJSON, wantErr: errDraftPermissionMissing},
+		{name: "missing without sent items", err: forbidden, noSent: true, wantErr: errDraftPermissionMissing},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			h := newCheckHandler(t, &calls, http.StatusAccepted)
+			h.config.CheckSendTo = ""
+			h.config.GraphSendMode = tt.sendMode
+			h.config.SaveToSentItems = !tt.noSent
+			var mailbox string
+			drafts := func(_ context.Context, sender string) error {
+				mailbox = sender
+				return tt.err
+			}
+
+			err := runCheck(context.Background(), h.config, h, h.getCachedToken, drafts, io.Discard)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("runCheck() error: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("runCheck() error = %v, want %v", err, tt.wantErr)
+			}
+			if mailbox != "sender@example.com" {
+				t.Fatalf("draft probe mailbox = %q, want sender@example.com", mailbox)
+			}
+		})
+	}
+}
+
+func TestCheckDrafts(t *testing.T) {
+	us := newUploadServer(t)
+	h := newUploadHandler(us)
+
+	if err := h.checkDrafts(context.Background(), "sender@example.com"); err != nil {
+		t.Fatalf("checkDrafts() error: %v", err)
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.drafts != 1 || !us.deleted {
+		t.Fatalf("drafts created = %d, deleted = %v; want 1, true", us.drafts, us.deleted)
+	}
+	if us.sent {
+		t.Fatal("check draft was sent")
+	}
+}
@@ -0,0 +1,53 @@
+// Package main provides the limit on concurrent Graph sends of smtp2graph.
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// errSendBusy is returned when no Graph send slot became free within GRAPH_CONCURRENCY_TIMEOUT.
+var errSendBusy = errors.New("too many concurrent sends to Microsoft Graph")
+
+// sendLimiter caps the number of sends to Graph in progress at once, so that a burst of SMTP
+// sessions does not trip tenant throttling. A nil limiter is unlimited.
+type sendLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration // maximum wait for a free slot
+}
+
+// newSendLimiter returns a limiter allowing max concurrent sends, or nil if max is not positive.
+func newSendLimiter(max int, timeout time.Duration) *sendLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &sendLimiter{slots: make(chan struct{}, max), timeout: timeout}
+}
+
+// acquire waits for a free send slot, for at most the limiter timeout. It returns errSendBusy
+// if none became free in time, or the context error if ctx is done first. Each successful
+// acquire must be followed by a release.
+func (l *sendLimiter) acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return errSendBusy
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees a slot taken by acquire.
+func (l *sendLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
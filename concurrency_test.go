@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandleMessageMaxConcurrency(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		timeout   time.Duration
+		wantPeak  int32
+		wantBusy  int
+		wantCalls int32
+	}{
+		{name: "unlimited", wantPeak: 4, wantCalls: 4},
+		{name: "capped", max: 2, timeout: 10 * time.Second, wantPeak: 2, wantCalls: 4},
+		{name: "timed out", max: 1, timeout: 20 * time.Millisecond, wantPeak: 1, wantBusy: 3, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var active, peak, calls atomic.Int32
+			// Sends block until all messages were submitted, so that they overlap.
+			release := make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				n := active.Add(1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+				<-release
+				active.Add(-1)
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer srv.Close()
+
+			h := newTestGraphHandler(srv, 0)
+			h.cred = &stubCredential{token: "token"}
+			h.sends = newSendLimiter(tt.max, tt.timeout)
+			// Fetch the token up front so that concurrent sends do not refresh it.
+			h.getCachedToken(context.Background())
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 4)
+			for range 4 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					msg, _ := mail.ReadMessage(strings.NewReader("To: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n"))
+					errs <- h.handleMessage(context.Background(), "sender@example.com", msg)
+				}()
+			}
+			// Let the sends start, and the ones waiting for a slot time out if they will.
+			time.Sleep(100 * time.Millisecond)
+			close(release)
+			wg.Wait()
+			close(errs)
+
+			busy := 0
+			for err := range errs {
+				switch {
+				case errors.Is(err, errSendBusy):
+					busy++
+				case err != nil:
+					t.Errorf("handleMessage() error: %v", err)
+				}
+			}
+			if busy != tt.wantBusy {
+				t.Errorf("busy sends = %d, want %d", busy, tt.wantBusy)
+			}
+			if got := peak.Load(); got != tt.wantPeak {
+				t.Errorf("peak concurrent sends = %d, want %d", got, tt.wantPeak)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("sends = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -2,8 +2,14 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/mail"
+	"net/textproto"
+	"net/url"
 	"os"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -14,42 +20,242 @@ import (
 //
 // Environment variables:
 //
-//	ENTRA_CLIENT_ID         - Microsoft Entra App registration client ID (required)
-//	ENTRA_TENANT_ID         - Microsoft Entra Directory (tenant) ID (required)
-//	ENTRA_CLIENT_SECRET     - Microsoft Entra App registration client secret (required)
-//	SENDER_EMAIL            - Email address used as sender (required)
-//	SENDER_PASSWORD         - Password for the sender email (required)
-//	SMTP_SERVER_ADDR        - Address to listen on (default: :1025)
-//	SMTP_SERVER_DOMAIN      - SMTP server domain (default: localhost)
-//	SMTP_MAX_MESSAGE_BYTES  - Maximum allowed message size in bytes (default: 10485760)
-//	SMTP_MAX_RECIPIENTS     - Maximum allowed recipients per message (default: 50)
-//	SMTP_WRITE_TIMEOUT      - Write timeout for SMTP connections (default: 10s, e.g. "5s", "1m")
-//	SMTP_READ_TIMEOUT       - Read timeout for SMTP connections (default: 10s, e.g. "5s", "1m")
-//	SENTRY_DSN              - Sentry DSN for error reporting (optional)
+//	ENTRA_USE_MANAGED_IDENTITY  - Use the Azure managed identity instead of an app registration (default: false)
+//	ENTRA_CLIENT_ID             - Microsoft Entra App registration client ID (required; with a managed identity, the optional user-assigned identity client ID)
+//	ENTRA_TENANT_ID             - Microsoft Entra Directory (tenant) ID (required unless ENTRA_USE_MANAGED_IDENTITY is set)
+//	ENTRA_CLIENT_SECRET         - Microsoft Entra App registration client secret (required unless ENTRA_CLIENT_CERT_PATH or ENTRA_USE_MANAGED_IDENTITY is set)
+//	ENTRA_CLIENT_CERT_PATH      - Path to a PEM or PKCS#12 client certificate with private key, used instead of the secret
+//	ENTRA_CLIENT_CERT_PASSWORD  - Password for the client certificate private key (optional)
+//	SENDER_EMAIL                - Email address used as sender (required unless SENDER_ACCOUNTS is set)
+//	GRAPH_SEND_AS               - Mailbox all messages are sent from, instead of the authenticated sender (optional)
+//	ALLOWED_SEND_AS             - Comma-separated From addresses whose mailbox messages may be sent from; others are rejected (optional)
+//	FROM_POLICY                 - Handling of a From that is not the authenticated sender: "rewrite", "reject" or "allow" (default: rewrite)
+//	ENFORCE_FROM_MATCH          - Shorthand for FROM_POLICY=reject (default: false)
+//	SENDER_FROM_POLICY          - Comma-separated sender:policy list overriding FROM_POLICY for those senders (optional)
+//	SENDER_PASSWORD             - Password for the sender email (required unless SENDER_ACCOUNTS is set)
+//	SENDER_ACCOUNTS             - Additional senders as a JSON object or comma-separated email:password list (optional)
+//	SENDER_HEADERS              - Headers added to the messages of each sender, as a JSON object of sender to header map (optional)
+//	SMTP_SERVER_ADDR            - Address to listen on, or "unix:" and a socket path (default: :1025)
+//	ENABLE_PROXY_PROTOCOL       - Require a PROXY protocol v1 or v2 header on each connection for the client address (default: false)
+//	MAX_CONNECTIONS_PER_IP      - Maximum open SMTP sessions per client IP address, 0 for no limit (default: 100)
+//	MAINTENANCE_WINDOWS         - Comma-separated recurring "[day] HH:MM-HH:MM" windows in which mail is refused (optional, e.g. "Sun 02:00-04:00")
+//	MAINTENANCE_TIMEZONE        - IANA time zone of MAINTENANCE_WINDOWS (default: the local time zone)
+//	SMTP_SERVER_DOMAIN          - SMTP server domain (default: localhost)
+//	EHLO_ALLOW_REGEX            - Regular expression HELO/EHLO hostnames must match in full; others are rejected (optional)
+//	SMTP_MAX_MESSAGE_BYTES      - Maximum allowed message size in bytes (default: 10485760)
+//	SMTP_MAX_RECIPIENTS         - Maximum allowed recipients per message (default: 50)
+//	MAX_HEADER_COUNT            - Maximum allowed header fields per message (default: 1000)
+//	MAX_HEADER_LINE_BYTES       - Maximum allowed length in bytes of a single (unfolded) header field (default: 65536)
+//	MAX_HEADER_BYTES            - Maximum total size in bytes of the header fields of a message; 0 disables (default: 0)
+//	MAX_BODY_BYTES              - Maximum total size in bytes of the body parts of a message, excluding attachments (optional)
+//	MAX_ATTACHMENT_BYTES        - Maximum total size in bytes of the attachments of a message (optional)
+//	ENABLE_CRAM_MD5             - Offer CRAM-MD5 authentication in addition to PLAIN (default: false)
+//	ENABLE_VRFY                 - Answer VRFY with 252 instead of refusing it with 502 (default: true)
+//	AUTH_SESSION_TIMEOUT        - Idle time after which an authenticated session is closed (optional, e.g. "5m")
+//	SMTP_WRITE_TIMEOUT          - Write timeout for SMTP connections (default: 10s, e.g. "5s", "1m")
+//	SMTP_READ_TIMEOUT           - Read timeout for SMTP connections (default: 10s, e.g. "5s", "1m")
+//	DATA_START_TIMEOUT          - Time allowed from the last accepted RCPT TO until the message data is complete (optional, e.g. "2m")
+//	TOKEN_ACQUIRE_TIMEOUT       - Time allowed for a single Graph token acquisition before it is abandoned (default: 15s)
+//	TOKEN_RETRY_INTERVAL        - Minimum delay before retrying a failed Graph token acquisition (default: 5s)
+//	TOKEN_RETRY_MAX_INTERVAL    - Maximum backoff between failed Graph token acquisitions (default: 1m)
+//	TOKEN_VALIDATE_INTERVAL     - Interval at which a valid Graph token is ensured in the background (optional, e.g. "1h")
+//	ENTRA_CREDENTIAL_EXPIRES    - Expiry date of the client secret or certificate, checked with TOKEN_VALIDATE_INTERVAL (optional, e.g. "2027-03-31")
+//	ENTRA_CREDENTIAL_WARN_DAYS  - Days before ENTRA_CREDENTIAL_EXPIRES from which a warning is logged and reported (default: 30)
+//	HEALTH_ADDR                 - Address for the /healthz and /readyz HTTP endpoints (default: :8080)
+//	METRICS_ENABLED             - Serve Prometheus metrics on /metrics of the health server (default: true)
+//	METRICS_AUTH_TOKEN          - Bearer token or basic auth password required for /metrics, /readyz and /version (optional)
+//	METRICS_AUTH_LIVENESS       - Require METRICS_AUTH_TOKEN for /healthz as well (default: false)
+//	GRAPH_CLOUD                 - Microsoft cloud of the tenant: public, gcc, gcchigh, dod or china (default: public)
+//	GRAPH_BASE_URL              - Microsoft Graph API base URL, overriding that of GRAPH_CLOUD (default: https://graph.microsoft.com/v1.0)
+//	ENTRA_AUTHORITY_HOST        - Microsoft Entra authority host for token requests, overriding that of GRAPH_CLOUD (default: https://login.microsoftonline.com/)
+//	GRAPH_AUDIT_LOG             - File to append the metadata of every Graph request to as JSON lines, credentials redacted (optional)
+//	GRAPH_MAX_CONCURRENCY       - Maximum number of sends to Graph in progress at once, 0 for no limit (default: 0)
+//	GRAPH_CONCURRENCY_TIMEOUT   - Maximum wait for a free send under GRAPH_MAX_CONCURRENCY before replying 450 (default: 10s)
+//	GRAPH_INLINE_LIMIT_BYTES    - Maximum base64-encoded message size sent inline to Graph (default: 4194304)
+//	BASE64_LINE_LENGTH          - Wrap the base64 message sent to Graph in lines of this length, e.g. 76 per RFC 2045 (default: 0, unwrapped)
+//	GRAPH_SEND_MODE             - How recipients are passed to Graph: "raw" MIME headers or "json" recipient fields (default: raw)
+//	GRAPH_MAX_IDLE_CONNS        - Idle connections kept open to Graph for reuse (default: 16)
+//	GRAPH_IDLE_CONN_TIMEOUT     - Time an idle Graph connection is kept open (default: 90s)
+//	GRAPH_FORCE_HTTP1           - Use HTTP/1.1 instead of HTTP/2 for Graph requests (default: false)
+//	GRAPH_TLS_RENEGOTIATION     - TLS renegotiation for Graph requests: "never", "once" or "freely" (default: never)
+//	GRAPH_HTTP_TIMEOUT          - Timeout for each Graph HTTP request (default: 30s)
+//	GRAPH_MAX_ERROR_BODY_BYTES  - Maximum bytes of a Graph error response body read and reported (default: 65536)
+//	GRAPH_MAX_RETRIES           - Retries for throttled (429) or unavailable (503) Graph sends (default: 3)
+//	GRAPH_RETRY_MAX_DELAY       - Maximum delay between Graph send retries (default: 30s)
+//	SAVE_TO_SENT_ITEMS          - Keep a copy of relayed messages in the sender's Sent Items (default: true)
+//	GRAPH_BATCH_RECIPIENTS      - Maximum recipients per Graph send; larger messages are split (optional)
+//	GRAPH_BATCH_POLICY          - Outcome when only some batches fail: "strict" or "partial" (default: strict)
+//	STRIP_CONTENT_LENGTH        - Remove Content-Length headers from relayed messages (default: true)
+//	STRIP_BOM                   - Remove a UTF-8 byte order mark from the start of text bodies and text parts (default: false)
+//	DEDUPE_CC                   - Remove addresses from the Cc header that are already in To (default: false)
+//	STRICT_RECIPIENT_MATCH      - Reject messages whose headers name none of the RCPT TO recipients, instead of adding them to Bcc (default: false)
+//	DKIM_PRIVATE_KEY_PATH       - PEM RSA or Ed25519 private key to add a DKIM signature to relayed messages with (optional)
+//	DKIM_SELECTOR               - DKIM selector of the key, required with DKIM_PRIVATE_KEY_PATH
+//	DKIM_DOMAIN                 - DKIM signing domain, required with DKIM_PRIVATE_KEY_PATH
+//	ADD_RELAY_HEADERS           - Stamp relayed messages with X-Relayed-By and X-Relay-Timestamp headers (default: false)
+//	TRANSCODE_SUBJECT           - Re-encode RFC 2047 subjects in other charsets as UTF-8 (default: false)
+//	GENERATE_MESSAGE_ID         - Add a Message-ID in the SMTP_SERVER_DOMAIN to messages lacking one (default: true)
+//	ADD_MISSING_DATE            - Add a Date header with the time of receipt to messages lacking one (default: true)
+//	IDEMPOTENCY_HEADER          - Header to add with a key derived from the Message-ID, for downstream deduplication (optional, e.g. "X-Idempotency-Key")
+//	AUTO_SUBMITTED              - Add "Auto-Submitted: auto-generated" to messages lacking it (default: false)
+//	AUTO_SUBMITTED_SENDERS      - Comma-separated senders to add Auto-Submitted for when AUTO_SUBMITTED is off (optional)
+//	RECIPIENT_ALLOW_DOMAINS     - Comma-separated recipient domains to relay to; others are rejected (optional)
+//	RECIPIENT_DENY_DOMAINS      - Comma-separated recipient domains to reject, overriding the allowlist (optional)
+//	SINGLE_DOMAIN_PER_MESSAGE   - Reject messages whose recipients span more than one domain (default: false)
+//	RATE_LIMIT_PER_MINUTE       - Maximum messages per authenticated sender per minute, 0 to disable (default: 0)
+//	PER_RECIPIENT_RATE          - Maximum messages to a single recipient address per minute, 0 to disable (default: 0)
+//	PER_CONNECTION_RATE         - Messages allowed per SMTP connection per minute; 0 disables (default: 0)
+//	LOG_REJECTIONS              - Log each rejected SMTP command with a machine-readable reason code (default: false)
+//	TRANSACTION_RETRIES         - Retries of a delivery that failed before the message was sent to Graph (default: 0)
+//	TRANSACTION_RETRY_DELAY     - Delay between such retries, best at least TOKEN_RETRY_INTERVAL (default: 5s)
+//	SPOOL_DIR                   - Directory to spool messages in whose relay failed temporarily, for retry (optional)
+//	SPOOL_RETRY_INTERVAL        - Interval between retries of spooled messages (default: 1m)
+//	SPOOL_MAX_ATTEMPTS          - Attempts after which a spooled message is given up, 0 for no limit (default: 0)
+//	SENDER_PRIORITY             - Comma-separated sender:priority list (high, normal, low) for retrying spooled messages (optional)
+//	DRY_RUN                     - Log accepted messages instead of sending them to Graph (default: false)
+//	FEATURES                    - Comma-separated boolean options to enable by lowercase name, or disable with a "-" prefix, e.g. "dedupe_cc,-save_to_sent_items"; the individual variables take precedence (optional)
+//	SEND_WORKERS                - Workers sending queued messages in the background after replying to DATA, 0 to send before replying (default: 0)
+//	SEND_QUEUE_SIZE             - Messages that may wait for a SEND_WORKERS worker before further messages are refused with 450, at least 1 (default: 100)
+//	SHUTDOWN_GRACE_PERIOD       - Time to wait for messages being relayed to finish on shutdown (default: 30s)
+//	SLOW_TRANSACTION_THRESHOLD  - Log a warning for transactions (receive + relay) slower than this (optional, e.g. "5s")
+//	TRACE_MESSAGES              - Log a debug trace correlating SMTP commands and Graph requests per message (default: false)
+//	CHECK_SEND_TO               - Recipient of the test message sent by -check to verify Mail.Send (optional)
+//	SENTRY_DSN                  - Sentry DSN for error reporting (optional)
+//	SENTRY_ENVIRONMENT          - Environment tag of Sentry events, e.g. "staging" (optional)
+//	SENTRY_SAMPLE_RATE          - Fraction of errors sent to Sentry, above 0 and up to 1 (default: 1)
+//	SENTRY_TRACES_SAMPLE_RATE   - Fraction of transactions traced for Sentry performance monitoring (default: 0)
+//	SENTRY_SCRUB_ADDRESSES      - Replace the local part of email addresses in Sentry breadcrumbs (default: false)
+//	OTEL_EXPORTER_OTLP_ENDPOINT - OTLP/HTTP endpoint to export OpenTelemetry traces to (optional)
+//	OTEL_EXPORTER_OTLP_HEADERS  - Comma-separated key=value headers sent with each OTLP export (optional)
+//
+// ENTRA_CLIENT_SECRET, ENTRA_CLIENT_CERT_PASSWORD, SENDER_PASSWORD, SENDER_ACCOUNTS,
+// METRICS_AUTH_TOKEN and SENTRY_DSN may instead be read from the file named by the variable with
+// a _FILE suffix, such as ENTRA_CLIENT_SECRET_FILE=/run/secrets/entra_client_secret.
 
 type appConfig struct {
-	SMTPAddr          string        // Address the SMTP server listens on
-	SMTPDomain        string        // Domain name for the SMTP server
-	MaxMessageBytes   int64         // Maximum allowed message size in bytes
-	MaxRecipients     int           // Maximum allowed recipients per message
-	WriteTimeout      time.Duration // Write timeout for SMTP connections
-	ReadTimeout       time.Duration // Read timeout for SMTP connections
-	SenderEmail       string        // Email address used as sender
-	SenderPassword    string        // Password for the sender email
-	EntraClientID     string        // Microsoft Entra App registration client ID
-	EntraTenantID     string        // Microsoft Entra Directory (tenant) ID
-	EntraClientSecret string        // Microsoft Entra App registration client secret
-	SentryDSN         string        // Sentry DSN for error reporting (optional)
+	SMTPAddr                 string                       // Address the SMTP server listens on
+	EnableProxyProtocol      bool                         // Take client addresses from PROXY protocol headers
+	MaxConnectionsPerIP      int                          // Maximum open SMTP sessions per client IP (0 = unlimited)
+	Maintenance              *maintenanceSchedule         // Recurring windows in which mail is refused, nil if none
+	SMTPDomain               string                       // Domain name for the SMTP server
+	EHLOAllowRegex           *regexp.Regexp               // HELO/EHLO hostnames allowed; nil allows all
+	MaxMessageBytes          int64                        // Maximum allowed message size in bytes
+	MaxRecipients            int                          // Maximum allowed recipients per message
+	MaxHeaderCount           int                          // Maximum allowed header fields per message
+	MaxBodyBytes             int                          // Maximum total size of the body parts of a message; 0 disables
+	MaxAttachmentBytes       int                          // Maximum total size of the attachments of a message; 0 disables
+	MaxHeaderLineBytes       int                          // Maximum allowed length of a single header field
+	MaxHeaderBytes           int                          // Maximum total size of the header fields of a message; 0 disables
+	EnableCramMD5            bool                         // Offer CRAM-MD5 SMTP authentication
+	EnableVRFY               bool                         // Answer VRFY with 252; refused with 502 if false
+	AuthSessionTimeout       time.Duration                // Idle time after which an authenticated session must authenticate again
+	WriteTimeout             time.Duration                // Write timeout for SMTP connections
+	ReadTimeout              time.Duration                // Read timeout for SMTP connections
+	DataStartTimeout         time.Duration                // Time from the last RCPT TO until DATA must be complete; 0 disables
+	TokenAcquireTimeout      time.Duration                // Time allowed for a single token acquisition; 0 disables
+	TokenRetryInterval       time.Duration                // Minimum delay before retrying a failed token acquisition
+	TokenRetryMaxInterval    time.Duration                // Maximum backoff between failed token acquisitions
+	TokenValidateInterval    time.Duration                // Interval of background token validation; 0 disables
+	CredentialExpires        time.Time                    // Expiry of the Entra client secret or certificate (optional)
+	CredentialWarnDays       int                          // Days before CredentialExpires from which to warn
+	HealthAddr               string                       // Address for the HTTP health check endpoints
+	MetricsEnabled           bool                         // Serve Prometheus metrics on the health server
+	MetricsAuthToken         string                       // Token protecting /metrics and /readyz (optional)
+	MetricsAuthLiveness      bool                         // Protect /healthz with MetricsAuthToken as well
+	GraphAuditLog            string                       // File to log the metadata of every Graph request to (optional)
+	GraphMaxConcurrency      int                          // Maximum concurrent sends to Graph; 0 for no limit
+	GraphConcurrencyTimeout  time.Duration                // Maximum wait for a free send slot
+	InlineLimitBytes         int64                        // Maximum base64-encoded message size sent to Graph
+	Base64LineLength         int                          // Line length of the base64 message sent to Graph; 0 for a single line
+	GraphSendMode            string                       // How recipients are passed to Graph
+	MaxIdleConns             int                          // Idle connections kept open to Graph for reuse
+	IdleConnTimeout          time.Duration                // Time an idle Graph connection is kept open
+	ForceHTTP1               bool                         // Use HTTP/1.1 instead of HTTP/2 for Graph requests
+	TLSRenegotiation         string                       // TLS renegotiation support for Graph requests
+	HTTPTimeout              time.Duration                // Timeout for each Graph HTTP request
+	MaxErrorBodyBytes        int64                        // Maximum bytes read from a Graph error response body
+	MaxRetries               int                          // Retries for throttled or unavailable Graph sends
+	RetryMaxDelay            time.Duration                // Maximum delay between Graph send retries
+	SaveToSentItems          bool                         // Keep a copy of relayed messages in Sent Items
+	BatchRecipients          int                          // Maximum recipients per Graph send (0 disables splitting)
+	BatchPolicy              string                       // Outcome when only some batches fail
+	StripContentLength       bool                         // Remove Content-Length headers from relayed messages
+	StripBOM                 bool                         // Remove UTF-8 byte order marks from text bodies
+	DedupeCc                 bool                         // Remove Cc addresses that are already in To
+	StrictRecipientMatch     bool                         // Reject messages whose headers name none of the recipients
+	DKIMPrivateKeyPath       string                       // Private key to DKIM sign messages with (optional)
+	DKIMSelector             string                       // DKIM selector of the key
+	DKIMDomain               string                       // DKIM signing domain
+	AddRelayHeaders          bool                         // Add X-Relayed-By and X-Relay-Timestamp headers
+	TranscodeSubject         bool                         // Re-encode non-UTF-8 encoded-word subjects as UTF-8
+	GenerateMessageID        bool                         // Add a Message-ID to messages lacking one
+	AddMissingDate           bool                         // Add a Date header to messages lacking one
+	IdempotencyHeader        string                       // Header carrying a key derived from Message-ID; empty disables
+	AutoSubmitted            bool                         // Add Auto-Submitted header to all messages lacking it
+	AutoSubmittedFor         []string                     // Senders to add Auto-Submitted header for
+	RecipientAllowDomains    []string                     // Recipient domains allowed; empty allows all
+	RecipientDenyDomains     []string                     // Recipient domains rejected, even if allowed
+	SingleDomainPerMessage   bool                         // Reject messages to more than one recipient domain
+	RateLimitPerMinute       int                          // Messages allowed per sender per minute; 0 disables
+	SenderEmail              string                       // Email address used as sender
+	SenderPassword           string                       // Password for the sender email
+	SenderAccounts           map[string]string            // Additional sender passwords keyed by lowercase email address
+	SenderHeaders            map[string]map[string]string // Headers added to messages, keyed by lowercase sender
+	GraphSendAs              string                       // Mailbox to send from instead of the authenticated sender (optional)
+	AllowedSendAs            []string                     // From addresses that are sent from their own mailbox (optional)
+	FromPolicy               string                       // Handling of a From that is not the authenticated sender
+	SenderFromPolicies       map[string]string            // FromPolicy overrides keyed by lowercase sender
+	SenderPriorities         map[string]int               // Spool retry priorities keyed by lowercase sender
+	GraphBaseURL             string                       // Microsoft Graph API base URL
+	EntraAuthorityHost       string                       // Microsoft Entra authority host for token requests
+	EntraUseManagedIdentity  bool                         // Use the Azure managed identity instead of an app registration
+	EntraClientID            string                       // Microsoft Entra App registration client ID
+	EntraTenantID            string                       // Microsoft Entra Directory (tenant) ID
+	EntraClientSecret        string                       // Microsoft Entra App registration client secret
+	EntraCertPath            string                       // Path to a PEM or PKCS#12 client certificate (alternative to the secret)
+	EntraCertPassword        string                       // Password for the client certificate private key
+	LogRejections            bool                         // Log rejected commands with a reason code
+	ShutdownGracePeriod      time.Duration                // Time to wait for in-flight sends on shutdown
+	PerRecipientRate         int                          // Messages allowed per recipient per minute; 0 disables
+	PerConnectionRate        int                          // Messages allowed per SMTP connection per minute; 0 disables
+	TransactionRetries       int                          // Retries of deliveries that failed before sending (0 disables)
+	TransactionRetryDelay    time.Duration                // Delay between transaction retries
+	SpoolDir                 string                       // Spool directory for failed messages (empty disables)
+	SpoolRetryInterval       time.Duration                // Interval between retries of spooled messages
+	SpoolMaxAttempts         int                          // Attempts per spooled message (0 is unlimited)
+	DryRun                   bool                         // Log messages instead of sending them
+	SendWorkers              int                          // Workers sending queued messages after DATA; 0 sends within DATA
+	SendQueueSize            int                          // Capacity of the send queue
+	SlowTransactionThreshold time.Duration                // Log transactions slower than this (0 disables)
+	TraceMessages            bool                         // Log a correlated SMTP/Graph debug trace per message
+	CheckSendTo              string                       // Recipient of the -check send probe
+	SentryDSN                string                       // Sentry DSN for error reporting (optional)
+	SentryEnvironment        string                       // Sentry environment tag (optional)
+	SentrySampleRate         float64                      // Fraction of errors sent to Sentry
+	SentryTracesSampleRate   float64                      // Fraction of transactions traced (0 disables tracing)
+	SentryScrubAddresses     bool                         // Hide the local part of addresses in Sentry breadcrumbs
+	OTelEndpoint             string                       // OTLP endpoint for traces (optional, tracing disabled if empty)
+	OTelHeaders              map[string]string            // Headers sent with each OTLP export
 }
 
 // loadConfig loads configuration from environment variables, applying defaults for SMTP settings.
-// Returns an error if required variables are missing or optional values are invalid.
-func loadConfig() (*appConfig, error) {
+// If path is not empty, the YAML config file at path is read as well, with environment variables
+// overriding its values. Returns an error if required variables are missing or optional values are invalid.
+func loadConfig(path string) (*appConfig, error) {
+	if path != "" {
+		return loadConfigFile(path, os.LookupEnv)
+	}
 	return loadConfigFrom(os.Getenv)
 }
 
 // loadConfigFrom loads configuration using lookup and is intended for tests.
 func loadConfigFrom(lookup func(string) string) (*appConfig, error) {
+	features, err := parseFeatures(lookup("FEATURES"))
+	if err != nil {
+		return nil, err
+	}
+	lookup = withFeatures(lookup, features)
+
 	maxMessageBytes, err := getenvInt64(lookup, "SMTP_MAX_MESSAGE_BYTES", 10*1024*1024)
 	if err != nil {
 		return nil, err
@@ -58,6 +264,38 @@ func loadConfigFrom(lookup func(string) string) (*appConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	maxHeaderCount, err := getenvInt(lookup, "MAX_HEADER_COUNT", 1000)
+	if err != nil {
+		return nil, err
+	}
+	maxHeaderLineBytes, err := getenvCount(lookup, "MAX_HEADER_LINE_BYTES", 64*1024)
+	if err != nil {
+		return nil, err
+	}
+	maxHeaderBytes, err := getenvCount(lookup, "MAX_HEADER_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxBodyBytes, err := getenvCount(lookup, "MAX_BODY_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxAttachmentBytes, err := getenvCount(lookup, "MAX_ATTACHMENT_BYTES", 0)
+	if err != nil {
+		return nil, err
+	}
+	enableCramMD5, err := getenvBool(lookup, "ENABLE_CRAM_MD5", false)
+	if err != nil {
+		return nil, err
+	}
+	enableVRFY, err := getenvBool(lookup, "ENABLE_VRFY", true)
+	if err != nil {
+		return nil, err
+	}
+	authSessionTimeout, err := getenvDuration(lookup, "AUTH_SESSION_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
 	writeTimeout, err := getenvDuration(lookup, "SMTP_WRITE_TIMEOUT", 10*time.Second)
 	if err != nil {
 		return nil, err
@@ -66,29 +304,458 @@ func loadConfigFrom(lookup func(string) string) (*appConfig, error) {
 	if err != nil {
 		return nil, err
 	}
+	dataStartTimeout, err := getenvDuration(lookup, "DATA_START_TIMEOUT", 0)
+	if err != nil {
+		return nil, err
+	}
+	tokenAcquireTimeout, err := getenvDuration(lookup, "TOKEN_ACQUIRE_TIMEOUT", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	tokenRetryInterval, err := getenvDuration(lookup, "TOKEN_RETRY_INTERVAL", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	tokenRetryMaxInterval, err := getenvDuration(lookup, "TOKEN_RETRY_MAX_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	tokenValidateInterval, err := getenvDuration(lookup, "TOKEN_VALIDATE_INTERVAL", 0)
+	if err != nil {
+		return nil, err
+	}
+	credentialExpires, err := getenvDate(lookup, "ENTRA_CREDENTIAL_EXPIRES")
+	if err != nil {
+		return nil, err
+	}
+	credentialWarnDays, err := getenvCount(lookup, "ENTRA_CREDENTIAL_WARN_DAYS", 30)
+	if err != nil {
+		return nil, err
+	}
+	metricsEnabled, err := getenvBool(lookup, "METRICS_ENABLED", true)
+	if err != nil {
+		return nil, err
+	}
+	metricsAuthLiveness, err := getenvBool(lookup, "METRICS_AUTH_LIVENESS", false)
+	if err != nil {
+		return nil, err
+	}
+	cloudName, err := getenvChoice(lookup, "GRAPH_CLOUD", cloudPublic, cloudPublic, cloudGCC, cloudGCCHigh, cloudDoD, cloudChina)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := graphClouds[cloudName]
+	graphBaseURL, err := getenvURL(lookup, "GRAPH_BASE_URL", endpoints.graphBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	authorityHost, err := getenvURL(lookup, "ENTRA_AUTHORITY_HOST", endpoints.authorityHost)
+	if err != nil {
+		return nil, err
+	}
+	graphMaxConcurrency, err := getenvCount(lookup, "GRAPH_MAX_CONCURRENCY", 0)
+	if err != nil {
+		return nil, err
+	}
+	graphConcurrencyTimeout, err := getenvDuration(lookup, "GRAPH_CONCURRENCY_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	inlineLimitBytes, err := getenvInt64(lookup, "GRAPH_INLINE_LIMIT_BYTES", 4*1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	base64LineLength, err := getenvCount(lookup, "BASE64_LINE_LENGTH", 0)
+	if err != nil {
+		return nil, err
+	}
+	if base64LineLength%4 != 0 {
+		return nil, errors.New("BASE64_LINE_LENGTH must be a multiple of 4")
+	}
+	graphSendMode, err := getenvChoice(lookup, "GRAPH_SEND_MODE", sendModeRaw, sendModeRaw, sendModeJSON)
+	if err != nil {
+		return nil, err
+	}
+	maxIdleConns, err := getenvInt(lookup, "GRAPH_MAX_IDLE_CONNS", 16)
+	if err != nil {
+		return nil, err
+	}
+	idleConnTimeout, err := getenvDuration(lookup, "GRAPH_IDLE_CONN_TIMEOUT", 90*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	forceHTTP1, err := getenvBool(lookup, "GRAPH_FORCE_HTTP1", false)
+	if err != nil {
+		return nil, err
+	}
+	tlsRenegotiation, err := getenvChoice(lookup, "GRAPH_TLS_RENEGOTIATION", "never", "never", "once", "freely")
+	if err != nil {
+		return nil, err
+	}
+	maxErrorBodyBytes, err := getenvInt64(lookup, "GRAPH_MAX_ERROR_BODY_BYTES", 64*1024)
+	if err != nil {
+		return nil, err
+	}
+	httpTimeout, err := getenvDuration(lookup, "GRAPH_HTTP_TIMEOUT", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	maxRetries, err := getenvCount(lookup, "GRAPH_MAX_RETRIES", 3)
+	if err != nil {
+		return nil, err
+	}
+	retryMaxDelay, err := getenvDuration(lookup, "GRAPH_RETRY_MAX_DELAY", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	saveToSentItems, err := getenvBool(lookup, "SAVE_TO_SENT_ITEMS", true)
+	if err != nil {
+		return nil, err
+	}
+	batchRecipients, err := getenvInt(lookup, "GRAPH_BATCH_RECIPIENTS", 0)
+	if err != nil {
+		return nil, err
+	}
+	batchPolicy, err := getenvChoice(lookup, "GRAPH_BATCH_POLICY", batchPolicyStrict, batchPolicyStrict, batchPolicyPartial)
+	if err != nil {
+		return nil, err
+	}
+	stripContentLength, err := getenvBool(lookup, "STRIP_CONTENT_LENGTH", true)
+	if err != nil {
+		return nil, err
+	}
+	stripBOM, err := getenvBool(lookup, "STRIP_BOM", false)
+	if err != nil {
+		return nil, err
+	}
+	dedupeCc, err := getenvBool(lookup, "DEDUPE_CC", false)
+	if err != nil {
+		return nil, err
+	}
+	strictRecipientMatch, err := getenvBool(lookup, "STRICT_RECIPIENT_MATCH", false)
+	if err != nil {
+		return nil, err
+	}
+	addRelayHeaders, err := getenvBool(lookup, "ADD_RELAY_HEADERS", false)
+	if err != nil {
+		return nil, err
+	}
+	transcodeSubject, err := getenvBool(lookup, "TRANSCODE_SUBJECT", false)
+	if err != nil {
+		return nil, err
+	}
+	generateMessageID, err := getenvBool(lookup, "GENERATE_MESSAGE_ID", true)
+	if err != nil {
+		return nil, err
+	}
+	addMissingDate, err := getenvBool(lookup, "ADD_MISSING_DATE", true)
+	if err != nil {
+		return nil, err
+	}
+	autoSubmitted, err := getenvBool(lookup, "AUTO_SUBMITTED", false)
+	if err != nil {
+		return nil, err
+	}
+	enforceFromMatch, err := getenvBool(lookup, "ENFORCE_FROM_MATCH", false)
+	if err != nil {
+		return nil, err
+	}
+	defaultFromPolicy := fromPolicyRewrite
+	if enforceFromMatch {
+		defaultFromPolicy = fromPolicyReject
+	}
+	fromPolicy, err := getenvChoice(lookup, "FROM_POLICY", defaultFromPolicy, fromPolicyRewrite, fromPolicyReject, fromPolicyAllow)
+	if err != nil {
+		return nil, err
+	}
+	if enforceFromMatch && fromPolicy != fromPolicyReject {
+		return nil, fmt.Errorf("ENFORCE_FROM_MATCH cannot be used with FROM_POLICY=%s", fromPolicy)
+	}
+	senderFromPolicies, err := parseSenderFromPolicies(getenvList(lookup, "SENDER_FROM_POLICY"))
+	if err != nil {
+		return nil, err
+	}
+	senderPriorities, err := parseSenderPriorities(getenvList(lookup, "SENDER_PRIORITY"))
+	if err != nil {
+		return nil, err
+	}
+	singleDomainPerMessage, err := getenvBool(lookup, "SINGLE_DOMAIN_PER_MESSAGE", false)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitPerMinute, err := getenvCount(lookup, "RATE_LIMIT_PER_MINUTE", 0)
+	if err != nil {
+		return nil, err
+	}
+	perRecipientRate, err := getenvCount(lookup, "PER_RECIPIENT_RATE", 0)
+	if err != nil {
+		return nil, err
+	}
+	perConnectionRate, err := getenvCount(lookup, "PER_CONNECTION_RATE", 0)
+	if err != nil {
+		return nil, err
+	}
+	logRejections, err := getenvBool(lookup, "LOG_REJECTIONS", false)
+	if err != nil {
+		return nil, err
+	}
+	transactionRetries, err := getenvCount(lookup, "TRANSACTION_RETRIES", 0)
+	if err != nil {
+		return nil, err
+	}
+	transactionRetryDelay, err := getenvDuration(lookup, "TRANSACTION_RETRY_DELAY", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	spoolRetryInterval, err := getenvDuration(lookup, "SPOOL_RETRY_INTERVAL", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if spoolRetryInterval <= 0 {
+		return nil, errors.New("SPOOL_RETRY_INTERVAL must be a positive duration")
+	}
+	spoolMaxAttempts, err := getenvCount(lookup, "SPOOL_MAX_ATTEMPTS", 0)
+	if err != nil {
+		return nil, err
+	}
+	dryRun, err := getenvBool(lookup, "DRY_RUN", false)
+	if err != nil {
+		return nil, err
+	}
+	sendWorkers, err := getenvCount(lookup, "SEND_WORKERS", 0)
+	if err != nil {
+		return nil, err
+	}
+	sendQueueSize, err := getenvInt(lookup, "SEND_QUEUE_SIZE", 100)
+	if err != nil {
+		return nil, err
+	}
+	shutdownGracePeriod, err := getenvDuration(lookup, "SHUTDOWN_GRACE_PERIOD", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	slowTransactionThreshold, err := getenvDuration(lookup, "SLOW_TRANSACTION_THRESHOLD", 0)
+	if err != nil {
+		return nil, err
+	}
+	sentrySampleRate, err := getenvRate(lookup, "SENTRY_SAMPLE_RATE", 1)
+	if err != nil {
+		return nil, err
+	}
+	if sentrySampleRate == 0 {
+		// Sentry treats a sample rate of 0 as 1; leave SENTRY_DSN empty to send no events.
+		return nil, errors.New("SENTRY_SAMPLE_RATE must be above 0; unset SENTRY_DSN to disable Sentry")
+	}
+	sentryTracesSampleRate, err := getenvRate(lookup, "SENTRY_TRACES_SAMPLE_RATE", 0)
+	if err != nil {
+		return nil, err
+	}
+	sentryScrubAddresses, err := getenvBool(lookup, "SENTRY_SCRUB_ADDRESSES", false)
+	if err != nil {
+		return nil, err
+	}
+	traceMessages, err := getenvBool(lookup, "TRACE_MESSAGES", false)
+	if err != nil {
+		return nil, err
+	}
+	useManagedIdentity, err := getenvBool(lookup, "ENTRA_USE_MANAGED_IDENTITY", false)
+	if err != nil {
+		return nil, err
+	}
+	ehloAllowRegex, err := getenvRegexp(lookup, "EHLO_ALLOW_REGEX")
+	if err != nil {
+		return nil, err
+	}
+	senderPassword, err := getenvSecret(lookup, "SENDER_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	senderAccountsValue, err := getenvSecret(lookup, "SENDER_ACCOUNTS")
+	if err != nil {
+		return nil, err
+	}
+	senderAccounts, err := parseSenderAccounts(senderAccountsValue)
+	if err != nil {
+		return nil, err
+	}
+	entraClientSecret, err := getenvSecret(lookup, "ENTRA_CLIENT_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	entraCertPassword, err := getenvSecret(lookup, "ENTRA_CLIENT_CERT_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	metricsAuthToken, err := getenvSecret(lookup, "METRICS_AUTH_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	sentryDSN, err := getenvSecret(lookup, "SENTRY_DSN")
+	if err != nil {
+		return nil, err
+	}
+	otelHeaders, err := parseOTLPHeaders(lookup("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return nil, err
+	}
+	senderHeaders, err := parseSenderHeaders(lookup("SENDER_HEADERS"))
+	if err != nil {
+		return nil, err
+	}
+	recipientAllowDomains, err := getenvDomains(lookup, "RECIPIENT_ALLOW_DOMAINS")
+	if err != nil {
+		return nil, err
+	}
+	recipientDenyDomains, err := getenvDomains(lookup, "RECIPIENT_DENY_DOMAINS")
+	if err != nil {
+		return nil, err
+	}
+
+	smtpAddr := getenv(lookup, "SMTP_SERVER_ADDR", ":1025")
+	if err := validateListenAddress(smtpAddr); err != nil {
+		return nil, err
+	}
+	maxConnectionsPerIP, err := getenvCount(lookup, "MAX_CONNECTIONS_PER_IP", 100)
+	if err != nil {
+		return nil, err
+	}
+	maintenanceLocation := time.Local
+	if tz := lookup("MAINTENANCE_TIMEZONE"); tz != "" {
+		if maintenanceLocation, err = time.LoadLocation(tz); err != nil {
+			return nil, fmt.Errorf("MAINTENANCE_TIMEZONE must be an IANA time zone such as Europe/Berlin")
+		}
+	}
+	maintenance, err := parseMaintenanceWindows(lookup("MAINTENANCE_WINDOWS"), maintenanceLocation)
+	if err != nil {
+		return nil, err
+	}
+	enableProxyProtocol, err := getenvBool(lookup, "ENABLE_PROXY_PROTOCOL", false)
+	if err != nil {
+		return nil, err
+	}
 
 	cfg := &appConfig{
-		SMTPAddr:          getenv(lookup, "SMTP_SERVER_ADDR", ":1025"),
-		SMTPDomain:        getenv(lookup, "SMTP_SERVER_DOMAIN", "localhost"),
-		MaxMessageBytes:   maxMessageBytes,
-		MaxRecipients:     maxRecipients,
-		WriteTimeout:      writeTimeout,
-		ReadTimeout:       readTimeout,
-		SenderEmail:       lookup("SENDER_EMAIL"),
-		SenderPassword:    lookup("SENDER_PASSWORD"),
-		EntraClientID:     lookup("ENTRA_CLIENT_ID"),
-		EntraTenantID:     lookup("ENTRA_TENANT_ID"),
-		EntraClientSecret: lookup("ENTRA_CLIENT_SECRET"),
-		SentryDSN:         lookup("SENTRY_DSN"),
+		SMTPAddr:                 smtpAddr,
+		EnableProxyProtocol:      enableProxyProtocol,
+		MaxConnectionsPerIP:      maxConnectionsPerIP,
+		Maintenance:              maintenance,
+		SMTPDomain:               getenv(lookup, "SMTP_SERVER_DOMAIN", "localhost"),
+		TokenAcquireTimeout:      tokenAcquireTimeout,
+		TokenRetryInterval:       tokenRetryInterval,
+		TokenRetryMaxInterval:    tokenRetryMaxInterval,
+		TokenValidateInterval:    tokenValidateInterval,
+		CredentialExpires:        credentialExpires,
+		CredentialWarnDays:       credentialWarnDays,
+		HealthAddr:               getenv(lookup, "HEALTH_ADDR", ":8080"),
+		EHLOAllowRegex:           ehloAllowRegex,
+		MaxMessageBytes:          maxMessageBytes,
+		MaxRecipients:            maxRecipients,
+		MaxHeaderCount:           maxHeaderCount,
+		MaxBodyBytes:             maxBodyBytes,
+		MaxAttachmentBytes:       maxAttachmentBytes,
+		MaxHeaderLineBytes:       maxHeaderLineBytes,
+		MaxHeaderBytes:           maxHeaderBytes,
+		EnableCramMD5:            enableCramMD5,
+		EnableVRFY:               enableVRFY,
+		AuthSessionTimeout:       authSessionTimeout,
+		WriteTimeout:             writeTimeout,
+		ReadTimeout:              readTimeout,
+		DataStartTimeout:         dataStartTimeout,
+		MetricsEnabled:           metricsEnabled,
+		MetricsAuthToken:         metricsAuthToken,
+		MetricsAuthLiveness:      metricsAuthLiveness,
+		GraphBaseURL:             strings.TrimSuffix(graphBaseURL, "/"),
+		EntraAuthorityHost:       authorityHost,
+		GraphAuditLog:            lookup("GRAPH_AUDIT_LOG"),
+		GraphMaxConcurrency:      graphMaxConcurrency,
+		GraphConcurrencyTimeout:  graphConcurrencyTimeout,
+		InlineLimitBytes:         inlineLimitBytes,
+		Base64LineLength:         base64LineLength,
+		GraphSendMode:            graphSendMode,
+		MaxIdleConns:             maxIdleConns,
+		IdleConnTimeout:          idleConnTimeout,
+		ForceHTTP1:               forceHTTP1,
+		TLSRenegotiation:         tlsRenegotiation,
+		HTTPTimeout:              httpTimeout,
+		MaxErrorBodyBytes:        maxErrorBodyBytes,
+		MaxRetries:               maxRetries,
+		RetryMaxDelay:            retryMaxDelay,
+		SaveToSentItems:          saveToSentItems,
+		BatchRecipients:          batchRecipients,
+		BatchPolicy:              batchPolicy,
+		StripContentLength:       stripContentLength,
+		StripBOM:                 stripBOM,
+		DedupeCc:                 dedupeCc,
+		StrictRecipientMatch:     strictRecipientMatch,
+		DKIMPrivateKeyPath:       lookup("DKIM_PRIVATE_KEY_PATH"),
+		DKIMSelector:             lookup("DKIM_SELECTOR"),
+		DKIMDomain:               lookup("DKIM_DOMAIN"),
+		AddRelayHeaders:          addRelayHeaders,
+		TranscodeSubject:         transcodeSubject,
+		GenerateMessageID:        generateMessageID,
+		AddMissingDate:           addMissingDate,
+		IdempotencyHeader:        lookup("IDEMPOTENCY_HEADER"),
+		AutoSubmitted:            autoSubmitted,
+		AutoSubmittedFor:         getenvList(lookup, "AUTO_SUBMITTED_SENDERS"),
+		RecipientAllowDomains:    recipientAllowDomains,
+		RecipientDenyDomains:     recipientDenyDomains,
+		SingleDomainPerMessage:   singleDomainPerMessage,
+		RateLimitPerMinute:       rateLimitPerMinute,
+		SenderEmail:              lookup("SENDER_EMAIL"),
+		SenderPassword:           senderPassword,
+		SenderAccounts:           senderAccounts,
+		SenderHeaders:            senderHeaders,
+		GraphSendAs:              lookup("GRAPH_SEND_AS"),
+		AllowedSendAs:            getenvList(lookup, "ALLOWED_SEND_AS"),
+		FromPolicy:               fromPolicy,
+		SenderFromPolicies:       senderFromPolicies,
+		SenderPriorities:         senderPriorities,
+		EntraUseManagedIdentity:  useManagedIdentity,
+		EntraClientID:            lookup("ENTRA_CLIENT_ID"),
+		EntraTenantID:            lookup("ENTRA_TENANT_ID"),
+		EntraClientSecret:        entraClientSecret,
+		EntraCertPath:            lookup("ENTRA_CLIENT_CERT_PATH"),
+		EntraCertPassword:        entraCertPassword,
+		PerRecipientRate:         perRecipientRate,
+		PerConnectionRate:        perConnectionRate,
+		LogRejections:            logRejections,
+		ShutdownGracePeriod:      shutdownGracePeriod,
+		DryRun:                   dryRun,
+		SendWorkers:              sendWorkers,
+		SendQueueSize:            sendQueueSize,
+		SpoolDir:                 lookup("SPOOL_DIR"),
+		SpoolRetryInterval:       spoolRetryInterval,
+		SpoolMaxAttempts:         spoolMaxAttempts,
+		TransactionRetries:       transactionRetries,
+		TransactionRetryDelay:    transactionRetryDelay,
+		SlowTransactionThreshold: slowTransactionThreshold,
+		TraceMessages:            traceMessages,
+		CheckSendTo:              lookup("CHECK_SEND_TO"),
+		SentryDSN:                sentryDSN,
+		SentryEnvironment:        lookup("SENTRY_ENVIRONMENT"),
+		SentrySampleRate:         sentrySampleRate,
+		SentryTracesSampleRate:   sentryTracesSampleRate,
+		SentryScrubAddresses:     sentryScrubAddresses,
+		OTelEndpoint:             lookup("OTEL_EXPORTER_OTLP_ENDPOINT"),
+		OTelHeaders:              otelHeaders,
 	}
 
 	// Map of required config field names to their values
-	required := map[string]string{
-		"SENDER_EMAIL":        cfg.SenderEmail,
-		"SENDER_PASSWORD":     cfg.SenderPassword,
-		"ENTRA_CLIENT_ID":     cfg.EntraClientID,
-		"ENTRA_TENANT_ID":     cfg.EntraTenantID,
-		"ENTRA_CLIENT_SECRET": cfg.EntraClientSecret,
+	required := make(map[string]string)
+	// A managed identity needs no app registration credentials; otherwise the client secret
+	// is only required when no certificate is configured.
+	if !cfg.EntraUseManagedIdentity {
+		required["ENTRA_CLIENT_ID"] = cfg.EntraClientID
+		required["ENTRA_TENANT_ID"] = cfg.EntraTenantID
+		if cfg.EntraCertPath == "" {
+			required["ENTRA_CLIENT_SECRET"] = cfg.EntraClientSecret
+		}
+	}
+	// The single sender is optional when SENDER_ACCOUNTS provides the credentials,
+	// but must be complete if either variable is set.
+	if len(senderAccounts) == 0 || cfg.SenderEmail != "" || cfg.SenderPassword != "" {
+		required["SENDER_EMAIL"] = cfg.SenderEmail
+		required["SENDER_PASSWORD"] = cfg.SenderPassword
 	}
 	var missing []string
 	for name, val := range required {
@@ -100,9 +767,314 @@ func loadConfigFrom(lookup func(string) string) (*appConfig, error) {
 		sort.Strings(missing)
 		return nil, fmt.Errorf("missing required environment variable(s): %s", strings.Join(missing, ", "))
 	}
+	for sender := range cfg.SenderFromPolicies {
+		if _, _, ok := cfg.senderPassword(sender); !ok {
+			return nil, fmt.Errorf("SENDER_FROM_POLICY sender %q is not configured in SENDER_EMAIL or SENDER_ACCOUNTS", sender)
+		}
+	}
+	for sender := range cfg.SenderPriorities {
+		if _, _, ok := cfg.senderPassword(sender); !ok {
+			return nil, fmt.Errorf("SENDER_PRIORITY sender %q is not configured in SENDER_EMAIL or SENDER_ACCOUNTS", sender)
+		}
+	}
+	for sender := range cfg.SenderHeaders {
+		if _, _, ok := cfg.senderPassword(sender); !ok {
+			return nil, fmt.Errorf("SENDER_HEADERS sender %q is not configured in SENDER_EMAIL or SENDER_ACCOUNTS", sender)
+		}
+	}
+	if !cfg.CredentialExpires.IsZero() && cfg.TokenValidateInterval == 0 {
+		return nil, errors.New("ENTRA_CREDENTIAL_EXPIRES requires TOKEN_VALIDATE_INTERVAL")
+	}
+	if (cfg.DKIMPrivateKeyPath != "" || cfg.DKIMSelector != "" || cfg.DKIMDomain != "") &&
+		(cfg.DKIMPrivateKeyPath == "" || cfg.DKIMSelector == "" || cfg.DKIMDomain == "") {
+		return nil, errors.New("DKIM_PRIVATE_KEY_PATH, DKIM_SELECTOR and DKIM_DOMAIN must be set together")
+	}
+	if strings.ContainsAny(cfg.IdempotencyHeader, " \t\r\n:") {
+		return nil, fmt.Errorf("IDEMPOTENCY_HEADER must be a header field name, got %q", cfg.IdempotencyHeader)
+	}
+	// Messages are sent from the GRAPH_SEND_AS mailbox if set, in which case SENDER_EMAIL is
+	// only a login name; otherwise SENDER_EMAIL is the mailbox and must be an address.
+	if cfg.GraphSendAs != "" {
+		if err := validateAddress("GRAPH_SEND_AS", cfg.GraphSendAs); err != nil {
+			return nil, err
+		}
+	} else if cfg.SenderEmail != "" {
+		if err := validateAddress("SENDER_EMAIL", cfg.SenderEmail); err != nil {
+			return nil, fmt.Errorf("%w (set GRAPH_SEND_AS to use a login name that is not a mailbox)", err)
+		}
+	}
+	for _, addr := range cfg.AllowedSendAs {
+		if err := validateAddress("ALLOWED_SEND_AS", addr); err != nil {
+			return nil, err
+		}
+	}
+	for _, addr := range cfg.AutoSubmittedFor {
+		if err := validateAddress("AUTO_SUBMITTED_SENDERS", addr); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CheckSendTo != "" {
+		if err := validateAddress("CHECK_SEND_TO", cfg.CheckSendTo); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.EntraClientSecret != "" && cfg.EntraCertPath != "" {
+		return nil, errors.New("only one of ENTRA_CLIENT_SECRET or ENTRA_CLIENT_CERT_PATH may be set")
+	}
+	if cfg.EntraUseManagedIdentity && (cfg.EntraClientSecret != "" || cfg.EntraCertPath != "") {
+		return nil, errors.New("ENTRA_CLIENT_SECRET and ENTRA_CLIENT_CERT_PATH cannot be used with ENTRA_USE_MANAGED_IDENTITY")
+	}
 	return cfg, nil
 }
 
+// senderPassword returns the configured password for the sender account username and the
+// account's canonical address. SENDER_EMAIL is matched in addition to SENDER_ACCOUNTS.
+func (c *appConfig) senderPassword(username string) (address, password string, ok bool) {
+	if c.SenderEmail != "" && strings.EqualFold(username, c.SenderEmail) {
+		return c.SenderEmail, c.SenderPassword, true
+	}
+	address = strings.ToLower(username)
+	password, ok = c.SenderAccounts[address]
+	return address, password, ok
+}
+
+// senderHeaders returns the SENDER_HEADERS fields added to messages of the authenticated sender user.
+func (c *appConfig) senderHeaders(user string) map[string]string {
+	return c.SenderHeaders[strings.ToLower(user)]
+}
+
+// mailbox returns the Graph mailbox messages of the authenticated sender user are sent from:
+// GRAPH_SEND_AS if set, otherwise the sender itself.
+func (c *appConfig) mailbox(user string) string {
+	if c.GraphSendAs != "" {
+		return c.GraphSendAs
+	}
+	return user
+}
+
+// parseSenderAccounts parses SENDER_ACCOUNTS, given either as a JSON object mapping email
+// addresses to passwords or as a comma-separated list of email:password pairs.
+func parseSenderAccounts(val string) (map[string]string, error) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return nil, nil
+	}
+
+	raw := make(map[string]string)
+	if strings.HasPrefix(val, "{") {
+		if err := json.Unmarshal([]byte(val), &raw); err != nil {
+			return nil, fmt.Errorf("SENDER_ACCOUNTS must be a valid JSON object: %w", err)
+		}
+	} else {
+		for _, entry := range strings.Split(val, ",") {
+			email, password, found := strings.Cut(strings.TrimSpace(entry), ":")
+			if !found {
+				return nil, errors.New("SENDER_ACCOUNTS entries must be in email:password form")
+			}
+			raw[email] = password
+		}
+	}
+
+	accounts := make(map[string]string, len(raw))
+	for email, password := range raw {
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email == "" || password == "" {
+			return nil, errors.New("SENDER_ACCOUNTS entries must have a non-empty email and password")
+		}
+		if err := validateAddress("SENDER_ACCOUNTS", email); err != nil {
+			return nil, err
+		}
+		accounts[email] = password
+	}
+	return accounts, nil
+}
+
+// parseSenderFromPolicies parses the sender:policy entries of SENDER_FROM_POLICY.
+func parseSenderFromPolicies(entries []string) (map[string]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	policies := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		sender, policy, found := strings.Cut(entry, ":")
+		sender, policy = strings.ToLower(strings.TrimSpace(sender)), strings.ToLower(strings.TrimSpace(policy))
+		if !found || sender == "" {
+			return nil, errors.New("SENDER_FROM_POLICY entries must be in sender:policy form")
+		}
+		switch policy {
+		case fromPolicyRewrite, fromPolicyReject, fromPolicyAllow:
+			policies[sender] = policy
+		default:
+			return nil, fmt.Errorf("SENDER_FROM_POLICY policy of %s must be one of: rewrite, reject, allow", sender)
+		}
+	}
+	return policies, nil
+}
+
+// parseSenderPriorities parses the sender:priority entries of SENDER_PRIORITY.
+func parseSenderPriorities(entries []string) (map[string]int, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	priorities := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		sender, name, found := strings.Cut(entry, ":")
+		sender, name = strings.ToLower(strings.TrimSpace(sender)), strings.ToLower(strings.TrimSpace(name))
+		if !found || sender == "" {
+			return nil, errors.New("SENDER_PRIORITY entries must be in sender:priority form")
+		}
+		priority, ok := priorityNames[name]
+		if !ok {
+			return nil, fmt.Errorf("SENDER_PRIORITY priority of %s must be one of: high, normal, low", sender)
+		}
+		priorities[sender] = priority
+	}
+	return priorities, nil
+}
+
+// parseSenderHeaders parses SENDER_HEADERS, a JSON object mapping sender accounts to the
+// header fields added to their messages, e.g. {"app@example.com": {"X-Cost-Center": "42"}}.
+func parseSenderHeaders(val string) (map[string]map[string]string, error) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		return nil, nil
+	}
+
+	var raw map[string]map[string]string
+	if err := json.Unmarshal([]byte(val), &raw); err != nil {
+		return nil, fmt.Errorf("SENDER_HEADERS must be a JSON object of sender to header map: %w", err)
+	}
+	headers := make(map[string]map[string]string, len(raw))
+	for sender, fields := range raw {
+		sender = strings.ToLower(strings.TrimSpace(sender))
+		if sender == "" {
+			return nil, errors.New("SENDER_HEADERS senders must be non-empty")
+		}
+		canonical := make(map[string]string, len(fields))
+		for name, value := range fields {
+			if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+				return nil, fmt.Errorf("SENDER_HEADERS must use header field names, got %q", name)
+			}
+			if strings.ContainsAny(value, "\r\n") {
+				return nil, fmt.Errorf("SENDER_HEADERS value of %s must be a single line", name)
+			}
+			canonical[textproto.CanonicalMIMEHeaderKey(name)] = value
+		}
+		headers[sender] = canonical
+	}
+	return headers, nil
+}
+
+// validateAddress returns a descriptive error if value, the value of the variable key, is not a
+// bare email address such as user@example.com.
+func validateAddress(key, value string) error {
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Address != value || addr.Name != "" {
+		return fmt.Errorf("%s must be a valid email address such as user@example.com, got %q", key, value)
+	}
+	return nil
+}
+
+// sendAsMailbox returns the mailbox a message with the From address from is sent from on behalf
+// of the authenticated sender user. If ALLOWED_SEND_AS is set, a From address in it is sent from
+// its own mailbox, and ok is false for a From address that is neither in the list nor the user's
+// own mailbox. Without ALLOWED_SEND_AS, the user's mailbox is used whatever the From address.
+func (c *appConfig) sendAsMailbox(user, from string) (mailbox string, ok bool) {
+	mailbox = c.mailbox(user)
+	if len(c.AllowedSendAs) == 0 || strings.EqualFold(from, mailbox) || strings.EqualFold(from, user) {
+		return mailbox, true
+	}
+	for _, addr := range c.AllowedSendAs {
+		if strings.EqualFold(addr, from) {
+			return addr, true
+		}
+	}
+	return "", false
+}
+
+// From header policies, applied to a From address that does not match the authenticated sender.
+const (
+	fromPolicyRewrite = "rewrite" // set From to the MAIL FROM address unless it contains it
+	fromPolicyReject  = "reject"  // reject the message
+	fromPolicyAllow   = "allow"   // relay From unchanged
+)
+
+// fromPolicy returns the From header policy of the authenticated sender user, rewrite if unset.
+func (c *appConfig) fromPolicy(user string) string {
+	if policy, ok := c.SenderFromPolicies[strings.ToLower(user)]; ok {
+		return policy
+	}
+	if c.FromPolicy == "" {
+		return fromPolicyRewrite
+	}
+	return c.FromPolicy
+}
+
+// fromMatches reports whether from is an address the authenticated sender user may put in the
+// From header under the reject policy: the user itself, its mailbox, or an ALLOWED_SEND_AS address.
+func (c *appConfig) fromMatches(user, from string) bool {
+	if from == "" {
+		return false
+	}
+	if strings.EqualFold(from, user) || strings.EqualFold(from, c.mailbox(user)) {
+		return true
+	}
+	for _, addr := range c.AllowedSendAs {
+		if strings.EqualFold(addr, from) {
+			return true
+		}
+	}
+	return false
+}
+
+// otherSender reports whether from is the address of a configured sender account other than the
+// authenticated sender user, and not an ALLOWED_SEND_AS address. Such a From is rejected whatever
+// the policy, so that with SENDER_ACCOUNTS one account cannot impersonate another.
+func (c *appConfig) otherSender(user, from string) bool {
+	if len(c.SenderAccounts) == 0 || from == "" || c.fromMatches(user, from) {
+		return false
+	}
+	_, _, ok := c.senderPassword(from)
+	return ok
+}
+
+// autoSubmittedFor reports whether messages from sender should carry an Auto-Submitted header.
+func (c *appConfig) autoSubmittedFor(sender string) bool {
+	if c.AutoSubmitted {
+		return true
+	}
+	for _, s := range c.AutoSubmittedFor {
+		if strings.EqualFold(s, sender) {
+			return true
+		}
+	}
+	return false
+}
+
+// recipientAllowed reports whether mail may be relayed to address according to the recipient
+// domain allowlist and denylist. Domains match case-insensitively; the denylist takes precedence.
+func (c *appConfig) recipientAllowed(address string) bool {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return false
+	}
+	domain := address[at+1:]
+	for _, d := range c.RecipientDenyDomains {
+		if strings.EqualFold(d, domain) {
+			return false
+		}
+	}
+	if len(c.RecipientAllowDomains) == 0 {
+		return true
+	}
+	for _, d := range c.RecipientAllowDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
 // getenv returns the value of the environment variable or the provided default if unset.
 func getenv(lookup func(string) string, key, def string) string {
 	if val := lookup(key); val != "" {
@@ -124,6 +1096,19 @@ func getenvInt(lookup func(string) string, key string, def int) (int, error) {
 	return int(u), nil
 }
 
+// getenvCount returns the non-negative int value of the environment variable or the provided default if unset.
+func getenvCount(lookup func(string) string, key string, def int) (int, error) {
+	val := lookup(key)
+	if val == "" {
+		return def, nil
+	}
+	u, err := strconv.ParseUint(val, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a non-negative integer", key)
+	}
+	return int(u), nil
+}
+
 // getenvInt64 returns the int64 value of the environment variable or the provided default if unset.
 func getenvInt64(lookup func(string) string, key string, def int64) (int64, error) {
 	val := lookup(key)
@@ -149,3 +1134,131 @@ func getenvDuration(lookup func(string) string, key string, def time.Duration) (
 	}
 	return d, nil
 }
+
+// getenvRegexp returns the value of the environment variable compiled as a regular expression
+// that must match a whole string, or nil if unset.
+func getenvRegexp(lookup func(string) string, key string) (*regexp.Regexp, error) {
+	val := lookup(key)
+	if val == "" {
+		return nil, nil
+	}
+	re, err := regexp.Compile("^(?:" + val + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("%s must be a valid regular expression: %w", key, err)
+	}
+	return re, nil
+}
+
+// getenvDate returns the value of the environment variable as a time, given either as a date
+// such as 2027-03-31 (midnight UTC) or in RFC 3339 form, or the zero time if unset.
+func getenvDate(lookup func(string) string, key string) (time.Time, error) {
+	val := lookup(key)
+	if val == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, val); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be a date such as 2027-03-31 or an RFC 3339 time", key)
+	}
+	return t, nil
+}
+
+// getenvRate returns the value of the environment variable as a fraction between 0 and 1, or
+// the provided default if unset.
+func getenvRate(lookup func(string) string, key string, def float64) (float64, error) {
+	val := lookup(key)
+	if val == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || f < 0 || f > 1 {
+		return 0, fmt.Errorf("%s must be a number between 0 and 1", key)
+	}
+	return f, nil
+}
+
+// getenvBool returns the bool value of the environment variable or the provided default if unset.
+func getenvBool(lookup func(string) string, key string, def bool) (bool, error) {
+	val := lookup(key)
+	if val == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean", key)
+	}
+	return b, nil
+}
+
+// getenvSecret returns the value of the environment variable, or the content of the file named by
+// the variable with a _FILE suffix, as used for Docker and Kubernetes secrets, with trailing
+// newlines trimmed. Returns an error if both are set or the file cannot be read.
+func getenvSecret(lookup func(string) string, key string) (string, error) {
+	val, path := lookup(key), lookup(key+"_FILE")
+	if path == "" {
+		return val, nil
+	}
+	if val != "" {
+		return "", fmt.Errorf("only one of %s or %s_FILE may be set", key, key)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE: %w", key, err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// getenvList returns the comma-separated values of the environment variable with
+// surrounding whitespace and empty entries removed, or nil if unset.
+func getenvList(lookup func(string) string, key string) []string {
+	var list []string
+	for _, v := range strings.Split(lookup(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// getenvDomains returns the getenvList domains of the environment variable, with internationalized
+// domains in A-label form so that they match the recipients accepted by RCPT TO.
+func getenvDomains(lookup func(string) string, key string) ([]string, error) {
+	domains := getenvList(lookup, key)
+	for i, d := range domains {
+		ascii, err := asciiDomain(d)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid domain %q: %w", key, d, err)
+		}
+		domains[i] = ascii
+	}
+	return domains, nil
+}
+
+// getenvURL returns the value of the environment variable or the provided default if unset.
+// Returns an error if the value is not an absolute http or https URL.
+func getenvURL(lookup func(string) string, key, def string) (string, error) {
+	val := getenv(lookup, key, def)
+	u, err := url.Parse(val)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return "", fmt.Errorf("%s must be an absolute http(s) URL", key)
+	}
+	return val, nil
+}
+
+// getenvChoice returns the value of the environment variable or the provided default if unset.
+// Returns an error if the value is not one of allowed.
+func getenvChoice(lookup func(string) string, key, def string, allowed ...string) (string, error) {
+	val := lookup(key)
+	if val == "" {
+		return def, nil
+	}
+	for _, a := range allowed {
+		if strings.EqualFold(val, a) {
+			return a, nil
+		}
+	}
+	return "", fmt.Errorf("%s must be one of: %s", key, strings.Join(allowed, ", "))
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"maps"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
@@ -36,6 +39,30 @@ func TestLoadConfigFromDefaults(t *testing.T) {
 	if cfg.ReadTimeout != 10*time.Second {
 		t.Errorf("ReadTimeout = %s, want 10s", cfg.ReadTimeout)
 	}
+	if cfg.SendWorkers != 0 || cfg.SendQueueSize != 100 {
+		t.Errorf("SendWorkers, SendQueueSize = %d, %d, want 0, 100", cfg.SendWorkers, cfg.SendQueueSize)
+	}
+	if cfg.TokenAcquireTimeout != 15*time.Second {
+		t.Errorf("TokenAcquireTimeout = %s, want 15s", cfg.TokenAcquireTimeout)
+	}
+	if !cfg.GenerateMessageID {
+		t.Error("GenerateMessageID = false, want true")
+	}
+	if !cfg.AddMissingDate {
+		t.Error("AddMissingDate = false, want true")
+	}
+	if !cfg.StripContentLength {
+		t.Error("StripContentLength = false, want true")
+	}
+	if cfg.MaxConnectionsPerIP != 100 {
+		t.Errorf("MaxConnectionsPerIP = %d, want 100", cfg.MaxConnectionsPerIP)
+	}
+	if cfg.GraphBaseURL != "https://graph.microsoft.com/v1.0" {
+		t.Errorf("GraphBaseURL = %q, want the public cloud endpoint", cfg.GraphBaseURL)
+	}
+	if cfg.EntraAuthorityHost != "https://login.microsoftonline.com/" {
+		t.Errorf("EntraAuthorityHost = %q, want the public cloud authority", cfg.EntraAuthorityHost)
+	}
 }
 
 func TestLoadConfigFromOverrides(t *testing.T) {
@@ -52,6 +79,8 @@ func TestLoadConfigFromOverrides(t *testing.T) {
 		"SMTP_WRITE_TIMEOUT":     "5s",
 		"SMTP_READ_TIMEOUT":      "3s",
 		"SENTRY_DSN":             "https://example.invalid/1",
+		"GRAPH_BASE_URL":         "https://graph.microsoft.us/v1.0/",
+		"ENTRA_AUTHORITY_HOST":   "https://login.microsoftonline.us/",
 	}))
 	if err != nil {
 		t.Fatalf("loadConfigFrom() error: %v", err)
@@ -78,6 +107,12 @@ func TestLoadConfigFromOverrides(t *testing.T) {
 	if cfg.SentryDSN != "https://example.invalid/1" {
 		t.Errorf("SentryDSN = %q, want configured DSN", cfg.SentryDSN)
 	}
+	if cfg.GraphBaseURL != "https://graph.microsoft.us/v1.0" {
+		t.Errorf("GraphBaseURL = %q, want https://graph.microsoft.us/v1.0", cfg.GraphBaseURL)
+	}
+	if cfg.EntraAuthorityHost != "https://login.microsoftonline.us/" {
+		t.Errorf("EntraAuthorityHost = %q, want https://login.microsoftonline.us/", cfg.EntraAuthorityHost)
+	}
 }
 
 func TestLoadConfigFromMissingRequired(t *testing.T) {
@@ -99,6 +134,154 @@ func TestLoadConfigFromMissingRequired(t *testing.T) {
 	}
 }
 
+func TestLoadConfigFromSenderAccounts(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{name: "json", value: `{"Shared@example.com": "pa:ss", "other@example.com": "secret"}`},
+		{name: "list", value: "Shared@example.com:pa:ss, other@example.com:secret"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := requiredConfig()
+			delete(values, "SENDER_EMAIL")
+			delete(values, "SENDER_PASSWORD")
+			values["SENDER_ACCOUNTS"] = tt.value
+
+			cfg, err := loadConfigFrom(configLookup(values))
+			if err != nil {
+				t.Fatalf("loadConfigFrom() error: %v", err)
+			}
+			if len(cfg.SenderAccounts) != 2 {
+				t.Fatalf("SenderAccounts = %v, want 2 accounts", cfg.SenderAccounts)
+			}
+			if got := cfg.SenderAccounts["shared@example.com"]; got != "pa:ss" {
+				t.Errorf("shared@example.com password = %q, want pa:ss", got)
+			}
+			if got := cfg.SenderAccounts["other@example.com"]; got != "secret" {
+				t.Errorf("other@example.com password = %q, want secret", got)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromSenderHeaders(t *testing.T) {
+	values := requiredConfig()
+	values["SENDER_ACCOUNTS"] = "shared@example.com:secret"
+	values["SENDER_HEADERS"] = `{"Sender@example.com": {"x-organization-id": "contoso"}, "shared@example.com": {"X-Cost-Center": "4711"}}`
+
+	cfg, err := loadConfigFrom(configLookup(values))
+	if err != nil {
+		t.Fatalf("loadConfigFrom() error: %v", err)
+	}
+	if got := cfg.senderHeaders("sender@example.com")["X-Organization-Id"]; got != "contoso" {
+		t.Errorf("sender X-Organization-Id = %q, want contoso", got)
+	}
+	if got := cfg.senderHeaders("Shared@example.com")["X-Cost-Center"]; got != "4711" {
+		t.Errorf("shared X-Cost-Center = %q, want 4711", got)
+	}
+
+	for _, tc := range []struct {
+		value   string
+		wantErr string
+	}{
+		{value: `["X-Cost-Center"]`, wantErr: "SENDER_HEADERS must be a JSON object"},
+		{value: `{"unknown@example.com": {"X-Cost-Center": "1"}}`, wantErr: `SENDER_HEADERS sender "unknown@example.com" is not configured`},
+		{value: `{"sender@example.com": {"X Cost": "1"}}`, wantErr: "SENDER_HEADERS must use header field names"},
+		{value: `{"sender@example.com": {"X-Cost-Center": "1\r\nBcc: x@example.com"}}`, wantErr: "SENDER_HEADERS value of X-Cost-Center must be a single line"},
+	} {
+		values["SENDER_HEADERS"] = tc.value
+		if _, err := loadConfigFrom(configLookup(values)); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("SENDER_HEADERS=%s: error = %v, want %q", tc.value, err, tc.wantErr)
+		}
+	}
+}
+
+func TestLoadConfigFromFromPolicy(t *testing.T) {
+	values := requiredConfig()
+	values["SENDER_ACCOUNTS"] = "app@example.com:secret"
+	values["FROM_POLICY"] = "Allow"
+	values["SENDER_FROM_POLICY"] = "App@example.com:reject"
+
+	cfg, err := loadConfigFrom(configLookup(values))
+	if err != nil {
+		t.Fatalf("loadConfigFrom() error: %v", err)
+	}
+	if got := cfg.fromPolicy("sender@example.com"); got != fromPolicyAllow {
+		t.Errorf("sender policy = %q, want allow", got)
+	}
+	if got := cfg.fromPolicy("app@example.com"); got != fromPolicyReject {
+		t.Errorf("app policy = %q, want reject", got)
+	}
+
+	delete(values, "FROM_POLICY")
+	values["ENFORCE_FROM_MATCH"] = "true"
+	cfg, err = loadConfigFrom(configLookup(values))
+	if err != nil {
+		t.Fatalf("loadConfigFrom() error: %v", err)
+	}
+	if cfg.FromPolicy != fromPolicyReject {
+		t.Errorf("FromPolicy with ENFORCE_FROM_MATCH = %q, want reject", cfg.FromPolicy)
+	}
+
+	for _, tc := range []struct {
+		key, value, wantErr string
+	}{
+		{key: "FROM_POLICY", value: "rewrite", wantErr: "ENFORCE_FROM_MATCH cannot be used with FROM_POLICY=rewrite"},
+		{key: "SENDER_FROM_POLICY", value: "app@example.com", wantErr: "SENDER_FROM_POLICY entries must be in sender:policy form"},
+		{key: "SENDER_FROM_POLICY", value: "app@example.com:drop", wantErr: "SENDER_FROM_POLICY policy of app@example.com must be one of"},
+		{key: "SENDER_FROM_POLICY", value: "unknown@example.com:reject", wantErr: `SENDER_FROM_POLICY sender "unknown@example.com" is not configured`},
+	} {
+		invalid := maps.Clone(values)
+		invalid[tc.key] = tc.value
+		if _, err := loadConfigFrom(configLookup(invalid)); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("%s=%s: error = %v, want %q", tc.key, tc.value, err, tc.wantErr)
+		}
+	}
+}
+
+func TestLoadConfigFromClientCertificate(t *testing.T) {
+	values := requiredConfig()
+	delete(values, "ENTRA_CLIENT_SECRET")
+	values["ENTRA_CLIENT_CERT_PATH"] = "/run/secrets/client.pem"
+
+	cfg, err := loadConfigFrom(configLookup(values))
+	if err != nil {
+		t.Fatalf("loadConfigFrom() error: %v", err)
+	}
+	if cfg.EntraCertPath != "/run/secrets/client.pem" {
+		t.Errorf("EntraCertPath = %q, want /run/secrets/client.pem", cfg.EntraCertPath)
+	}
+
+	values["ENTRA_CLIENT_SECRET"] = "client-secret"
+	if _, err := loadConfigFrom(configLookup(values)); err == nil {
+		t.Fatal("loadConfigFrom() error = nil, want error when both secret and certificate are set")
+	}
+}
+
+func TestLoadConfigFromManagedIdentity(t *testing.T) {
+	values := map[string]string{
+		"SENDER_EMAIL":               "sender@example.com",
+		"SENDER_PASSWORD":            "password",
+		"ENTRA_USE_MANAGED_IDENTITY": "true",
+	}
+
+	cfg, err := loadConfigFrom(configLookup(values))
+	if err != nil {
+		t.Fatalf("loadConfigFrom() error: %v", err)
+	}
+	if !cfg.EntraUseManagedIdentity {
+		t.Error("EntraUseManagedIdentity = false, want true")
+	}
+
+	values["ENTRA_CLIENT_SECRET"] = "client-secret"
+	if _, err := loadConfigFrom(configLookup(values)); err == nil {
+		t.Fatal("loadConfigFrom() error = nil, want error when a secret is set with managed identity")
+	}
+}
+
 func TestLoadConfigFromInvalidOptionalValues(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -112,6 +295,72 @@ func TestLoadConfigFromInvalidOptionalValues(t *testing.T) {
 			value:   "invalid",
 			wantErr: "SMTP_MAX_MESSAGE_BYTES must be a positive integer",
 		},
+		{
+			name:    "invalid recipient allow domain",
+			key:     "RECIPIENT_ALLOW_DOMAINS",
+			value:   "example.com,xn--zz.example",
+			wantErr: `RECIPIENT_ALLOW_DOMAINS: invalid domain "xn--zz.example"`,
+		},
+		{
+			name:    "negative max connections per IP",
+			key:     "MAX_CONNECTIONS_PER_IP",
+			value:   "-1",
+			wantErr: "MAX_CONNECTIONS_PER_IP must be a non-negative integer",
+		},
+		{
+			name:    "negative send workers",
+			key:     "SEND_WORKERS",
+			value:   "-2",
+			wantErr: "SEND_WORKERS must be a non-negative integer",
+		},
+		{
+			name:    "zero send queue size",
+			key:     "SEND_QUEUE_SIZE",
+			value:   "0",
+			wantErr: "SEND_QUEUE_SIZE must be a positive integer",
+		},
+		{
+			name:    "negative per connection rate",
+			key:     "PER_CONNECTION_RATE",
+			value:   "-5",
+			wantErr: "PER_CONNECTION_RATE must be a non-negative integer",
+		},
+		{
+			name:    "invalid max body bytes",
+			key:     "MAX_BODY_BYTES",
+			value:   "10MB",
+			wantErr: "MAX_BODY_BYTES must be a non-negative integer",
+		},
+		{
+			name:    "invalid max header bytes",
+			key:     "MAX_HEADER_BYTES",
+			value:   "1k",
+			wantErr: "MAX_HEADER_BYTES must be a non-negative integer",
+		},
+		{
+			name:    "negative max attachment bytes",
+			key:     "MAX_ATTACHMENT_BYTES",
+			value:   "-1",
+			wantErr: "MAX_ATTACHMENT_BYTES must be a non-negative integer",
+		},
+		{
+			name:    "invalid maintenance window",
+			key:     "MAINTENANCE_WINDOWS",
+			value:   "Sun 02:00-04:00,Funday 02:00-04:00",
+			wantErr: `MAINTENANCE_WINDOWS: invalid day in "Funday 02:00-04:00"`,
+		},
+		{
+			name:    "invalid maintenance time zone",
+			key:     "MAINTENANCE_TIMEZONE",
+			value:   "Mars/Olympus_Mons",
+			wantErr: "MAINTENANCE_TIMEZONE must be an IANA time zone",
+		},
+		{
+			name:    "DKIM key without selector",
+			key:     "DKIM_PRIVATE_KEY_PATH",
+			value:   "/etc/smtp2graph/dkim.pem",
+			wantErr: "DKIM_PRIVATE_KEY_PATH, DKIM_SELECTOR and DKIM_DOMAIN must be set together",
+		},
 		{
 			name:    "zero max recipients",
 			key:     "SMTP_MAX_RECIPIENTS",
@@ -130,6 +379,150 @@ func TestLoadConfigFromInvalidOptionalValues(t *testing.T) {
 			value:   "0s",
 			wantErr: "SMTP_READ_TIMEOUT must be a positive duration",
 		},
+		{
+			name:    "invalid EHLO regex",
+			key:     "EHLO_ALLOW_REGEX",
+			value:   "[a-z",
+			wantErr: "EHLO_ALLOW_REGEX must be a valid regular expression",
+		},
+		{
+			name:    "unknown graph cloud",
+			key:     "GRAPH_CLOUD",
+			value:   "gcc-moderate",
+			wantErr: "GRAPH_CLOUD must be one of: public, gcc, gcchigh, dod, china",
+		},
+		{
+			name:    "unknown send mode",
+			key:     "GRAPH_SEND_MODE",
+			value:   "mime",
+			wantErr: "GRAPH_SEND_MODE must be one of: raw, json",
+		},
+		{
+			name:    "unknown batch policy",
+			key:     "GRAPH_BATCH_POLICY",
+			value:   "sometimes",
+			wantErr: "GRAPH_BATCH_POLICY must be one of: strict, partial",
+		},
+		{
+			name:    "invalid credential expiry",
+			key:     "ENTRA_CREDENTIAL_EXPIRES",
+			value:   "31.03.2027",
+			wantErr: "ENTRA_CREDENTIAL_EXPIRES must be a date such as 2027-03-31 or an RFC 3339 time",
+		},
+		{
+			name:    "credential expiry without validation",
+			key:     "ENTRA_CREDENTIAL_EXPIRES",
+			value:   "2027-03-31",
+			wantErr: "ENTRA_CREDENTIAL_EXPIRES requires TOKEN_VALIDATE_INTERVAL",
+		},
+		{
+			name:    "invalid sender priority",
+			key:     "SENDER_PRIORITY",
+			value:   "sender@example.com:urgent",
+			wantErr: "SENDER_PRIORITY priority of sender@example.com must be one of: high, normal, low",
+		},
+		{
+			name:    "sender priority of unknown sender",
+			key:     "SENDER_PRIORITY",
+			value:   "other@example.com:high",
+			wantErr: `SENDER_PRIORITY sender "other@example.com" is not configured`,
+		},
+		{
+			name:    "base64 line length not a multiple of 4",
+			key:     "BASE64_LINE_LENGTH",
+			value:   "75",
+			wantErr: "BASE64_LINE_LENGTH must be a multiple of 4",
+		},
+		{
+			name:    "unix socket without path",
+			key:     "SMTP_SERVER_ADDR",
+			value:   "unix:",
+			wantErr: "SMTP_SERVER_ADDR must name a socket path after unix:",
+		},
+		{
+			name:    "sentry sample rate above one",
+			key:     "SENTRY_SAMPLE_RATE",
+			value:   "1.5",
+			wantErr: "SENTRY_SAMPLE_RATE must be a number between 0 and 1",
+		},
+		{
+			name:    "zero sentry sample rate",
+			key:     "SENTRY_SAMPLE_RATE",
+			value:   "0",
+			wantErr: "SENTRY_SAMPLE_RATE must be above 0",
+		},
+		{
+			name:    "invalid sentry traces sample rate",
+			key:     "SENTRY_TRACES_SAMPLE_RATE",
+			value:   "half",
+			wantErr: "SENTRY_TRACES_SAMPLE_RATE must be a number between 0 and 1",
+		},
+		{
+			name:    "sender email without domain",
+			key:     "SENDER_EMAIL",
+			value:   "sender@",
+			wantErr: `SENDER_EMAIL must be a valid email address such as user@example.com, got "sender@"`,
+		},
+		{
+			name:    "sender email with display name",
+			key:     "SENDER_EMAIL",
+			value:   "Sender <sender@example.com>",
+			wantErr: "SENDER_EMAIL must be a valid email address",
+		},
+		{
+			name:    "sender email with typo",
+			key:     "SENDER_EMAIL",
+			value:   "sender.example.com",
+			wantErr: "SENDER_EMAIL must be a valid email address",
+		},
+		{
+			name:    "invalid sender account address",
+			key:     "SENDER_ACCOUNTS",
+			value:   "shared@@example.com:password",
+			wantErr: "SENDER_ACCOUNTS must be a valid email address",
+		},
+		{
+			name:    "invalid send-as mailbox",
+			key:     "GRAPH_SEND_AS",
+			value:   "shared",
+			wantErr: "GRAPH_SEND_AS must be a valid email address",
+		},
+		{
+			name:    "invalid allowed send-as address",
+			key:     "ALLOWED_SEND_AS",
+			value:   "shared@example.com, shared",
+			wantErr: "ALLOWED_SEND_AS must be a valid email address",
+		},
+		{
+			name:    "invalid auto-submitted sender",
+			key:     "AUTO_SUBMITTED_SENDERS",
+			value:   "alerts@example.com, alerts",
+			wantErr: "AUTO_SUBMITTED_SENDERS must be a valid email address",
+		},
+		{
+			name:    "invalid check recipient",
+			key:     "CHECK_SEND_TO",
+			value:   "admin@",
+			wantErr: "CHECK_SEND_TO must be a valid email address",
+		},
+		{
+			name:    "invalid idempotency header",
+			key:     "IDEMPOTENCY_HEADER",
+			value:   "X-Idempotency-Key:",
+			wantErr: "IDEMPOTENCY_HEADER must be a header field name",
+		},
+		{
+			name:    "relative graph base URL",
+			key:     "GRAPH_BASE_URL",
+			value:   "graph.microsoft.us/v1.0",
+			wantErr: "GRAPH_BASE_URL must be an absolute http(s) URL",
+		},
+		{
+			name:    "malformed sender accounts",
+			key:     "SENDER_ACCOUNTS",
+			value:   "shared@example.com",
+			wantErr: "SENDER_ACCOUNTS entries must be in email:password form",
+		},
 	}
 
 	for _, tt := range tests {
@@ -163,3 +556,142 @@ func configLookup(values map[string]string) func(string) string {
 		return values[key]
 	}
 }
+
+func TestLoadConfigFromValidSenderEmail(t *testing.T) {
+	for _, email := range []string{"sender@example.com", "first.last+relay@mail.example.co.uk"} {
+		values := requiredConfig()
+		values["SENDER_EMAIL"] = email
+		cfg, err := loadConfigFrom(configLookup(values))
+		if err != nil {
+			t.Fatalf("loadConfigFrom(SENDER_EMAIL=%q) error: %v", email, err)
+		}
+		if cfg.SenderEmail != email {
+			t.Errorf("SenderEmail = %q, want %q", cfg.SenderEmail, email)
+		}
+	}
+}
+
+func TestLoadConfigSendAs(t *testing.T) {
+	tests := []struct {
+		name        string
+		senderEmail string
+		sendAs      string
+		accounts    string
+		wantMailbox string // mailbox of the SENDER_EMAIL user
+		wantErr     string
+	}{
+		{name: "sender email only", senderEmail: "sender@example.com", wantMailbox: "sender@example.com"},
+		{name: "send-as overrides sender email", senderEmail: "sender@example.com", sendAs: "shared@example.com", wantMailbox: "shared@example.com"},
+		{name: "login name with send-as", senderEmail: "relay", sendAs: "shared@example.com", wantMailbox: "shared@example.com"},
+		{name: "login name without send-as", senderEmail: "relay", wantErr: "SENDER_EMAIL must be a valid email address"},
+		{name: "invalid send-as", senderEmail: "sender@example.com", sendAs: "shared@", wantErr: "GRAPH_SEND_AS must be a valid email address"},
+		{name: "both unset", wantErr: "missing required environment variable(s): SENDER_EMAIL, SENDER_PASSWORD"},
+		{name: "send-as without sender", sendAs: "shared@example.com", wantErr: "missing required environment variable(s): SENDER_EMAIL, SENDER_PASSWORD"},
+		{name: "sender accounts with send-as", sendAs: "shared@example.com", accounts: "user@example.com:secret", wantMailbox: "shared@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := requiredConfig()
+			delete(values, "SENDER_EMAIL")
+			delete(values, "SENDER_PASSWORD")
+			if tt.senderEmail != "" {
+				values["SENDER_EMAIL"] = tt.senderEmail
+				values["SENDER_PASSWORD"] = "password"
+			}
+			if tt.sendAs != "" {
+				values["GRAPH_SEND_AS"] = tt.sendAs
+			}
+			if tt.accounts != "" {
+				values["SENDER_ACCOUNTS"] = tt.accounts
+			}
+
+			cfg, err := loadConfigFrom(configLookup(values))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfigFrom() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfigFrom() error: %v", err)
+			}
+			if got := cfg.mailbox(tt.senderEmail); got != tt.wantMailbox {
+				t.Errorf("mailbox(%q) = %q, want %q", tt.senderEmail, got, tt.wantMailbox)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeSecret := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	values := requiredConfig()
+	delete(values, "ENTRA_CLIENT_SECRET")
+	delete(values, "SENDER_PASSWORD")
+	values["ENTRA_CLIENT_SECRET_FILE"] = writeSecret("client_secret", "file-secret\n")
+	values["SENDER_PASSWORD_FILE"] = writeSecret("sender_password", "file-password\r\n")
+	values["SENDER_ACCOUNTS_FILE"] = writeSecret("sender_accounts", "other@example.com:other-password")
+	values["METRICS_AUTH_TOKEN_FILE"] = writeSecret("metrics_token", "metrics-token\n\n")
+
+	cfg, err := loadConfigFrom(configLookup(values))
+	if err != nil {
+		t.Fatalf("loadConfigFrom() error: %v", err)
+	}
+	if cfg.EntraClientSecret != "file-secret" {
+		t.Errorf("EntraClientSecret = %q, want file-secret", cfg.EntraClientSecret)
+	}
+	if cfg.SenderPassword != "file-password" {
+		t.Errorf("SenderPassword = %q, want file-password", cfg.SenderPassword)
+	}
+	if got := cfg.SenderAccounts["other@example.com"]; got != "other-password" {
+		t.Errorf("SenderAccounts[other@example.com] = %q, want other-password", got)
+	}
+	if cfg.MetricsAuthToken != "metrics-token" {
+		t.Errorf("MetricsAuthToken = %q, want metrics-token", cfg.MetricsAuthToken)
+	}
+}
+
+func TestLoadConfigFromSecretFileErrors(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		values  map[string]string
+		wantErr string
+	}{
+		{
+			name:    "both set",
+			values:  map[string]string{"ENTRA_CLIENT_SECRET_FILE": secret},
+			wantErr: "only one of ENTRA_CLIENT_SECRET or ENTRA_CLIENT_SECRET_FILE may be set",
+		},
+		{
+			name:    "missing file",
+			values:  map[string]string{"SENTRY_DSN_FILE": filepath.Join(t.TempDir(), "missing")},
+			wantErr: "SENTRY_DSN_FILE:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := requiredConfig()
+			for k, v := range tt.values {
+				values[k] = v
+			}
+			_, err := loadConfigFrom(configLookup(values))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadConfigFrom() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
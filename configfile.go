@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configKeys are the environment variables that may be set in a config file, in the order of the
+// list in config.go, with the _FILE variants of the secrets read with getenvSecret.
+var configKeys = []string{
+	"ENTRA_USE_MANAGED_IDENTITY", "ENTRA_CLIENT_ID", "ENTRA_TENANT_ID", "ENTRA_CLIENT_SECRET",
+	"ENTRA_CLIENT_SECRET_FILE", "ENTRA_CLIENT_CERT_PATH", "ENTRA_CLIENT_CERT_PASSWORD",
+	"ENTRA_CLIENT_CERT_PASSWORD_FILE", "SENDER_EMAIL", "GRAPH_SEND_AS", "ALLOWED_SEND_AS",
+	"FROM_POLICY", "ENFORCE_FROM_MATCH", "SENDER_FROM_POLICY", "SENDER_PASSWORD",
+	"SENDER_PASSWORD_FILE", "SENDER_ACCOUNTS", "SENDER_ACCOUNTS_FILE", "SENDER_HEADERS",
+	"SMTP_SERVER_ADDR", "ENABLE_PROXY_PROTOCOL", "MAX_CONNECTIONS_PER_IP", "MAINTENANCE_WINDOWS",
+	"MAINTENANCE_TIMEZONE", "SMTP_SERVER_DOMAIN", "EHLO_ALLOW_REGEX", "SMTP_MAX_MESSAGE_BYTES",
+	"SMTP_MAX_RECIPIENTS", "MAX_HEADER_COUNT", "MAX_HEADER_LINE_BYTES", "MAX_HEADER_BYTES",
+	"MAX_BODY_BYTES", "MAX_ATTACHMENT_BYTES", "ENABLE_CRAM_MD5", "ENABLE_VRFY", "AUTH_SESSION_TIMEOUT",
+	"SMTP_WRITE_TIMEOUT", "SMTP_READ_TIMEOUT", "DATA_START_TIMEOUT", "TOKEN_ACQUIRE_TIMEOUT",
+	"TOKEN_RETRY_INTERVAL", "TOKEN_RETRY_MAX_INTERVAL", "TOKEN_VALIDATE_INTERVAL",
+	"ENTRA_CREDENTIAL_EXPIRES", "ENTRA_CREDENTIAL_WARN_DAYS", "HEALTH_ADDR", "METRICS_ENABLED",
+	"METRICS_AUTH_TOKEN", "METRICS_AUTH_TOKEN_FILE", "METRICS_AUTH_LIVENESS", "GRAPH_CLOUD",
+	"GRAPH_BASE_URL", "ENTRA_AUTHORITY_HOST", "GRAPH_AUDIT_LOG", "GRAPH_MAX_CONCURRENCY",
+	"GRAPH_CONCURRENCY_TIMEOUT", "GRAPH_INLINE_LIMIT_BYTES", "BASE64_LINE_LENGTH", "GRAPH_SEND_MODE",
+	"GRAPH_MAX_IDLE_CONNS", "GRAPH_IDLE_CONN_TIMEOUT", "GRAPH_FORCE_HTTP1", "GRAPH_TLS_RENEGOTIATION",
+	"GRAPH_HTTP_TIMEOUT", "GRAPH_MAX_ERROR_BODY_BYTES", "GRAPH_MAX_RETRIES", "GRAPH_RETRY_MAX_DELAY",
+	"SAVE_TO_SENT_ITEMS", "GRAPH_BATCH_RECIPIENTS", "GRAPH_BATCH_POLICY", "STRIP_CONTENT_LENGTH",
+	"STRIP_BOM", "DEDUPE_CC", "STRICT_RECIPIENT_MATCH", "DKIM_PRIVATE_KEY_PATH", "DKIM_SELECTOR",
+	"DKIM_DOMAIN", "ADD_RELAY_HEADERS", "TRANSCODE_SUBJECT", "GENERATE_MESSAGE_ID",
+	"ADD_MISSING_DATE", "IDEMPOTENCY_HEADER", "AUTO_SUBMITTED", "AUTO_SUBMITTED_SENDERS",
+	"RECIPIENT_ALLOW_DOMAINS", "RECIPIENT_DENY_DOMAINS", "SINGLE_DOMAIN_PER_MESSAGE",
+	"RATE_LIMIT_PER_MINUTE", "PER_RECIPIENT_RATE", "PER_CONNECTION_RATE", "LOG_REJECTIONS",
+	"TRANSACTION_RETRIES", "TRANSACTION_RETRY_DELAY", "SPOOL_DIR", "SPOOL_RETRY_INTERVAL",
+	"SPOOL_MAX_ATTEMPTS", "SENDER_PRIORITY", "DRY_RUN", "FEATURES", "SEND_WORKERS", "SEND_QUEUE_SIZE",
+	"SHUTDOWN_GRACE_PERIOD", "SLOW_TRANSACTION_THRESHOLD", "TRACE_MESSAGES", "CHECK_SEND_TO",
+	"SENTRY_DSN", "SENTRY_DSN_FILE", "SENTRY_ENVIRONMENT", "SENTRY_SAMPLE_RATE",
+	"SENTRY_TRACES_SAMPLE_RATE", "SENTRY_SCRUB_ADDRESSES", "OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_HEADERS",
+}
+
+// readConfigFile reads a YAML config file whose keys are the lowercase names of the environment
+// variables (smtp_server_addr, entra_client_id, ...) and returns its values as they would appear
+// in the environment: lists are joined with commas and mappings (sender_accounts) are encoded
+// as JSON.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]any
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, val := range raw {
+		s, err := configFileValue(val)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", path, key, err)
+		}
+		values[strings.ToUpper(key)] = s
+	}
+	return values, nil
+}
+
+// configFileValue returns the environment variable form of a YAML value.
+func configFileValue(val any) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configFileValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// loadConfigFile loads configuration from the YAML file at path, with the environment variables
+// of lookup taking precedence over the file. A variable that is set overrides the file even if it
+// is empty, which restores the default of a setting. Keys not in configKeys are rejected.
+func loadConfigFile(path string, lookup func(string) (string, bool)) (*appConfig, error) {
+	file, err := readConfigFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var unknown []string
+	for key := range file {
+		if !slices.Contains(configKeys, key) {
+			unknown = append(unknown, strings.ToLower(key))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%s: unknown config key(s): %s", path, strings.Join(unknown, ", "))
+	}
+
+	return loadConfigFrom(func(key string) string {
+		if val, ok := lookup(key); ok {
+			return val
+		}
+		return file[key]
+	})
+}
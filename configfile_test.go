@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	return path
+}
+
+// envLookup returns a lookup of values like os.LookupEnv.
+func envLookup(values map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		val, ok := values[key]
+		return val, ok
+	}
+}
+
+const testConfigFile = `
+sender_email: file@example.com
+sender_password: file-password
+entra_client_id: client-id
+entra_tenant_id: tenant-id
+entra_client_secret: client-secret
+smtp_server_addr: ":2525"
+smtp_max_recipients: 10
+smtp_write_timeout: 30s
+save_to_sent_items: false
+recipient_allow_domains:
+  - example.com
+  - example.org
+sender_accounts:
+  other@example.com: other-password
+`
+
+func TestLoadConfigFile(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		env       map[string]string
+		wantEmail string
+		wantAddr  string
+	}{
+		{name: "file only", file: testConfigFile, wantEmail: "file@example.com", wantAddr: ":2525"},
+		{name: "env only", file: "", env: requiredConfig(), wantEmail: "sender@example.com", wantAddr: ":1025"},
+		{
+			name:      "env overrides file",
+			file:      testConfigFile,
+			env:       map[string]string{"SENDER_EMAIL": "env@example.com", "SMTP_SERVER_ADDR": ":3525"},
+			wantEmail: "env@example.com",
+			wantAddr:  ":3525",
+		},
+		{
+			name:      "empty env overrides file",
+			file:      testConfigFile,
+			env:       map[string]string{"SMTP_SERVER_ADDR": ""},
+			wantEmail: "file@example.com",
+			wantAddr:  ":1025",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := loadConfigFile(writeConfigFile(t, tt.file), envLookup(tt.env))
+			if err != nil {
+				t.Fatalf("loadConfigFile() error: %v", err)
+			}
+			if cfg.SenderEmail != tt.wantEmail {
+				t.Errorf("SenderEmail = %q, want %q", cfg.SenderEmail, tt.wantEmail)
+			}
+			if cfg.SMTPAddr != tt.wantAddr {
+				t.Errorf("SMTPAddr = %q, want %q", cfg.SMTPAddr, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileValues(t *testing.T) {
+	cfg, err := loadConfigFile(writeConfigFile(t, testConfigFile), envLookup(nil))
+	if err != nil {
+		t.Fatalf("loadConfigFile() error: %v", err)
+	}
+	if cfg.MaxRecipients != 10 {
+		t.Errorf("MaxRecipients = %d, want 10", cfg.MaxRecipients)
+	}
+	if cfg.WriteTimeout != 30*time.Second {
+		t.Errorf("WriteTimeout = %s, want 30s", cfg.WriteTimeout)
+	}
+	if cfg.SaveToSentItems {
+		t.Error("SaveToSentItems = true, want false")
+	}
+	if want := []string{"example.com", "example.org"}; !slices.Equal(cfg.RecipientAllowDomains, want) {
+		t.Errorf("RecipientAllowDomains = %v, want %v", cfg.RecipientAllowDomains, want)
+	}
+	if cfg.SenderAccounts["other@example.com"] != "other-password" {
+		t.Errorf("SenderAccounts = %v, want other@example.com", cfg.SenderAccounts)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+	}{
+		{name: "missing required", file: "sender_email: file@example.com\n", wantErr: "missing required"},
+		{name: "unknown key", file: testConfigFile + "smtp_server_adress: \":25\"\n", wantErr: "unknown config key(s): smtp_server_adress"},
+		{name: "unknown key with missing required", file: "sender_email: file@example.com\nsmtp_server_adress: \":25\"\n", wantErr: "unknown config key(s): smtp_server_adress"},
+		{name: "invalid yaml", file: "sender_email: [\n", wantErr: "config.yaml"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadConfigFile(writeConfigFile(t, tt.file), envLookup(nil))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadConfigFile() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigKeysComplete(t *testing.T) {
+	values := requiredConfig()
+	var missing []string
+	_, err := loadConfigFrom(func(key string) string {
+		if !slices.Contains(configKeys, key) && !slices.Contains(missing, key) {
+			missing = append(missing, key)
+		}
+		return values[key]
+	})
+	if err != nil {
+		t.Fatalf("loadConfigFrom() error: %v", err)
+	}
+	if len(missing) > 0 {
+		t.Fatalf("configKeys is missing %v", missing)
+	}
+}
@@ -0,0 +1,62 @@
+// Package main provides the per-client connection limit of smtp2graph.
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimiter counts the SMTP sessions open from each remote IP address, so that a single
+// client cannot exhaust the server with connections. It is safe for concurrent use and shared by
+// all sessions of a backend. A nil limiter allows every session.
+type connLimiter struct {
+	max int
+
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// newConnLimiter returns a limiter allowing max sessions per IP address, or nil if max is not
+// positive.
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{max: max, active: make(map[string]int)}
+}
+
+// acquire counts a new session from ip and reports whether it is within the limit. Each
+// successful acquire must be followed by a release.
+func (l *connLimiter) acquire(ip string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] >= l.max {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+// release ends a session counted by acquire.
+func (l *connLimiter) release(ip string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip]--; l.active[ip] <= 0 {
+		delete(l.active, ip)
+	}
+}
+
+// remoteIP returns the IP address of a TCP remote address, or "" for other addresses such as
+// those of Unix domain socket clients, which are not limited.
+func remoteIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	return ""
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestBackendMaxConnectionsPerIP(t *testing.T) {
+	const limit = 3
+	bkd := &smtpBackend{config: &appConfig{}, ctx: t.Context(), handler: &mockHandler{}, conns: newConnLimiter(limit)}
+	srv := smtp.NewServer(bkd)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	// Many clients from the same address greet at once; only limit of them get a session.
+	const clients = 20
+	var (
+		mu       sync.Mutex
+		accepted []*netsmtp.Client
+		refused  int
+		wg       sync.WaitGroup
+	)
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := netsmtp.Dial(ln.Addr().String())
+			if err != nil {
+				t.Errorf("Dial() error: %v", err)
+				return
+			}
+			err = c.Hello("client.example.com")
+			mu.Lock()
+			defer mu.Unlock()
+			if err == nil {
+				accepted = append(accepted, c)
+				return
+			}
+			c.Close()
+			var protoErr *textproto.Error
+			if !errors.As(err, &protoErr) || protoErr.Code != 421 || !strings.HasPrefix(protoErr.Msg, "4.7.0") {
+				t.Errorf("Hello() error = %v, want 421 4.7.0", err)
+			}
+			refused++
+		}()
+	}
+	wg.Wait()
+	if len(accepted) != limit || refused != clients-limit {
+		t.Fatalf("accepted %d and refused %d sessions, want %d and %d", len(accepted), refused, limit, clients-limit)
+	}
+
+	// Once a session ends, its slot is free for a new one.
+	if err := accepted[0].Quit(); err != nil {
+		t.Fatalf("Quit() error: %v", err)
+	}
+	for _, c := range accepted[1:] {
+		defer c.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c, err := netsmtp.Dial(ln.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial() error: %v", err)
+		}
+		err = c.Hello("client.example.com")
+		c.Close()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Hello() after a session ended error: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	l := newConnLimiter(2)
+	if !l.acquire("192.0.2.1") || !l.acquire("192.0.2.1") {
+		t.Fatal("acquire() within the limit = false, want true")
+	}
+	if l.acquire("192.0.2.1") {
+		t.Fatal("acquire() beyond the limit = true, want false")
+	}
+	if !l.acquire("192.0.2.2") {
+		t.Fatal("acquire() from another address = false, want true")
+	}
+	l.release("192.0.2.1")
+	if !l.acquire("192.0.2.1") {
+		t.Fatal("acquire() after release = false, want true")
+	}
+	l.release("192.0.2.1")
+	l.release("192.0.2.1")
+	l.release("192.0.2.2")
+	if len(l.active) != 0 {
+		t.Fatalf("active = %v, want empty after all sessions are released", l.active)
+	}
+
+	var unlimited *connLimiter
+	if !unlimited.acquire("192.0.2.1") {
+		t.Fatal("nil limiter acquire() = false, want true")
+	}
+	unlimited.release("192.0.2.1")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+)
+
+// cramMD5 is the name of the CRAM-MD5 SASL mechanism (RFC 2195).
+const cramMD5 = "CRAM-MD5"
+
+// cramMD5Authenticator authenticates username. matches reports whether the client's response
+// proves knowledge of secret, the user's password.
+type cramMD5Authenticator func(username string, matches func(secret string) bool) error
+
+// cramMD5Server is the server side of CRAM-MD5: the client answers a unique challenge with its
+// user name and the HMAC-MD5 of the challenge keyed with its password, so the password itself
+// is never sent.
+type cramMD5Server struct {
+	challenge    []byte
+	authenticate cramMD5Authenticator
+	sent         bool
+}
+
+// newCramMD5Server returns a CRAM-MD5 server with a fresh challenge for domain.
+func newCramMD5Server(domain string, authenticate cramMD5Authenticator) sasl.Server {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	challenge := fmt.Sprintf("<%d.%d@%s>", binary.BigEndian.Uint64(b)>>1, time.Now().Unix(), domain)
+	return &cramMD5Server{challenge: []byte(challenge), authenticate: authenticate}
+}
+
+func (s *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if !s.sent {
+		// CRAM-MD5 has no initial response: the challenge comes first.
+		if len(response) > 0 {
+			return nil, false, sasl.ErrUnexpectedClientResponse
+		}
+		s.sent = true
+		return s.challenge, false, nil
+	}
+
+	i := strings.LastIndexByte(string(response), ' ')
+	if i <= 0 {
+		return nil, false, errors.New("cram-md5: malformed response")
+	}
+	username, digest := string(response[:i]), strings.ToLower(string(response[i+1:]))
+	err = s.authenticate(username, func(secret string) bool {
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(s.challenge)
+		return subtle.ConstantTimeCompare([]byte(digest), []byte(hex.EncodeToString(mac.Sum(nil)))) == 1
+	})
+	return nil, true, err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+// cramMD5Response returns the client response to challenge for username and password.
+func cramMD5Response(username, password string, challenge []byte) []byte {
+	mac := hmac.New(md5.New, []byte(password))
+	mac.Write(challenge)
+	return []byte(username + " " + hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestSessionAuthCramMD5(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantAuth bool
+	}{
+		{name: "valid credentials", username: "sender@example.com", password: "password", wantAuth: true},
+		{name: "username case", username: "Sender@Example.com", password: "password", wantAuth: true},
+		{name: "wrong password", username: "sender@example.com", password: "wrong"},
+		{name: "unknown user", username: "other@example.com", password: "password"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.EnableCramMD5 = true
+			session.config.SMTPDomain = "relay.example.com"
+			if !slices.Contains(session.AuthMechanisms(), "CRAM-MD5") {
+				t.Fatalf("AuthMechanisms() = %v, want CRAM-MD5", session.AuthMechanisms())
+			}
+
+			server, err := session.Auth("CRAM-MD5")
+			if err != nil {
+				t.Fatalf("Auth() error: %v", err)
+			}
+			challenge, done, err := server.Next(nil)
+			if err != nil || done {
+				t.Fatalf("Next(nil) = %q, %v, %v, want a challenge", challenge, done, err)
+			}
+			if !strings.HasPrefix(string(challenge), "<") || !strings.HasSuffix(string(challenge), "@relay.example.com>") {
+				t.Fatalf("challenge = %q, want <...@relay.example.com>", challenge)
+			}
+
+			_, done, err = server.Next(cramMD5Response(tt.username, tt.password, challenge))
+			if !done {
+				t.Fatal("Next(response) done = false, want true")
+			}
+			if tt.wantAuth {
+				if err != nil || !session.auth || session.user != "sender@example.com" {
+					t.Fatalf("Next(response) error = %v, auth = %v as %q, want authenticated as sender@example.com", err, session.auth, session.user)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 454 || session.auth {
+				t.Fatalf("Next(response) error = %v, auth = %v, want 454 and unauthenticated", err, session.auth)
+			}
+		})
+	}
+}
+
+func TestSessionAuthCramMD5Challenges(t *testing.T) {
+	session := newTestSessionWithT(t)
+	session.config.EnableCramMD5 = true
+	first, _ := session.Auth("CRAM-MD5")
+	second, _ := session.Auth("CRAM-MD5")
+	c1, _, _ := first.Next(nil)
+	c2, _, _ := second.Next(nil)
+	if string(c1) == string(c2) {
+		t.Fatalf("challenges repeat: %q", c1)
+	}
+
+	// A response to another challenge is not accepted.
+	if _, _, err := second.Next(cramMD5Response("sender@example.com", "password", c1)); err == nil {
+		t.Fatal("Next() accepted a response to another challenge")
+	}
+	// CRAM-MD5 has no initial response.
+	third, _ := session.Auth("CRAM-MD5")
+	if _, _, err := third.Next([]byte("sender@example.com 00")); err == nil {
+		t.Fatal("Next(initial response) error = nil, want error")
+	}
+}
+
+func TestSessionAuthCramMD5Disabled(t *testing.T) {
+	session := newTestSessionWithT(t)
+	if slices.Contains(session.AuthMechanisms(), "CRAM-MD5") {
+		t.Fatalf("AuthMechanisms() = %v, want no CRAM-MD5 unless enabled", session.AuthMechanisms())
+	}
+	if _, err := session.Auth("CRAM-MD5"); err == nil {
+		t.Fatal("Auth(CRAM-MD5) error = nil, want unknown mechanism")
+	}
+}
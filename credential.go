@@ -0,0 +1,170 @@
+// Package main provides the Graph credential validation, expiry warning and reload for smtp2graph.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// validateToken ensures a valid Graph token every config.TokenValidateInterval until ctx is done,
+// so that failing credentials show in readiness and the logs before they fail a message, and
+// checks the configured credential expiry each time.
+func (h *graphMailHandler) validateToken(ctx context.Context) {
+	ticker := time.NewTicker(h.config.TokenValidateInterval)
+	defer ticker.Stop()
+	var state credentialState
+	for {
+		h.checkCredential(ctx, &state)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// credentialState is the outcome of the previous checkCredential, so that a failure or warning
+// that persists across checks is reported to Sentry only once.
+type credentialState struct {
+	failing  bool // token acquisition failed
+	expiring bool // the credential expires within config.CredentialWarnDays
+	expired  bool
+}
+
+// checkCredential acquires a token if the cached one is due for refresh and warns if the
+// credential expires within config.CredentialWarnDays. Each check logs a failure or warning, but
+// reports it to Sentry only when it differs from state, which it then updates.
+func (h *graphMailHandler) checkCredential(ctx context.Context, state *credentialState) {
+	if !h.config.DryRun {
+		_, err := h.getCachedToken(ctx)
+		switch {
+		case err != nil && ctx.Err() == nil:
+			log.Printf("Token validation failed: %v", err)
+			if !state.failing {
+				reportError(ctx, err)
+			}
+			state.failing = true
+		case err == nil && state.failing:
+			log.Println("Token validation recovered")
+			state.failing = false
+		}
+	}
+	if h.config.CredentialExpires.IsZero() {
+		return
+	}
+	days, expiring := credentialExpiry(h.timeNow(), h.config.CredentialExpires, h.config.CredentialWarnDays)
+	credentialExpiryDays.Set(float64(days))
+	expired := days < 0
+	if expiring {
+		err := fmt.Errorf("credential expires in %d day(s) on %s, rotate the Entra client secret or certificate", days, h.config.CredentialExpires.Format(time.DateOnly))
+		log.Printf("warning: %v", err)
+		if !state.expiring || expired != state.expired {
+			reportError(ctx, err)
+		}
+	}
+	state.expiring, state.expired = expiring, expired
+}
+
+// credentialExpiry returns the whole days from now until expires, negative once it has passed, and
+// whether that is at most warnDays.
+func credentialExpiry(now, expires time.Time, warnDays int) (days int, expiring bool) {
+	remaining := expires.Sub(now)
+	days = int(remaining / (24 * time.Hour))
+	if remaining < 0 && remaining%(24*time.Hour) != 0 {
+		days-- // round towards the past, so an expired credential is never reported as 0 days left
+	}
+	return days, days <= warnDays
+}
+
+// credentialKey returns a digest of the configuration the Graph credential is built from,
+// including the content of the client certificate file, so that a reload can tell whether the
+// credential changed, also when a certificate was rotated in place.
+func credentialKey(config *appConfig) (string, error) {
+	h := sha256.New()
+	for _, field := range []string{
+		strconv.FormatBool(config.EntraUseManagedIdentity),
+		config.EntraTenantID,
+		config.EntraClientID,
+		config.EntraClientSecret,
+		config.EntraCertPath,
+		config.EntraCertPassword,
+		config.EntraAuthorityHost,
+	} {
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	if config.EntraCertPath != "" && !config.EntraUseManagedIdentity {
+		data, err := os.ReadFile(config.EntraCertPath)
+		if err != nil {
+			return "", fmt.Errorf("read client certificate: %w", err)
+		}
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reloadCredential rebuilds the Graph credential from config if its credential settings differ
+// from those of the current one, such as after a client secret rotation, and clears the cached
+// token so that the next send acquires one with the new credential. It reports whether the
+// credential was replaced. Other settings in config are not applied.
+func (h *graphMailHandler) reloadCredential(config *appConfig) (bool, error) {
+	key, err := credentialKey(config)
+	if err != nil {
+		return false, err
+	}
+	h.tokenMutex.Lock()
+	unchanged := key == h.credKey
+	h.tokenMutex.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	cred, err := newCredential(config)
+	if err != nil {
+		return false, err
+	}
+
+	h.tokenMutex.Lock()
+	defer h.tokenMutex.Unlock()
+	h.cred = cred
+	h.credKey = key
+	h.token = ""
+	h.tokenExp = 0
+	// A refresh in progress uses the old credential; its result is not cached.
+	h.tokenInflight = nil
+	// Failures of the old credential do not delay the first attempt with the new one.
+	h.tokenFailures = 0
+	h.tokenRetryAt = time.Time{}
+	return true, nil
+}
+
+// reloadOnHangup reloads the Graph credential from configPath and the environment on each SIGHUP
+// received on hup, until ctx is done, logging the outcome.
+func (h *graphMailHandler) reloadOnHangup(ctx context.Context, hup <-chan os.Signal, configPath string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			log.Printf("Reload failed, keeping the current credential: %v", err)
+			continue
+		}
+		changed, err := h.reloadCredential(cfg)
+		switch {
+		case err != nil:
+			log.Printf("Reload failed, keeping the current credential: %v", err)
+			reportError(ctx, err)
+		case changed:
+			log.Println("Reloaded the Graph credential; the next send acquires a new token")
+		default:
+			log.Println("Reload: Graph credential unchanged")
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/getsentry/sentry-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCredentialExpiry(t *testing.T) {
+	expires := time.Date(2027, 3, 31, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name         string
+		remaining    time.Duration
+		warnDays     int
+		wantDays     int
+		wantExpiring bool
+	}{
+		{name: "far off", remaining: 45 * 24 * time.Hour, warnDays: 30, wantDays: 45},
+		{name: "at threshold", remaining: 30 * 24 * time.Hour, warnDays: 30, wantDays: 30, wantExpiring: true},
+		{name: "partial day", remaining: 29*24*time.Hour + 12*time.Hour, warnDays: 30, wantDays: 29, wantExpiring: true},
+		{name: "last hours", remaining: time.Hour, warnDays: 30, wantDays: 0, wantExpiring: true},
+		{name: "expired", remaining: -time.Hour, warnDays: 30, wantDays: -1, wantExpiring: true},
+		{name: "no warning period", remaining: 24 * time.Hour, warnDays: 0, wantDays: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			days, expiring := credentialExpiry(expires.Add(-tt.remaining), expires, tt.warnDays)
+			if days != tt.wantDays || expiring != tt.wantExpiring {
+				t.Fatalf("credentialExpiry() = %d, %v, want %d, %v", days, expiring, tt.wantDays, tt.wantExpiring)
+			}
+		})
+	}
+}
+
+func TestCheckCredential(t *testing.T) {
+	now := time.Date(2027, 3, 1, 12, 0, 0, 0, time.UTC)
+	cred := &stubCredential{token: "token"}
+	h := &graphMailHandler{
+		config: &appConfig{
+			CredentialExpires:  time.Date(2027, 3, 31, 0, 0, 0, 0, time.UTC),
+			CredentialWarnDays: 30,
+		},
+		cred: cred,
+		now:  func() time.Time { return now },
+	}
+
+	h.checkCredential(context.Background(), &credentialState{})
+	if cred.calls != 1 {
+		t.Fatalf("GetToken calls = %d, want 1", cred.calls)
+	}
+	if !h.ready() {
+		t.Fatal("ready() = false after a successful validation")
+	}
+	if got := testutil.ToFloat64(credentialExpiryDays); got != 29 {
+		t.Fatalf("credential expiry days = %v, want 29", got)
+	}
+}
+
+func TestCheckCredentialReportsOncePerState(t *testing.T) {
+	var events int
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn: "https://key@sentry.example.com/1",
+		BeforeSend: func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+			events++
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error: %v", err)
+	}
+	ctx := sentry.SetHubOnContext(t.Context(), sentry.NewHub(client, sentry.NewScope()))
+
+	now := time.Date(2027, 3, 1, 12, 0, 0, 0, time.UTC)
+	cred := &stubCredential{err: errors.New("invalid client secret")}
+	h := &graphMailHandler{
+		config: &appConfig{
+			CredentialExpires:  time.Date(2027, 3, 31, 0, 0, 0, 0, time.UTC),
+			CredentialWarnDays: 30,
+		},
+		cred: cred,
+		now:  func() time.Time { return now },
+	}
+	var state credentialState
+	check := func(want int) {
+		t.Helper()
+		h.tokenRetryAt = time.Time{} // skip the refresh backoff
+		h.checkCredential(ctx, &state)
+		if events != want {
+			t.Fatalf("reported %d events, want %d", events, want)
+		}
+	}
+
+	check(2) // the token failure and the expiry warning
+	check(2)
+	cred.err = nil
+	check(2)
+	h.token = "" // force a refresh
+	cred.err = errors.New("invalid client secret")
+	check(3)
+	now = now.AddDate(0, 1, 0)
+	check(4) // expired
+	check(4)
+}
+
+func TestReloadCredential(t *testing.T) {
+	cfg, err := loadConfigFrom(configLookup(requiredConfig()))
+	if err != nil {
+		t.Fatalf("loadConfigFrom() error: %v", err)
+	}
+	key, err := credentialKey(cfg)
+	if err != nil {
+		t.Fatalf("credentialKey() error: %v", err)
+	}
+	stub := &stubCredential{token: "token"}
+	h := &graphMailHandler{
+		config:        cfg,
+		cred:          stub,
+		credKey:       key,
+		token:         "cached",
+		tokenExp:      time.Now().Add(time.Hour).Unix(),
+		tokenFailures: 3,
+		tokenRetryAt:  time.Now().Add(time.Minute),
+	}
+
+	changed, err := h.reloadCredential(cfg)
+	if err != nil || changed {
+		t.Fatalf("reloadCredential(same) = %v, %v, want false, nil", changed, err)
+	}
+	if h.cred != stub || h.token != "cached" {
+		t.Fatal("unchanged reload replaced the credential or cleared the token")
+	}
+
+	rotated := requiredConfig()
+	rotated["ENTRA_CLIENT_SECRET"] = "rotated-secret"
+	cfg, err = loadConfigFrom(configLookup(rotated))
+	if err != nil {
+		t.Fatalf("loadConfigFrom() error: %v", err)
+	}
+	changed, err = h.reloadCredential(cfg)
+	if err != nil || !changed {
+		t.Fatalf("reloadCredential(rotated) = %v, %v, want true, nil", changed, err)
+	}
+	if _, ok := h.cred.(*azidentity.ClientSecretCredential); !ok {
+		t.Fatalf("credential after reload = %T, want *azidentity.ClientSecretCredential", h.cred)
+	}
+	if h.token != "" || h.tokenFailures != 0 || !h.tokenRetryAt.IsZero() {
+		t.Fatalf("token state not cleared: token=%q failures=%d retryAt=%s", h.token, h.tokenFailures, h.tokenRetryAt)
+	}
+}
+
+func TestReloadCredentialDuringRefresh(t *testing.T) {
+	cfg, err := loadConfigFrom(configLookup(requiredConfig()))
+	if err != nil {
+		t.Fatalf("loadConfigFrom() error: %v", err)
+	}
+	old := &blockingCredential{release: make(chan struct{})}
+	h := &graphMailHandler{config: cfg, cred: old}
+
+	result := make(chan string)
+	go func() {
+		token, _ := h.getCachedToken(context.Background())
+		result <- token
+	}()
+	for {
+		h.tokenMutex.Lock()
+		started := h.tokenInflight != nil
+		h.tokenMutex.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if changed, err := h.reloadCredential(cfg); err != nil || !changed {
+		t.Fatalf("reloadCredential() = %v, %v, want true, nil", changed, err)
+	}
+	close(old.release)
+	if token := <-result; token != "token" {
+		t.Fatalf("waiting caller got %q, want the token of its refresh", token)
+	}
+	h.tokenMutex.Lock()
+	defer h.tokenMutex.Unlock()
+	if h.token != "" {
+		t.Fatalf("token of the replaced credential cached: %q", h.token)
+	}
+}
+
+func TestCredentialKeyCertificateRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.pem")
+	cfg := &appConfig{EntraTenantID: "tenant-id", EntraClientID: "client-id", EntraCertPath: path}
+	key := func() string {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(t.Name()+time.Now().String()), 0o600); err != nil {
+			t.Fatalf("WriteFile() error: %v", err)
+		}
+		k, err := credentialKey(cfg)
+		if err != nil {
+			t.Fatalf("credentialKey() error: %v", err)
+		}
+		return k
+	}
+	if key() == key() {
+		t.Fatal("credentialKey() unchanged after the certificate file was replaced")
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// writeKey writes der as a PEM block of type typ and returns the file path.
+func writeKey(t *testing.T, typ string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestDKIMOptions returns the signing options of a new Ed25519 key for selector relay of
+// example.com, and its public key.
+func newTestDKIMOptions(t *testing.T) (ed25519.PublicKey, *dkim.SignOptions) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options, err := newDKIMOptions(&appConfig{
+		DKIMPrivateKeyPath: writeKey(t, "PRIVATE KEY", der),
+		DKIMSelector:       "relay",
+		DKIMDomain:         "example.com",
+	})
+	if err != nil {
+		t.Fatalf("newDKIMOptions() error: %v", err)
+	}
+	return pub, options
+}
+
+func TestHandleMessageDKIMRoundTrip(t *testing.T) {
+	pub, options := newTestDKIMOptions(t)
+
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	h := newTestGraphHandler(srv, 0)
+	h.cred = &stubCredential{token: "token"}
+	h.dkim = options
+
+	msg, err := mail.ReadMessage(strings.NewReader("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatalf("ReadMessage() error: %v", err)
+	}
+	if err := h.handleMessage(context.Background(), "sender@example.com", msg); err != nil {
+		t.Fatalf("handleMessage() error: %v", err)
+	}
+
+	sent, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil {
+		t.Fatalf("decode request body: %v", err)
+	}
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(sent), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "relay._domainkey.example.com" {
+				t.Errorf("LookupTXT(%q), want relay._domainkey.example.com", domain)
+			}
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	if len(verifications) != 1 || verifications[0].Err != nil || verifications[0].Domain != "example.com" {
+		t.Fatalf("verifications = %+v, want one valid signature for example.com", verifications)
+	}
+}
+
+func TestHandleMessageDKIMSkipsDrafts(t *testing.T) {
+	us := newUploadServer(t)
+	h := newUploadHandler(us)
+	_, h.dkim = newTestDKIMOptions(t)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024/16)
+
+	if err := h.handleMessage(context.Background(), "sender@example.com", largeMessage(t, data)); err != nil {
+		t.Fatalf("handleMessage() error: %v", err)
+	}
+	if !us.sent {
+		t.Fatal("draft was not sent")
+	}
+	if bytes.Contains(us.draft, []byte("DKIM-Signature:")) {
+		t.Fatalf("draft should not be signed:\n%s", us.draft)
+	}
+}
+
+func TestSessionDataDKIMKnownKey(t *testing.T) {
+	// A fixed key, so that the published record below is known.
+	priv := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{0x42}, ed25519.SeedSize))
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(priv.Public().(ed25519.PublicKey))
+	options, err := newDKIMOptions(&appConfig{
+		DKIMPrivateKeyPath: writeKey(t, "PRIVATE KEY", der),
+		DKIMSelector:       "relay",
+		DKIMDomain:         "example.com",
+	})
+	if err != nil {
+		t.Fatalf("newDKIMOptions() error: %v", err)
+	}
+
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	h := newTestGraphHandler(srv, 0)
+	h.cred = &stubCredential{token: "token"}
+	h.dkim = options
+
+	// Folded headers, odd whitespace and headers added by the session must all survive signing.
+	session := newTestSessionWithT(t)
+	session.config.GenerateMessageID = true
+	session.config.AddMissingDate = true
+	session.handler = h
+	session.auth = true
+	session.user = "sender@example.com"
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	if err := session.Rcpt("recipient@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() error: %v", err)
+	}
+	raw := "From: Sender  <sender@example.com>\r\nTo: recipient@example.com\r\n" +
+		"Subject: A subject that is\r\n folded\t over two lines  \r\n\r\nHello  \r\nWorld\r\n\r\n\r\n"
+	if err := session.Data(strings.NewReader(raw)); err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+
+	sent, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil {
+		t.Fatalf("decode request body: %v", err)
+	}
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(sent), &dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) { return []string{record}, nil },
+	})
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	if len(verifications) != 1 || verifications[0].Err != nil {
+		t.Fatalf("verifications = %+v, want one valid signature\n%s", verifications, sent)
+	}
+	// The fields added by the session are signed, as they are in dkimHeaderKeys.
+	for _, field := range []string{"\r\nMessage-Id: ", "\r\nDate: "} {
+		if !strings.Contains(string(sent), field) {
+			t.Errorf("sent message lacks %q:\n%s", field, sent)
+		}
+	}
+}
+
+func TestNewDKIMOptions(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("not configured", func(t *testing.T) {
+		options, err := newDKIMOptions(&appConfig{})
+		if err != nil || options != nil {
+			t.Fatalf("newDKIMOptions() = %v, %v; want nil, nil", options, err)
+		}
+		mime := []byte("Subject: Test\r\n\r\nHello\r\n")
+		if signed, err := signDKIM(mime, options); err != nil || !bytes.Equal(signed, mime) {
+			t.Fatalf("signDKIM() = %q, %v; want the message unchanged", signed, err)
+		}
+	})
+	t.Run("PKCS #1 RSA key", func(t *testing.T) {
+		path := writeKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+		options, err := newDKIMOptions(&appConfig{DKIMPrivateKeyPath: path, DKIMSelector: "s", DKIMDomain: "example.com"})
+		if err != nil {
+			t.Fatalf("newDKIMOptions() error: %v", err)
+		}
+		signed, err := signDKIM([]byte("From: sender@example.com\r\nSubject: Test\r\n\r\nHello\r\n"), options)
+		if err != nil {
+			t.Fatalf("signDKIM() error: %v", err)
+		}
+		if !bytes.HasPrefix(signed, []byte("DKIM-Signature: ")) || !bytes.Contains(signed, []byte("a=rsa-sha256")) {
+			t.Fatalf("signed message = %q, want an rsa-sha256 DKIM-Signature first", signed)
+		}
+	})
+	t.Run("invalid key", func(t *testing.T) {
+		path := writeKey(t, "PRIVATE KEY", []byte("not a key"))
+		if _, err := newDKIMOptions(&appConfig{DKIMPrivateKeyPath: path, DKIMSelector: "s", DKIMDomain: "example.com"}); err == nil {
+			t.Fatal("newDKIMOptions() error = nil, want parse error")
+		}
+	})
+}
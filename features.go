@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// featureFlags are the boolean options that may also be toggled through FEATURES, by the
+// lowercase name of their environment variable. Each reports whether it is enabled in a config.
+var featureFlags = []struct {
+	key     string
+	enabled func(c *appConfig) bool
+}{
+	{"ENABLE_CRAM_MD5", func(c *appConfig) bool { return c.EnableCramMD5 }},
+	{"ENABLE_VRFY", func(c *appConfig) bool { return c.EnableVRFY }},
+	{"SAVE_TO_SENT_ITEMS", func(c *appConfig) bool { return c.SaveToSentItems }},
+	{"STRIP_CONTENT_LENGTH", func(c *appConfig) bool { return c.StripContentLength }},
+	{"STRIP_BOM", func(c *appConfig) bool { return c.StripBOM }},
+	{"DEDUPE_CC", func(c *appConfig) bool { return c.DedupeCc }},
+	{"STRICT_RECIPIENT_MATCH", func(c *appConfig) bool { return c.StrictRecipientMatch }},
+	{"ADD_RELAY_HEADERS", func(c *appConfig) bool { return c.AddRelayHeaders }},
+	{"TRANSCODE_SUBJECT", func(c *appConfig) bool { return c.TranscodeSubject }},
+	{"GENERATE_MESSAGE_ID", func(c *appConfig) bool { return c.GenerateMessageID }},
+	{"ADD_MISSING_DATE", func(c *appConfig) bool { return c.AddMissingDate }},
+	{"AUTO_SUBMITTED", func(c *appConfig) bool { return c.AutoSubmitted }},
+	{"SINGLE_DOMAIN_PER_MESSAGE", func(c *appConfig) bool { return c.SingleDomainPerMessage }},
+	{"LOG_REJECTIONS", func(c *appConfig) bool { return c.LogRejections }},
+	{"TRACE_MESSAGES", func(c *appConfig) bool { return c.TraceMessages }},
+	{"DRY_RUN", func(c *appConfig) bool { return c.DryRun }},
+}
+
+// parseFeatures parses FEATURES, a comma-separated list of feature names such as
+// "dedupe_cc,strip_bom,-save_to_sent_items", into the values of their environment variables:
+// "true" for a name, "false" for a name prefixed with "-".
+func parseFeatures(s string) (map[string]string, error) {
+	known := make(map[string]bool, len(featureFlags))
+	for _, f := range featureFlags {
+		known[f.key] = true
+	}
+
+	values := make(map[string]string)
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		value := "true"
+		if rest, ok := strings.CutPrefix(name, "-"); ok {
+			name, value = rest, "false"
+		}
+		key := strings.ToUpper(name)
+		if !known[key] {
+			return nil, fmt.Errorf("FEATURES: unknown feature %q", name)
+		}
+		if prev, ok := values[key]; ok && prev != value {
+			return nil, fmt.Errorf("FEATURES: feature %q both enabled and disabled", strings.ToLower(key))
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// withFeatures returns lookup with the feature values of FEATURES filled in for the variables
+// that are not set themselves, so that an individual variable takes precedence.
+func withFeatures(lookup func(string) string, features map[string]string) func(string) string {
+	if len(features) == 0 {
+		return lookup
+	}
+	return func(key string) string {
+		if val := lookup(key); val != "" {
+			return val
+		}
+		return features[key]
+	}
+}
+
+// Features returns the lowercase names of the enabled feature flags, for logging.
+func (c *appConfig) Features() []string {
+	var names []string
+	for _, f := range featureFlags {
+		if f.enabled(c) {
+			names = append(names, strings.ToLower(f.key))
+		}
+	}
+	return names
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFromFeatures(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string]string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			want: []string{"enable_vrfy", "save_to_sent_items", "strip_content_length", "generate_message_id", "add_missing_date"},
+		},
+		{
+			name:   "enable and disable",
+			values: map[string]string{"FEATURES": "dedupe_cc, Strip_BOM,-enable_vrfy,-save_to_sent_items,-generate_message_id,-add_missing_date"},
+			want:   []string{"strip_content_length", "strip_bom", "dedupe_cc"},
+		},
+		{
+			name:   "variable takes precedence over FEATURES",
+			values: map[string]string{"FEATURES": "dedupe_cc,-strip_content_length", "DEDUPE_CC": "false", "STRIP_CONTENT_LENGTH": "true"},
+			want:   []string{"enable_vrfy", "save_to_sent_items", "strip_content_length", "generate_message_id", "add_missing_date"},
+		},
+		{
+			name:   "variable enables what FEATURES leaves out",
+			values: map[string]string{"FEATURES": "strip_bom", "DRY_RUN": "true"},
+			want:   []string{"enable_vrfy", "save_to_sent_items", "strip_content_length", "strip_bom", "generate_message_id", "add_missing_date", "dry_run"},
+		},
+		{
+			name:    "unknown feature",
+			values:  map[string]string{"FEATURES": "dedupe_cc,turbo"},
+			wantErr: `FEATURES: unknown feature "turbo"`,
+		},
+		{
+			name:    "not a boolean option",
+			values:  map[string]string{"FEATURES": "smtp_max_recipients"},
+			wantErr: `FEATURES: unknown feature "smtp_max_recipients"`,
+		},
+		{
+			name:    "enabled and disabled",
+			values:  map[string]string{"FEATURES": "dedupe_cc,-dedupe_cc"},
+			wantErr: `FEATURES: feature "dedupe_cc" both enabled and disabled`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := requiredConfig()
+			for k, v := range tt.values {
+				values[k] = v
+			}
+			cfg, err := loadConfigFrom(configLookup(values))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadConfigFrom() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfigFrom() error: %v", err)
+			}
+			if got := cfg.Features(); !slices.Equal(got, tt.want) {
+				t.Fatalf("Features() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeatureFlagsAreBooleanOptions(t *testing.T) {
+	// Every feature must be a boolean variable that loadConfigFrom reads, or FEATURES would
+	// silently have no effect on it.
+	for _, f := range featureFlags {
+		values := requiredConfig()
+		values[f.key] = "not-a-bool"
+		_, err := loadConfigFrom(configLookup(values))
+		if err == nil || !strings.Contains(err.Error(), f.key+" must be a boolean") {
+			t.Errorf("loadConfigFrom(%s=not-a-bool) error = %v, want boolean error", f.key, err)
+		}
+	}
+}
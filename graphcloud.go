@@ -0,0 +1,45 @@
+package main
+
+// Names of the Microsoft clouds selectable with GRAPH_CLOUD.
+const (
+	cloudPublic  = "public"
+	cloudGCC     = "gcc"
+	cloudGCCHigh = "gcchigh"
+	cloudDoD     = "dod"
+	cloudChina   = "china"
+)
+
+// graphCloud holds the endpoints of a Microsoft cloud.
+type graphCloud struct {
+	graphBaseURL  string // Microsoft Graph API base URL
+	authorityHost string // Microsoft Entra authority host for token requests
+}
+
+// graphClouds maps the GRAPH_CLOUD names to their endpoints.
+//
+// GCC (moderate) tenants are commonly confused with GCC High: although they are US Government
+// Community Cloud tenants, they live in the commercial cloud, so Graph and Entra are reached at the
+// public endpoints exactly as for any other tenant. Only GCC High and DoD have their own
+// endpoints, sharing the US Government authority but with separate Graph hosts.
+var graphClouds = map[string]graphCloud{
+	cloudPublic: {
+		graphBaseURL:  graphBaseURL,
+		authorityHost: "https://login.microsoftonline.com/",
+	},
+	cloudGCC: {
+		graphBaseURL:  graphBaseURL,
+		authorityHost: "https://login.microsoftonline.com/",
+	},
+	cloudGCCHigh: {
+		graphBaseURL:  "https://graph.microsoft.us/v1.0",
+		authorityHost: "https://login.microsoftonline.us/",
+	},
+	cloudDoD: {
+		graphBaseURL:  "https://dod-graph.microsoft.us/v1.0",
+		authorityHost: "https://login.microsoftonline.us/",
+	},
+	cloudChina: {
+		graphBaseURL:  "https://microsoftgraph.chinacloudapi.cn/v1.0",
+		authorityHost: "https://login.chinacloudapi.cn/",
+	},
+}
@@ -0,0 +1,70 @@
+package main
+
+import "testing"
+
+func TestLoadConfigFromGraphCloud(t *testing.T) {
+	tests := []struct {
+		name          string
+		env           map[string]string
+		wantBaseURL   string
+		wantAuthority string
+	}{
+		{
+			name:          "default",
+			wantBaseURL:   "https://graph.microsoft.com/v1.0",
+			wantAuthority: "https://login.microsoftonline.com/",
+		},
+		{
+			name:          "gcc moderate uses the commercial endpoints",
+			env:           map[string]string{"GRAPH_CLOUD": "gcc"},
+			wantBaseURL:   "https://graph.microsoft.com/v1.0",
+			wantAuthority: "https://login.microsoftonline.com/",
+		},
+		{
+			name:          "gcc high",
+			env:           map[string]string{"GRAPH_CLOUD": "GCCHigh"},
+			wantBaseURL:   "https://graph.microsoft.us/v1.0",
+			wantAuthority: "https://login.microsoftonline.us/",
+		},
+		{
+			name:          "dod",
+			env:           map[string]string{"GRAPH_CLOUD": "dod"},
+			wantBaseURL:   "https://dod-graph.microsoft.us/v1.0",
+			wantAuthority: "https://login.microsoftonline.us/",
+		},
+		{
+			name:          "china",
+			env:           map[string]string{"GRAPH_CLOUD": "china"},
+			wantBaseURL:   "https://microsoftgraph.chinacloudapi.cn/v1.0",
+			wantAuthority: "https://login.chinacloudapi.cn/",
+		},
+		{
+			name: "explicit endpoints override the cloud",
+			env: map[string]string{
+				"GRAPH_CLOUD":    "gcc",
+				"GRAPH_BASE_URL": "https://graph.example.test/v1.0",
+			},
+			wantBaseURL:   "https://graph.example.test/v1.0",
+			wantAuthority: "https://login.microsoftonline.com/",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := requiredConfig()
+			for k, v := range tt.env {
+				env[k] = v
+			}
+			cfg, err := loadConfigFrom(configLookup(env))
+			if err != nil {
+				t.Fatalf("loadConfigFrom() error = %v", err)
+			}
+			if cfg.GraphBaseURL != tt.wantBaseURL {
+				t.Errorf("GraphBaseURL = %q, want %q", cfg.GraphBaseURL, tt.wantBaseURL)
+			}
+			if cfg.EntraAuthorityHost != tt.wantAuthority {
+				t.Errorf("EntraAuthorityHost = %q, want %q", cfg.EntraAuthorityHost, tt.wantAuthority)
+			}
+		})
+	}
+}
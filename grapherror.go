@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// maxGraphReplyMessage caps the Graph error message repeated in an SMTP reply.
+const maxGraphReplyMessage = 200
+
+// graphErrorReplies maps well-known Graph error codes to the SMTP reply code and enhanced status
+// code for a message Graph rejected with them.
+var graphErrorReplies = map[string]struct {
+	code     int
+	enhanced smtp.EnhancedCode
+}{
+	"ErrorAccessDenied":                {550, smtp.EnhancedCode{5, 7, 1}},
+	"ErrorSendAsDenied":                {550, smtp.EnhancedCode{5, 7, 1}},
+	"Authorization_RequestDenied":      {550, smtp.EnhancedCode{5, 7, 1}},
+	"ErrorInvalidRecipients":           {550, smtp.EnhancedCode{5, 1, 3}},
+	"ErrorMessageSizeExceeded":         {552, smtp.EnhancedCode{5, 3, 4}},
+	"ErrorQuotaExceeded":               {452, smtp.EnhancedCode{4, 2, 2}},
+	"ErrorMailboxStoreUnavailable":     {451, smtp.EnhancedCode{4, 2, 1}},
+	"MailboxNotEnabledForRESTAPI":      {550, smtp.EnhancedCode{5, 1, 8}},
+	"ErrorInvalidUser":                 {550, smtp.EnhancedCode{5, 1, 8}},
+	"ErrorNonExistentMailbox":          {550, smtp.EnhancedCode{5, 1, 8}},
+	"ErrorMimeContentConversionFailed": {554, smtp.EnhancedCode{5, 6, 0}},
+}
+
+// details returns the code and message of the JSON error envelope in the response body, which
+// are empty if the body has none, for example because it was truncated.
+func (e *graphError) details() (code, message string) {
+	var envelope struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal([]byte(e.Body), &envelope) != nil {
+		return "", ""
+	}
+	return envelope.Error.Code, envelope.Error.Message
+}
+
+// smtpReply returns the SMTP reply for a message Graph rejected with e. Well-known Graph error
+// codes get a matching enhanced status code, others 554 5.3.0. The message gives the Graph error
+// code and a shortened error message instead of the raw response body, which may be long and
+// hold internal detail; the full error is reported to Sentry separately.
+func (e *graphError) smtpReply() (int, smtp.EnhancedCode, string) {
+	code, message := e.details()
+	if code == "" {
+		return 554, smtp.EnhancedCode{5, 3, 0}, fmt.Sprintf("Microsoft Graph rejected the message: %s", e.Status)
+	}
+	reply, ok := graphErrorReplies[code]
+	if !ok {
+		reply.code, reply.enhanced = 554, smtp.EnhancedCode{5, 3, 0}
+	}
+	message = strings.Join(strings.Fields(message), " ")
+	if len(message) > maxGraphReplyMessage {
+		message = strings.ToValidUTF8(message[:maxGraphReplyMessage], "") + "..."
+	}
+	if message == "" {
+		return reply.code, reply.enhanced, fmt.Sprintf("Microsoft Graph rejected the message: %s", code)
+	}
+	return reply.code, reply.enhanced, fmt.Sprintf("Microsoft Graph rejected the message: %s: %s", code, message)
+}
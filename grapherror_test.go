@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestGraphErrorSMTPReply(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		body         string
+		wantCode     int
+		wantEnhanced smtp.EnhancedCode
+		wantMessage  string
+	}{
+		{
+			name:         "access denied",
+			status:       http.StatusForbidden,
+			body:         `{"error":{"code":"ErrorAccessDenied","message":"Access is denied. Check credentials and try again."}}`,
+			wantCode:     550,
+			wantEnhanced: smtp.EnhancedCode{5, 7, 1},
+			wantMessage:  "Microsoft Graph rejected the message: ErrorAccessDenied: Access is denied. Check credentials and try again.",
+		},
+		{
+			name:         "invalid recipients",
+			status:       http.StatusBadRequest,
+			body:         `{"error":{"code":"ErrorInvalidRecipients","message":"At least one recipient isn't valid.","innerError":{"request-id":"0f0e","client-request-id":"0f0e"}}}`,
+			wantCode:     550,
+			wantEnhanced: smtp.EnhancedCode{5, 1, 3},
+			wantMessage:  "Microsoft Graph rejected the message: ErrorInvalidRecipients: At least one recipient isn't valid.",
+		},
+		{
+			name:         "mailbox not enabled",
+			status:       http.StatusNotFound,
+			body:         `{"error":{"code":"MailboxNotEnabledForRESTAPI","message":"The mailbox is either inactive, soft-deleted, or is hosted on-premise."}}`,
+			wantCode:     550,
+			wantEnhanced: smtp.EnhancedCode{5, 1, 8},
+			wantMessage:  "Microsoft Graph rejected the message: MailboxNotEnabledForRESTAPI: The mailbox is either inactive, soft-deleted, or is hosted on-premise.",
+		},
+		{
+			name:         "unknown code",
+			status:       http.StatusBadRequest,
+			body:         `{"error":{"code":"ErrorInvalidRequest","message":"Line one.\r\nLine   two."}}`,
+			wantCode:     554,
+			wantEnhanced: smtp.EnhancedCode{5, 3, 0},
+			wantMessage:  "Microsoft Graph rejected the message: ErrorInvalidRequest: Line one. Line two.",
+		},
+		{
+			name:         "long message",
+			status:       http.StatusBadRequest,
+			body:         `{"error":{"code":"ErrorInvalidRequest","message":"` + strings.Repeat("x", 500) + `"}}`,
+			wantCode:     554,
+			wantEnhanced: smtp.EnhancedCode{5, 3, 0},
+			wantMessage:  "Microsoft Graph rejected the message: ErrorInvalidRequest: " + strings.Repeat("x", maxGraphReplyMessage) + "...",
+		},
+		{
+			name:         "no JSON envelope",
+			status:       http.StatusBadGateway,
+			body:         "<html>upstream error</html>",
+			wantCode:     554,
+			wantEnhanced: smtp.EnhancedCode{5, 3, 0},
+			wantMessage:  "Microsoft Graph rejected the message: 502 Bad Gateway",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gerr := &graphError{StatusCode: tt.status, Status: fmt.Sprintf("%d %s", tt.status, http.StatusText(tt.status)), Body: tt.body}
+			code, enhanced, message := gerr.smtpReply()
+			if code != tt.wantCode || enhanced != tt.wantEnhanced {
+				t.Fatalf("smtpReply() = %d %v, want %d %v", code, enhanced, tt.wantCode, tt.wantEnhanced)
+			}
+			if message != tt.wantMessage {
+				t.Fatalf("smtpReply() message = %q, want %q", message, tt.wantMessage)
+			}
+		})
+	}
+}
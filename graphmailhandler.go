@@ -4,102 +4,465 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"maps"
+	"math/rand/v2"
 	"net/http"
 	"net/mail"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	policy "github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	azcore "github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
 	azidentity "github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/emersion/go-msgauth/dkim"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// graphBaseURL is the default Microsoft Graph API endpoint messages are sent through, that of
+// the public cloud. GRAPH_BASE_URL overrides it for sovereign clouds.
+const graphBaseURL = "https://graph.microsoft.com/v1.0"
+
+// errMessageTooLarge is returned when a message exceeds the size Graph accepts.
+var errMessageTooLarge = errors.New("message too large")
+
+// encodeError is a failure to encode a message for relay, such as a malformed header. It is a
+// problem with the message rather than with Graph, so relaying it again would fail the same way.
+type encodeError struct {
+	err error
+}
+
+func (e *encodeError) Error() string { return "encodeMailMessage: " + e.err.Error() }
+func (e *encodeError) Unwrap() error { return e.err }
+
+// Graph send modes, selecting how recipients reach Graph.
+const (
+	sendModeRaw  = "raw"  // Graph parses the recipients from the MIME headers
+	sendModeJSON = "json" // recipients are set through the Graph recipient fields of a draft
+)
+
+// retryBaseDelay is the backoff delay before the first retry of a throttled send.
+const retryBaseDelay = time.Second
+
 // graphMailHandler implements the messageHandler interface and relays messages to Microsoft Graph API.
 type graphMailHandler struct {
-	config *appConfig
-	cred   *azidentity.ClientSecretCredential
+	config  *appConfig
+	cred    azcore.TokenCredential // replaced by reloadCredential, guarded by tokenMutex
+	credKey string                 // credentialKey of the configuration cred was built from
+	client  *http.Client
+	baseURL string
+	sends   *sendLimiter      // GRAPH_MAX_CONCURRENCY, nil if unlimited
+	dkim    *dkim.SignOptions // DKIM signing, nil if not configured
 
-	token      string
-	tokenExp   int64 // Unix seconds
-	tokenMutex sync.Mutex
+	token         string
+	tokenExp      int64 // Unix seconds
+	tokenMutex    sync.Mutex
+	tokenReady    atomic.Bool   // true while the most recent token acquisition succeeded or the cached token is valid
+	tokenErr      error         // most recent token acquisition error
+	tokenFailures int           // consecutive token acquisition failures
+	tokenRetryAt  time.Time     // no token acquisition is attempted before this time
+	tokenInflight *tokenRefresh // refresh in progress, if any
+	now           func() time.Time
 }
 
-// newGraphMailHandler creates a new graphMailHandler with a single ClientSecretCredential instance.
+// newGraphMailHandler creates a new graphMailHandler with a single credential instance.
 func newGraphMailHandler(config *appConfig) (*graphMailHandler, error) {
-	cred, err := azidentity.NewClientSecretCredential(
-		config.EntraTenantID,
-		config.EntraClientID,
-		config.EntraClientSecret,
-		nil,
-	)
+	cred, err := newCredential(config)
+	if err != nil {
+		return nil, err
+	}
+	credKey, err := credentialKey(config)
+	if err != nil {
+		return nil, err
+	}
+	dkimOptions, err := newDKIMOptions(config)
 	if err != nil {
 		return nil, err
 	}
 
+	client := newGraphHTTPClient(config)
+	if config.GraphAuditLog != "" {
+		f, err := os.OpenFile(config.GraphAuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("open GRAPH_AUDIT_LOG: %w", err)
+		}
+		client.Transport = &auditTransport{next: client.Transport, out: f}
+	}
+
 	return &graphMailHandler{
-		config: config,
-		cred:   cred,
+		config:  config,
+		cred:    cred,
+		credKey: credKey,
+		client:  client,
+		baseURL: config.GraphBaseURL,
+		sends:   newSendLimiter(config.GraphMaxConcurrency, config.GraphConcurrencyTimeout),
+		dkim:    dkimOptions,
+		now:     time.Now,
 	}, nil
 }
 
-// handleMessage relays the given MIME message to Microsoft Graph API.
-func (h *graphMailHandler) handleMessage(ctx context.Context, msg *mail.Message) error {
+// newGraphHTTPClient returns the HTTP client used for Graph requests. Its transport is shared by
+// all sends and keeps up to config.MaxIdleConns idle connections to Graph for reuse. HTTP/2 is
+// disabled when config.ForceHTTP1 is set, for TLS-inspecting proxies that break it, and TLS
+// renegotiation follows config.TLSRenegotiation.
+func newGraphHTTPClient(config *appConfig) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.MaxIdleConns > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConns
+		transport.MaxIdleConns = max(transport.MaxIdleConns, config.MaxIdleConns)
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	transport.TLSClientConfig = &tls.Config{
+		MinVersion:    tls.VersionTLS12,
+		Renegotiation: tlsRenegotiationModes[config.TLSRenegotiation],
+	}
+	if config.ForceHTTP1 {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP1(true)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// withHTTPTimeout returns a copy of ctx that expires after GRAPH_HTTP_TIMEOUT, so that a single
+// hung Graph request fails on its own instead of holding the SMTP session until shutdown.
+func (h *graphMailHandler) withHTTPTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if h.config.HTTPTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, h.config.HTTPTimeout)
+}
+
+// tlsRenegotiationModes maps GRAPH_TLS_RENEGOTIATION values to TLS renegotiation support.
+var tlsRenegotiationModes = map[string]tls.RenegotiationSupport{
+	"never":  tls.RenegotiateNever,
+	"once":   tls.RenegotiateOnceAsClient,
+	"freely": tls.RenegotiateFreelyAsClient,
+}
+
+// newCredential returns a managed identity credential when selected, a client certificate
+// credential when a certificate is configured, and a client secret credential otherwise.
+func newCredential(config *appConfig) (azcore.TokenCredential, error) {
+	if config.EntraUseManagedIdentity {
+		opts := &azidentity.ManagedIdentityCredentialOptions{}
+		if config.EntraClientID != "" {
+			opts.ID = azidentity.ClientID(config.EntraClientID)
+		}
+		return azidentity.NewManagedIdentityCredential(opts)
+	}
+	if config.EntraCertPath == "" {
+		return azidentity.NewClientSecretCredential(
+			config.EntraTenantID,
+			config.EntraClientID,
+			config.EntraClientSecret,
+			&azidentity.ClientSecretCredentialOptions{ClientOptions: entraClientOptions(config)},
+		)
+	}
+
+	data, err := os.ReadFile(config.EntraCertPath)
+	if err != nil {
+		return nil, fmt.Errorf("read client certificate: %w", err)
+	}
+	var password []byte
+	if config.EntraCertPassword != "" {
+		password = []byte(config.EntraCertPassword)
+	}
+	certs, key, err := azidentity.ParseCertificates(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("parse client certificate: %w", err)
+	}
+	return azidentity.NewClientCertificateCredential(
+		config.EntraTenantID,
+		config.EntraClientID,
+		certs,
+		key,
+		&azidentity.ClientCertificateCredentialOptions{ClientOptions: entraClientOptions(config)},
+	)
+}
+
+// entraClientOptions returns the credential client options for the configured Entra authority host.
+// The managed identity endpoint is local to the host and needs no authority.
+func entraClientOptions(config *appConfig) azcore.ClientOptions {
+	return azcore.ClientOptions{
+		Cloud: cloud.Configuration{ActiveDirectoryAuthorityHost: config.EntraAuthorityHost},
+	}
+}
+
+// handleMessage relays the given MIME message to Microsoft Graph API as sender.
+func (h *graphMailHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	// Graph delivers to the Bcc recipients of a MIME message and removes the header from the
+	// copies it delivers, so it stays in the MIME. Only json mode, which sets every recipient
+	// through the Graph recipient fields, takes it out to set the recipients on the draft. msg
+	// itself is left alone, since a retry relays it again.
+	var bcc []*mail.Address
+	if h.config.GraphSendMode == sendModeJSON {
+		if bcc = headerAddresses(msg.Header, "Bcc"); len(bcc) > 0 {
+			msg = withoutHeader(msg, "Bcc")
+		}
+	}
 	mimeMessage, err := encodeMailMessage(msg)
 	if err != nil {
-		return fmt.Errorf("encodeMailMessage: %w", err)
+		return &encodeError{err: err}
 	}
 
-	accessToken, err := h.getCachedToken(ctx)
+	// The request body is the base64-encoded message, so the limit applies to the encoded size.
+	// Larger messages are sent as a draft with their large attachments uploaded separately.
+	var attachments []largeAttachment
+	if err := checkInlineSize(mimeMessage, h.config.InlineLimitBytes, h.config.Base64LineLength); err != nil {
+		draft, large, splitErr := splitLargeAttachments(mimeMessage)
+		if splitErr != nil || len(large) == 0 {
+			return err
+		}
+		if err := checkInlineSize(draft, h.config.InlineLimitBytes, h.config.Base64LineLength); err != nil {
+			return err
+		}
+		mimeMessage, attachments = draft, large
+	}
+
+	// In json mode all recipients are set through the Graph recipient fields instead of being
+	// parsed by Graph from the MIME headers, which requires the draft path.
+	var update draftUpdate
+	if h.config.GraphSendMode == sendModeJSON {
+		update.To = graphRecipients(headerAddresses(msg.Header, "To"))
+		update.Cc = graphRecipients(headerAddresses(msg.Header, "Cc"))
+		update.Bcc = graphRecipients(bcc)
+	}
+	// The MIME form of sendMail always saves a copy to Sent Items, so a message that must not be
+	// saved is sent as a draft that Exchange deletes once it is sent.
+	if !h.config.SaveToSentItems {
+		update.Properties = []graphExtendedProperty{deleteAfterSubmit}
+	}
+	drafted := len(attachments) > 0 || !update.empty()
+
+	// Graph rebuilds the MIME of a draft from its stored properties, which breaks any signature,
+	// so only messages sent inline through sendMail are signed.
+	if !drafted {
+		if mimeMessage, err = signDKIM(mimeMessage, h.dkim); err != nil {
+			return fmt.Errorf("signDKIM: %w", err)
+		}
+	} else if h.dkim != nil {
+		log.Printf("Not DKIM signing message from %s: it is sent as a draft, which Graph rewrites", sender)
+	}
+
+	if h.config.DryRun {
+		recipients := headerRecipients(msg.Header)
+		for _, addr := range bcc {
+			recipients = append(recipients, addr.Address)
+		}
+		traceEventf(ctx, "dry run: not sent")
+		log.Printf("Dry run: not sending %d byte message (%d large attachment(s)) from %s to %d recipient(s): %s",
+			len(mimeMessage), len(attachments), sender, len(recipients), strings.Join(recipients, ", "))
+		return nil
+	}
+
+	timings := timingsFrom(ctx)
+	tokenStart := time.Now()
+	tokenCtx, span := tracer.Start(ctx, "graph.token")
+	accessToken, err := h.getCachedToken(tokenCtx)
+	endSpan(span, err)
+	timings.addToken(time.Since(tokenStart))
 	if err != nil {
-		return fmt.Errorf("getCachedToken: %w", err)
+		return &tokenError{err: err}
 	}
 
-	if err := sendRawMimeMail(ctx, accessToken, h.config.SenderEmail, mimeMessage); err != nil {
+	send := h.sendWithRetry
+	if drafted {
+		send = func(ctx context.Context, accessToken, sender string, draft []byte) error {
+			return h.sendDraft(ctx, accessToken, sender, draft, attachments, update)
+		}
+	}
+	sendStart := time.Now()
+	if err := h.sends.acquire(ctx); err != nil {
+		return err
+	}
+	err = func() error {
+		defer h.sends.release()
+		markSendAttempted(ctx)
+		return send(ctx, accessToken, sender, mimeMessage)
+	}()
+	timings.addSend(time.Since(sendStart))
+	if err != nil {
+		sendFailures.Inc()
 		return fmt.Errorf("sendRawMimeMail: %w", err)
 	}
 
+	messagesSent.Inc()
+	return nil
+}
+
+// readErrorBody reads at most config.MaxErrorBodyBytes of an error response body, marking a
+// longer body as truncated. A non-positive limit reads the whole body.
+func (h *graphMailHandler) readErrorBody(body io.Reader) string {
+	limit := h.config.MaxErrorBodyBytes
+	if limit <= 0 {
+		b, _ := io.ReadAll(body)
+		return string(b)
+	}
+	b, _ := io.ReadAll(io.LimitReader(body, limit+1))
+	if int64(len(b)) > limit {
+		return string(b[:limit]) + "... (truncated)"
+	}
+	return string(b)
+}
+
+// withoutHeader returns a copy of msg without the header field, given in canonical form, sharing
+// its body.
+func withoutHeader(msg *mail.Message, field string) *mail.Message {
+	header := maps.Clone(msg.Header)
+	delete(header, field)
+	return &mail.Message{Header: header, Body: msg.Body}
+}
+
+// headerAddresses returns the addresses of the header field, or nil if it is missing or cannot be parsed.
+func headerAddresses(header mail.Header, field string) []*mail.Address {
+	list, err := header.AddressList(field)
+	if err != nil {
+		return nil
+	}
+	return list
+}
+
+// checkInlineSize returns errMessageTooLarge if the base64 encoding of mimeMessage, in lines of
+// lineLength, exceeds limit bytes. A limit <= 0 disables the check.
+func checkInlineSize(mimeMessage []byte, limit int64, lineLength int) error {
+	encoded := int64(base64EncodedLen(len(mimeMessage), lineLength))
+	if limit > 0 && encoded > limit {
+		return fmt.Errorf("%w: %d bytes encoded exceeds Graph limit of %d bytes", errMessageTooLarge, encoded, limit)
+	}
 	return nil
 }
 
-// getCachedToken returns a valid access token, refreshing it if needed.
-func (h *graphMailHandler) getCachedToken(ctx context.Context) (string, error) {
-	h.tokenMutex.Lock()
-	defer h.tokenMutex.Unlock()
+// sendWithRetry sends the message inline through sendMail, retrying as described at retrySend.
+func (h *graphMailHandler) sendWithRetry(ctx context.Context, accessToken, sender string, mimeMessage []byte) error {
+	return h.retrySend(ctx, func() error {
+		return h.sendRawMimeMail(ctx, accessToken, sender, mimeMessage)
+	})
+}
 
-	now := time.Now().Unix()
-	// Refresh if token is missing or expires in <60s
-	if h.token == "" || now > h.tokenExp-60 {
-		token, err := h.cred.GetToken(ctx, policy.TokenRequestOptions{
-			Scopes: []string{"https://graph.microsoft.com/.default"},
-		})
-		if err != nil {
-			return "", fmt.Errorf("GetToken: %w", err)
+// retrySend calls send, retrying throttled (429) and unavailable (503) responses up to
+// config.MaxRetries times. Retry-After is honored when present, otherwise exponential
+// backoff with jitter is used; delays are capped at config.RetryMaxDelay.
+func (h *graphMailHandler) retrySend(ctx context.Context, send func() error) error {
+	attempts := 0
+	for {
+		attempts++
+		err := send()
+		if err == nil {
+			return nil
+		}
+
+		var gerr *graphError
+		if !errors.As(err, &gerr) || !gerr.retryable() || attempts > h.config.MaxRetries {
+			if attempts > 1 {
+				return fmt.Errorf("after %d attempts: %w", attempts, err)
+			}
+			return err
+		}
+
+		delay := gerr.RetryAfter
+		if !gerr.RetryAfterSet {
+			delay = backoffDelay(attempts)
+		}
+		delay = min(delay, h.config.RetryMaxDelay)
+		log.Printf("Graph request returned %s, retrying in %s (attempt %d of %d)", gerr.Status, delay, attempts+1, h.config.MaxRetries+1)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("after %d attempts: %w", attempts, errors.Join(err, ctx.Err()))
+		case <-timer.C:
+		}
+	}
+}
+
+// backoffDelay returns the exponential backoff delay with jitter before retry attempt n (n >= 1).
+// The delay is chosen uniformly from the upper half of retryBaseDelay * 2^(n-1).
+func backoffDelay(n int) time.Duration {
+	d := retryBaseDelay << min(n-1, 16)
+	return d/2 + rand.N(d/2+1)
+}
+
+// graphError describes a non-success response from the Graph API.
+type graphError struct {
+	StatusCode    int
+	Status        string
+	Body          string
+	RetryAfter    time.Duration // delay requested by the Retry-After header, if RetryAfterSet
+	RetryAfterSet bool          // whether the response had a usable Retry-After header
+}
+
+func (e *graphError) Error() string {
+	return fmt.Sprintf("sendMail failed: %s\n%s", e.Status, e.Body)
+}
+
+// retryable reports whether the request may succeed if retried later.
+func (e *graphError) retryable() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusServiceUnavailable
+}
+
+// parseRetryAfter parses a Retry-After header given as delay seconds or an HTTP date. ok is false
+// if the header is missing or unusable; "0" and dates in the past are a zero delay.
+func parseRetryAfter(val string, now time.Time) (delay time.Duration, ok bool) {
+	if val == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(val); err == nil {
+		if secs < 0 {
+			return 0, false
 		}
-		h.token = token.Token
-		h.tokenExp = token.ExpiresOn.Unix()
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		return max(t.Sub(now), 0), true
 	}
-	return h.token, nil
+	return 0, false
 }
 
 // encodeMailMessage encodes a mail.Message into raw []byte in RFC822 format.
+// Messages parsed by parseMessage keep their original header layout and body bytes.
 func encodeMailMessage(msg *mail.Message) ([]byte, error) {
 	var buf bytes.Buffer
-	// Write headers
-	for k, v := range msg.Header {
-		for _, vv := range v {
+	if rb, ok := msg.Body.(*rawBody); ok {
+		if err := writePreservedHeader(&buf, rb.header, msg.Header); err != nil {
+			return nil, err
+		}
+		if _, err := buf.ReadFrom(rb); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	// Write headers, sorted for a deterministic encoding
+	keys := make([]string, 0, len(msg.Header))
+	for k := range msg.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, vv := range msg.Header[k] {
 			// Write header line: Key: Value\r\n
 			if _, err := buf.WriteString(k + ": " + vv + "\r\n"); err != nil {
 				return nil, err
 			}
 		}
 	}
-	// Blank line between headers and body
+	// Blank line between headers and body; a headers-only message ends here
 	if _, err := buf.WriteString("\r\n"); err != nil {
 		return nil, err
 	}
-	// Write body
+	// Write body, if any
 	if msg.Body != nil {
 		if _, err := buf.ReadFrom(msg.Body); err != nil {
 			return nil, err
@@ -113,25 +476,42 @@ func encodeMailMessage(msg *mail.Message) ([]byte, error) {
 // userID: the user ID or email address to send as
 // mimeMessage: the full RFC 5322 message (headers + body)
 // The official Go SDK does not support sending raw MIME messages, so we use a direct HTTP request.
-func sendRawMimeMail(ctx context.Context, accessToken string, userID string, mimeMessage []byte) error {
-	url := fmt.Sprintf("https://graph.microsoft.com/v1.0/users/%s/sendMail", userID)
-	encoded := base64.StdEncoding.EncodeToString(mimeMessage)
+//
+// The raw MIME endpoint takes the base64 message as a text/plain body and always saves the message
+// to Sent Items; a JSON body must carry a message resource, not MIME. Messages that must not be
+// saved are sent as drafts by handleMessage instead.
+func (h *graphMailHandler) sendRawMimeMail(ctx context.Context, accessToken string, userID string, mimeMessage []byte) (err error) {
+	ctx, span := tracer.Start(ctx, "graph.sendMail", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+	ctx, cancel := h.withHTTPTimeout(ctx)
+	defer cancel()
+	url := fmt.Sprintf("%s/users/%s/sendMail", h.baseURL, userID)
+	encoded := encodeBase64(mimeMessage, h.config.Base64LineLength)
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBufferString(encoded))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(encoded))
 	if err != nil {
 		return fmt.Errorf("NewRequestWithContext: %w", err)
 	}
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 	req.Header.Set("Content-Type", "text/plain")
 
-	resp, err := http.DefaultClient.Do(req)
+	start := time.Now()
+	resp, err := h.client.Do(req)
+	graphSendDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		traceEventf(ctx, "http POST %s failed after %s: %v", url, time.Since(start), err)
 		return fmt.Errorf("http.Do: %w", err)
 	}
 	defer resp.Body.Close()
+	traceEventf(ctx, "http POST %s -> %s in %s request-id=%s", url, resp.Status, time.Since(start), resp.Header.Get("request-id"))
+	span.SetAttributes(
+		attribute.Int("http.response.status_code", resp.StatusCode),
+		attribute.String("graph.request_id", resp.Header.Get("request-id")),
+	)
 	if resp.StatusCode != http.StatusAccepted {
-		b, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("sendMail failed: %s\n%s", resp.Status, string(b))
+		gerr := &graphError{StatusCode: resp.StatusCode, Status: resp.Status, Body: h.readErrorBody(resp.Body)}
+		gerr.RetryAfter, gerr.RetryAfterSet = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return gerr
 	}
 	return nil
 }
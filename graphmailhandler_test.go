@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	azidentity "github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// newTestGraphServer starts a Graph API stub that replies with statuses in order,
+// repeating the last one, and counts the requests it receives.
+func newTestGraphServer(t *testing.T, calls *atomic.Int32, statuses ...int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(calls.Add(1))
+		status := statuses[min(n, len(statuses))-1]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newTestGraphHandler(srv *httptest.Server, maxRetries int) *graphMailHandler {
+	return &graphMailHandler{
+		config: &appConfig{
+			MaxRetries:      maxRetries,
+			RetryMaxDelay:   time.Millisecond,
+			SaveToSentItems: true,
+		},
+		client:  http.DefaultClient,
+		baseURL: srv.URL,
+	}
+}
+
+func TestSendWithRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantCalls int32
+		wantErr   string
+	}{
+		{
+			name:      "throttled then accepted",
+			statuses:  []int{http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusAccepted},
+			wantCalls: 3,
+		},
+		{
+			name:      "retries exhausted",
+			statuses:  []int{http.StatusServiceUnavailable},
+			wantCalls: 4,
+			wantErr:   "after 4 attempts",
+		},
+		{
+			name:      "not retryable",
+			statuses:  []int{http.StatusBadRequest},
+			wantCalls: 1,
+			wantErr:   "400 Bad Request",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			h := newTestGraphHandler(newTestGraphServer(t, &calls, tt.statuses...), 3)
+
+			err := h.sendWithRetry(context.Background(), "token", "sender@example.com", []byte("raw"))
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("sendWithRetry() error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("sendWithRetry() error = %v, want %q", err, tt.wantErr)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Fatalf("requests = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestSendWithRetryAfterZero(t *testing.T) {
+	var calls atomic.Int32
+	h := newTestGraphHandler(newTestGraphServer(t, &calls, http.StatusTooManyRequests, http.StatusAccepted), 3)
+	h.config.RetryMaxDelay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// Retry-After: 0 asks for an immediate retry rather than the exponential backoff.
+	if err := h.sendWithRetry(ctx, "token", "sender@example.com", []byte("raw")); err != nil {
+		t.Fatalf("sendWithRetry() error: %v", err)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("requests = %d, want 2", got)
+	}
+}
+
+func TestSendWithRetryCanceled(t *testing.T) {
+	var calls atomic.Int32
+	h := newTestGraphHandler(newTestGraphServer(t, &calls, http.StatusServiceUnavailable), 3)
+	h.config.RetryMaxDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	err := h.sendWithRetry(ctx, "token", "sender@example.com", []byte("raw"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("sendWithRetry() error = %v, want context.Canceled", err)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("requests = %d, want 1", got)
+	}
+}
+
+func TestSendRawMimeMailHTTPTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release // hang until the test is done
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	h := newTestGraphHandler(srv, 0)
+	h.config.HTTPTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	err := h.sendRawMimeMail(context.Background(), "token", "sender@example.com", []byte("raw"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("sendRawMimeMail() error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("sendRawMimeMail() took %s, want it to fail after the HTTP timeout", elapsed)
+	}
+}
+
+// endlessReader is an infinite body of 'x' bytes that counts the bytes read from it.
+type endlessReader struct{ n int64 }
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestReadErrorBody(t *testing.T) {
+	h := &graphMailHandler{config: &appConfig{MaxErrorBodyBytes: 1024}}
+	body := &endlessReader{}
+	got := h.readErrorBody(body)
+	if want := strings.Repeat("x", 1024) + "... (truncated)"; got != want {
+		t.Fatalf("readErrorBody() = %d bytes, want the first 1024 bytes marked as truncated", len(got))
+	}
+	if body.n > 64*1024 {
+		t.Fatalf("read %d bytes, want the read capped near the 1024 byte limit", body.n)
+	}
+
+	if got := h.readErrorBody(strings.NewReader(`{"error":{"code":"ErrorAccessDenied"}}`)); got != `{"error":{"code":"ErrorAccessDenied"}}` {
+		t.Fatalf("readErrorBody() = %q, want the short body unchanged", got)
+	}
+}
+
+func TestSendRawMimeMailOversizedErrorBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = io.CopyN(w, &endlessReader{}, 8*1024*1024)
+	}))
+	defer srv.Close()
+
+	h := newTestGraphHandler(srv, 0)
+	h.config.MaxErrorBodyBytes = 4096
+	err := h.sendRawMimeMail(context.Background(), "token", "sender@example.com", []byte("raw"))
+	var gerr *graphError
+	if !errors.As(err, &gerr) || gerr.StatusCode != http.StatusBadGateway {
+		t.Fatalf("sendRawMimeMail() error = %v, want 502 graphError", err)
+	}
+	if len(gerr.Body) != 4096+len("... (truncated)") {
+		t.Fatalf("error body = %d bytes, want 4096 bytes and the truncation marker", len(gerr.Body))
+	}
+}
+
+func TestNewGraphMailHandlerBaseURL(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	h, err := newGraphMailHandler(&appConfig{
+		EntraTenantID:      "tenant-id",
+		EntraClientID:      "client-id",
+		EntraClientSecret:  "client-secret",
+		EntraAuthorityHost: "https://login.microsoftonline.us/",
+		GraphBaseURL:       srv.URL + "/v1.0",
+		SaveToSentItems:    true,
+	})
+	if err != nil {
+		t.Fatalf("newGraphMailHandler() error: %v", err)
+	}
+	if err := h.sendRawMimeMail(context.Background(), "token", "sender@example.com", []byte("raw")); err != nil {
+		t.Fatalf("sendRawMimeMail() error: %v", err)
+	}
+	if want := "/v1.0/users/sender@example.com/sendMail"; path != want {
+		t.Fatalf("request path = %q, want %q", path, want)
+	}
+}
+
+func TestGraphScope(t *testing.T) {
+	tests := []struct {
+		baseURL string
+		want    string
+	}{
+		{baseURL: graphBaseURL, want: "https://graph.microsoft.com/.default"},
+		{baseURL: "https://graph.microsoft.us/v1.0", want: "https://graph.microsoft.us/.default"},
+		{baseURL: "https://microsoftgraph.chinacloudapi.cn/v1.0", want: "https://microsoftgraph.chinacloudapi.cn/.default"},
+	}
+	for _, tt := range tests {
+		if got := graphScope(tt.baseURL); got != tt.want {
+			t.Errorf("graphScope(%q) = %q, want %q", tt.baseURL, got, tt.want)
+		}
+	}
+}
+
+func TestCheckInlineSize(t *testing.T) {
+	const limit = 4000 // 3000 raw bytes encode to exactly 4000 base64 bytes
+
+	tests := []struct {
+		name    string
+		size    int
+		wantErr bool
+	}{
+		{name: "encoded at limit", size: 3000},
+		{name: "raw below limit, encoded above", size: 3001, wantErr: true},
+		{name: "raw just below limit", size: limit - 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkInlineSize(make([]byte, tt.size), limit, 0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkInlineSize(%d) error = %v, wantErr %v", tt.size, err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, errMessageTooLarge) {
+				t.Fatalf("checkInlineSize(%d) error = %v, want errMessageTooLarge", tt.size, err)
+			}
+		})
+	}
+}
+
+func TestHandleMessageRejectsOversizedEncoding(t *testing.T) {
+	var calls atomic.Int32
+	h := newTestGraphHandler(newTestGraphServer(t, &calls, http.StatusAccepted), 0)
+	h.config.InlineLimitBytes = 4000
+
+	msg, err := mail.ReadMessage(strings.NewReader("Subject: Test\r\n\r\n" + strings.Repeat("x", 3900)))
+	if err != nil {
+		t.Fatalf("ReadMessage() error: %v", err)
+	}
+
+	err = h.handleMessage(context.Background(), "sender@example.com", msg)
+	if !errors.Is(err, errMessageTooLarge) {
+		t.Fatalf("handleMessage() error = %v, want errMessageTooLarge", err)
+	}
+	if got := calls.Load(); got != 0 {
+		t.Fatalf("requests = %d, want 0", got)
+	}
+}
+
+func TestHandleMessageDryRun(t *testing.T) {
+	var calls atomic.Int32
+	h := newTestGraphHandler(newTestGraphServer(t, &calls, http.StatusAccepted), 0)
+	h.config.DryRun = true
+	cred := &stubCredential{token: "token"}
+	h.cred = cred
+
+	msg, err := mail.ReadMessage(strings.NewReader("To: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n"))
+	if err != nil {
+		t.Fatalf("ReadMessage() error: %v", err)
+	}
+	if err := h.handleMessage(context.Background(), "sender@example.com", msg); err != nil {
+		t.Fatalf("handleMessage() error: %v", err)
+	}
+	if got := calls.Load(); got != 0 {
+		t.Fatalf("requests = %d, want 0", got)
+	}
+	if cred.calls != 0 {
+		t.Fatalf("GetToken calls = %d, want 0", cred.calls)
+	}
+	if !h.ready() {
+		t.Fatal("ready() = false, want true in dry-run mode")
+	}
+}
+
+func TestSessionDataSendsBccInMIME(t *testing.T) {
+	var requests []string
+	var sent []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		b, _ := io.ReadAll(r.Body)
+		sent, _ = base64.StdEncoding.DecodeString(string(b))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	h := newTestGraphHandler(srv, 0)
+	h.token = "token"
+	h.tokenExp = time.Now().Add(time.Hour).Unix()
+
+	session := newTestSessionWithT(t)
+	session.handler = h
+	session.auth = true
+	session.user = "sender@example.com"
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	for _, rcpt := range []string{"to@example.com", "envelope@example.com", "hidden@example.com"} {
+		if err := session.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt() error: %v", err)
+		}
+	}
+	raw := "From: sender@example.com\r\nTo: to@example.com\r\nBcc: hidden@example.com\r\nSubject: Test\r\n\r\nHello\r\n"
+	if err := session.Data(strings.NewReader(raw)); err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+
+	// Graph reads the Bcc recipients from the MIME and removes the header from delivered copies.
+	if want := []string{"POST /users/sender@example.com/sendMail"}; !slices.Equal(requests, want) {
+		t.Fatalf("requests = %v, want %v", requests, want)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(sent))
+	if err != nil {
+		t.Fatalf("sent MIME: %v", err)
+	}
+	if got, want := msg.Header.Get("Bcc"), "hidden@example.com, <envelope@example.com>"; got != want {
+		t.Fatalf("Bcc = %q, want %q", got, want)
+	}
+}
+
+func TestHandleMessageSaveToSentItems(t *testing.T) {
+	mime := "Subject: Test\r\nTo: recipient@example.com\r\n\r\nHello\r\n"
+	encoded := base64.StdEncoding.EncodeToString([]byte("Subject: Test\r\nTo: recipient@example.com\r\n\r\nHello\r\n"))
+	deleteAfterSubmit := `{"singleValueExtendedProperties":[{"id":"Boolean 0x0E01","value":"true"}]}`
+
+	tests := []struct {
+		name         string
+		save         bool
+		wantRequests []string
+	}{
+		{
+			name:         "saved",
+			save:         true,
+			wantRequests: []string{"POST /users/sender@example.com/sendMail text/plain " + encoded},
+		},
+		{
+			name: "not saved",
+			wantRequests: []string{
+				"POST /users/sender@example.com/messages text/plain " + encoded,
+				"PATCH /users/sender@example.com/messages/draft1 application/json " + deleteAfterSubmit,
+				"POST /users/sender@example.com/messages/draft1/send  ",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				requests = append(requests, fmt.Sprintf("%s %s %s %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"), b))
+				switch {
+				case r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/messages"):
+					w.WriteHeader(http.StatusCreated)
+					fmt.Fprint(w, `{"id":"draft1"}`)
+				case r.Method == http.MethodPatch:
+					fmt.Fprint(w, `{"id":"draft1"}`)
+				default:
+					w.WriteHeader(http.StatusAccepted)
+				}
+			}))
+			defer srv.Close()
+
+			h := &graphMailHandler{
+				config:   &appConfig{SaveToSentItems: tt.save},
+				client:   srv.Client(),
+				baseURL:  srv.URL,
+				token:    "token",
+				tokenExp: time.Now().Add(time.Hour).Unix(),
+			}
+			msg, err := mail.ReadMessage(strings.NewReader(mime))
+			if err != nil {
+				t.Fatalf("ReadMessage() error: %v", err)
+			}
+			if err := h.handleMessage(context.Background(), "sender@example.com", msg); err != nil {
+				t.Fatalf("handleMessage() error: %v", err)
+			}
+			if strings.Join(requests, "\n") != strings.Join(tt.wantRequests, "\n") {
+				t.Fatalf("requests:\n%s\nwant:\n%s", strings.Join(requests, "\n"), strings.Join(tt.wantRequests, "\n"))
+			}
+		})
+	}
+}
+
+func TestSendRawMimeMailBase64LineLength(t *testing.T) {
+	mime := []byte("Subject: Test\r\n\r\n" + strings.Repeat("Hello, world! ", 20) + "\r\n")
+
+	for _, lineLength := range []int{0, 8, 76} {
+		var body []byte
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		h := &graphMailHandler{
+			config:  &appConfig{SaveToSentItems: true, Base64LineLength: lineLength},
+			client:  srv.Client(),
+			baseURL: srv.URL,
+		}
+		err := h.sendRawMimeMail(context.Background(), "token", "sender@example.com", mime)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("sendRawMimeMail(lineLength=%d) error: %v", lineLength, err)
+		}
+		if want := encodeBase64(mime, lineLength); !bytes.Equal(body, want) {
+			t.Errorf("lineLength=%d: body = %q, want %q", lineLength, body, want)
+		}
+	}
+}
+
+func TestNewGraphHTTPClientForceHTTP1(t *testing.T) {
+	var proto string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto = r.Proto
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	for _, tt := range []struct {
+		forceHTTP1 bool
+		want       string
+	}{
+		{forceHTTP1: false, want: "HTTP/2.0"},
+		{forceHTTP1: true, want: "HTTP/1.1"},
+	} {
+		client := newGraphHTTPClient(&appConfig{ForceHTTP1: tt.forceHTTP1, TLSRenegotiation: "never"})
+		client.Transport.(*http.Transport).TLSClientConfig.RootCAs = roots
+
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Get(ForceHTTP1=%v) error: %v", tt.forceHTTP1, err)
+		}
+		resp.Body.Close()
+		if proto != tt.want {
+			t.Errorf("ForceHTTP1=%v: request protocol = %s, want %s", tt.forceHTTP1, proto, tt.want)
+		}
+	}
+}
+
+// newConnCountingServer starts a server that accepts every send and counts the connections
+// opened to it.
+func newConnCountingServer(tb testing.TB, conns *atomic.Int32) *httptest.Server {
+	tb.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	tb.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGraphHTTPClientReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	srv := newConnCountingServer(t, &conns)
+	h := newTestGraphHandler(srv, 0)
+	h.client = newGraphHTTPClient(&appConfig{MaxIdleConns: 4, TLSRenegotiation: "never"})
+
+	const sends = 20
+	for range sends {
+		if err := h.sendRawMimeMail(context.Background(), "token", "sender@example.com", []byte("raw")); err != nil {
+			t.Fatalf("sendRawMimeMail() error: %v", err)
+		}
+	}
+	if got := conns.Load(); got != 1 {
+		t.Fatalf("connections = %d for %d sequential sends, want 1", got, sends)
+	}
+	if got := h.client.Transport.(*http.Transport).MaxIdleConnsPerHost; got != 4 {
+		t.Fatalf("MaxIdleConnsPerHost = %d, want 4", got)
+	}
+}
+
+func BenchmarkSendRawMimeMailParallel(b *testing.B) {
+	var conns atomic.Int32
+	srv := newConnCountingServer(b, &conns)
+	h := newTestGraphHandler(srv, 0)
+	h.client = newGraphHTTPClient(&appConfig{MaxIdleConns: 16, TLSRenegotiation: "never"})
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := h.sendRawMimeMail(context.Background(), "token", "sender@example.com", []byte("raw")); err != nil {
+				b.Error(err)
+			}
+		}
+	})
+	b.ReportMetric(float64(conns.Load()), "conns")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0, wantOK: true},
+		{value: "5", want: 5 * time.Second, wantOK: true},
+		{value: "-1", want: 0},
+		{value: "Mon, 01 Jan 2024 12:00:30 GMT", want: 30 * time.Second, wantOK: true},
+		{value: "Mon, 01 Jan 2024 11:59:00 GMT", want: 0, wantOK: true},
+		{value: "soon", want: 0},
+	}
+
+	for _, tt := range tests {
+		if got, ok := parseRetryAfter(tt.value, now); got != tt.want || ok != tt.wantOK {
+			t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", tt.value, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestNewCredentialManagedIdentity(t *testing.T) {
+	for _, clientID := range []string{"", "user-assigned-client-id"} {
+		cred, err := newCredential(&appConfig{EntraUseManagedIdentity: true, EntraClientID: clientID})
+		if err != nil {
+			t.Fatalf("newCredential(clientID=%q) error: %v", clientID, err)
+		}
+		if _, ok := cred.(*azidentity.ManagedIdentityCredential); !ok {
+			t.Fatalf("newCredential(clientID=%q) = %T, want *azidentity.ManagedIdentityCredential", clientID, cred)
+		}
+	}
+}
+
+func TestNewCredentialFromCertificate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smtp2graph"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey() error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "client.pem")
+	data := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})...)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	cfg := &appConfig{
+		EntraTenantID: "tenant-id",
+		EntraClientID: "client-id",
+		EntraCertPath: path,
+	}
+	cred, err := newCredential(cfg)
+	if err != nil {
+		t.Fatalf("newCredential() error: %v", err)
+	}
+	if _, ok := cred.(*azidentity.ClientCertificateCredential); !ok {
+		t.Fatalf("newCredential() = %T, want *azidentity.ClientCertificateCredential", cred)
+	}
+
+	cfg.EntraCertPath = filepath.Join(t.TempDir(), "missing.pem")
+	if _, err := newCredential(cfg); err == nil {
+		t.Fatal("newCredential() error = nil, want error for missing certificate")
+	}
+}
@@ -0,0 +1,101 @@
+// Package main provides the HTTP health check endpoints for smtp2graph.
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// readinessChecker reports whether the application is ready to relay messages.
+type readinessChecker interface {
+	ready() bool
+}
+
+// newHealthServer returns an HTTP server on config.HealthAddr exposing the health check endpoints.
+func newHealthServer(config *appConfig, rc readinessChecker) *http.Server {
+	return &http.Server{
+		Addr:              config.HealthAddr,
+		Handler:           newHealthMux(config, rc),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+}
+
+// newHealthMux returns a handler serving:
+//
+//	/healthz - 200 while the process is running (liveness)
+//	/readyz  - 200 once a Graph token has been acquired, 503 if the latest refresh failed (readiness)
+//	/version - the revision, Go version, platform and uptime as JSON
+//	/metrics - Prometheus metrics, if config.MetricsEnabled
+//
+// If config.MetricsAuthToken is set, /readyz, /version and /metrics, and /healthz as well if
+// config.MetricsAuthLiveness, require it as a bearer token or basic auth password.
+func newHealthMux(config *appConfig, rc readinessChecker) *http.ServeMux {
+	protect := func(h http.HandlerFunc) http.HandlerFunc {
+		return requireToken(config.MetricsAuthToken, h)
+	}
+	liveness := func(h http.HandlerFunc) http.HandlerFunc { return h }
+	if config.MetricsAuthLiveness {
+		liveness = protect
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", liveness(func(w http.ResponseWriter, r *http.Request) {
+		writeStatus(w, http.StatusOK)
+	}))
+	mux.HandleFunc("GET /readyz", protect(func(w http.ResponseWriter, r *http.Request) {
+		if !rc.ready() {
+			writeStatus(w, http.StatusServiceUnavailable)
+			return
+		}
+		writeStatus(w, http.StatusOK)
+	}))
+	mux.HandleFunc("GET /version", protect(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(currentVersion())
+	}))
+	if config.MetricsEnabled {
+		mux.HandleFunc("GET /metrics", protect(promhttp.Handler().ServeHTTP))
+	}
+	return mux
+}
+
+// requireToken wraps h to reply 401 to requests that do not present token, either as
+// "Authorization: Bearer <token>" or as the basic auth password with any user name.
+// An empty token leaves h unprotected.
+func requireToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	if token == "" {
+		return h
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !hasToken(r, token) {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="smtp2graph"`)
+			w.Header().Add("WWW-Authenticate", `Basic realm="smtp2graph"`)
+			writeStatus(w, http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// hasToken reports whether r carries token as a bearer token or basic auth password.
+func hasToken(r *http.Request, token string) bool {
+	presented, ok := "", false
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		presented, ok = strings.TrimSpace(auth[7:]), true
+	} else {
+		_, presented, ok = r.BasicAuth()
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// writeStatus writes code with its status text as a plain-text body.
+func writeStatus(w http.ResponseWriter, code int) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	_, _ = w.Write([]byte(http.StatusText(code) + "\n"))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	cred := &stubCredential{token: "token"}
+	h := &graphMailHandler{config: &appConfig{}, cred: cred}
+	mux := newHealthMux(h.config, h)
+
+	get := func(path string) int {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz = %d, want 200", code)
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz before token = %d, want 503", code)
+	}
+
+	if _, err := h.getCachedToken(context.Background()); err != nil {
+		t.Fatalf("getCachedToken() error: %v", err)
+	}
+	if code := get("/readyz"); code != http.StatusOK {
+		t.Fatalf("/readyz after token = %d, want 200", code)
+	}
+
+	cred.err = errors.New("token endpoint unavailable")
+	if _, err := h.getCachedToken(context.Background()); err == nil {
+		t.Fatal("getCachedToken() error = nil, want refresh failure")
+	}
+	if code := get("/readyz"); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz after failed refresh = %d, want 503", code)
+	}
+	if code := get("/healthz"); code != http.StatusOK {
+		t.Fatalf("/healthz after failed refresh = %d, want 200", code)
+	}
+}
+
+func TestVersionEndpoint(t *testing.T) {
+	oldRevision, oldStart := revision, startTime
+	defer func() { revision, startTime = oldRevision, oldStart }()
+	revision = "1a2b3c4"
+	startTime = time.Now().Add(-90 * time.Second)
+
+	mux := newHealthMux(&appConfig{}, &graphMailHandler{config: &appConfig{}})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/version = %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", ct)
+	}
+
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decode /version: %v", err)
+	}
+	want := map[string]any{
+		"revision":   "1a2b3c4",
+		"go_version": runtime.Version(),
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %v, want %v", key, got[key], value)
+		}
+	}
+	if uptime, ok := got["uptime_seconds"].(float64); !ok || uptime < 90 || uptime > 3600 {
+		t.Errorf("uptime_seconds = %v, want about 90", got["uptime_seconds"])
+	}
+	if len(got) != len(want)+1 {
+		t.Errorf("/version = %v, want only %d fields", got, len(want)+1)
+	}
+}
+
+func TestHealthEndpointsAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		liveness bool
+		path     string
+		auth     func(r *http.Request)
+		want     int
+	}{
+		{name: "metrics without token", path: "/metrics", want: http.StatusUnauthorized},
+		{name: "readiness without token", path: "/readyz", want: http.StatusUnauthorized},
+		{name: "version without token", path: "/version", want: http.StatusUnauthorized},
+		{name: "version with bearer token", path: "/version", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, want: http.StatusOK},
+		{name: "metrics with bearer token", path: "/metrics", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, want: http.StatusOK},
+		{name: "readiness with basic auth", path: "/readyz", auth: func(r *http.Request) { r.SetBasicAuth("prometheus", "secret") }, want: http.StatusOK},
+		{name: "wrong bearer token", path: "/metrics", auth: func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret2") }, want: http.StatusUnauthorized},
+		{name: "wrong basic auth password", path: "/readyz", auth: func(r *http.Request) { r.SetBasicAuth("secret", "") }, want: http.StatusUnauthorized},
+		{name: "open liveness", path: "/healthz", want: http.StatusOK},
+		{name: "protected liveness", liveness: true, path: "/healthz", want: http.StatusUnauthorized},
+		{name: "protected liveness with token", liveness: true, path: "/healthz", auth: func(r *http.Request) { r.Header.Set("Authorization", "bearer secret") }, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &appConfig{MetricsEnabled: true, MetricsAuthToken: "secret", MetricsAuthLiveness: tt.liveness, DryRun: true}
+			mux := newHealthMux(config, &graphMailHandler{config: config})
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.auth != nil {
+				tt.auth(req)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Fatalf("%s = %d, want %d", tt.path, rec.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && len(rec.Header().Values("WWW-Authenticate")) == 0 {
+				t.Error("401 response without WWW-Authenticate challenge")
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Package main provides internationalized domain name handling for smtp2graph.
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// asciiAddress returns address with an internationalized domain converted to its A-label
+// (punycode) form, which Graph accepts, leaving the local part as it is. A domain that is already
+// ASCII is returned unchanged unless it has an A-label, which must then be valid.
+func asciiAddress(address string) (string, error) {
+	at := strings.LastIndex(address, "@")
+	if at < 0 {
+		return address, nil
+	}
+	domain, err := asciiDomain(address[at+1:])
+	if err != nil {
+		return "", err
+	}
+	return address[:at+1] + domain, nil
+}
+
+// asciiDomain returns domain in A-label form, validated according to IDNA. Domains that are plain
+// ASCII without A-labels, including address literals such as [192.0.2.1], are not checked.
+func asciiDomain(domain string) (string, error) {
+	if !isIDN(domain) {
+		return domain, nil
+	}
+	return idna.Lookup.ToASCII(domain)
+}
+
+// isIDN reports whether domain has non-ASCII characters or an A-label.
+func isIDN(domain string) bool {
+	for _, r := range domain {
+		if r >= utf8.RuneSelf {
+			return true
+		}
+	}
+	lower := strings.ToLower(domain)
+	return strings.HasPrefix(lower, "xn--") || strings.Contains(lower, ".xn--")
+}
+
+// asciiAddressOrSelf returns the asciiAddress form of address, or address itself if its domain
+// is not valid, for comparing header addresses with the normalized recipients.
+func asciiAddressOrSelf(address string) string {
+	if a, err := asciiAddress(address); err == nil {
+		return a
+	}
+	return address
+}
@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestAsciiAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		wantErr bool
+	}{
+		{address: "user@example.com", want: "user@example.com"},
+		{address: "User@Example.COM", want: "User@Example.COM"},
+		{address: "user@bücher.example", want: "user@xn--bcher-kva.example"},
+		{address: "user@Bücher.example", want: "user@xn--bcher-kva.example"},
+		{address: "user@例え.テスト", want: "user@xn--r8jz45g.xn--zckzah"},
+		{address: "müller@bücher.example", want: "müller@xn--bcher-kva.example"},
+		{address: "user@xn--bcher-kva.example", want: "user@xn--bcher-kva.example"},
+		{address: "user@mail.xn--bcher-kva.example", want: "user@mail.xn--bcher-kva.example"},
+		{address: "user@[192.0.2.1]", want: "user@[192.0.2.1]"},
+		{address: "user@xn--zz.example", wantErr: true},
+		{address: "user@-bücher.example", wantErr: true},
+		{address: "user@bü_cher.example", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			got, err := asciiAddress(tt.address)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("asciiAddress() = %q, want error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("asciiAddress() error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("asciiAddress() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+// Package main provides the TCP and Unix domain socket SMTP listeners of smtp2graph.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixAddrPrefix marks an SMTP_SERVER_ADDR that is the path of a Unix domain socket, for
+// sidecar deployments that should not expose a TCP port.
+const unixAddrPrefix = "unix:"
+
+// listenAddress splits an SMTP_SERVER_ADDR into the network and address to listen on.
+func listenAddress(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, unixAddrPrefix); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// validateListenAddress checks an SMTP_SERVER_ADDR before anything is started.
+func validateListenAddress(addr string) error {
+	if network, path := listenAddress(addr); network == "unix" && path == "" {
+		return errors.New("SMTP_SERVER_ADDR must name a socket path after unix:")
+	}
+	return nil
+}
+
+// listenSMTP listens on an SMTP_SERVER_ADDR. A socket file left behind by a previous run that
+// did not shut down cleanly is replaced; the socket file is removed again when the listener is
+// closed on shutdown.
+func listenSMTP(addr string) (net.Listener, error) {
+	network, address := listenAddress(addr)
+	if network == "unix" {
+		if fi, err := os.Lstat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(address); err != nil {
+				return nil, fmt.Errorf("remove stale socket: %w", err)
+			}
+		}
+	}
+	return net.Listen(network, address)
+}
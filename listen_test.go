@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"net"
+	netsmtp "net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		addr        string
+		wantNetwork string
+		wantAddress string
+	}{
+		{addr: ":1025", wantNetwork: "tcp", wantAddress: ":1025"},
+		{addr: "127.0.0.1:25", wantNetwork: "tcp", wantAddress: "127.0.0.1:25"},
+		{addr: "unix:/run/smtp2graph.sock", wantNetwork: "unix", wantAddress: "/run/smtp2graph.sock"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			network, address := listenAddress(tt.addr)
+			if network != tt.wantNetwork || address != tt.wantAddress {
+				t.Fatalf("listenAddress(%q) = %q, %q, want %q, %q", tt.addr, network, address, tt.wantNetwork, tt.wantAddress)
+			}
+		})
+	}
+}
+
+func TestListenSMTPUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtp2graph.sock")
+	// A socket file left behind by a previous run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listenSMTP(unixAddrPrefix + path)
+	if err != nil {
+		t.Fatalf("listenSMTP() error: %v", err)
+	}
+	h := &mockHandler{}
+	cfg := &appConfig{SenderEmail: "sender@example.com", SenderPassword: "password"}
+	srv := smtp.NewServer(&smtpBackend{config: cfg, ctx: t.Context(), handler: h})
+	srv.AllowInsecureAuth = true
+	done := make(chan error, 1)
+	go func() { done <- srv.Serve(ln) }()
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	c, err := netsmtp.NewClient(conn, "localhost")
+	if err != nil {
+		t.Fatalf("NewClient() error: %v", err)
+	}
+	if err := c.Auth(netsmtp.PlainAuth("", "sender@example.com", "password", "localhost")); err != nil {
+		t.Fatalf("Auth() error: %v", err)
+	}
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	if err := c.Rcpt("recipient@example.com"); err != nil {
+		t.Fatalf("Rcpt() error: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+	if _, err := w.Write([]byte("Subject: Test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Data close error: %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit() error: %v", err)
+	}
+	if !h.called {
+		t.Fatal("handler not called")
+	}
+
+	srv.Close()
+	if err := <-done; err != nil && !errors.Is(err, smtp.ErrServerClosed) {
+		t.Fatalf("Serve() error = %v, want ErrServerClosed", err)
+	}
+	if _, err := os.Lstat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("socket file after shutdown: Lstat() error = %v, want not exist", err)
+	}
+}
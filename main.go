@@ -6,12 +6,15 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"net/mail"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"runtime"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/emersion/go-smtp"
 	"github.com/getsentry/sentry-go"
@@ -19,16 +22,22 @@ import (
 
 // main loads configuration, initializes Sentry, sets up the SMTP backend, and starts the SMTP server.
 func main() {
+	startTime = time.Now()
 	versionFlag := flag.Bool("version", false, "print version and exit")
+	configFlag := flag.String("config", "", "load configuration from a YAML file; environment variables take precedence")
+	checkFlag := flag.Bool("check", false, "verify Graph credentials (and Mail.Send if CHECK_SEND_TO is set) and exit")
+	replayFlag := flag.String("replay", "", "re-attempt delivery of the spooled and failed messages in `dir` and exit")
+	replayRemoveFlag := flag.Bool("replay-remove", false, "with -replay, delete replayed messages instead of keeping them as .sent")
 	flag.Parse()
 	if *versionFlag {
 		appName := filepath.Base(os.Args[0])
-		fmt.Printf("%s (%s) %s %s/%s\n", appName, revision, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+		v := currentVersion()
+		fmt.Printf("%s (%s) %s %s/%s\n", appName, v.Revision, v.GoVersion, v.OS, v.Arch)
 
 		os.Exit(0)
 	}
 
-	cfg, err := loadConfig()
+	cfg, err := loadConfig(*configFlag)
 	if err != nil {
 		exitWithError(err)
 	}
@@ -46,8 +55,9 @@ func main() {
 
 	defer func() {
 		if r := recover(); r != nil {
-			sentry.CurrentHub().Recover(r)
-			log.Printf("panic: %v", r)
+			// Panics in SMTP sessions are recovered by the session; this is a server-level panic.
+			reportPanic(ctx, r, "server", nil)
+			log.Printf("server panic: %v", r)
 			cleanupSentry(ctx)
 			os.Exit(2)
 		}
@@ -55,6 +65,10 @@ func main() {
 	defer cancel()
 	defer cleanupSentry(ctx)
 
+	// Export OpenTelemetry traces if an OTLP endpoint is configured.
+	cleanupTracing := initTracing(cfg)
+	defer cleanupTracing(ctx)
+
 	// Set up signal handling for graceful shutdown
 	shutdownCh := make(chan os.Signal, 1)
 	doneCh := make(chan struct{})
@@ -66,16 +80,91 @@ func main() {
 		exitWithError(err)
 	}
 
+	// With -check, verify the Graph credentials and permissions instead of serving.
+	if *checkFlag {
+		if err := runCheck(ctx, cfg, handler, handler.getCachedToken, handler.checkDrafts, os.Stdout); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	// With -replay, resend stored messages instead of serving.
+	if *replayFlag != "" {
+		if err := runReplay(ctx, *replayFlag, handler, *replayRemoveFlag, os.Stdout); err != nil {
+			exitWithError(err)
+		}
+		os.Exit(0)
+	}
+
+	if features := cfg.Features(); len(features) > 0 {
+		log.Printf("Enabled features: %s", strings.Join(features, ", "))
+	}
+
+	// Acquire the initial Graph token in the background so readiness reflects the credentials.
+	// A dry run never sends, so it does not need one.
+	if cfg.DryRun {
+		log.Println("Dry run: messages are accepted and logged but not sent to Graph")
+	} else {
+		go func() {
+			if _, err := handler.getCachedToken(ctx); err != nil {
+				log.Printf("Initial Graph token acquisition failed: %v", err)
+			}
+		}()
+	}
+
+	// Pick up a rotated client secret or certificate on SIGHUP without a restart.
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	go handler.reloadOnHangup(ctx, hupCh, *configFlag)
+
+	// Keep a valid token and watch the credential expiry in the background if configured.
+	if cfg.TokenValidateInterval > 0 {
+		go handler.validateToken(ctx)
+	}
+
+	// Start the health check server.
+	healthSrv := newHealthServer(cfg, handler)
+	go func() {
+		log.Println("Starting health server at", healthSrv.Addr)
+		if err := healthSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			exitWithError(err)
+		}
+	}()
+
+	// Spool messages whose relay failed temporarily if a spool directory is configured.
+	var relay messageHandler = handler
+	if cfg.SpoolDir != "" {
+		sp, err := newSpool(cfg, handler)
+		if err != nil {
+			exitWithError(err)
+		}
+		go sp.run(ctx)
+		relay = sp
+	}
+
+	// Send messages in the background after replying to DATA if send workers are configured.
+	inflight := &inflightSends{}
+	var queue *sendQueue
+	if cfg.SendWorkers > 0 {
+		queue = newSendQueue(cfg, relay, inflight)
+		queue.run(ctx)
+		relay = queue
+	}
+
 	be := &smtpBackend{
-		config:  cfg,
-		ctx:     ctx,
-		handler: handler,
+		config:      cfg,
+		ctx:         ctx,
+		handler:     relay,
+		limiter:     newRateLimiter(cfg.RateLimitPerMinute),
+		rcptLimiter: newRateLimiter(cfg.PerRecipientRate),
+		inflight:    inflight,
+		conns:       newConnLimiter(cfg.MaxConnectionsPerIP),
 	}
 
 	// Create and configure the SMTP server instance.
 	s := smtp.NewServer(be)
 	s.EnableSMTPUTF8 = true
-	s.EnableBINARYMIME = true
+	s.EnableBINARYMIME = true // go-smtp always offers CHUNKING; BDAT chunks reach Session.Data as one stream
 	s.AllowInsecureAuth = true
 
 	s.Addr = cfg.SMTPAddr
@@ -88,16 +177,41 @@ func main() {
 	go func() {
 		<-shutdownCh
 		log.Println("Received interrupt signal, shutting down SMTP server...")
+		// Refuse new sessions and messages, then let messages being relayed finish before their
+		// context is canceled.
+		be.inflight.close()
+		if pending := be.inflight.wait(cfg.ShutdownGracePeriod); pending > 0 {
+			log.Printf("warning: shutdown grace period of %s elapsed with %d send(s) still pending", cfg.ShutdownGracePeriod, pending)
+		}
+		// Messages still queued are spooled or logged rather than started and canceled.
+		if queue != nil {
+			queue.drain()
+		}
 		cancel() // cancel context for all in-flight operations
 		if err := s.Close(); err != nil {
 			log.Printf("Error shutting down SMTP server: %v", err)
 		}
+		shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelShutdown()
+		if err := healthSrv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Error shutting down health server: %v", err)
+		}
 		close(doneCh)
 	}()
 
 	// Main loop: start the server and wait for shutdown signal
 	log.Println("Starting server at", s.Addr)
-	if err := s.ListenAndServe(); err != nil && err != smtp.ErrServerClosed {
+	ln, err := listenSMTP(s.Addr)
+	if err != nil {
+		exitWithError(err)
+	}
+	if cfg.EnableProxyProtocol {
+		ln = &proxyListener{Listener: ln}
+	}
+	if !cfg.EnableVRFY {
+		ln = &noVRFYListener{Listener: ln}
+	}
+	if err := s.Serve(ln); err != nil && err != smtp.ErrServerClosed {
 		exitWithError(err)
 	}
 
@@ -105,27 +219,122 @@ func main() {
 	<-doneCh
 }
 
+// errShuttingDown is returned for sessions started while the server shuts down.
+var errShuttingDown = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "server shutting down, try again later",
+}
+
 // smtpBackend implements the SMTP server methods required by go-smtp.
 // smtpBackend holds the handler used for processing messages.
 type smtpBackend struct {
-	config  *appConfig
-	ctx     context.Context
-	handler messageHandler
+	config      *appConfig
+	ctx         context.Context
+	handler     messageHandler
+	limiter     *rateLimiter     // per-sender message rate limit shared by all sessions, nil if disabled
+	rcptLimiter *rateLimiter     // per-recipient message rate limit shared by all sessions, nil if disabled
+	inflight    *inflightSends   // handler calls in progress, waited for on shutdown
+	conns       *connLimiter     // open sessions per remote IP shared by all sessions, nil if unlimited
+	now         func() time.Time // clock for the maintenance windows, for tests (default: time.Now)
+}
+
+// errMaintenance is returned for sessions started during a MAINTENANCE_WINDOWS window.
+var errMaintenance = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+	Message:      "down for scheduled maintenance, try again later",
+}
+
+// errTooManyConnections is returned for sessions beyond MAX_CONNECTIONS_PER_IP.
+var errTooManyConnections = &smtp.SMTPError{
+	Code:         421,
+	EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+	Message:      "too many connections from your address, try again later",
 }
 
 // NewSession is called after the client greeting (EHLO, HELO) and creates a new SMTP session.
+// Once shutdown has begun, new sessions are refused with a 421 reply,
+// which is not reported to Sentry since it is expected. A greeting whose hostname does not match
+// EHLO_ALLOW_REGEX is refused with a 550 reply, and one beyond MAX_CONNECTIONS_PER_IP sessions
+// from the same IP address with a 421 reply. So are sessions started in a maintenance window.
 func (bkd *smtpBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	ctx := bkd.ctx // Use the backend's context directly
+	if ctx.Err() != nil || bkd.inflight.closing() {
+		return nil, errShuttingDown
+	}
+	var conn net.Conn
+	var remote, ip string
+	var conns *connLimiter
+	if c != nil {
+		conn = c.Conn()
+		remote = conn.RemoteAddr().String()
+	}
+	if bkd.config.Maintenance.active(bkd.timeNow()) {
+		if bkd.config.LogRejections {
+			log.Printf("rejected reason=%s code=421 enhanced=4.3.2 remote=%q", reasonMaintenance, remote)
+		}
+		return nil, errMaintenance
+	}
+	if c != nil {
+		if err := bkd.checkGreeting(c.Hostname(), remote); err != nil {
+			return nil, err
+		}
+		if ip = remoteIP(conn.RemoteAddr()); ip != "" {
+			if !bkd.conns.acquire(ip) {
+				if bkd.config.LogRejections {
+					log.Printf("rejected reason=%s code=421 enhanced=4.7.0 remote=%q", reasonTooManyConnections, remote)
+				}
+				return nil, errTooManyConnections
+			}
+			conns = bkd.conns
+		}
+	}
+	ctx = withSessionHub(ctx)
+	if c != nil {
+		addBreadcrumb(ctx, "smtp", "EHLO", map[string]any{"hostname": c.Hostname(), "remote": remote})
+	}
 	return &smtpSession{
-		config:     bkd.config,
-		ctx:        ctx,
-		handler:    bkd.handler,
-		auth:       false,
-		sender:     nil,
-		recipients: make([]mail.Address, 0, 1),
+		config:      bkd.config,
+		ctx:         ctx,
+		handler:     bkd.handler,
+		limiter:     bkd.limiter,
+		rcptLimiter: bkd.rcptLimiter,
+		connRate:    newRateLimiter(bkd.config.PerConnectionRate),
+		inflight:    bkd.inflight,
+		conn:        conn,
+		remoteAddr:  remote,
+		conns:       conns,
+		connIP:      ip,
+		now:         bkd.now,
+		auth:        false,
+		sender:      nil,
+		recipients:  make([]mail.Address, 0, 1),
 	}, nil
 }
 
+// timeNow returns the current time from bkd.now, defaulting to time.Now.
+func (bkd *smtpBackend) timeNow() time.Time {
+	if bkd.now != nil {
+		return bkd.now()
+	}
+	return time.Now()
+}
+
+// checkGreeting returns an SMTP error for a HELO/EHLO hostname that does not match
+// EHLO_ALLOW_REGEX. Like other rejections it is logged with LOG_REJECTIONS but not reported to
+// Sentry, since bogus greetings are expected from abusive clients.
+func (bkd *smtpBackend) checkGreeting(hostname, remote string) error {
+	allow := bkd.config.EHLOAllowRegex
+	if allow == nil || allow.MatchString(hostname) {
+		return nil
+	}
+	if bkd.config.LogRejections {
+		log.Printf("rejected reason=%s code=550 enhanced=5.7.1 hostname=%q remote=%q", reasonEHLOHostname, hostname, remote)
+	}
+	return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "HELO/EHLO hostname not allowed"}
+}
+
 // exitWithError logs, reports, and exits on fatal errors.
 func exitWithError(err error) {
 	if err == nil {
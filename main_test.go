@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestBackendNewSessionAfterShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	bkd := &smtpBackend{config: &appConfig{}, ctx: ctx, handler: &mockHandler{}}
+
+	if _, err := bkd.NewSession(nil); err != nil {
+		t.Fatalf("NewSession() before shutdown error: %v", err)
+	}
+
+	cancel()
+	session, err := bkd.NewSession(nil)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Fatalf("NewSession() after shutdown error = %v, want 421", err)
+	}
+	if session != nil {
+		t.Fatalf("NewSession() after shutdown session = %v, want nil", session)
+	}
+}
+
+func TestBackendNewSessionGreeting(t *testing.T) {
+	tests := []struct {
+		name      string
+		regex     string
+		hostname  string
+		wantError bool
+	}{
+		{name: "no regex", hostname: "anything"},
+		{name: "matching", regex: `[a-z0-9-]+\.example\.com`, hostname: "app-1.example.com"},
+		{name: "non-matching", regex: `[a-z0-9-]+\.example\.com`, hostname: "localhost", wantError: true},
+		{name: "partial match", regex: `[a-z0-9-]+\.example\.com`, hostname: "app.example.com.attacker.test", wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &appConfig{}
+			if tt.regex != "" {
+				var err error
+				if cfg.EHLOAllowRegex, err = getenvRegexp(configLookup(map[string]string{"EHLO_ALLOW_REGEX": tt.regex}), "EHLO_ALLOW_REGEX"); err != nil {
+					t.Fatalf("getenvRegexp() error: %v", err)
+				}
+			}
+			srv := smtp.NewServer(&smtpBackend{config: cfg, ctx: t.Context(), handler: &mockHandler{}})
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen() error: %v", err)
+			}
+			go srv.Serve(ln)
+			t.Cleanup(func() { srv.Close() })
+
+			c, err := netsmtp.Dial(ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial() error: %v", err)
+			}
+			defer c.Close()
+			err = c.Hello(tt.hostname)
+			if !tt.wantError {
+				if err != nil {
+					t.Fatalf("Hello(%q) error: %v", tt.hostname, err)
+				}
+				return
+			}
+			var protoErr *textproto.Error
+			if !errors.As(err, &protoErr) || protoErr.Code != 550 || !strings.HasPrefix(protoErr.Msg, "5.7.1") {
+				t.Fatalf("Hello(%q) error = %v, want 550 5.7.1", tt.hostname, err)
+			}
+		})
+	}
+}
+
+func TestBackendDataStartTimeout(t *testing.T) {
+	cfg := &appConfig{SenderEmail: "sender@example.com", SenderPassword: "password", DataStartTimeout: 200 * time.Millisecond}
+	h := &mockHandler{}
+	srv := smtp.NewServer(&smtpBackend{config: cfg, ctx: t.Context(), handler: h})
+	srv.AllowInsecureAuth = true
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+
+	c, err := netsmtp.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer c.Close()
+	if err := c.Auth(netsmtp.PlainAuth("", "sender@example.com", "password", "127.0.0.1")); err != nil {
+		t.Fatalf("Auth() error: %v", err)
+	}
+	if err := c.Mail("sender@example.com"); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	if err := c.Rcpt("recipient@example.com"); err != nil {
+		t.Fatalf("Rcpt() error: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+	// A client that stalls mid-message is cut off at the deadline rather than SMTP_READ_TIMEOUT.
+	if _, err := w.Write([]byte("Subject: Test\r\n\r\n")); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	w.Write([]byte("Hello\r\nRSET\r\n"))
+	err = w.Close()
+	var protoErr *textproto.Error
+	if !errors.As(err, &protoErr) || protoErr.Code != 451 || !strings.HasPrefix(protoErr.Msg, "4.4.2") {
+		t.Fatalf("Data close error = %v, want 451 4.4.2", err)
+	}
+	if h.called {
+		t.Fatal("handler called after DATA_START_TIMEOUT")
+	}
+	// The rest of the message is not read as commands; the connection is closed instead.
+	if err := c.Noop(); err == nil {
+		t.Fatal("Noop() after DATA_START_TIMEOUT succeeded, want closed connection")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // the runtime image has no zoneinfo for MAINTENANCE_TIMEZONE
+)
+
+// maintenanceSchedule is a set of recurring weekly or daily windows, configured with
+// MAINTENANCE_WINDOWS, during which the server refuses mail so that planned downtime does not
+// need a manual switch. A nil schedule is never active.
+type maintenanceSchedule struct {
+	windows []maintenanceWindow
+	loc     *time.Location // time zone the windows are given in
+}
+
+// maintenanceWindow is a time range on one weekday, or on every day if daily is set. A window
+// whose end is not after its start runs past midnight into the next day.
+type maintenanceWindow struct {
+	day        time.Weekday
+	daily      bool
+	start, end time.Duration // offsets from midnight
+}
+
+// weekdays maps the lowercase full and abbreviated day names to their weekday.
+var weekdays = func() map[string]time.Weekday {
+	m := make(map[string]time.Weekday, 14)
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		name := strings.ToLower(d.String())
+		m[name] = d
+		m[name[:3]] = d
+	}
+	return m
+}()
+
+// parseMaintenanceWindows parses a comma-separated list of windows of the form
+// "[day] HH:MM-HH:MM", such as "Sun 02:00-04:00" or "23:30-00:30", in the time zone loc.
+// It returns nil if s is empty.
+func parseMaintenanceWindows(s string, loc *time.Location) (*maintenanceSchedule, error) {
+	var windows []maintenanceWindow
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		w, err := parseMaintenanceWindow(entry)
+		if err != nil {
+			return nil, fmt.Errorf("MAINTENANCE_WINDOWS: %w", err)
+		}
+		windows = append(windows, w)
+	}
+	if len(windows) == 0 {
+		return nil, nil
+	}
+	return &maintenanceSchedule{windows: windows, loc: loc}, nil
+}
+
+// parseMaintenanceWindow parses a single "[day] HH:MM-HH:MM" window.
+func parseMaintenanceWindow(entry string) (maintenanceWindow, error) {
+	w := maintenanceWindow{daily: true}
+	fields := strings.Fields(entry)
+	switch len(fields) {
+	case 1:
+	case 2:
+		day, ok := weekdays[strings.ToLower(fields[0])]
+		if !ok {
+			return w, fmt.Errorf("invalid day in %q", entry)
+		}
+		w.day, w.daily = day, false
+	default:
+		return w, fmt.Errorf("invalid window %q, want [day] HH:MM-HH:MM", entry)
+	}
+
+	from, to, ok := strings.Cut(fields[len(fields)-1], "-")
+	var err error
+	if ok {
+		if w.start, err = parseClock(from); err == nil {
+			w.end, err = parseClock(to)
+		}
+	}
+	if !ok || err != nil {
+		return w, fmt.Errorf("invalid window %q, want [day] HH:MM-HH:MM", entry)
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("window %q is empty", entry)
+	}
+	return w, nil
+}
+
+// parseClock parses a HH:MM time of day as an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// active reports whether t falls in one of the windows.
+func (m *maintenanceSchedule) active(t time.Time) bool {
+	if m == nil {
+		return false
+	}
+	t = t.In(m.loc)
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	yesterday := (t.Weekday() + 6) % 7
+	for _, w := range m.windows {
+		if w.start < w.end {
+			if w.on(t.Weekday()) && offset >= w.start && offset < w.end {
+				return true
+			}
+			continue
+		}
+		// The window runs past midnight: its start is today or its end is yesterday's.
+		if (w.on(t.Weekday()) && offset >= w.start) || (w.on(yesterday) && offset < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// on reports whether the window starts on day.
+func (w maintenanceWindow) on(day time.Weekday) bool {
+	return w.daily || w.day == day
+}
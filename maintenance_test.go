@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestMaintenanceScheduleActive(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf("LoadLocation() error: %v", err)
+	}
+	// 2024-06-02 is a Sunday.
+	at := func(day int, clock string) time.Time {
+		c, err := time.Parse("15:04", clock)
+		if err != nil {
+			t.Fatalf("Parse(%q) error: %v", clock, err)
+		}
+		return time.Date(2024, 6, day, c.Hour(), c.Minute(), 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name    string
+		windows string
+		loc     *time.Location
+		t       time.Time
+		want    bool
+	}{
+		{name: "inside weekly window", windows: "Sun 02:00-04:00", t: at(2, "03:00"), want: true},
+		{name: "at window start", windows: "Sun 02:00-04:00", t: at(2, "02:00"), want: true},
+		{name: "at window end", windows: "Sun 02:00-04:00", t: at(2, "04:00")},
+		{name: "before window", windows: "Sun 02:00-04:00", t: at(2, "01:59")},
+		{name: "other day", windows: "Sun 02:00-04:00", t: at(3, "03:00")},
+		{name: "full day name", windows: "sunday 02:00-04:00", t: at(2, "03:00"), want: true},
+		{name: "daily window", windows: "12:00-12:30", t: at(5, "12:15"), want: true},
+		{name: "past midnight before", windows: "Sat 23:00-01:00", t: at(1, "23:30"), want: true},
+		{name: "past midnight after", windows: "Sat 23:00-01:00", t: at(2, "00:30"), want: true},
+		{name: "past midnight wrong day", windows: "Sat 23:00-01:00", t: at(3, "00:30")},
+		{name: "past midnight until midnight", windows: "Sun 22:00-00:00", t: at(2, "23:59"), want: true},
+		{name: "second window", windows: "Sat 02:00-04:00, Sun 02:00-04:00", t: at(2, "02:30"), want: true},
+		{name: "time zone", windows: "Sun 02:00-04:00", loc: berlin, t: at(2, "01:00"), want: true},
+		{name: "time zone outside", windows: "Sun 02:00-04:00", loc: berlin, t: at(2, "03:00")},
+		{name: "no windows", t: at(2, "03:00")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := tt.loc
+			if loc == nil {
+				loc = time.UTC
+			}
+			m, err := parseMaintenanceWindows(tt.windows, loc)
+			if err != nil {
+				t.Fatalf("parseMaintenanceWindows(%q) error: %v", tt.windows, err)
+			}
+			if got := m.active(tt.t); got != tt.want {
+				t.Fatalf("active(%s) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMaintenanceWindowsInvalid(t *testing.T) {
+	for _, windows := range []string{"Sun", "Sun 02:00", "Someday 02:00-04:00", "25:00-26:00", "Sun 02:00-02:00", "Sun Mon 02:00-04:00"} {
+		if _, err := parseMaintenanceWindows(windows, time.UTC); err == nil {
+			t.Errorf("parseMaintenanceWindows(%q) error = nil, want invalid window", windows)
+		}
+	}
+}
+
+func TestMaintenanceRejections(t *testing.T) {
+	window, err := parseMaintenanceWindows("Sun 02:00-04:00", time.UTC)
+	if err != nil {
+		t.Fatalf("parseMaintenanceWindows() error: %v", err)
+	}
+	outside := time.Date(2024, 6, 2, 1, 59, 0, 0, time.UTC)
+	inside := time.Date(2024, 6, 2, 2, 0, 0, 0, time.UTC)
+
+	now := outside
+	bkd := &smtpBackend{
+		config:  &appConfig{SenderEmail: "sender@example.com", SenderPassword: "password", Maintenance: window},
+		ctx:     t.Context(),
+		handler: &mockHandler{},
+		now:     func() time.Time { return now },
+	}
+	sess, err := bkd.NewSession(nil)
+	if err != nil {
+		t.Fatalf("NewSession() outside the window error: %v", err)
+	}
+	session := sess.(*smtpSession)
+	session.auth = true
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() outside the window error: %v", err)
+	}
+	session.Reset()
+
+	now = inside
+	var smtpErr *smtp.SMTPError
+	if _, err := bkd.NewSession(nil); !errors.As(err, &smtpErr) || smtpErr.Code != 421 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 3, 2}) {
+		t.Fatalf("NewSession() in the window error = %v, want 421 4.3.2", err)
+	}
+	// A session opened before the window may finish its transaction but not start another.
+	if err := session.Mail("sender@example.com", nil); !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 3, 2}) {
+		t.Fatalf("Mail() in the window error = %v, want 451 4.3.2", err)
+	}
+
+	now = inside.Add(2 * time.Hour)
+	if _, err := bkd.NewSession(nil); err != nil {
+		t.Fatalf("NewSession() after the window error: %v", err)
+	}
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() after the window error: %v", err)
+	}
+}
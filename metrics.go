@@ -0,0 +1,57 @@
+// Package main provides Prometheus metrics for smtp2graph.
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default Prometheus registry and served on /metrics
+// by the health server when METRICS_ENABLED is true.
+var (
+	messagesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp2graph_messages_received_total",
+		Help: "Messages received over SMTP DATA.",
+	})
+	messagesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp2graph_messages_sent_total",
+		Help: "Messages accepted by the Microsoft Graph API.",
+	})
+	sendFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp2graph_send_failures_total",
+		Help: "Messages that could not be relayed to the Microsoft Graph API.",
+	})
+	transactionRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp2graph_transaction_retries_total",
+		Help: "Deliveries retried within SMTP DATA after failing before the message was sent to Graph.",
+	})
+	messagesSpooled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp2graph_messages_spooled_total",
+		Help: "Messages spooled to disk for retry after a temporary relay failure.",
+	})
+	tokenCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp2graph_token_cache_hits_total",
+		Help: "Graph access token requests served from the cache.",
+	})
+	tokenRefreshes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "smtp2graph_token_refreshes_total",
+		Help: "Graph access token acquisitions started because the cached token was missing or about to expire.",
+	})
+	clientDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "smtp2graph_client_disconnects_during_send_total",
+		Help: "Messages whose client disconnected while they were relayed to Graph, by outcome (delivered or failed).",
+	}, []string{"outcome"})
+	sendQueueLength = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "smtp2graph_send_queue_length",
+		Help: "Messages waiting in the send queue for a free SEND_WORKERS worker.",
+	})
+	credentialExpiryDays = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "smtp2graph_credential_expiry_days",
+		Help: "Whole days until ENTRA_CREDENTIAL_EXPIRES, negative once it has passed.",
+	})
+	graphSendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "smtp2graph_graph_send_duration_seconds",
+		Help:    "Duration of Microsoft Graph sendMail requests.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
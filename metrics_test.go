@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRecordRelayedMessages(t *testing.T) {
+	received := testutil.ToFloat64(messagesReceived)
+	sent := testutil.ToFloat64(messagesSent)
+	failed := testutil.ToFloat64(sendFailures)
+
+	var calls atomic.Int32
+	h := newTestGraphHandler(newTestGraphServer(t, &calls, http.StatusAccepted, http.StatusBadRequest), 0)
+	h.token = "token"
+	h.tokenExp = time.Now().Add(time.Hour).Unix()
+
+	for range 2 {
+		session := newTestSessionWithT(t)
+		session.handler = h
+		session.auth = true
+		_ = session.Mail("sender@example.com", nil)
+		_ = session.Rcpt("recipient@example.com", nil)
+		_ = session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+	}
+
+	if got := testutil.ToFloat64(messagesReceived) - received; got != 2 {
+		t.Errorf("messages received = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(messagesSent) - sent; got != 1 {
+		t.Errorf("messages sent = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(sendFailures) - failed; got != 1 {
+		t.Errorf("send failures = %v, want 1", got)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		h := &graphMailHandler{config: &appConfig{MetricsEnabled: enabled}, cred: &stubCredential{}}
+		rec := httptest.NewRecorder()
+		newHealthMux(h.config, h).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		want := http.StatusNotFound
+		if enabled {
+			want = http.StatusOK
+		}
+		if rec.Code != want {
+			t.Fatalf("/metrics with MetricsEnabled=%v = %d, want %d", enabled, rec.Code, want)
+		}
+		if enabled && !strings.Contains(rec.Body.String(), "smtp2graph_graph_send_duration_seconds") {
+			t.Fatalf("/metrics body does not include smtp2graph_graph_send_duration_seconds")
+		}
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/google/uuid"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// rawBody is the body of a message parsed by parseMessage. It keeps the raw header block the
+// message was parsed from, so encodeMailMessage can reproduce every unchanged header field
+// byte for byte, including its order and folding.
+type rawBody struct {
+	io.Reader
+	header []byte // raw header block including the terminating blank line
+}
+
+// splitHeader splits raw at the blank line ending the header block. The returned header
+// includes the blank line. ok is false if raw has no blank line.
+func splitHeader(raw []byte) (header, body []byte, ok bool) {
+	for i := 0; i < len(raw); {
+		end := bytes.IndexByte(raw[i:], '\n')
+		if end < 0 {
+			break
+		}
+		line := raw[i : i+end+1]
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			return raw[:i+end+1], raw[i+end+1:], true
+		}
+		i += end + 1
+	}
+	return nil, nil, false
+}
+
+// terminateHeader returns a copy of raw, a message without a blank line and thus without a body,
+// as a complete header block: the last line is ended and a blank line is appended, both with CRLF
+// as RFC 5322 requires.
+func terminateHeader(raw []byte) []byte {
+	header := slices.Clone(raw)
+	if !bytes.HasSuffix(header, []byte("\n")) {
+		header = append(header, "\r\n"...)
+	}
+	return append(header, "\r\n"...)
+}
+
+// headerField is a single header field as it appears in a raw header block.
+type headerField struct {
+	key string // canonical field name
+	raw []byte // field lines including continuation lines and line endings
+}
+
+// splitHeaderFields splits a raw header block into fields, dropping the terminating blank line.
+func splitHeaderFields(header []byte) []headerField {
+	var fields []headerField
+	for len(header) > 0 {
+		end := bytes.IndexByte(header, '\n') + 1
+		if end == 0 {
+			end = len(header)
+		}
+		line := header[:end]
+		header = header[end:]
+
+		switch {
+		case len(bytes.TrimRight(line, "\r\n")) == 0:
+			return fields
+		case (line[0] == ' ' || line[0] == '\t') && len(fields) > 0:
+			f := &fields[len(fields)-1]
+			f.raw = append(f.raw, line...)
+		default:
+			name, _, _ := bytes.Cut(line, []byte(":"))
+			fields = append(fields, headerField{
+				key: textproto.CanonicalMIMEHeaderKey(string(bytes.TrimSpace(name))),
+				raw: slices.Clone(line),
+			})
+		}
+	}
+	return fields
+}
+
+// writePreservedHeader writes header to buf, copying the fields of raw whose values are unchanged
+// verbatim. Changed fields are rewritten at the position of their first occurrence, removed fields
+// are dropped, and new fields are appended in sorted order.
+func writePreservedHeader(buf *bytes.Buffer, raw []byte, header mail.Header) error {
+	orig, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	eol := "\n"
+	if bytes.Contains(raw, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+
+	writeField := func(key string) {
+		for _, v := range header[key] {
+			buf.WriteString(key + ": " + v + eol)
+		}
+	}
+
+	rewritten := make(map[string]bool)
+	for _, f := range splitHeaderFields(raw) {
+		if slices.Equal(orig[f.key], header[f.key]) {
+			buf.Write(f.raw)
+			continue
+		}
+		if !rewritten[f.key] {
+			rewritten[f.key] = true
+			writeField(f.key)
+		}
+	}
+
+	added := make([]string, 0)
+	for key := range header {
+		if _, ok := orig[key]; !ok {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+	for _, key := range added {
+		writeField(key)
+	}
+
+	_, err = buf.WriteString(eol)
+	return err
+}
+
+// encodedWordCharset matches the charset of each RFC 2047 encoded word.
+var encodedWordCharset = regexp.MustCompile(`=\?([^?*]+)(?:\*[^?]*)?\?[bBqQ]\?`)
+
+// subjectDecoder decodes RFC 2047 encoded words in any charset known to the WHATWG encoding index.
+var subjectDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported charset %q", charset)
+		}
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// transcodeSubject re-encodes a subject containing encoded words in a charset other than UTF-8
+// as UTF-8 encoded words, keeping its text. It reports false, leaving the subject to be relayed
+// unchanged, if there is nothing to transcode or the subject cannot be decoded.
+func transcodeSubject(subject string) (string, bool) {
+	needed := false
+	for _, m := range encodedWordCharset.FindAllStringSubmatch(subject, -1) {
+		if cs := strings.ToLower(m[1]); cs != "utf-8" && cs != "us-ascii" {
+			needed = true
+		}
+	}
+	if !needed {
+		return subject, false
+	}
+	decoded, err := subjectDecoder.DecodeHeader(subject)
+	// DecodeHeader keeps malformed encoded words as they are.
+	if err != nil || encodedWordCharset.MatchString(decoded) {
+		return subject, false
+	}
+	return mime.QEncoding.Encode("utf-8", decoded), true
+}
+
+// newMessageID returns a new unique Message-ID header value in domain, or localhost if empty.
+func newMessageID(domain string) string {
+	if domain == "" {
+		domain = "localhost"
+	}
+	return "<" + uuid.NewString() + "@" + domain + ">"
+}
+
+// idempotencyKey derives a stable key from a Message-ID header value, so that every send of the
+// same message, whether retried by us or resubmitted by the client, carries the same key for
+// downstream systems to deduplicate on. It returns "" for a message without a Message-ID.
+func idempotencyKey(messageID string) string {
+	messageID = strings.TrimSpace(messageID)
+	if messageID == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(messageID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// utf8BOM is the UTF-8 encoded byte order mark.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// stripMessageBOM removes a UTF-8 byte order mark from the start of the text body of msg, or of
+// each text part of a multipart body, leaving everything else byte for byte. It reports whether
+// the body changed.
+func stripMessageBOM(msg *mail.Message) (bool, error) {
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return false, err
+	}
+	stripped, changed := stripBOM(textproto.MIMEHeader(msg.Header), body)
+	if rb, ok := msg.Body.(*rawBody); ok {
+		rb.Reader = bytes.NewReader(stripped)
+	} else {
+		msg.Body = bytes.NewReader(stripped)
+	}
+	return changed, nil
+}
+
+// stripBOM removes a byte order mark from the start of the content of an entity with header and
+// body: a text entity that is not an attachment, in any of the parts of a multipart entity, with
+// its transfer encoding. Other entities, such as binary attachments, are returned unchanged.
+func stripBOM(header textproto.MIMEHeader, body []byte) ([]byte, bool) {
+	mediaType := "text/plain"
+	params := map[string]string{}
+	if ct := header.Get("Content-Type"); ct != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return body, false
+		}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		return stripPartsBOM(body, params["boundary"])
+	}
+	if !strings.HasPrefix(mediaType, "text/") {
+		return body, false
+	}
+	if disposition, _, _ := mime.ParseMediaType(header.Get("Content-Disposition")); disposition == "attachment" {
+		return body, false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "", "7bit", "8bit", "binary":
+		if bytes.HasPrefix(body, utf8BOM) {
+			return body[len(utf8BOM):], true
+		}
+	case "quoted-printable":
+		if len(body) >= 9 && strings.EqualFold(string(body[:9]), "=EF=BB=BF") {
+			return body[9:], true
+		}
+	case "base64":
+		decoded, err := base64.StdEncoding.DecodeString(string(bytes.Join(bytes.Fields(body), nil)))
+		if err != nil || !bytes.HasPrefix(decoded, utf8BOM) {
+			return body, false
+		}
+		return encodeBase64(decoded[len(utf8BOM):], mimeLineLength), true
+	}
+	return body, false
+}
+
+// stripPartsBOM applies stripBOM to each part of a multipart body with the given boundary,
+// keeping the preamble, delimiters, part headers and epilogue unchanged.
+func stripPartsBOM(body []byte, boundary string) ([]byte, bool) {
+	if boundary == "" {
+		return body, false
+	}
+	delimiter := []byte("--" + boundary)
+
+	var out bytes.Buffer
+	changed := false
+	partStart := -1 // offset of the content of the current part, after its delimiter line
+	for i := 0; i < len(body); {
+		end := len(body)
+		if n := bytes.IndexByte(body[i:], '\n'); n >= 0 {
+			end = i + n + 1
+		}
+		line := body[i:end]
+		rest := bytes.TrimRight(bytes.TrimPrefix(line, delimiter), " \t\r\n")
+		if !bytes.HasPrefix(line, delimiter) || (len(rest) > 0 && !bytes.Equal(rest, []byte("--"))) {
+			i = end
+			continue
+		}
+
+		if partStart < 0 {
+			out.Write(body[:i])
+		} else {
+			// The line break before a delimiter belongs to the delimiter.
+			contentEnd := i
+			if contentEnd > partStart && body[contentEnd-1] == '\n' {
+				contentEnd--
+				if contentEnd > partStart && body[contentEnd-1] == '\r' {
+					contentEnd--
+				}
+			}
+			part, partChanged := stripPartBOM(body[partStart:contentEnd])
+			changed = changed || partChanged
+			out.Write(part)
+			out.Write(body[contentEnd:i])
+		}
+		if len(rest) > 0 { // close delimiter: the epilogue follows
+			out.Write(body[i:])
+			return out.Bytes(), changed
+		}
+		out.Write(line)
+		partStart = end
+		i = end
+	}
+	// Without a close delimiter, the rest is left as it is.
+	if partStart >= 0 {
+		out.Write(body[partStart:])
+	} else {
+		out.Write(body)
+	}
+	return out.Bytes(), changed
+}
+
+// stripPartBOM applies stripBOM to a body part given with its header.
+func stripPartBOM(part []byte) ([]byte, bool) {
+	header, body, ok := splitHeader(part)
+	if !ok {
+		return part, false
+	}
+	fields, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return part, false
+	}
+	stripped, changed := stripBOM(fields, body)
+	if !changed {
+		return part, false
+	}
+	return append(slices.Clone(header), stripped...), true
+}
+
+// mimeLineLength is the maximum length of base64 lines in MIME bodies, per RFC 2045.
+const mimeLineLength = 76
+
+// encodeBase64 returns the base64 encoding of data in CRLF-separated lines of lineLength
+// characters, or on a single line if lineLength <= 0.
+func encodeBase64(data []byte, lineLength int) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	if lineLength <= 0 {
+		return []byte(encoded)
+	}
+	out := make([]byte, 0, base64EncodedLen(len(data), lineLength))
+	for len(encoded) > lineLength {
+		out = append(out, encoded[:lineLength]...)
+		out = append(out, "\r\n"...)
+		encoded = encoded[lineLength:]
+	}
+	return append(out, encoded...)
+}
+
+// base64EncodedLen returns the length of encodeBase64(data, lineLength) for n bytes of data.
+func base64EncodedLen(n, lineLength int) int {
+	encoded := base64.StdEncoding.EncodedLen(n)
+	if lineLength <= 0 || encoded == 0 {
+		return encoded
+	}
+	return encoded + 2*((encoded-1)/lineLength)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// encodingHandler records the bytes encodeMailMessage produces for each message.
+type encodingHandler struct {
+	encoded []byte
+}
+
+func (h *encodingHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	b, err := encodeMailMessage(msg)
+	h.encoded = b
+	return err
+}
+
+// multipartMessage returns a two-part multipart/mixed message with a PDF attachment,
+// using the given extra header lines.
+func multipartMessage(extraHeader string) string {
+	pdf := base64.StdEncoding.EncodeToString([]byte("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n1 0 obj\n<< /Type /Catalog >>\nendobj\ntrailer\n<< /Root 1 0 R >>\n%%EOF\n"))
+	return "From: Sender <sender@example.com>\r\n" +
+		"To: recipient@example.com\r\n" +
+		extraHeader +
+		"Subject: Report with a rather long subject line that the client\r\n" +
+		" folded onto a continuation line\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed;\r\n" +
+		"\tboundary=\"=_boundary_42\"\r\n" +
+		"\r\n" +
+		"--=_boundary_42\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"Please find the report attached.\r\n" +
+		"--=_boundary_42\r\n" +
+		"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+		"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		pdf + "\r\n" +
+		"--=_boundary_42--\r\n"
+}
+
+func sendRaw(t *testing.T, raw string, recipients ...string) []byte {
+	t.Helper()
+	h := &encodingHandler{}
+	session := newTestSessionWithT(t)
+	session.config.StripContentLength = true
+	session.handler = h
+	session.auth = true
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	for _, rcpt := range recipients {
+		if err := session.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt(%s) error: %v", rcpt, err)
+		}
+	}
+	if err := session.Data(strings.NewReader(raw)); err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+	return h.encoded
+}
+
+func TestEncodePreservesMultipartMessage(t *testing.T) {
+	raw := multipartMessage("")
+
+	got := sendRaw(t, raw, "recipient@example.com")
+	if !bytes.Equal(got, []byte(raw)) {
+		t.Fatalf("encoded message differs from received message\ngot:\n%s\nwant:\n%s", got, raw)
+	}
+}
+
+func TestEncodePreservesMultipartMessageAfterHeaderPatching(t *testing.T) {
+	raw := multipartMessage("Content-Length: 12\r\n")
+
+	got := sendRaw(t, raw, "recipient@example.com", "hidden@example.com")
+
+	// Content-Length is stripped and the envelope-only recipient is appended as Bcc;
+	// all other header lines and the body are untouched.
+	want := strings.Replace(multipartMessage(""), "\r\n\r\n--=_boundary_42\r\n", "\r\nBcc: <hidden@example.com>\r\n\r\n--=_boundary_42\r\n", 1)
+	if !bytes.Equal(got, []byte(want)) {
+		t.Fatalf("encoded message differs from patched message\ngot:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestEncodeRewritesChangedHeaderInPlace(t *testing.T) {
+	raw := "Received: from a\r\nFrom: other@example.com\r\nTo: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n"
+
+	got := sendRaw(t, raw, "recipient@example.com")
+
+	want := "Received: from a\r\nFrom: <sender@example.com>\r\nTo: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n"
+	if string(got) != want {
+		t.Fatalf("encoded message = %q, want %q", got, want)
+	}
+}
+
+func TestEncodeHeadersOnlyMessage(t *testing.T) {
+	const header = "From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Test\r\n"
+	tests := []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{name: "empty body", raw: header + "\r\n", want: header + "\r\n"},
+		{name: "no blank line", raw: header, want: header + "\r\n"},
+		{name: "no final line ending", raw: strings.TrimSuffix(header, "\r\n"), want: header + "\r\n"},
+		{name: "LF line endings", raw: strings.ReplaceAll(header, "\r\n", "\n"), want: strings.ReplaceAll(header, "\r\n", "\n") + "\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sendRaw(t, tt.raw, "recipient@example.com")
+			if string(got) != tt.want {
+				t.Fatalf("encoded message = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeMessageWithoutBody(t *testing.T) {
+	header := mail.Header{
+		"Subject": {"Test"},
+		"From":    {"sender@example.com"},
+	}
+	want := "From: sender@example.com\r\nSubject: Test\r\n\r\n"
+
+	for _, body := range []io.Reader{nil, strings.NewReader("")} {
+		got, err := encodeMailMessage(&mail.Message{Header: header, Body: body})
+		if err != nil {
+			t.Fatalf("encodeMailMessage(body=%v) error: %v", body, err)
+		}
+		if string(got) != want {
+			t.Fatalf("encodeMailMessage(body=%v) = %q, want %q", body, got, want)
+		}
+	}
+}
+
+func TestTranscodeSubject(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		want    string // decoded text of the transcoded subject, or the unchanged subject
+		wantOK  bool
+	}{
+		{name: "ISO-8859-1 quoted-printable", subject: "=?ISO-8859-1?Q?Caf=E9_cr=E8me?=", want: "Café crème", wantOK: true},
+		{name: "ISO-8859-1 base64", subject: "=?iso-8859-1?B?R3Lf?=", want: "Grß", wantOK: true},
+		{name: "Windows-1252", subject: "=?windows-1252?Q?=80_price?=", want: "€ price", wantOK: true},
+		{name: "KOI8-R with plain text", subject: "Re: =?KOI8-R?B?8NLJ18XU?=", want: "Re: Привет", wantOK: true},
+		{name: "Shift_JIS", subject: "=?Shift_JIS?B?k/qWe4zq?=", want: "日本語", wantOK: true},
+		{name: "already UTF-8", subject: "=?UTF-8?Q?Caf=C3=A9?=", want: "=?UTF-8?Q?Caf=C3=A9?="},
+		{name: "plain", subject: "Hello", want: "Hello"},
+		{name: "unknown charset", subject: "=?x-unknown?Q?abc?=", want: "=?x-unknown?Q?abc?="},
+		{name: "malformed", subject: "=?ISO-8859-1?B?!!!?=", want: "=?ISO-8859-1?B?!!!?="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := transcodeSubject(tt.subject)
+			if ok != tt.wantOK {
+				t.Fatalf("transcodeSubject(%q) ok = %v, want %v", tt.subject, ok, tt.wantOK)
+			}
+			if !ok {
+				if got != tt.subject {
+					t.Fatalf("transcodeSubject(%q) = %q, want it unchanged", tt.subject, got)
+				}
+				return
+			}
+			if !strings.Contains(strings.ToLower(got), "=?utf-8?") {
+				t.Fatalf("transcodeSubject(%q) = %q, want UTF-8 encoded words", tt.subject, got)
+			}
+			decoded, err := new(mime.WordDecoder).DecodeHeader(got)
+			if err != nil {
+				t.Fatalf("DecodeHeader(%q) error: %v", got, err)
+			}
+			if decoded != tt.want {
+				t.Fatalf("transcodeSubject(%q) decodes to %q, want %q", tt.subject, decoded, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionDataTranscodeSubject(t *testing.T) {
+	h := &encodingHandler{}
+	session := newTestSessionWithT(t)
+	session.config.TranscodeSubject = true
+	session.handler = h
+	session.auth = true
+	_ = session.Mail("sender@example.com", nil)
+	_ = session.Rcpt("recipient@example.com", nil)
+	if err := session.Data(strings.NewReader("To: recipient@example.com\r\nSubject: =?ISO-8859-1?Q?Caf=E9?=\r\n\r\nHello\r\n")); err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+	if want := "Subject: =?utf-8?q?Caf=C3=A9?=\r\n"; !strings.Contains(string(h.encoded), want) {
+		t.Fatalf("encoded message = %q, want it to contain %q", h.encoded, want)
+	}
+}
+
+func TestIdempotencyHeaderStableAcrossRetries(t *testing.T) {
+	var bodies []string
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+	h := newTestGraphHandler(srv, 3)
+	h.token = "token"
+	h.tokenExp = time.Now().Add(time.Hour).Unix()
+
+	raw := "Message-ID: <1234@example.com>\r\nSubject: Test\r\n\r\nHello\r\n"
+	// The first submission is retried by the handler; the second is a resubmission by the client.
+	for range 2 {
+		session := newTestSessionWithT(t)
+		session.config.IdempotencyHeader = "x-idempotency-key"
+		session.handler = h
+		session.auth = true
+		_ = session.Mail("sender@example.com", nil)
+		_ = session.Rcpt("recipient@example.com", nil)
+		if err := session.Data(strings.NewReader(raw)); err != nil {
+			t.Fatalf("Data() error: %v", err)
+		}
+	}
+
+	if len(bodies) != 3 {
+		t.Fatalf("requests = %d, want 3", len(bodies))
+	}
+	want := "X-Idempotency-Key: " + idempotencyKey("<1234@example.com>") + "\r\n"
+	for i, body := range bodies {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			t.Fatalf("request %d: DecodeString() error: %v", i+1, err)
+		}
+		if !strings.Contains(string(decoded), want) {
+			t.Fatalf("request %d: message = %q, want header %q", i+1, decoded, want)
+		}
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	a := idempotencyKey("<1234@example.com>")
+	if len(a) != 32 || a != idempotencyKey(" <1234@example.com> ") {
+		t.Fatalf("idempotencyKey() = %q, want a stable 32 character key", a)
+	}
+	if a == idempotencyKey("<5678@example.com>") {
+		t.Fatal("idempotencyKey() is the same for different Message-IDs")
+	}
+	if got := idempotencyKey(""); got != "" {
+		t.Fatalf("idempotencyKey(\"\") = %q, want none", got)
+	}
+}
+
+func TestStripBOM(t *testing.T) {
+	const bom = "\xef\xbb\xbf"
+	binary := base64.StdEncoding.EncodeToString([]byte(bom + "\x00\x01binary"))
+	tests := []struct {
+		name   string
+		header string
+		body   string
+		want   string
+	}{
+		{name: "plain text", header: "Content-Type: text/plain; charset=utf-8\r\n", body: bom + "Hello\r\n", want: "Hello\r\n"},
+		{name: "no content type", body: bom + "Hello\r\n", want: "Hello\r\n"},
+		{name: "no bom", header: "Content-Type: text/plain\r\n", body: "Hello\r\n", want: "Hello\r\n"},
+		{name: "bom later in text", header: "Content-Type: text/plain\r\n", body: "Hello " + bom + "\r\n", want: "Hello " + bom + "\r\n"},
+		{name: "quoted-printable", header: "Content-Type: text/html\r\nContent-Transfer-Encoding: quoted-printable\r\n", body: "=ef=bb=bf<p>Hello</p>\r\n", want: "<p>Hello</p>\r\n"},
+		{
+			name:   "base64",
+			header: "Content-Type: text/plain\r\nContent-Transfer-Encoding: base64\r\n",
+			body:   base64.StdEncoding.EncodeToString([]byte(bom+"Hello")) + "\r\n",
+			want:   base64.StdEncoding.EncodeToString([]byte("Hello")),
+		},
+		{name: "binary body", header: "Content-Type: application/octet-stream\r\n", body: bom + "\x00\x01", want: bom + "\x00\x01"},
+		{name: "text attachment", header: "Content-Type: text/csv\r\nContent-Disposition: attachment; filename=\"a.csv\"\r\n", body: bom + "a,b\r\n", want: bom + "a,b\r\n"},
+		{
+			name:   "multipart",
+			header: "Content-Type: multipart/mixed; boundary=\"b1\"\r\n",
+			body: "preamble\r\n" +
+				"--b1\r\n" +
+				"Content-Type: multipart/alternative; boundary=b2\r\n" +
+				"\r\n" +
+				"--b2\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				bom + "Hello\r\n" +
+				"--b2\r\n" +
+				"Content-Type: text/html; charset=utf-8\r\n" +
+				"\r\n" +
+				bom + "<p>Hello</p>\r\n" +
+				"--b2--\r\n" +
+				"--b1\r\n" +
+				"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				binary + "\r\n" +
+				"--b1\r\n" +
+				"Content-Type: application/octet-stream\r\n" +
+				"\r\n" +
+				bom + "\x00raw\r\n" +
+				"--b1--\r\n" +
+				"epilogue " + bom + "\r\n",
+			want: "preamble\r\n" +
+				"--b1\r\n" +
+				"Content-Type: multipart/alternative; boundary=b2\r\n" +
+				"\r\n" +
+				"--b2\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				"Hello\r\n" +
+				"--b2\r\n" +
+				"Content-Type: text/html; charset=utf-8\r\n" +
+				"\r\n" +
+				"<p>Hello</p>\r\n" +
+				"--b2--\r\n" +
+				"--b1\r\n" +
+				"Content-Type: application/octet-stream; name=\"data.bin\"\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				binary + "\r\n" +
+				"--b1\r\n" +
+				"Content-Type: application/octet-stream\r\n" +
+				"\r\n" +
+				bom + "\x00raw\r\n" +
+				"--b1--\r\n" +
+				"epilogue " + bom + "\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := parseMessage([]byte("To: recipient@example.com\r\n"+tt.header+"\r\n"+tt.body), nil, nil)
+			if err != nil {
+				t.Fatalf("parseMessage() error: %v", err)
+			}
+			changed, err := stripMessageBOM(msg)
+			if err != nil {
+				t.Fatalf("stripMessageBOM() error: %v", err)
+			}
+			body, err := io.ReadAll(msg.Body)
+			if err != nil {
+				t.Fatalf("ReadAll() error: %v", err)
+			}
+			if string(body) != tt.want {
+				t.Fatalf("body = %q, want %q", body, tt.want)
+			}
+			if wantChanged := tt.want != tt.body; changed != wantChanged {
+				t.Fatalf("stripMessageBOM() = %v, want %v", changed, wantChanged)
+			}
+		})
+	}
+}
+
+func TestSessionDataStripBOM(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		h := &encodingHandler{}
+		session := newTestSessionWithT(t)
+		session.config.StripBOM = enabled
+		session.handler = h
+		session.auth = true
+		_ = session.Mail("sender@example.com", nil)
+		_ = session.Rcpt("recipient@example.com", nil)
+		if err := session.Data(strings.NewReader("To: recipient@example.com\r\nSubject: Test\r\n\r\n\xef\xbb\xbfHello\r\n")); err != nil {
+			t.Fatalf("Data() error: %v", err)
+		}
+		if got := bytes.Contains(h.encoded, []byte("\xef\xbb\xbf")); got == enabled {
+			t.Fatalf("STRIP_BOM=%v: relayed message contains byte order mark = %v\n%q", enabled, got, h.encoded)
+		}
+	}
+}
+
+func TestEncodeBase64(t *testing.T) {
+	data := []byte(strings.Repeat("0123456789", 23)) // 230 bytes, 308 base64 characters
+
+	tests := []struct {
+		lineLength int
+		wantLines  int
+	}{
+		{lineLength: 0, wantLines: 1},
+		{lineLength: 76, wantLines: 5},
+		{lineLength: 8, wantLines: 39},
+		{lineLength: 308, wantLines: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.lineLength), func(t *testing.T) {
+			encoded := encodeBase64(data, tt.lineLength)
+			if got, want := len(encoded), base64EncodedLen(len(data), tt.lineLength); got != want {
+				t.Errorf("len = %d, base64EncodedLen = %d", got, want)
+			}
+			lines := strings.Split(string(encoded), "\r\n")
+			if len(lines) != tt.wantLines {
+				t.Fatalf("lines = %d, want %d:\n%s", len(lines), tt.wantLines, encoded)
+			}
+			for i, line := range lines[:len(lines)-1] {
+				if len(line) != tt.lineLength {
+					t.Errorf("line %d length = %d, want %d", i+1, len(line), tt.lineLength)
+				}
+			}
+			if last := lines[len(lines)-1]; tt.lineLength > 0 && (len(last) == 0 || len(last) > tt.lineLength) {
+				t.Errorf("last line length = %d, want 1 to %d", len(last), tt.lineLength)
+			}
+			decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+			if err != nil || !bytes.Equal(decoded, data) {
+				t.Fatalf("decoded = %q, %v, want %q", decoded, err, data)
+			}
+		})
+	}
+}
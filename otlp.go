@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpExporter exports spans to an OTLP/HTTP collector as protobuf. It takes the place of the
+// otlptracehttp exporter, which pulls in the gRPC modules although only HTTP is used.
+type otlpExporter struct {
+	client  *http.Client
+	url     string            // the traces endpoint, ending in /v1/traces
+	headers map[string]string // from OTEL_EXPORTER_OTLP_HEADERS
+}
+
+// newOTLPExporter returns an exporter sending spans to the OTLP/HTTP collector at endpoint, the
+// base URL from OTEL_EXPORTER_OTLP_ENDPOINT.
+func newOTLPExporter(endpoint string, headers map[string]string) *otlpExporter {
+	return &otlpExporter{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers: headers,
+	}
+}
+
+// ExportSpans sends spans in a single request and returns an error if the collector does not
+// accept them.
+func (e *otlpExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+	// An ExportTraceServiceRequest has the same encoding as TracesData, whose package does not
+	// depend on gRPC.
+	body, err := proto.Marshal(&tracepb.TracesData{ResourceSpans: otlpResourceSpans(spans)})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for key, val := range e.headers {
+		req.Header.Set(key, val)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("OTLP export to %s returned %s", e.url, resp.Status)
+	}
+	return nil
+}
+
+// Shutdown does nothing; the exporter holds no state to flush.
+func (e *otlpExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+// parseOTLPHeaders parses OTEL_EXPORTER_OTLP_HEADERS, a comma-separated list of key=value pairs
+// whose values are URL-encoded.
+func parseOTLPHeaders(val string) (map[string]string, error) {
+	if strings.TrimSpace(val) == "" {
+		return nil, nil
+	}
+	headers := make(map[string]string)
+	for pair := range strings.SplitSeq(val, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS must be a comma-separated list of key=value pairs")
+		}
+		value, err := url.PathUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("OTEL_EXPORTER_OTLP_HEADERS: %s: %w", key, err)
+		}
+		headers[key] = value
+	}
+	return headers, nil
+}
+
+// otlpResourceSpans groups spans by resource and instrumentation scope.
+func otlpResourceSpans(spans []sdktrace.ReadOnlySpan) []*tracepb.ResourceSpans {
+	var out []*tracepb.ResourceSpans
+	resources := make(map[attribute.Distinct]*tracepb.ResourceSpans)
+	type scopeKey struct {
+		resource      attribute.Distinct
+		name, version string
+	}
+	scopes := make(map[scopeKey]*tracepb.ScopeSpans)
+	for _, span := range spans {
+		res := span.Resource()
+		rs, ok := resources[res.Equivalent()]
+		if !ok {
+			rs = &tracepb.ResourceSpans{
+				Resource:  &resourcepb.Resource{Attributes: otlpAttributes(res.Attributes())},
+				SchemaUrl: res.SchemaURL(),
+			}
+			resources[res.Equivalent()] = rs
+			out = append(out, rs)
+		}
+		scope := span.InstrumentationScope()
+		key := scopeKey{resource: res.Equivalent(), name: scope.Name, version: scope.Version}
+		ss, ok := scopes[key]
+		if !ok {
+			ss = &tracepb.ScopeSpans{
+				Scope:     &commonpb.InstrumentationScope{Name: scope.Name, Version: scope.Version},
+				SchemaUrl: scope.SchemaURL,
+			}
+			scopes[key] = ss
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+		ss.Spans = append(ss.Spans, otlpSpan(span))
+	}
+	return out
+}
+
+// otlpSpan returns the OTLP form of span.
+func otlpSpan(span sdktrace.ReadOnlySpan) *tracepb.Span {
+	sc := span.SpanContext()
+	traceID, spanID := sc.TraceID(), sc.SpanID()
+	s := &tracepb.Span{
+		TraceId:                traceID[:],
+		SpanId:                 spanID[:],
+		TraceState:             sc.TraceState().String(),
+		Name:                   span.Name(),
+		Kind:                   otlpSpanKind(span.SpanKind()),
+		StartTimeUnixNano:      uint64(span.StartTime().UnixNano()),
+		EndTimeUnixNano:        uint64(span.EndTime().UnixNano()),
+		Attributes:             otlpAttributes(span.Attributes()),
+		DroppedAttributesCount: uint32(span.DroppedAttributes()),
+		DroppedEventsCount:     uint32(span.DroppedEvents()),
+		DroppedLinksCount:      uint32(span.DroppedLinks()),
+		Status:                 &tracepb.Status{Message: span.Status().Description},
+	}
+	if parent := span.Parent(); parent.SpanID().IsValid() {
+		parentID := parent.SpanID()
+		s.ParentSpanId = parentID[:]
+	}
+	switch span.Status().Code {
+	case codes.Ok:
+		s.Status.Code = tracepb.Status_STATUS_CODE_OK
+	case codes.Error:
+		s.Status.Code = tracepb.Status_STATUS_CODE_ERROR
+	}
+	for _, event := range span.Events() {
+		s.Events = append(s.Events, &tracepb.Span_Event{
+			TimeUnixNano:           uint64(event.Time.UnixNano()),
+			Name:                   event.Name,
+			Attributes:             otlpAttributes(event.Attributes),
+			DroppedAttributesCount: uint32(event.DroppedAttributeCount),
+		})
+	}
+	for _, link := range span.Links() {
+		traceID, spanID := link.SpanContext.TraceID(), link.SpanContext.SpanID()
+		s.Links = append(s.Links, &tracepb.Span_Link{
+			TraceId:                traceID[:],
+			SpanId:                 spanID[:],
+			TraceState:             link.SpanContext.TraceState().String(),
+			Attributes:             otlpAttributes(link.Attributes),
+			DroppedAttributesCount: uint32(link.DroppedAttributeCount),
+		})
+	}
+	return s
+}
+
+// otlpSpanKind returns the OTLP form of kind.
+func otlpSpanKind(kind trace.SpanKind) tracepb.Span_SpanKind {
+	switch kind {
+	case trace.SpanKindInternal:
+		return tracepb.Span_SPAN_KIND_INTERNAL
+	case trace.SpanKindServer:
+		return tracepb.Span_SPAN_KIND_SERVER
+	case trace.SpanKindClient:
+		return tracepb.Span_SPAN_KIND_CLIENT
+	case trace.SpanKindProducer:
+		return tracepb.Span_SPAN_KIND_PRODUCER
+	case trace.SpanKindConsumer:
+		return tracepb.Span_SPAN_KIND_CONSUMER
+	default:
+		return tracepb.Span_SPAN_KIND_UNSPECIFIED
+	}
+}
+
+// otlpAttributes returns the OTLP form of attrs.
+func otlpAttributes(attrs []attribute.KeyValue) []*commonpb.KeyValue {
+	if len(attrs) == 0 {
+		return nil
+	}
+	out := make([]*commonpb.KeyValue, len(attrs))
+	for i, attr := range attrs {
+		out[i] = &commonpb.KeyValue{Key: string(attr.Key), Value: otlpValue(attr.Value)}
+	}
+	return out
+}
+
+// otlpValue returns the OTLP form of v.
+func otlpValue(v attribute.Value) *commonpb.AnyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_BoolValue{BoolValue: v.AsBool()}}
+	case attribute.INT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: v.AsInt64()}}
+	case attribute.FLOAT64:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_DoubleValue{DoubleValue: v.AsFloat64()}}
+	case attribute.BOOLSLICE:
+		return otlpArray(v.AsBoolSlice(), attribute.BoolValue)
+	case attribute.INT64SLICE:
+		return otlpArray(v.AsInt64Slice(), attribute.Int64Value)
+	case attribute.FLOAT64SLICE:
+		return otlpArray(v.AsFloat64Slice(), attribute.Float64Value)
+	case attribute.STRINGSLICE:
+		return otlpArray(v.AsStringSlice(), attribute.StringValue)
+	default:
+		return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v.Emit()}}
+	}
+}
+
+// otlpArray returns the OTLP array of the values in items.
+func otlpArray[T any](items []T, value func(T) attribute.Value) *commonpb.AnyValue {
+	values := make([]*commonpb.AnyValue, len(items))
+	for i, item := range items {
+		values[i] = otlpValue(value(item))
+	}
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_ArrayValue{ArrayValue: &commonpb.ArrayValue{Values: values}}}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// messageSizes is the size of the content of a message, split into its body and its attachments.
+// Sizes are counted in bytes as transmitted, with their transfer encoding, without part headers
+// and multipart delimiters.
+type messageSizes struct {
+	body        int
+	attachments int
+}
+
+// measureMessage returns the sizes of the body and attachments of msg, leaving its body to be
+// read again.
+func measureMessage(msg *mail.Message) (messageSizes, error) {
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return messageSizes{}, err
+	}
+	if rb, ok := msg.Body.(*rawBody); ok {
+		rb.Reader = bytes.NewReader(body)
+	} else {
+		msg.Body = bytes.NewReader(body)
+	}
+	var sizes messageSizes
+	sizes.add(textproto.MIMEHeader(msg.Header), body)
+	return sizes, nil
+}
+
+// add adds the content of an entity with header and body. The parts of a multipart entity are
+// added one by one, including those of nested multipart parts. Attachments are counted as such,
+// everything else, such as text and inline images, as body. A multipart entity that cannot be
+// parsed counts as body as a whole.
+func (s *messageSizes) add(header textproto.MIMEHeader, body []byte) {
+	mediaType, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && s.addParts(body, params["boundary"]) {
+		return
+	}
+	if isAttachment(header) {
+		s.attachments += len(body)
+	} else {
+		s.body += len(body)
+	}
+}
+
+// addParts adds each part of a multipart body with the given boundary. It reports false, adding
+// nothing, if the body is not valid multipart.
+func (s *messageSizes) addParts(body []byte, boundary string) bool {
+	var parts messageSizes
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false
+		}
+		raw, err := io.ReadAll(part)
+		if err != nil {
+			return false
+		}
+		parts.add(part.Header, raw)
+	}
+	s.body += parts.body
+	s.attachments += parts.attachments
+	return true
+}
+
+// isAttachment reports whether an entity is an attachment: it has the attachment disposition or,
+// as attachments from some clients only do, a file name.
+func isAttachment(header textproto.MIMEHeader) bool {
+	disposition, dparams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	_, cparams, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return disposition == "attachment" || dparams["filename"] != "" || cparams["name"] != ""
+}
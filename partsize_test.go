@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+// sizeTestMessage is a multipart/mixed message with a multipart/alternative body of a 5 byte
+// text part and a 9 byte HTML part, followed by a 12 byte attachment and an 8 byte part that is
+// only marked as an attachment by its name.
+const sizeTestMessage = "From: sender@example.com\r\n" +
+	"Content-Type: multipart/mixed; boundary=outer\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html\r\n" +
+	"\r\n" +
+	"<p>Hi</p>\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf\r\n" +
+	"Content-Disposition: attachment; filename=a.pdf\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--outer\r\n" +
+	"Content-Type: image/png; name=b.png\r\n" +
+	"\r\n" +
+	"PNG data\r\n" +
+	"--outer--\r\n"
+
+func TestMeasureMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+		want messageSizes
+	}{
+		{
+			name: "plain text",
+			raw:  "Subject: Test\r\n\r\nHello, world",
+			want: messageSizes{body: 12},
+		},
+		{
+			name: "single attachment",
+			raw:  "Content-Type: application/octet-stream\r\nContent-Disposition: attachment\r\n\r\nabcd",
+			want: messageSizes{attachments: 4},
+		},
+		{
+			name: "nested multipart",
+			raw:  sizeTestMessage,
+			want: messageSizes{body: 5 + 9, attachments: 12 + 8},
+		},
+		{
+			name: "invalid multipart counts as body",
+			raw:  "Content-Type: multipart/mixed; boundary=b\r\n\r\n--b\r\nno header end",
+			want: messageSizes{body: 18},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := readMessage([]byte(tt.raw), nil)
+			if err != nil {
+				t.Fatalf("readMessage() error: %v", err)
+			}
+			got, err := measureMessage(msg)
+			if err != nil {
+				t.Fatalf("measureMessage() error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("measureMessage() = %+v, want %+v", got, tt.want)
+			}
+			// The body can still be relayed.
+			body, err := io.ReadAll(msg.Body)
+			if err != nil || len(body) == 0 || !strings.HasSuffix(tt.raw, string(body)) {
+				t.Fatalf("body after measureMessage() = %q, %v, want the original body", body, err)
+			}
+		})
+	}
+}
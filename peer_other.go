@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// peerClosed always reports false: a closed connection is only detected on Unix.
+func peerClosed(conn net.Conn) bool {
+	return false
+}
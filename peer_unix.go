@@ -0,0 +1,31 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// peerClosed reports whether the client has closed or reset conn, without consuming anything it
+// sent. It reports false if that cannot be told, such as for a connection without a socket.
+func peerClosed(conn net.Conn) bool {
+	sc, ok := socketConn(conn).(syscall.Conn)
+	if !ok {
+		return false
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return false
+	}
+	closed := false
+	buf := make([]byte, 1)
+	err = raw.Read(func(fd uintptr) bool {
+		// The socket is non-blocking, so this fails with EAGAIN if there is nothing to read.
+		n, _, err := syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK)
+		closed = (n == 0 && err == nil) || errors.Is(err, syscall.ECONNRESET)
+		return true
+	})
+	return err == nil && closed
+}
@@ -0,0 +1,63 @@
+// Package main provides message priorities for smtp2graph.
+package main
+
+import (
+	"context"
+	"net/mail"
+	"strings"
+)
+
+// Messages waiting in the send queue or the spool are relayed in priority order, so that
+// transactional mail such as password resets is not stuck behind a backlog of bulk notifications.
+// The priority of a message is that of its sender account in SENDER_PRIORITY if set, or else
+// follows its X-Priority header.
+
+// Message priorities, in the order queued and spooled messages are relayed.
+const (
+	priorityHigh = iota
+	priorityNormal
+	priorityLow
+)
+
+// priorityNames are the SENDER_PRIORITY names of the priorities.
+var priorityNames = map[string]int{"high": priorityHigh, "normal": priorityNormal, "low": priorityLow}
+
+// headerPriority returns the priority given by the X-Priority header, such as "1 (Highest)":
+// high for 1 and 2, low for 4 and 5, and normal otherwise.
+func headerPriority(header mail.Header) int {
+	value := strings.TrimSpace(header.Get("X-Priority"))
+	if value == "" {
+		return priorityNormal
+	}
+	switch value[0] {
+	case '1', '2':
+		return priorityHigh
+	case '4', '5':
+		return priorityLow
+	}
+	return priorityNormal
+}
+
+// messagePriority returns the priority of a message from the authenticated sender user.
+func (c *appConfig) messagePriority(user string, header mail.Header) int {
+	if priority, ok := c.SenderPriorities[strings.ToLower(user)]; ok {
+		return priority
+	}
+	return headerPriority(header)
+}
+
+// priorityKey is the context key of the priority of the message being relayed.
+type priorityKey struct{}
+
+// withPriority returns a copy of ctx carrying the priority of the message being relayed.
+func withPriority(ctx context.Context, priority int) context.Context {
+	return context.WithValue(ctx, priorityKey{}, priority)
+}
+
+// contextPriority returns the priority of the message being relayed, normal if ctx has none.
+func contextPriority(ctx context.Context) int {
+	if priority, ok := ctx.Value(priorityKey{}).(int); ok {
+		return priority
+	}
+	return priorityNormal
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/mail"
+	"testing"
+)
+
+func TestMessagePriority(t *testing.T) {
+	cfg := &appConfig{SenderPriorities: map[string]int{"bulk@example.com": priorityLow}}
+
+	tests := []struct {
+		name      string
+		user      string
+		xPriority string
+		want      int
+	}{
+		{name: "no header", user: "app@example.com", want: priorityNormal},
+		{name: "highest", user: "app@example.com", xPriority: "1 (Highest)", want: priorityHigh},
+		{name: "high", user: "app@example.com", xPriority: "2", want: priorityHigh},
+		{name: "normal", user: "app@example.com", xPriority: "3 (Normal)", want: priorityNormal},
+		{name: "low", user: "app@example.com", xPriority: "4", want: priorityLow},
+		{name: "lowest", user: "app@example.com", xPriority: "5 (Lowest)", want: priorityLow},
+		{name: "invalid header", user: "app@example.com", xPriority: "urgent", want: priorityNormal},
+		{name: "sender priority", user: "Bulk@Example.com", want: priorityLow},
+		{name: "sender priority over header", user: "bulk@example.com", xPriority: "1", want: priorityLow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := mail.Header{}
+			if tt.xPriority != "" {
+				header["X-Priority"] = []string{tt.xPriority}
+			}
+			if got := cfg.messagePriority(tt.user, header); got != tt.want {
+				t.Fatalf("messagePriority(%q, X-Priority %q) = %d, want %d", tt.user, tt.xPriority, got, tt.want)
+			}
+		})
+	}
+}
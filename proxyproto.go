@@ -0,0 +1,174 @@
+// Package main provides PROXY protocol support for the SMTP listeners of smtp2graph.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Connections accepted through a TCP load balancer all come from the load balancer. With
+// ENABLE_PROXY_PROTOCOL, each connection must start with a PROXY protocol header, version 1
+// (text) or 2 (binary), from which the client address is taken. A connection without a valid
+// header is closed, since accepting it would attribute its traffic to the load balancer.
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt.
+
+// proxyV2Signature starts every PROXY protocol version 2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the maximum length of a version 1 header, including CRLF.
+const proxyV1MaxLength = 107
+
+// proxyListener accepts connections that start with a PROXY protocol header.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn reads the PROXY protocol header of a connection on first use, from the first Read or
+// RemoteAddr, so that Accept does not wait for it. The header is read under the read deadline
+// go-smtp sets before reading the first command.
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr // client address from the header, nil to keep the connection's own
+	err    error
+}
+
+// readHeader reads the PROXY protocol header once, closing the connection if it is invalid.
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		c.remote, c.err = readProxyHeader(c.r)
+		if c.err != nil {
+			log.Printf("Closing connection from %s: invalid PROXY protocol header: %v", c.Conn.RemoteAddr(), c.err)
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(p)
+}
+
+// RemoteAddr returns the client address from the PROXY protocol header, or the address of the
+// peer if the header carries none.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a PROXY protocol version 1 or 2 header from r and returns the source
+// address it carries. The address is nil for a header that does not carry one: a version 1
+// UNKNOWN header, a version 2 LOCAL command such as a health check, or an address family other
+// than TCP over IPv4 or IPv6.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	switch {
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r)
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	case err != nil:
+		return nil, err
+	}
+	return nil, errors.New("missing header")
+}
+
+// readProxyV1 reads a version 1 header such as "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	text, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return nil, errors.New("version 1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Split(text, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed version 1 header %q", text)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || net.ParseIP(fields[3]) == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid addresses in version 1 header %q", text)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil || fields[4] != strconv.FormatUint(port, 10) {
+		return nil, fmt.Errorf("invalid source port in version 1 header %q", text)
+	}
+	if _, err := strconv.ParseUint(fields[5], 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid destination port in version 1 header %q", text)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a version 2 header: the signature, version and command, address family and
+// protocol, the length of the rest, then the addresses and any TLVs, which are ignored.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var fixed [16]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	verCmd, family := fixed[12], fixed[13]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", verCmd>>4)
+	}
+	rest := make([]byte, binary.BigEndian.Uint16(fixed[14:]))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	switch verCmd & 0xf {
+	case 0x0: // LOCAL: the connection was made by the proxy itself
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported command %d", verCmd&0xf)
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(rest) < 12 {
+			return nil, errors.New("version 2 IPv4 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(rest[0:4]), Port: int(binary.BigEndian.Uint16(rest[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(rest) < 36 {
+			return nil, errors.New("version 2 IPv6 addresses truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(rest[0:16]), Port: int(binary.BigEndian.Uint16(rest[32:34]))}, nil
+	}
+	return nil, nil
+}
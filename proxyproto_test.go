@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header returns a version 2 header with the given version and command byte, address
+// family and address block.
+func proxyV2Header(verCmd, family byte, addrs []byte) string {
+	h := append([]byte(nil), proxyV2Signature...)
+	h = append(h, verCmd, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(addrs)))
+	return string(append(h, addrs...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0, 25}
+	ipv6 := make([]byte, 36)
+	copy(ipv6, net.ParseIP("2001:db8::1"))
+	copy(ipv6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(ipv6[32:], 56324)
+	binary.BigEndian.PutUint16(ipv6[34:], 25)
+
+	tests := []struct {
+		name       string
+		input      string
+		wantRemote string // "" for no address
+		wantErr    bool
+	}{
+		{name: "v1 TCP4", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\n", wantRemote: "192.0.2.1:56324"},
+		{name: "v1 TCP6", input: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 25\r\n", wantRemote: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", input: "PROXY UNKNOWN\r\n"},
+		{name: "v1 UNKNOWN with addresses", input: "PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n"},
+		{name: "v2 TCP4", input: proxyV2Header(0x21, 0x11, ipv4), wantRemote: "192.0.2.1:56324"},
+		{name: "v2 TCP6", input: proxyV2Header(0x21, 0x21, ipv6), wantRemote: "[2001:db8::1]:56324"},
+		{name: "v2 TCP4 with TLVs", input: proxyV2Header(0x21, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0x00)), wantRemote: "192.0.2.1:56324"},
+		{name: "v2 LOCAL", input: proxyV2Header(0x20, 0x00, nil)},
+		{name: "v2 UNIX", input: proxyV2Header(0x21, 0x31, make([]byte, 216))},
+		{name: "missing header", input: "EHLO client.example.com\r\n", wantErr: true},
+		{name: "v1 invalid address", input: "PROXY TCP4 192.0.2 198.51.100.1 56324 25\r\n", wantErr: true},
+		{name: "v1 family mismatch", input: "PROXY TCP4 2001:db8::1 2001:db8::2 56324 25\r\n", wantErr: true},
+		{name: "v1 invalid port", input: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 25\r\n", wantErr: true},
+		{name: "v1 missing field", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", wantErr: true},
+		{name: "v1 without CRLF", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\n", wantErr: true},
+		{name: "v1 too long", input: "PROXY UNKNOWN " + strings.Repeat("x", 100) + "\r\n", wantErr: true},
+		{name: "v2 bad version", input: proxyV2Header(0x11, 0x11, ipv4), wantErr: true},
+		{name: "v2 bad command", input: proxyV2Header(0x22, 0x11, ipv4), wantErr: true},
+		{name: "v2 truncated addresses", input: proxyV2Header(0x21, 0x11, ipv4[:8]), wantErr: true},
+		{name: "v2 truncated header", input: proxyV2Header(0x21, 0x11, ipv4)[:20], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := tt.input
+			if !tt.wantErr {
+				input += "EHLO client.example.com\r\n"
+			}
+			r := bufio.NewReader(strings.NewReader(input))
+			remote, err := readProxyHeader(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readProxyHeader() = %v, want error", remote)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader() error: %v", err)
+			}
+			got := ""
+			if remote != nil {
+				got = remote.String()
+			}
+			if got != tt.wantRemote {
+				t.Fatalf("readProxyHeader() = %q, want %q", got, tt.wantRemote)
+			}
+			if rest, _ := io.ReadAll(r); string(rest) != "EHLO client.example.com\r\n" {
+				t.Fatalf("data after header = %q, want the first command", rest)
+			}
+		})
+	}
+}
+
+func TestProxyListener(t *testing.T) {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	ln := &proxyListener{Listener: tcp}
+	defer ln.Close()
+
+	tests := []struct {
+		name       string
+		input      string
+		wantRemote string
+		wantData   string
+	}{
+		{name: "valid header", input: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 25\r\nEHLO x\r\n", wantRemote: "192.0.2.1:56324", wantData: "EHLO x\r\n"},
+		{name: "malformed header", input: "PROXY TCP4 nonsense\r\nEHLO x\r\n"},
+		{name: "no header", input: "EHLO client.example.com\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", tcp.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial() error: %v", err)
+			}
+			defer client.Close()
+			if _, err := client.Write([]byte(tt.input)); err != nil {
+				t.Fatalf("Write() error: %v", err)
+			}
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("Accept() error: %v", err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if tt.wantRemote == "" {
+				if err == nil {
+					t.Fatalf("Read() = %q, want error for %s", buf[:n], tt.name)
+				}
+				// The connection is closed rather than served.
+				client.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := client.Read(buf); err != io.EOF {
+					t.Fatalf("client Read() error = %v, want EOF", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read() error: %v", err)
+			}
+			if got := string(buf[:n]); got != tt.wantData {
+				t.Fatalf("Read() = %q, want %q", got, tt.wantData)
+			}
+			if got := conn.RemoteAddr().String(); got != tt.wantRemote {
+				t.Fatalf("RemoteAddr() = %q, want %q", got, tt.wantRemote)
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token-bucket rate limiter keyed by address, used per authenticated sender
+// and per recipient. Each key may burst up to perMinute messages, and its bucket refills at
+// perMinute messages per minute. It is safe for concurrent use and shared by all sessions of
+// a backend.
+type rateLimiter struct {
+	perMinute int
+	now       func() time.Time // clock, for tests (default: time.Now)
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time // when buckets was last swept of full buckets
+}
+
+// tokenBucket holds the remaining tokens of one key as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing perMinute messages per key, or nil if
+// perMinute is not positive. A nil limiter allows every message.
+func newRateLimiter(perMinute int) *rateLimiter {
+	if perMinute <= 0 {
+		return nil
+	}
+	return &rateLimiter{perMinute: perMinute, buckets: make(map[string]*tokenBucket)}
+}
+
+// allow takes a token from key's bucket and reports whether one was available.
+func (l *rateLimiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.bucket(key)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// available reports whether key's bucket has a token, without taking it.
+func (l *rateLimiter) available(key string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.bucket(key).tokens >= 1
+}
+
+// charge takes a token from key's bucket for a message accepted after available reported one.
+// Other sessions may have taken it in the meantime, so the bucket can go into debt, which delays
+// the next message to key.
+func (l *rateLimiter) charge(key string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bucket(key).tokens--
+}
+
+// bucket returns key's bucket, refilled for the time since it was last used. The caller must hold l.mu.
+func (l *rateLimiter) bucket(key string) *tokenBucket {
+	now := time.Now()
+	if l.now != nil {
+		now = l.now()
+	}
+	if now.Sub(l.swept) >= time.Minute {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.perMinute), last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = min(float64(l.perMinute), b.tokens+elapsed.Minutes()*float64(l.perMinute))
+		b.last = now
+	}
+	return b
+}
+
+// sweep removes the buckets that have refilled by now. A full bucket behaves like a missing one,
+// so this only bounds the memory used for keys that are no longer sending. The caller must hold l.mu.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Minutes()*float64(l.perMinute) >= float64(l.perMinute) {
+			delete(l.buckets, key)
+		}
+	}
+	l.swept = now
+}
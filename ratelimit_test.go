@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestSenderRateLimiterRefill(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2)
+	l.now = func() time.Time { return now }
+
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow("a@example.com"); got != want {
+			t.Fatalf("allow() #%d = %v, want %v", i+1, got, want)
+		}
+	}
+	if !l.allow("b@example.com") {
+		t.Fatal("allow() for another sender = false, want separate bucket")
+	}
+	now = now.Add(30 * time.Second) // refills one token
+	if !l.allow("a@example.com") {
+		t.Fatal("allow() after refill = false, want true")
+	}
+	if l.allow("a@example.com") {
+		t.Fatal("allow() after refill = true, want a single refilled token")
+	}
+}
+
+func TestRateLimiterEvictsIdleBuckets(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l := newRateLimiter(2)
+	l.now = func() time.Time { return now }
+
+	l.allow("idle@example.com")
+	l.charge("busy@example.com")
+	l.charge("busy@example.com")
+	l.charge("busy@example.com") // one token in debt: full again only after 90 seconds
+
+	now = now.Add(time.Minute)
+	l.allow("new@example.com")
+	if _, ok := l.buckets["idle@example.com"]; ok {
+		t.Fatal("refilled bucket not evicted")
+	}
+	if _, ok := l.buckets["busy@example.com"]; !ok {
+		t.Fatal("bucket still refilling was evicted")
+	}
+}
+
+func TestSenderRateLimiterDisabled(t *testing.T) {
+	l := newRateLimiter(0)
+	for range 100 {
+		if !l.allow("a@example.com") {
+			t.Fatal("allow() = false with rate limiting disabled")
+		}
+	}
+}
+
+func TestSessionDataRateLimited(t *testing.T) {
+	limiter := newRateLimiter(3)
+	send := func() error {
+		session := newTestSessionWithT(t)
+		session.limiter = limiter
+		session.auth = true
+		session.user = "sender@example.com"
+		_ = session.Mail("sender@example.com", nil)
+		_ = session.Rcpt("recipient@example.com", nil)
+		return session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+	}
+
+	for i := range 3 {
+		if err := send(); err != nil {
+			t.Fatalf("Data() #%d error: %v", i+1, err)
+		}
+	}
+	err := send()
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 450 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 7, 1}) {
+		t.Fatalf("Data() error = %v, want 450 4.7.1", err)
+	}
+}
+
+func TestSessionDataConnectionRateLimited(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	session := newTestSessionWithT(t)
+	session.connRate = newRateLimiter(3)
+	session.connRate.now = func() time.Time { return now }
+	session.auth = true
+	session.user = "sender@example.com"
+	send := func() error {
+		session.Reset()
+		_ = session.Mail("sender@example.com", nil)
+		_ = session.Rcpt("recipient@example.com", nil)
+		return session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+	}
+
+	for i := range 3 {
+		if err := send(); err != nil {
+			t.Fatalf("Data() #%d error: %v", i+1, err)
+		}
+	}
+	for range 2 {
+		err := send()
+		var smtpErr *smtp.SMTPError
+		if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 7, 1}) {
+			t.Fatalf("Data() error = %v, want 451 4.7.1", err)
+		}
+	}
+
+	// Another connection of the same sender has its own limit.
+	other := newTestSessionWithT(t)
+	other.connRate = newRateLimiter(3)
+	other.auth = true
+	other.user = "sender@example.com"
+	_ = other.Mail("sender@example.com", nil)
+	_ = other.Rcpt("recipient@example.com", nil)
+	if err := other.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatalf("Data() on another connection error: %v", err)
+	}
+
+	now = now.Add(20 * time.Second)
+	if err := send(); err != nil {
+		t.Fatalf("Data() after the bucket refilled error: %v", err)
+	}
+}
+
+func TestSessionRcptRateLimited(t *testing.T) {
+	limiter := newRateLimiter(2)
+	newSession := func() *smtpSession {
+		session := newTestSessionWithT(t)
+		session.rcptLimiter = limiter
+		session.auth = true
+		_ = session.Mail("sender@example.com", nil)
+		return session
+	}
+	rcpt := func(to string) error {
+		return newSession().Rcpt(to, nil)
+	}
+
+	// A transaction that is reset before DATA does not use up the recipient's tokens.
+	for range 3 {
+		session := newSession()
+		if err := session.Rcpt("loop@example.com", nil); err != nil {
+			t.Fatalf("Rcpt() before reset error: %v", err)
+		}
+		session.Reset()
+	}
+
+	for i := range 2 {
+		session := newSession()
+		if err := session.Rcpt("loop@example.com", nil); err != nil {
+			t.Fatalf("Rcpt() #%d error: %v", i+1, err)
+		}
+		if err := session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n")); err != nil {
+			t.Fatalf("Data() #%d error: %v", i+1, err)
+		}
+	}
+	err := rcpt("LOOP@example.com")
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 450 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 7, 1}) {
+		t.Fatalf("Rcpt() error = %v, want 450 4.7.1", err)
+	}
+	if err := rcpt("other@example.com"); err != nil {
+		t.Fatalf("Rcpt() for another recipient error: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+// Package main provides the -replay recovery command for smtp2graph.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// spoolSentExt is the extension replayed messages are kept under unless removed, so that neither
+// the spool nor a later replay sends them again.
+const spoolSentExt = ".sent"
+
+// runReplay re-attempts delivery of the spooled and given-up messages in dir through h, for
+// instance after a configuration problem has been fixed. Each message is reported to out.
+// Relayed messages are deleted if remove is set, and otherwise renamed to spoolSentExt.
+// Messages locked by a running spool worker are skipped. An error is returned if any message
+// could not be relayed.
+func runReplay(ctx context.Context, dir string, h messageHandler, remove bool, out io.Writer) error {
+	var paths []string
+	for _, ext := range []string{spoolExt, spoolFailedExt} {
+		matches, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, matches...)
+	}
+	sort.Strings(paths)
+
+	failed := 0
+	for _, path := range paths {
+		name := filepath.Base(path)
+		sent, err := replayFile(ctx, path, h, remove)
+		switch {
+		case err != nil:
+			failed++
+			fmt.Fprintf(out, "fail: %s: %v\n", name, err)
+		case !sent:
+			fmt.Fprintf(out, "skip: %s: locked by a running spool\n", name)
+		default:
+			fmt.Fprintf(out, "ok: %s\n", name)
+		}
+	}
+	fmt.Fprintf(out, "%d of %d message(s) replayed\n", len(paths)-failed, len(paths))
+	if failed > 0 {
+		return fmt.Errorf("%d message(s) could not be replayed", failed)
+	}
+	return nil
+}
+
+// replayFile relays the message stored at path and deletes or renames the file once relayed.
+// It reports false without error if the file is locked or gone.
+func replayFile(ctx context.Context, path string, h messageHandler, remove bool) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if locked, err := lockFile(f); err != nil || !locked {
+		return false, err
+	}
+	if !sameFile(f, path) {
+		return false, nil
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return false, err
+	}
+	var m spooledMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return false, fmt.Errorf("decode: %w", err)
+	}
+	msg, err := rawMessage(m.Message)
+	if err != nil {
+		return false, err
+	}
+	if err := h.handleMessage(ctx, m.Sender, msg); err != nil {
+		return false, err
+	}
+
+	if remove {
+		return true, os.Remove(path)
+	}
+	sent := strings.TrimSuffix(strings.TrimSuffix(path, spoolExt), spoolFailedExt) + spoolSentExt
+	return true, os.Rename(path, sent)
+}
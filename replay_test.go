@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunReplay(t *testing.T) {
+	tests := []struct {
+		name       string
+		remove     bool
+		errs       []error
+		wantErr    bool
+		wantOutput []string
+		wantFiles  []string
+	}{
+		{
+			name:       "keep relayed messages",
+			wantOutput: []string{"ok: 1-a.json", "ok: 2-b.failed", "fail: 3-c.json: decode:", "2 of 3 message(s) replayed"},
+			wantFiles:  []string{"1-a.sent", "2-b.sent", "3-c.json"},
+			wantErr:    true,
+		},
+		{
+			name:       "remove relayed messages",
+			remove:     true,
+			wantOutput: []string{"ok: 1-a.json", "ok: 2-b.failed"},
+			wantFiles:  []string{"3-c.json"},
+			wantErr:    true,
+		},
+		{
+			name:       "relay failure",
+			remove:     true,
+			errs:       []error{errors.New("sendMail failed: 403 Forbidden")},
+			wantOutput: []string{"fail: 1-a.json: sendMail failed: 403 Forbidden", "ok: 2-b.failed", "1 of 3 message(s) replayed"},
+			wantFiles:  []string{"1-a.json", "3-c.json"},
+			wantErr:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			sp := &spool{dir: dir}
+			for _, name := range []string{"1-a.json", "2-b.failed"} {
+				m := &spooledMessage{Sender: "mailbox@example.com", Attempts: 3, Message: []byte(spoolTestMessage)}
+				if err := sp.write(filepath.Join(dir, name), m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(dir, "3-c.json"), []byte("{"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			next := &recordingHandler{errs: tt.errs}
+			var out bytes.Buffer
+			err := runReplay(context.Background(), dir, next, tt.remove, &out)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("runReplay() error = %v, want error %v", err, tt.wantErr)
+			}
+			for _, want := range tt.wantOutput {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output = %q, want %q", out.String(), want)
+				}
+			}
+			for i, raw := range next.messages {
+				if raw != spoolTestMessage || next.senders[i] != "mailbox@example.com" {
+					t.Errorf("relay %d = %s %q, want the stored message", i+1, next.senders[i], raw)
+				}
+			}
+
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, e := range entries {
+				files = append(files, e.Name())
+			}
+			if got, want := strings.Join(files, ","), strings.Join(tt.wantFiles, ","); got != want {
+				t.Errorf("files = %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"sync/atomic"
+	"time"
+)
+
+// A delivery that fails before any request to send the message has been made to Graph is retried
+// within Session.Data up to TRANSACTION_RETRIES times, without involving the SMTP client. Only
+// failures to acquire a token qualify for now. Once the send has begun, a failure is never
+// retried here: Graph may already have accepted the message, and a retry could deliver it twice.
+
+// sendAttemptedKey is the context key of the flag set when a delivery starts sending to Graph.
+type sendAttemptedKey struct{}
+
+// withSendTracking returns a context whose handler marks the returned flag when it starts
+// sending the message to Graph.
+func withSendTracking(ctx context.Context) (context.Context, *atomic.Bool) {
+	attempted := &atomic.Bool{}
+	return context.WithValue(ctx, sendAttemptedKey{}, attempted), attempted
+}
+
+// markSendAttempted records on ctx that a request to send the message is about to be made.
+// It is a no-op if ctx does not track send attempts.
+func markSendAttempted(ctx context.Context) {
+	if attempted, ok := ctx.Value(sendAttemptedKey{}).(*atomic.Bool); ok {
+		attempted.Store(true)
+	}
+}
+
+// retryableBeforeSend reports whether err is a failure that may succeed when the delivery is
+// retried, provided that nothing was sent yet.
+func retryableBeforeSend(err error) bool {
+	var terr *tokenError
+	return errors.As(err, &terr)
+}
+
+// deliverWithRetry delivers msg from mailbox, retrying failures that happened before anything was sent to
+// Graph up to config.TransactionRetries times, config.TransactionRetryDelay apart.
+func (s *smtpSession) deliverWithRetry(ctx context.Context, mailbox string, msg *mail.Message) error {
+	deliver := func(ctx context.Context) error { return s.deliver(ctx, mailbox, msg) }
+	return retryBeforeSend(ctx, msg, s.config.TransactionRetries, s.config.TransactionRetryDelay, deliver, func(attempt int, err error) {
+		s.logf("Retrying delivery from %s (%d/%d) after it failed before sending: %v",
+			s.sender.Address, attempt, s.config.TransactionRetries, err)
+		s.trace.eventf("retry %d/%d after pre-send failure: %v", attempt, s.config.TransactionRetries, err)
+	})
+}
+
+// retryBeforeSend calls deliver for msg, retrying failures that happened before anything was sent
+// to Graph up to retries times, delay apart. onRetry is called before each retry.
+func retryBeforeSend(ctx context.Context, msg *mail.Message, retries int, delay time.Duration, deliver func(context.Context) error, onRetry func(attempt int, err error)) error {
+	if retries <= 0 {
+		return deliver(ctx)
+	}
+	rewind, err := replayableBody(msg)
+	if err != nil {
+		return fmt.Errorf("read body: %w", err)
+	}
+	for attempt := 1; ; attempt++ {
+		attemptCtx, attempted := withSendTracking(ctx)
+		err := deliver(attemptCtx)
+		if err == nil || attempted.Load() || !retryableBeforeSend(err) || attempt > retries {
+			return err
+		}
+		onRetry(attempt, err)
+		transactionRetries.Inc()
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		rewind()
+	}
+}
+
+// replayableBody buffers the body of msg and returns a function that restores it, so that msg
+// can be delivered again after a failed attempt consumed the body.
+func replayableBody(msg *mail.Message) (func(), error) {
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	rb, raw := msg.Body.(*rawBody)
+	rewind := func() {
+		if raw {
+			msg.Body = &rawBody{Reader: bytes.NewReader(body), header: rb.header}
+			return
+		}
+		msg.Body = bytes.NewReader(body)
+	}
+	rewind()
+	return rewind, nil
+}
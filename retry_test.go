@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/mail"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	azcore "github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	policy "github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// scriptedHandler fails the first len(errs) deliveries with errs, marking the send as begun
+// first for the attempts listed in sendBegun, and records the body of every attempt.
+type scriptedHandler struct {
+	errs      []error
+	sendBegun map[int]bool
+	bodies    []string
+}
+
+func (h *scriptedHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	attempt := len(h.bodies)
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return err
+	}
+	h.bodies = append(h.bodies, string(body))
+	if h.sendBegun[attempt] {
+		markSendAttempted(ctx)
+	}
+	if attempt < len(h.errs) {
+		return h.errs[attempt]
+	}
+	return nil
+}
+
+func TestSessionDataTransactionRetry(t *testing.T) {
+	errToken := &tokenError{err: errors.New("AADSTS7000215: connection reset")}
+	errGraph := &graphError{StatusCode: http.StatusInternalServerError, Status: "500 Internal Server Error"}
+	tests := []struct {
+		name      string
+		retries   int
+		errs      []error
+		sendBegun map[int]bool
+		wantCalls int
+		wantErr   bool
+	}{
+		{name: "token failure retried", retries: 2, errs: []error{errToken}, wantCalls: 2},
+		{name: "token failure exhausts retries", retries: 2, errs: []error{errToken, errToken, errToken}, wantCalls: 3, wantErr: true},
+		{name: "retries disabled", errs: []error{errToken}, wantCalls: 1, wantErr: true},
+		{name: "graph failure after send", retries: 2, errs: []error{errGraph}, sendBegun: map[int]bool{0: true}, wantCalls: 1, wantErr: true},
+		{name: "token failure after send began", retries: 2, errs: []error{errToken}, sendBegun: map[int]bool{0: true}, wantCalls: 1, wantErr: true},
+		{name: "permanent failure before send", retries: 2, errs: []error{errMessageTooLarge}, wantCalls: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &scriptedHandler{errs: tt.errs, sendBegun: tt.sendBegun}
+			session := newTestSessionWithT(t)
+			session.config.TransactionRetries = tt.retries
+			session.config.TransactionRetryDelay = time.Millisecond
+			session.handler = h
+			session.auth = true
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+
+			err := session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("Data() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(h.bodies) != tt.wantCalls {
+				t.Fatalf("deliveries = %d, want %d", len(h.bodies), tt.wantCalls)
+			}
+			for i, body := range h.bodies {
+				if body != "Hello\r\n" {
+					t.Errorf("delivery %d body = %q, want the full body", i+1, body)
+				}
+			}
+		})
+	}
+}
+
+// flakyCredential fails the first failures GetToken calls.
+type flakyCredential struct {
+	failures int32
+	calls    atomic.Int32
+}
+
+func (c *flakyCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	if c.calls.Add(1) <= c.failures {
+		return azcore.AccessToken{}, errors.New("token endpoint unavailable")
+	}
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestSessionDataTransactionRetryGraph(t *testing.T) {
+	tests := []struct {
+		name          string
+		tokenFailures int32
+		status        int
+		wantTokens    int32
+		wantSends     int32
+		wantErr       bool
+	}{
+		{name: "token failure", tokenFailures: 1, status: http.StatusAccepted, wantTokens: 2, wantSends: 1},
+		{name: "send failure", status: http.StatusBadGateway, wantTokens: 1, wantSends: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sends atomic.Int32
+			h := newTestGraphHandler(newTestGraphServer(t, &sends, tt.status), 0)
+			cred := &flakyCredential{failures: tt.tokenFailures}
+			h.cred = cred
+
+			session := newTestSessionWithT(t)
+			session.config.TransactionRetries = 1
+			session.config.TransactionRetryDelay = time.Millisecond
+			session.handler = h
+			session.auth = true
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+
+			err := session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("Data() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := cred.calls.Load(); got != tt.wantTokens {
+				t.Errorf("GetToken calls = %d, want %d", got, tt.wantTokens)
+			}
+			if got := sends.Load(); got != tt.wantSends {
+				t.Errorf("sendMail requests = %d, want %d", got, tt.wantSends)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"sync"
+	"time"
+)
+
+// errQueueFull is returned when a message cannot be queued because SEND_QUEUE_SIZE messages are
+// already waiting to be sent.
+var errQueueFull = errors.New("send queue full")
+
+// sendQueue relays messages through next in the background, so that SMTP clients get the reply
+// to DATA without waiting for Graph. Messages are queued in memory and sent by a fixed pool of
+// workers, higher priority messages first; a full queue refuses further messages, so that
+// clients back off until it drains. As the client has its reply before the send, a failure is
+// logged and reported to Sentry rather than returned to it; with SPOOL_DIR set, next is the
+// spool, so temporary failures are spooled for retry as usual, and so are the messages still
+// queued on shutdown.
+type sendQueue struct {
+	next       messageHandler
+	spool      *spool // next, if it is the spool
+	workers    int
+	inflight   *inflightSends // counts queued messages too, so that shutdown waits for them
+	retries    int            // retries of failures before sending, as TRANSACTION_RETRIES
+	retryDelay time.Duration
+
+	// ready holds a value for each queued message, so that workers can wait for one along with
+	// their context. Its capacity is the queue size.
+	ready chan struct{}
+
+	mu     sync.Mutex
+	jobs   [priorityLow + 1][]queuedMessage // by priority, oldest first
+	closed bool                             // set by drain; no more messages are queued
+}
+
+// queuedMessage is a message waiting in a sendQueue.
+type queuedMessage struct {
+	ctx    context.Context // context of the transaction, without its cancellation
+	sender string
+	msg    *mail.Message
+}
+
+// newSendQueue returns a queue of config.SendQueueSize messages relayed through next by
+// config.SendWorkers workers once run is called. Queued messages are tracked in inflight.
+func newSendQueue(config *appConfig, next messageHandler, inflight *inflightSends) *sendQueue {
+	sp, _ := next.(*spool)
+	return &sendQueue{
+		next:       next,
+		spool:      sp,
+		ready:      make(chan struct{}, config.SendQueueSize),
+		workers:    config.SendWorkers,
+		inflight:   inflight,
+		retries:    config.TransactionRetries,
+		retryDelay: config.TransactionRetryDelay,
+	}
+}
+
+// handleMessage queues msg for sending at the priority of ctx and returns without waiting for
+// the send. It returns errQueueFull if the queue has no room for msg, and errShuttingDown once
+// the queue is drained.
+func (q *sendQueue) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errShuttingDown
+	}
+	if len(q.ready) == cap(q.ready) {
+		return errQueueFull
+	}
+	// The session delivering msg has started a send in inflight, so this one may start even if
+	// shutdown has begun waiting for it.
+	q.inflight.extend()
+	priority := contextPriority(ctx)
+	if priority < priorityHigh || priority > priorityLow {
+		priority = priorityNormal
+	}
+	// The send outlives the transaction, so it must not be canceled when the transaction ends.
+	q.jobs[priority] = append(q.jobs[priority], queuedMessage{ctx: context.WithoutCancel(ctx), sender: sender, msg: msg})
+	q.ready <- struct{}{}
+	sendQueueLength.Inc()
+	traceEventf(ctx, "queued for sending")
+	return nil
+}
+
+// pop removes the queued message of the highest priority, and reports whether there was one.
+func (q *sendQueue) pop() (queuedMessage, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for priority, jobs := range q.jobs {
+		if len(jobs) > 0 {
+			job := jobs[0]
+			jobs[0] = queuedMessage{}
+			q.jobs[priority] = jobs[1:]
+			sendQueueLength.Dec()
+			return job, true
+		}
+	}
+	return queuedMessage{}, false
+}
+
+// run starts the workers, which send queued messages until ctx is canceled. On shutdown, ctx
+// should only be canceled once the messages in inflight, including the queued ones, are done,
+// or the queue is drained.
+func (q *sendQueue) run(ctx context.Context) {
+	for range q.workers {
+		go q.work(ctx)
+	}
+}
+
+// work sends queued messages one at a time until ctx is canceled.
+func (q *sendQueue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.ready:
+			// A drained queue leaves values in ready without their messages.
+			if job, ok := q.pop(); ok {
+				q.send(ctx, job)
+			}
+		}
+	}
+}
+
+// drain empties the queue on shutdown and refuses further messages. Each message still queued
+// is spooled without a send attempt if next is the spool, and otherwise logged as dropped with
+// its Message-ID, so that it can be traced back to its client.
+func (q *sendQueue) drain() {
+	q.mu.Lock()
+	q.closed = true
+	var jobs []queuedMessage
+	for priority := range q.jobs {
+		jobs = append(jobs, q.jobs[priority]...)
+		q.jobs[priority] = nil
+	}
+	q.mu.Unlock()
+
+	for _, job := range jobs {
+		sendQueueLength.Dec()
+		q.keep(job)
+		q.inflight.done()
+	}
+}
+
+// keep spools a message left in the queue on shutdown, or logs and reports it as dropped.
+func (q *sendQueue) keep(job queuedMessage) {
+	messageID := job.msg.Header.Get("Message-ID")
+	if q.spool != nil {
+		name, err := q.spool.spoolUnsent(job.ctx, job.sender, job.msg)
+		if err == nil {
+			log.Printf("Spooled queued message %s from %s as %s on shutdown", messageID, job.sender, name)
+			return
+		}
+		log.Printf("Failed to spool queued message %s from %s on shutdown: %v", messageID, job.sender, err)
+	}
+	err := fmt.Errorf("queued message %s from %s dropped on shutdown before it was sent", messageID, job.sender)
+	log.Printf("warning: %v", err)
+	reportError(job.ctx, err)
+}
+
+// send relays a queued message, retrying failures before sending like Session.Data does, and
+// logs and reports a failure. The send is canceled with ctx.
+func (q *sendQueue) send(ctx context.Context, job queuedMessage) {
+	defer q.inflight.done()
+	sendCtx, cancel := context.WithCancel(job.ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, cancel)
+	defer stop()
+
+	deliver := func(ctx context.Context) error { return q.next.handleMessage(ctx, job.sender, job.msg) }
+	err := retryBeforeSend(sendCtx, job.msg, q.retries, q.retryDelay, deliver, func(attempt int, err error) {
+		log.Printf("Retrying queued delivery from %s (%d/%d) after it failed before sending: %v", job.sender, attempt, q.retries, err)
+		traceEventf(sendCtx, "retry %d/%d after pre-send failure: %v", attempt, q.retries, err)
+	})
+	if err != nil {
+		err = fmt.Errorf("queued message from %s: %w", job.sender, err)
+		log.Printf("Failed to send %v", err)
+		traceEventf(sendCtx, "queued send failed: %v", err)
+		reportError(sendCtx, err)
+		return
+	}
+	traceEventf(sendCtx, "queued send accepted")
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/getsentry/sentry-go"
+)
+
+// gatedHandler records the subjects of the messages it relays, failing the first len(errs) of
+// them with errs. If release is set, each send waits for it to be closed; started receives a
+// value as each send begins.
+type gatedHandler struct {
+	started chan struct{}
+	release chan struct{}
+
+	mu       sync.Mutex
+	errs     []error
+	subjects []string
+}
+
+func (h *gatedHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	if h.started != nil {
+		h.started <- struct{}{}
+	}
+	if h.release != nil {
+		<-h.release
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subjects = append(h.subjects, msg.Header.Get("Subject"))
+	if n := len(h.subjects); n <= len(h.errs) {
+		return h.errs[n-1]
+	}
+	return nil
+}
+
+func queueTestMessage(subject string) *mail.Message {
+	return &mail.Message{
+		Header: mail.Header{"Subject": {subject}},
+		Body:   strings.NewReader("Hello\r\n"),
+	}
+}
+
+func TestSendQueueDrains(t *testing.T) {
+	const messages = 20
+	h := &gatedHandler{}
+	inflight := &inflightSends{}
+	q := newSendQueue(&appConfig{SendWorkers: 3, SendQueueSize: messages}, h, inflight)
+
+	var want []string
+	for i := range messages {
+		subject := fmt.Sprintf("message %d", i)
+		want = append(want, subject)
+		if err := q.handleMessage(context.Background(), "sender@example.com", queueTestMessage(subject)); err != nil {
+			t.Fatalf("handleMessage(%d) error: %v", i, err)
+		}
+	}
+	// Queued messages are pending until sent, so shutdown waits for them.
+	if pending := inflight.wait(0); pending == 0 {
+		t.Fatal("no pending sends before the workers started")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.run(ctx)
+	if pending := inflight.wait(5 * time.Second); pending != 0 {
+		t.Fatalf("%d send(s) still pending, want the queue drained", pending)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	slices.Sort(want)
+	slices.Sort(h.subjects)
+	if !slices.Equal(h.subjects, want) {
+		t.Fatalf("sent %q, want %q", h.subjects, want)
+	}
+}
+
+func TestSendQueueBackpressure(t *testing.T) {
+	h := &gatedHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+	inflight := &inflightSends{}
+	q := newSendQueue(&appConfig{SendWorkers: 1, SendQueueSize: 2}, h, inflight)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.run(ctx)
+
+	enqueue := func(subject string) error {
+		return q.handleMessage(context.Background(), "sender@example.com", queueTestMessage(subject))
+	}
+	// The worker takes the first message, the next two wait in the queue.
+	if err := enqueue("sending"); err != nil {
+		t.Fatalf("handleMessage() error: %v", err)
+	}
+	<-h.started
+	for _, subject := range []string{"queued 1", "queued 2"} {
+		if err := enqueue(subject); err != nil {
+			t.Fatalf("handleMessage(%s) error: %v", subject, err)
+		}
+	}
+	if err := enqueue("refused"); !errors.Is(err, errQueueFull) {
+		t.Fatalf("handleMessage() with a full queue error = %v, want errQueueFull", err)
+	}
+
+	close(h.release)
+	if pending := inflight.wait(5 * time.Second); pending != 0 {
+		t.Fatalf("%d send(s) still pending, want the queue drained", pending)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if want := []string{"sending", "queued 1", "queued 2"}; !slices.Equal(h.subjects, want) {
+		t.Fatalf("sent %q, want %q", h.subjects, want)
+	}
+	// Once drained, the queue accepts messages again.
+	if err := enqueue("after"); err != nil {
+		t.Fatalf("handleMessage() after draining error: %v", err)
+	}
+}
+
+func TestSendQueuePriority(t *testing.T) {
+	h := &gatedHandler{started: make(chan struct{}, 10), release: make(chan struct{})}
+	inflight := &inflightSends{}
+	q := newSendQueue(&appConfig{SendWorkers: 1, SendQueueSize: 3}, h, inflight)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.run(ctx)
+
+	enqueue := func(subject string, priority int) {
+		t.Helper()
+		if err := q.handleMessage(withPriority(context.Background(), priority), "sender@example.com", queueTestMessage(subject)); err != nil {
+			t.Fatalf("handleMessage(%s) error: %v", subject, err)
+		}
+	}
+	// The worker is busy with the first message while the others are queued.
+	enqueue("sending", priorityLow)
+	<-h.started
+	enqueue("low", priorityLow)
+	enqueue("normal", priorityNormal)
+	enqueue("high", priorityHigh)
+
+	close(h.release)
+	if pending := inflight.wait(5 * time.Second); pending != 0 {
+		t.Fatalf("%d send(s) still pending, want the queue drained", pending)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if want := []string{"sending", "high", "normal", "low"}; !slices.Equal(h.subjects, want) {
+		t.Fatalf("sent %q, want %q", h.subjects, want)
+	}
+}
+
+func TestSendQueueDrainSpools(t *testing.T) {
+	h := &gatedHandler{}
+	sp := newTestSpool(t, h, 0)
+	inflight := &inflightSends{}
+	q := newSendQueue(&appConfig{SendWorkers: 1, SendQueueSize: 2}, sp, inflight)
+	for _, priority := range []int{priorityLow, priorityHigh} {
+		if err := q.handleMessage(withPriority(context.Background(), priority), "sender@example.com", queueTestMessage("queued")); err != nil {
+			t.Fatalf("handleMessage() error: %v", err)
+		}
+	}
+
+	q.drain()
+	if pending := inflight.wait(0); pending != 0 {
+		t.Fatalf("%d send(s) still pending after drain", pending)
+	}
+	if err := q.handleMessage(context.Background(), "sender@example.com", queueTestMessage("late")); !errors.Is(err, errShuttingDown) {
+		t.Fatalf("handleMessage() after drain error = %v, want errShuttingDown", err)
+	}
+	if len(h.subjects) != 0 {
+		t.Fatalf("sent %q on drain, want nothing sent", h.subjects)
+	}
+	paths, _ := filepath.Glob(filepath.Join(sp.dir, "*"+spoolExt))
+	sortSpool(paths)
+	if len(paths) != 2 {
+		t.Fatalf("spooled %d message(s), want 2", len(paths))
+	}
+	for i, want := range []int{priorityHigh, priorityLow} {
+		if priority, _ := spoolKey(paths[i]); priority != want {
+			t.Errorf("spool file %s has priority %d, want %d", filepath.Base(paths[i]), priority, want)
+		}
+	}
+	data, err := os.ReadFile(paths[0])
+	if err != nil || !strings.Contains(string(data), "not sent before shutdown") {
+		t.Fatalf("spool file = %s, %v; want it kept as not sent", data, err)
+	}
+}
+
+func TestSendQueueDrainDrops(t *testing.T) {
+	var events []*sentry.Event
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn: "https://key@sentry.example.com/1",
+		BeforeSend: func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+			events = append(events, event)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error: %v", err)
+	}
+	ctx := sentry.SetHubOnContext(context.Background(), sentry.NewHub(client, sentry.NewScope()))
+
+	h := &gatedHandler{}
+	inflight := &inflightSends{}
+	q := newSendQueue(&appConfig{SendWorkers: 1, SendQueueSize: 1}, h, inflight)
+	msg := queueTestMessage("queued")
+	msg.Header["Message-Id"] = []string{"<queued@example.com>"}
+	if err := q.handleMessage(ctx, "sender@example.com", msg); err != nil {
+		t.Fatalf("handleMessage() error: %v", err)
+	}
+
+	q.drain()
+	if pending := inflight.wait(0); pending != 0 {
+		t.Fatalf("%d send(s) still pending after drain", pending)
+	}
+	if len(h.subjects) != 0 {
+		t.Fatalf("sent %q on drain, want nothing sent", h.subjects)
+	}
+	if len(events) != 1 || !strings.Contains(events[0].Exception[0].Value, "<queued@example.com>") {
+		t.Fatalf("reported %+v, want the dropped message with its Message-ID", events)
+	}
+}
+
+func TestSendQueueRetriesBeforeSend(t *testing.T) {
+	h := &gatedHandler{errs: []error{&tokenError{err: errors.New("token endpoint down")}}}
+	inflight := &inflightSends{}
+	q := newSendQueue(&appConfig{SendWorkers: 1, SendQueueSize: 1, TransactionRetries: 1}, h, inflight)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.run(ctx)
+
+	if err := q.handleMessage(context.Background(), "sender@example.com", queueTestMessage("retried")); err != nil {
+		t.Fatalf("handleMessage() error: %v", err)
+	}
+	if pending := inflight.wait(5 * time.Second); pending != 0 {
+		t.Fatalf("%d send(s) still pending", pending)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if want := []string{"retried", "retried"}; !slices.Equal(h.subjects, want) {
+		t.Fatalf("sent %q, want %q", h.subjects, want)
+	}
+}
+
+func TestSessionDataSendQueueFull(t *testing.T) {
+	// Without workers, an unbuffered queue never has room.
+	session := newTestSessionWithT(t)
+	session.handler = newSendQueue(&appConfig{}, &gatedHandler{}, nil)
+	session.auth = true
+	_ = session.Mail("sender@example.com", nil)
+	_ = session.Rcpt("recipient@example.com", nil)
+
+	err := session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 450 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 3, 1}) {
+		t.Fatalf("Data() error = %v, want 450 4.3.1", err)
+	}
+}
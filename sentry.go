@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/getsentry/sentry-go"
@@ -15,10 +16,7 @@ func initSentry(cfg *appConfig) func(context.Context) {
 	if cfg.SentryDSN == "" {
 		return func(context.Context) {}
 	}
-	err := sentry.Init(sentry.ClientOptions{
-		Dsn:     cfg.SentryDSN,
-		Release: "smtp2graph@" + revision,
-	})
+	err := sentry.Init(sentryOptions(cfg))
 	if err != nil {
 		log.Fatalf("Sentry initialization failed: %v", err)
 	}
@@ -27,6 +25,18 @@ func initSentry(cfg *appConfig) func(context.Context) {
 	}
 }
 
+// sentryOptions returns the Sentry client options for cfg.
+func sentryOptions(cfg *appConfig) sentry.ClientOptions {
+	return sentry.ClientOptions{
+		Dsn:              cfg.SentryDSN,
+		Release:          "smtp2graph@" + revision,
+		Environment:      cfg.SentryEnvironment,
+		SampleRate:       cfg.SentrySampleRate,
+		EnableTracing:    cfg.SentryTracesSampleRate > 0,
+		TracesSampleRate: cfg.SentryTracesSampleRate,
+	}
+}
+
 // reportError sends an error to Sentry if initialized.
 func reportError(ctx context.Context, err error) {
 	if err == nil {
@@ -39,3 +49,52 @@ func reportError(ctx context.Context, err error) {
 	}
 	hub.CaptureException(err)
 }
+
+// reportPanic reports a recovered panic to Sentry, tagged with where it was recovered ("server"
+// for the process, "session" for an SMTP session) and with details of the session, if any.
+func reportPanic(ctx context.Context, r any, where string, details sentry.Context) {
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		hub = sentry.CurrentHub().Clone()
+	}
+	hub.WithScope(func(scope *sentry.Scope) {
+		scope.SetTag("panic", where)
+		if details != nil {
+			scope.SetContext("smtp session", details)
+		}
+		hub.Recover(r)
+	})
+}
+
+// withSessionHub returns ctx with its own Sentry hub, so that the breadcrumbs of one SMTP session
+// are attached to the errors it reports and not to those of other sessions.
+func withSessionHub(ctx context.Context) context.Context {
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		hub = sentry.CurrentHub()
+	}
+	return sentry.SetHubOnContext(ctx, hub.Clone())
+}
+
+// addBreadcrumb records a breadcrumb on the Sentry hub of ctx, if it has one.
+func addBreadcrumb(ctx context.Context, category, message string, data map[string]any) {
+	hub := sentry.GetHubFromContext(ctx)
+	if hub == nil {
+		return
+	}
+	hub.AddBreadcrumb(&sentry.Breadcrumb{
+		Category:  category,
+		Message:   message,
+		Data:      data,
+		Level:     sentry.LevelInfo,
+		Timestamp: time.Now(),
+	}, nil)
+}
+
+// scrubAddress replaces the local part of addr, keeping the domain for debugging.
+func scrubAddress(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return "***" + addr[i:]
+	}
+	return "***"
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/getsentry/sentry-go"
+)
+
+func TestSentryOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		env         map[string]string
+		wantEnv     string
+		wantSample  float64
+		wantTraces  float64
+		wantTracing bool
+	}{
+		{
+			name:       "defaults",
+			wantSample: 1,
+		},
+		{
+			name: "configured",
+			env: map[string]string{
+				"SENTRY_ENVIRONMENT":        "staging",
+				"SENTRY_SAMPLE_RATE":        "0.5",
+				"SENTRY_TRACES_SAMPLE_RATE": "0.25",
+			},
+			wantEnv:     "staging",
+			wantSample:  0.5,
+			wantTraces:  0.25,
+			wantTracing: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := requiredConfig()
+			values["SENTRY_DSN"] = "https://key@sentry.example.com/1"
+			for k, v := range tt.env {
+				values[k] = v
+			}
+			cfg, err := loadConfigFrom(configLookup(values))
+			if err != nil {
+				t.Fatalf("loadConfigFrom() error: %v", err)
+			}
+
+			opts := sentryOptions(cfg)
+			if opts.Dsn != values["SENTRY_DSN"] {
+				t.Errorf("Dsn = %q, want %q", opts.Dsn, values["SENTRY_DSN"])
+			}
+			if opts.Environment != tt.wantEnv {
+				t.Errorf("Environment = %q, want %q", opts.Environment, tt.wantEnv)
+			}
+			if opts.SampleRate != tt.wantSample {
+				t.Errorf("SampleRate = %v, want %v", opts.SampleRate, tt.wantSample)
+			}
+			if opts.TracesSampleRate != tt.wantTraces {
+				t.Errorf("TracesSampleRate = %v, want %v", opts.TracesSampleRate, tt.wantTraces)
+			}
+			if opts.EnableTracing != tt.wantTracing {
+				t.Errorf("EnableTracing = %v, want %v", opts.EnableTracing, tt.wantTracing)
+			}
+		})
+	}
+}
+
+func TestSessionBreadcrumbs(t *testing.T) {
+	tests := []struct {
+		name       string
+		scrub      bool
+		wantSender string
+		wantRcpt   string
+	}{
+		{name: "addresses", wantSender: "sender@example.com", wantRcpt: "recipient@example.com"},
+		{name: "scrubbed", scrub: true, wantSender: "***@example.com", wantRcpt: "***@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []*sentry.Event
+			client, err := sentry.NewClient(sentry.ClientOptions{
+				Dsn: "https://key@sentry.example.com/1",
+				BeforeSend: func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+					events = append(events, event)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewClient() error: %v", err)
+			}
+
+			session := newTestSessionWithT(t)
+			session.config.SentryScrubAddresses = tt.scrub
+			session.ctx = withSessionHub(sentry.SetHubOnContext(t.Context(), sentry.NewHub(client, sentry.NewScope())))
+			session.handler = &mockHandler{err: errors.New("graph unavailable")}
+			session.authenticated("sender@example.com")
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+			msg := "To: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n"
+			if err := session.Data(strings.NewReader(msg)); err == nil {
+				t.Fatal("Data() error = nil, want relay failure")
+			}
+
+			if len(events) != 1 {
+				t.Fatalf("reported %d events, want 1", len(events))
+			}
+			crumbs := events[0].Breadcrumbs
+			var messages []string
+			for _, b := range crumbs {
+				messages = append(messages, b.Message)
+			}
+			if got, want := strings.Join(messages, ", "), "MAIL FROM, RCPT TO, DATA, message received"; got != want {
+				t.Fatalf("breadcrumbs = %s, want %s", got, want)
+			}
+			if got := crumbs[0].Data["sender"]; got != tt.wantSender {
+				t.Errorf("MAIL FROM sender = %v, want %s", got, tt.wantSender)
+			}
+			if got := crumbs[1].Data["recipient"]; got != tt.wantRcpt {
+				t.Errorf("RCPT TO recipient = %v, want %s", got, tt.wantRcpt)
+			}
+			if got := crumbs[3].Data["recipients"]; got != 1 {
+				t.Errorf("message recipients = %v, want 1", got)
+			}
+			if got := crumbs[3].Data["bytes"]; got != len(msg) {
+				t.Errorf("message bytes = %v, want %d", got, len(msg))
+			}
+		})
+	}
+}
+
+// panicHandler panics on every message.
+type panicHandler struct{}
+
+func (panicHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	panic("boom")
+}
+
+func TestSessionPanicContext(t *testing.T) {
+	var events []*sentry.Event
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn: "https://key@sentry.example.com/1",
+		BeforeSend: func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+			events = append(events, event)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error: %v", err)
+	}
+
+	var logs bytes.Buffer
+	session := newTestSessionWithT(t)
+	session.ctx = withSessionHub(sentry.SetHubOnContext(t.Context(), sentry.NewHub(client, sentry.NewScope())))
+	session.handler = panicHandler{}
+	session.inflight = &inflightSends{}
+	session.logger = log.New(&logs, "", 0)
+	session.remoteAddr = "192.0.2.1:56324"
+	session.authenticated("sender@example.com")
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	if err := session.Rcpt("recipient@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() error: %v", err)
+	}
+	msg := "Message-ID: <panic@example.com>\r\nTo: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n"
+	err = session.Data(strings.NewReader(msg))
+
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 3, 0}) {
+		t.Fatalf("Data() error = %v, want 451 4.3.0", err)
+	}
+	if session.sender != nil || len(session.recipients) != 0 || session.messageID != "" {
+		t.Fatal("transaction not reset after panic")
+	}
+	if pending := session.inflight.pending.Load(); pending != 0 {
+		t.Fatalf("pending sends after panic = %d, want 0", pending)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("reported %d events, want 1", len(events))
+	}
+	if got := events[0].Tags["panic"]; got != "session" {
+		t.Errorf("panic tag = %q, want session", got)
+	}
+	details := events[0].Contexts["smtp session"]
+	want := map[string]any{
+		"remote":     "192.0.2.1:56324",
+		"user":       "sender@example.com",
+		"sender":     "sender@example.com",
+		"message_id": "<panic@example.com>",
+	}
+	for key, value := range want {
+		if details[key] != value {
+			t.Errorf("context %s = %v, want %v", key, details[key], value)
+		}
+	}
+
+	line := logs.String()
+	for _, field := range []string{`remote="192.0.2.1:56324"`, `sender="sender@example.com"`, `message_id="<panic@example.com>"`, "boom"} {
+		if !strings.Contains(line, field) {
+			t.Errorf("panic log missing %s:\n%s", field, line)
+		}
+	}
+}
+
+func TestSessionEncodeFailureReportedOnce(t *testing.T) {
+	var events []*sentry.Event
+	client, err := sentry.NewClient(sentry.ClientOptions{
+		Dsn: "https://key@sentry.example.com/1",
+		BeforeSend: func(event *sentry.Event, _ *sentry.EventHint) *sentry.Event {
+			events = append(events, event)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClient() error: %v", err)
+	}
+
+	session := newTestSessionWithT(t)
+	session.ctx = withSessionHub(sentry.SetHubOnContext(t.Context(), sentry.NewHub(client, sentry.NewScope())))
+	session.handler = &corruptingHandler{next: &graphMailHandler{config: &appConfig{}}}
+	session.authenticated("sender@example.com")
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	if err := session.Rcpt("recipient@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() error: %v", err)
+	}
+	var smtpErr *smtp.SMTPError
+	if err := session.Data(strings.NewReader("To: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n")); !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatalf("Data() error = %v, want 550", err)
+	}
+
+	if len(events) != 1 {
+		t.Fatalf("reported %d events, want 1", len(events))
+	}
+	if got := events[0].Exception[0].Value; !strings.Contains(got, "malformed MIME header") {
+		t.Fatalf("reported %q, want the encoding error", got)
+	}
+}
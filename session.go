@@ -4,167 +4,758 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/mail"
+	"net/textproto"
+	"os"
+	"runtime/debug"
+	"slices"
 	"strings"
+	"time"
 
 	"crypto/subtle"
+	"crypto/tls"
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/getsentry/sentry-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // messageHandler defines the interface for processing SMTP messages.
 type messageHandler interface {
-	handleMessage(ctx context.Context, msg *mail.Message) error
+	// handleMessage relays msg on behalf of the sender mailbox address.
+	handleMessage(ctx context.Context, sender string, msg *mail.Message) error
 }
 
 // smtpSession manages SMTP session state and implements SMTP command handlers.
 type smtpSession struct {
-	config  *appConfig
-	ctx     context.Context
-	handler messageHandler
-
-	auth       bool
-	sender     *mail.Address
-	recipients []mail.Address
+	config      *appConfig
+	ctx         context.Context
+	handler     messageHandler
+	limiter     *rateLimiter
+	rcptLimiter *rateLimiter
+	connRate    *rateLimiter // message rate limit of this connection alone, nil if disabled
+	inflight    *inflightSends
+	conn        net.Conn     // client connection, nil in tests
+	remoteAddr  string       // client address, taken from the PROXY protocol header if enabled
+	conns       *connLimiter // limiter that counted this session, released on logout; nil if not counted
+	connIP      string       // IP address the session was counted for
+
+	auth         bool
+	user         string           // canonical address of the authenticated sender account
+	lastActivity time.Time        // time of authentication or of the last command since
+	now          func() time.Time // clock, for tests (default: time.Now)
+	sender       *mail.Address
+	recipients   []mail.Address
+	messageID    string    // Message-ID of the message being relayed, for panic reports
+	lastRcpt     time.Time // time the last recipient was accepted, for DATA_START_TIMEOUT
+	rejected     int       // recipients of the current transaction refused by recipient filtering
+
+	trace  *messageTrace // debug trace of the current transaction, nil unless enabled
+	logger *log.Logger   // destination for trace and slow transaction logs (default: standard logger)
 }
 
-// AuthMechanisms returns the supported authentication mechanisms. Only PLAIN is supported.
+// AuthMechanisms returns the supported authentication mechanisms: PLAIN, and CRAM-MD5 if
+// ENABLE_CRAM_MD5 is set.
 func (s *smtpSession) AuthMechanisms() []string {
+	if s.config.EnableCramMD5 {
+		return []string{sasl.Plain, cramMD5}
+	}
 	return []string{sasl.Plain}
 }
 
 func (s *smtpSession) Auth(mech string) (sasl.Server, error) {
-	return sasl.NewPlainServer(func(identity, username, password string) error {
-		usernameMatch := subtle.ConstantTimeCompare([]byte(username), []byte(s.config.SenderEmail)) == 1
-		passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(s.config.SenderPassword)) == 1
-		if !usernameMatch || !passwordMatch {
-			return errors.New("invalid username or password")
-		}
+	switch {
+	case mech == cramMD5 && s.config.EnableCramMD5:
+		return newCramMD5Server(s.config.SMTPDomain, func(username string, matches func(secret string) bool) error {
+			address, expected, found := s.config.senderPassword(username)
+			if !found || !matches(expected) {
+				return s.authFailed()
+			}
+			s.authenticated(address)
+			return nil
+		}), nil
+	case mech == sasl.Plain:
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			address, expected, found := s.config.senderPassword(username)
+			passwordMatch := subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+			if !found || !passwordMatch {
+				return s.authFailed()
+			}
+			s.authenticated(address)
+			return nil
+		}), nil
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+// breadcrumb records an SMTP command as a Sentry breadcrumb, giving errors reported later in the
+// session the command sequence that led to them.
+func (s *smtpSession) breadcrumb(message string, data map[string]any) {
+	addBreadcrumb(s.ctx, "smtp", message, data)
+}
 
-		s.auth = true
-		return nil
-	}), nil
+// breadcrumbAddress returns addr as recorded in breadcrumbs: scrubbed if SENTRY_SCRUB_ADDRESSES is set.
+func (s *smtpSession) breadcrumbAddress(addr string) string {
+	if s.config.SentryScrubAddresses {
+		return scrubAddress(addr)
+	}
+	return addr
+}
+
+// authFailed logs and returns the reply to invalid credentials.
+func (s *smtpSession) authFailed() error {
+	// Same reply go-smtp sends for a plain error, without reporting every bad password to Sentry.
+	s.logRejection(reasonAuthFailed, 454, smtp.EnhancedCode{4, 7, 0}, "invalid username or password")
+	return &smtp.SMTPError{Code: 454, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "invalid username or password"}
 }
 
-func (s *smtpSession) Mail(from string, opts *smtp.MailOptions) error {
+// authenticated marks the session as authenticated as the sender account address.
+func (s *smtpSession) authenticated(address string) {
+	s.auth = true
+	s.user = address
+	s.lastActivity = s.timeNow()
+}
+
+func (s *smtpSession) Mail(from string, opts *smtp.MailOptions) (err error) {
+	defer s.recoverPanic(&err)
+	s.breadcrumb("MAIL FROM", map[string]any{"sender": s.breadcrumbAddress(from)})
+	if s.authExpired() {
+		return s.authExpiredError()
+	}
 	if !s.auth {
-		err := newSMTPError(s.ctx, 530, smtp.EnhancedCode{5, 7, 0}, "authentication required")
+		err := s.reject(reasonAuthRequired, 530, smtp.EnhancedCode{5, 7, 0}, "authentication required")
+		return err
+	}
+	// Sessions opened before a maintenance window began are refused new transactions in it.
+	if s.config.Maintenance.active(s.timeNow()) {
+		err := s.reject(reasonMaintenance, 451, smtp.EnhancedCode{4, 3, 2}, "down for scheduled maintenance, try again later")
 		return err
 	}
 
 	// Only allow one sender per SMTP transaction; MAIL FROM must be first.
 	if s.sender != nil {
-		err := newSMTPError(s.ctx, 503, smtp.EnhancedCode{5, 5, 1}, "sender already specified")
+		err := s.reject(reasonBadSequence, 503, smtp.EnhancedCode{5, 5, 1}, "sender already specified")
 		return err
 	}
 	if len(s.recipients) > 0 {
-		err := newSMTPError(s.ctx, 503, smtp.EnhancedCode{5, 5, 1}, "bad sequence of commands: MAIL FROM after RCPT TO")
+		err := s.reject(reasonBadSequence, 503, smtp.EnhancedCode{5, 5, 1}, "bad sequence of commands: MAIL FROM after RCPT TO")
 		return err
 	}
 
 	addr, err := mail.ParseAddress(from)
 	if err != nil {
-		smtpErr := newSMTPError(s.ctx, 550, smtp.EnhancedCode{5, 1, 7}, "invalid sender address")
+		smtpErr := s.reject(reasonInvalidSender, 550, smtp.EnhancedCode{5, 1, 7}, "invalid sender address")
 		return smtpErr
 	}
 	s.sender = addr
 
+	if s.config.TraceMessages {
+		s.trace = newMessageTrace(s.logger)
+	}
+	s.trace.eventf("smtp MAIL FROM:<%s> user=%s", addr.Address, s.user)
+
 	return nil
 }
 
-func (s *smtpSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+func (s *smtpSession) Rcpt(to string, opts *smtp.RcptOptions) (err error) {
+	defer s.recoverPanic(&err)
+	s.breadcrumb("RCPT TO", map[string]any{"recipient": s.breadcrumbAddress(to), "accepted": len(s.recipients)})
+	if s.authExpired() {
+		return s.authExpiredError()
+	}
 	if !s.auth {
-		err := newSMTPError(s.ctx, 530, smtp.EnhancedCode{5, 7, 0}, "authentication required")
+		err := s.reject(reasonAuthRequired, 530, smtp.EnhancedCode{5, 7, 0}, "authentication required")
 		return err
 	}
 
 	// RCPT TO is not allowed before MAIL FROM.
 	if s.sender == nil {
-		err := newSMTPError(s.ctx, 503, smtp.EnhancedCode{5, 5, 1}, "bad sequence of commands: RCPT TO before MAIL FROM")
+		err := s.reject(reasonBadSequence, 503, smtp.EnhancedCode{5, 5, 1}, "bad sequence of commands: RCPT TO before MAIL FROM")
 		return err
 	}
 	// Validate recipient address before accepting.
 	addr, err := mail.ParseAddress(to)
 	if err != nil {
-		smtpErr := newSMTPError(s.ctx, 550, smtp.EnhancedCode{5, 1, 3}, "invalid recipient address")
+		smtpErr := s.reject(reasonInvalidRecipient, 550, smtp.EnhancedCode{5, 1, 3}, "invalid recipient address")
 		return smtpErr
 	}
+	// SMTPUTF8 clients may send an internationalized domain, which Graph only accepts as A-labels.
+	if addr.Address, err = asciiAddress(addr.Address); err != nil {
+		smtpErr := s.reject(reasonInvalidRecipient, 550, smtp.EnhancedCode{5, 1, 3}, "invalid recipient domain")
+		return smtpErr
+	}
+	if !s.config.recipientAllowed(addr.Address) {
+		s.rejected++
+		err := s.reject(reasonRecipientDomain, 550, smtp.EnhancedCode{5, 7, 1}, "recipient domain not allowed")
+		return err
+	}
+	// The token is only taken once the message is accepted, so that a transaction that is reset or
+	// rejected does not use up the recipient's allowance.
+	if !s.rcptLimiter.available(strings.ToLower(addr.Address)) {
+		err := s.reject(reasonRecipientRateLimited, 450, smtp.EnhancedCode{4, 7, 1}, "recipient rate limit exceeded, try again later")
+		return err
+	}
 
 	s.recipients = append(s.recipients, *addr)
+	s.lastRcpt = s.timeNow()
+	s.trace.eventf("smtp RCPT TO:<%s>", addr.Address)
 
 	return nil
 }
 
-func (s *smtpSession) Data(r io.Reader) error {
+func (s *smtpSession) Data(r io.Reader) (err error) {
+	defer s.recoverPanic(&err)
+	s.breadcrumb("DATA", map[string]any{"recipients": len(s.recipients)})
+	if s.authExpired() {
+		return s.authExpiredError()
+	}
 	if !s.auth {
-		err := newSMTPError(s.ctx, 530, smtp.EnhancedCode{5, 7, 0}, "authentication required")
+		err := s.reject(reasonAuthRequired, 530, smtp.EnhancedCode{5, 7, 0}, "authentication required")
 		return err
 	}
 	if s.sender == nil {
-		err := newSMTPError(s.ctx, 503, smtp.EnhancedCode{5, 5, 1}, "sender not specified")
+		err := s.reject(reasonBadSequence, 503, smtp.EnhancedCode{5, 5, 1}, "sender not specified")
+		return err
+	}
+	// Reject rather than relay a message whose recipients were all filtered out.
+	if len(s.recipients) == 0 && s.rejected > 0 {
+		err := s.reject(reasonNoValidRecipients, 550, smtp.EnhancedCode{5, 1, 1}, "no valid recipients")
 		return err
 	}
 	if len(s.recipients) == 0 {
-		err := newSMTPError(s.ctx, 503, smtp.EnhancedCode{5, 5, 1}, "no recipients specified")
+		err := s.reject(reasonBadSequence, 503, smtp.EnhancedCode{5, 5, 1}, "no recipients specified")
 		return err
 	}
+	if s.config.SingleDomainPerMessage {
+		if domains := recipientDomains(s.recipients); len(domains) > 1 {
+			err := s.reject(reasonMultipleDomains, 550, smtp.EnhancedCode{5, 7, 1}, fmt.Sprintf("recipients must be in a single domain, got %s", strings.Join(domains, ", ")))
+			return err
+		}
+	}
+	if !s.connRate.allow("") {
+		err := s.reject(reasonConnectionRateLimited, 451, smtp.EnhancedCode{4, 7, 1}, "connection rate limit exceeded, try again later")
+		return err
+	}
+	if !s.limiter.allow(s.user) {
+		err := s.reject(reasonRateLimited, 450, smtp.EnhancedCode{4, 7, 1}, "sender rate limit exceeded, try again later")
+		return err
+	}
+
+	spanCtx, span := tracer.Start(s.ctx, "smtp.data", trace.WithAttributes(
+		attribute.String("smtp.sender", s.sender.Address),
+		attribute.Int("smtp.recipients", len(s.recipients)),
+	))
+	defer func() { endSpan(span, err) }()
 
+	if s.config.DataStartTimeout > 0 {
+		deadline := s.lastRcpt.Add(s.config.DataStartTimeout)
+		if !s.timeNow().Before(deadline) {
+			return s.dataTimeout()
+		}
+		r = s.dataDeadlineReader(r, deadline)
+	}
+
+	start := time.Now()
+	// go-smtp enforces MaxMessageBytes with ErrDataTooLarge; the limit is also applied here so
+	// that the session does not depend on the server configuration.
+	if s.config.MaxMessageBytes > 0 {
+		r = io.LimitReader(r, s.config.MaxMessageBytes+1)
+	}
 	b, err := io.ReadAll(r)
+	if s.conn != nil && s.config.DataStartTimeout > 0 && s.config.ReadTimeout <= 0 && !errors.Is(err, errDataTimeout) {
+		// go-smtp only sets a read deadline before each command if SMTP_READ_TIMEOUT is set.
+		s.conn.SetReadDeadline(time.Time{})
+	}
+	if err == nil && s.config.MaxMessageBytes > 0 && int64(len(b)) > s.config.MaxMessageBytes {
+		err = smtp.ErrDataTooLarge
+	}
+	if errors.Is(err, smtp.ErrDataTooLarge) {
+		// The partial body is dropped; go-smtp discards the rest of the DATA stream.
+		smtpErr := s.reject(reasonMessageTooLarge, 552, smtp.EnhancedCode{5, 3, 4}, fmt.Sprintf("message exceeds the maximum size of %d bytes", s.config.MaxMessageBytes))
+		return smtpErr
+	}
+	if errors.Is(err, errDataTimeout) {
+		return s.dataTimeout()
+	}
 	if err != nil {
 		reportError(s.ctx, err)
 		return err
 	}
+	received := time.Since(start)
+	s.breadcrumb("message received", map[string]any{"sender": s.breadcrumbAddress(s.sender.Address), "recipients": len(s.recipients), "bytes": len(b)})
 
-	msg, err := parseMessage(b, s.sender, s.recipients)
+	messagesReceived.Inc()
+	s.trace.eventf("smtp DATA %d bytes, %d recipient(s)", len(b), len(s.recipients))
+
+	// Only the rewrite policy sets From to MAIL FROM; the others check the From header as sent.
+	policy := s.config.fromPolicy(s.user)
+	rewriteFrom := s.sender
+	if policy != fromPolicyRewrite {
+		rewriteFrom = nil
+	}
+	msg, err := readMessage(b, s.recipients)
 	if err != nil {
-		smtpErr := newSMTPError(s.ctx, 550, smtp.EnhancedCode{5, 6, 0}, "invalid message format")
+		smtpErr := s.reject(reasonInvalidMessage, 550, smtp.EnhancedCode{5, 6, 0}, "invalid message format")
+		return smtpErr
+	}
+	// The header limits apply to the header as the client sent it, before any fields are added
+	// below. A message wrapped by plainTextMessage had no header of its own.
+	var sentHeader mail.Header
+	if _, ok := msg.Body.(*rawBody); ok {
+		sentHeader = msg.Header
+	}
+	if n := headerCount(sentHeader); s.config.MaxHeaderCount > 0 && n > s.config.MaxHeaderCount {
+		smtpErr := s.reject(reasonTooManyHeaders, 552, smtp.EnhancedCode{5, 3, 4}, fmt.Sprintf("too many header fields (%d, limit %d)", n, s.config.MaxHeaderCount))
+		return smtpErr
+	}
+	if key, n := longestHeaderField(sentHeader); s.config.MaxHeaderLineBytes > 0 && n > s.config.MaxHeaderLineBytes {
+		smtpErr := s.reject(reasonHeaderTooLong, 552, smtp.EnhancedCode{5, 3, 4}, fmt.Sprintf("header field %s too long (%d bytes, limit %d)", key, n, s.config.MaxHeaderLineBytes))
+		return smtpErr
+	}
+	if n := headerSize(sentHeader); s.config.MaxHeaderBytes > 0 && n > s.config.MaxHeaderBytes {
+		smtpErr := s.reject(reasonHeaderTooLarge, 552, smtp.EnhancedCode{5, 3, 4}, fmt.Sprintf("header too large (%d bytes, limit %d)", n, s.config.MaxHeaderBytes))
+		return smtpErr
+	}
+	// Checked before normalizing, which adds the recipients missing from the header to Bcc.
+	if s.config.StrictRecipientMatch && !headerNamesRecipient(msg.Header, s.recipients) {
+		smtpErr := s.reject(reasonRecipientMismatch, 550, smtp.EnhancedCode{5, 7, 1}, "none of the recipients appear in the message headers")
 		return smtpErr
 	}
+	normalizeEnvelopeHeaders(msg, rewriteFrom, s.recipients)
+	if s.config.GenerateMessageID && msg.Header.Get("Message-Id") == "" {
+		msg.Header["Message-Id"] = []string{newMessageID(s.config.SMTPDomain)}
+	}
+	// RFC 5322 requires a Date; messages without one may be flagged by Graph or recipients.
+	if s.config.AddMissingDate && msg.Header.Get("Date") == "" {
+		msg.Header["Date"] = []string{s.timeNow().Format(time.RFC1123Z)}
+	}
+	s.messageID = msg.Header.Get("Message-Id")
+
+	if s.config.MaxBodyBytes > 0 || s.config.MaxAttachmentBytes > 0 {
+		sizes, err := measureMessage(msg)
+		if err != nil {
+			reportError(s.ctx, err)
+			return err
+		}
+		if s.config.MaxBodyBytes > 0 && sizes.body > s.config.MaxBodyBytes {
+			smtpErr := s.reject(reasonBodyTooLarge, 552, smtp.EnhancedCode{5, 3, 4}, fmt.Sprintf("message body too large (%d bytes, limit %d)", sizes.body, s.config.MaxBodyBytes))
+			return smtpErr
+		}
+		if s.config.MaxAttachmentBytes > 0 && sizes.attachments > s.config.MaxAttachmentBytes {
+			smtpErr := s.reject(reasonAttachmentsTooLarge, 552, smtp.EnhancedCode{5, 3, 4}, fmt.Sprintf("attachments too large (%d bytes, limit %d)", sizes.attachments, s.config.MaxAttachmentBytes))
+			return smtpErr
+		}
+	}
+
+	from := fromAddress(msg.Header)
+	if policy == fromPolicyReject && !s.config.fromMatches(s.user, from) {
+		smtpErr := s.reject(reasonFromMismatch, 550, smtp.EnhancedCode{5, 7, 1}, "From address does not match the authenticated sender")
+		return smtpErr
+	}
+	if s.config.otherSender(s.user, from) {
+		smtpErr := s.reject(reasonFromMismatch, 550, smtp.EnhancedCode{5, 7, 1}, "From address belongs to another sender account")
+		return smtpErr
+	}
+	mailbox, ok := s.config.sendAsMailbox(s.user, from)
+	if !ok {
+		smtpErr := s.reject(reasonSendAsDenied, 550, smtp.EnhancedCode{5, 7, 1}, "From address not allowed for this sender")
+		return smtpErr
+	}
+
+	// Content-Length is not an email header; a stale value can confuse downstream parsers.
+	if s.config.StripContentLength {
+		delete(msg.Header, "Content-Length")
+	}
+
+	if s.config.StripBOM {
+		stripped, err := stripMessageBOM(msg)
+		if err != nil {
+			reportError(s.ctx, err)
+			return err
+		}
+		if stripped {
+			s.trace.eventf("stripped UTF-8 byte order mark from the body")
+		}
+	}
+
+	if s.config.DedupeCc {
+		if n := dedupeCc(msg.Header); n > 0 {
+			s.trace.eventf("removed %d Cc address(es) already in To", n)
+		}
+	}
+
+	if s.config.autoSubmittedFor(s.sender.Address) && msg.Header.Get("Auto-Submitted") == "" {
+		msg.Header["Auto-Submitted"] = []string{"auto-generated"}
+	}
 
-	err = s.handler.handleMessage(s.ctx, msg)
+	if s.config.IdempotencyHeader != "" {
+		if key := idempotencyKey(msg.Header.Get("Message-Id")); key != "" {
+			msg.Header[textproto.CanonicalMIMEHeaderKey(s.config.IdempotencyHeader)] = []string{key}
+		}
+	}
+
+	// Relay headers replace any the client set, so that they cannot be forged.
+	if s.config.AddRelayHeaders {
+		msg.Header["X-Relayed-By"] = []string{relayedBy()}
+		msg.Header["X-Relay-Timestamp"] = []string{s.timeNow().Format(time.RFC1123Z)}
+	}
+
+	// Sender headers replace any the client set, so that downstream attribution can rely on them.
+	for name, value := range s.config.senderHeaders(s.user) {
+		msg.Header[name] = []string{value}
+	}
+
+	if s.config.TranscodeSubject {
+		if subject, ok := transcodeSubject(msg.Header.Get("Subject")); ok {
+			msg.Header["Subject"] = []string{subject}
+		}
+	}
+
+	ctx, timings := withTransactionTimings(withMessageTrace(spanCtx, s.trace))
+	ctx = withPriority(ctx, s.config.messagePriority(s.user, msg.Header))
+	// Once shutdown has begun waiting for the messages being relayed, no new one may start. Like
+	// for new sessions, this is expected and not reported to Sentry.
+	if !s.inflight.start() {
+		s.logRejection(reasonShuttingDown, errShuttingDown.Code, errShuttingDown.EnhancedCode, errShuttingDown.Message)
+		return errShuttingDown
+	}
+	err = func() error {
+		defer s.inflight.done() // also if the handler panics, so that shutdown does not wait for it
+		return s.deliverWithRetry(ctx, mailbox, msg)
+	}()
+	s.checkClientDisconnect(err)
+	if total := time.Since(start); s.config.SlowTransactionThreshold > 0 && total > s.config.SlowTransactionThreshold {
+		s.logf("warning: slow transaction from %s to %d recipient(s): %s total (receive %s, token %s, send %s)",
+			s.sender.Address, len(s.recipients), total.Round(time.Millisecond), received.Round(time.Millisecond),
+			timings.token().Round(time.Millisecond), timings.send().Round(time.Millisecond))
+	}
+	if err != nil {
+		s.trace.eventf("smtp DATA failed: %v", err)
+	} else {
+		s.trace.eventf("smtp DATA accepted")
+		for _, rcpt := range s.recipients {
+			s.rcptLimiter.charge(strings.ToLower(rcpt.Address))
+		}
+	}
+	if errors.Is(err, errMessageTooLarge) {
+		smtpErr := s.reject(reasonMessageTooLarge, 552, smtp.EnhancedCode{5, 3, 4}, err.Error())
+		return smtpErr
+	}
+	if errors.Is(err, errSendBusy) {
+		smtpErr := s.reject(reasonGraphBusy, 450, smtp.EnhancedCode{4, 7, 1}, "too many concurrent sends, try again later")
+		return smtpErr
+	}
+	if errors.Is(err, errQueueFull) {
+		smtpErr := s.reject(reasonQueueFull, 450, smtp.EnhancedCode{4, 3, 1}, "send queue full, try again later")
+		return smtpErr
+	}
+	// A token failure is a problem with the relay's own credentials that may clear up, such as an
+	// expired secret being rotated; a temporary reply makes the client retry rather than bounce.
+	var terr *tokenError
+	if errors.As(err, &terr) {
+		smtpErr := s.reject(reasonTokenUnavailable, 454, smtp.EnhancedCode{4, 7, 0}, err.Error())
+		return smtpErr
+	}
+	// A message that cannot be encoded is the client's problem, not Graph's; resending it as it
+	// is would fail again. Sentry gets the encoding error itself.
+	var eerr *encodeError
+	if errors.As(err, &eerr) {
+		reportError(s.ctx, err)
+		message := fmt.Sprintf("message could not be encoded for relay: %v", eerr.err)
+		s.logRejection(reasonInvalidMessage, 550, smtp.EnhancedCode{5, 6, 0}, message)
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 6, 0}, Message: message}
+	}
+	// The client gets a concise reply for a Graph error response, while Sentry gets the full
+	// error with the response body.
+	var gerr *graphError
+	if errors.As(err, &gerr) {
+		reportError(s.ctx, err)
+		code, enhanced, message := gerr.smtpReply()
+		s.logRejection(reasonRelayFailed, code, enhanced, message)
+		return &smtp.SMTPError{Code: code, EnhancedCode: enhanced, Message: message}
+	}
 	if err != nil {
-		smtpErr := newSMTPError(s.ctx, 554, smtp.EnhancedCode{5, 3, 0}, err.Error())
+		smtpErr := s.reject(reasonRelayFailed, 554, smtp.EnhancedCode{5, 3, 0}, err.Error())
 		return smtpErr
 	}
 
 	return nil
 }
 
+// errDataTimeout is returned by a dataDeadlineReader once DATA_START_TIMEOUT has passed.
+var errDataTimeout = errors.New("timed out waiting for message data")
+
+// dataDeadlineReader returns r limited to the time before deadline. The connection's read
+// deadline is moved up to it, unless SMTP_READ_TIMEOUT expires first, so that a client that
+// stops sending does not hold the transaction open until then.
+func (s *smtpSession) dataDeadlineReader(r io.Reader, deadline time.Time) io.Reader {
+	if s.conn != nil && (s.config.ReadTimeout <= 0 || deadline.Before(s.timeNow().Add(s.config.ReadTimeout))) {
+		s.conn.SetReadDeadline(deadline)
+	}
+	return &deadlineReader{r: r, deadline: deadline, now: s.timeNow}
+}
+
+// dataTimeout rejects a transaction whose DATA exceeded DATA_START_TIMEOUT. The rest of the
+// message may still be on its way, so the connection is closed after the reply rather than
+// reading it as commands.
+func (s *smtpSession) dataTimeout() error {
+	err := s.reject(reasonDataTimeout, 451, smtp.EnhancedCode{4, 4, 2}, "timed out waiting for message data")
+	if s.conn != nil {
+		closeRead(s.conn)
+	}
+	return err
+}
+
+// deadlineReader fails reads with errDataTimeout from deadline on.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+	now      func() time.Time
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if !d.now().Before(d.deadline) {
+		return 0, errDataTimeout
+	}
+	n, err := d.r.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) && !d.now().Before(d.deadline) {
+		err = errDataTimeout
+	}
+	return n, err
+}
+
+// checkClientDisconnect logs and counts a client that disconnected while its message was relayed,
+// given the result of the relay. The send is not tied to the connection and has run to completion
+// regardless, but the client never gets the reply: if the message was delivered, a client that
+// resubmits it causes a duplicate.
+func (s *smtpSession) checkClientDisconnect(err error) {
+	if s.conn == nil || !peerClosed(s.conn) {
+		return
+	}
+	if err != nil {
+		clientDisconnects.WithLabelValues("failed").Inc()
+		s.logf("warning: client %s disconnected while message %s was relayed, which failed: %v", s.remoteAddr, s.messageID, err)
+		return
+	}
+	clientDisconnects.WithLabelValues("delivered").Inc()
+	s.logf("warning: client %s disconnected while message %s was relayed; it was delivered, but the client did not get the reply and may resubmit it, causing a duplicate", s.remoteAddr, s.messageID)
+}
+
+// closeRead shuts down the reading side of conn, so that go-smtp still writes its reply but
+// then sees the end of the connection. Connections that cannot be half-closed are left open.
+func closeRead(conn net.Conn) {
+	if c, ok := socketConn(conn).(interface{ CloseRead() error }); ok {
+		c.CloseRead()
+	}
+}
+
+// socketConn returns the connection conn is layered on, without TLS, the VRFY reply rewriting
+// and PROXY protocol.
+func socketConn(conn net.Conn) net.Conn {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if nc, ok := conn.(*noVRFYConn); ok {
+		conn = nc.Conn
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+	return conn
+}
+
+// recoverPanic recovers a panic in an SMTP command handler, which go-smtp would otherwise only log
+// before dropping the connection. The panic is logged and reported to Sentry with the session
+// context, the transaction is reset, and the client gets a temporary error to retry. It must be
+// deferred directly by the handler, with err its named result.
+func (s *smtpSession) recoverPanic(err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	sender := ""
+	if s.sender != nil {
+		sender = s.sender.Address
+	}
+	s.logf("session panic remote=%q user=%q sender=%q message_id=%q: %v\n%s", s.remoteAddr, s.user, sender, s.messageID, r, debug.Stack())
+	reportPanic(s.ctx, r, "session", sentry.Context{
+		"remote":     s.remoteAddr,
+		"user":       s.breadcrumbAddress(s.user),
+		"sender":     s.breadcrumbAddress(sender),
+		"message_id": s.messageID,
+	})
+	s.Reset()
+	*err = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 3, 0}, Message: "internal error, try again later"}
+}
+
+// logf logs to the session logger, defaulting to the standard logger.
+func (s *smtpSession) logf(format string, args ...any) {
+	if s.logger == nil {
+		log.Printf(format, args...)
+		return
+	}
+	s.logger.Printf(format, args...)
+}
+
+// authExpired reports whether the session's authentication has expired because it was idle for
+// longer than AUTH_SESSION_TIMEOUT. An expired session loses its authentication and current
+// transaction, and is closed by authExpiredError. Otherwise the command counts as activity.
+func (s *smtpSession) authExpired() bool {
+	if !s.auth || s.config.AuthSessionTimeout <= 0 {
+		return false
+	}
+	now := s.timeNow()
+	if now.Sub(s.lastActivity) > s.config.AuthSessionTimeout {
+		s.Reset()
+		s.auth = false
+		s.user = ""
+		return true
+	}
+	s.lastActivity = now
+	return false
+}
+
+// authExpiredError rejects a command of a session whose authentication expired. The connection
+// is closed after the reply, since clients rarely authenticate again within a session.
+func (s *smtpSession) authExpiredError() error {
+	err := s.reject(reasonAuthExpired, 421, smtp.EnhancedCode{4, 7, 0}, "authentication expired after inactivity, closing connection")
+	if s.conn != nil {
+		closeRead(s.conn)
+	}
+	return err
+}
+
+// timeNow returns the current time from s.now, or time.Now if unset.
+func (s *smtpSession) timeNow() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
 func (s *smtpSession) Reset() {
+	s.trace.eventf("smtp RSET")
 	s.sender = nil
 	s.recipients = nil
+	s.messageID = ""
+	s.rejected = 0
+	s.trace = nil
 }
 
 func (s *smtpSession) Logout() error {
+	s.conns.release(s.connIP)
 	return nil
 }
 
+// parseMessage parses raw with readMessage and normalizes its envelope headers: From is set to
+// sender unless it already contains it or sender is nil, and recipients missing from the header
+// are added to Bcc.
 func parseMessage(raw []byte, sender *mail.Address, recipients []mail.Address) (*mail.Message, error) {
+	msg, err := readMessage(raw, recipients)
+	if err != nil {
+		return nil, err
+	}
+	normalizeEnvelopeHeaders(msg, sender, recipients)
+	return msg, nil
+}
+
+// readMessage parses raw into a message whose body keeps the raw header block, so that the
+// original bytes can be relayed intact after the envelope headers are normalized. Text without a
+// header block is wrapped in a plain text message addressed to recipients.
+func readMessage(raw []byte, recipients []mail.Address) (*mail.Message, error) {
 	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	header, body, ok := splitHeader(raw)
+	if err == nil && !ok {
+		// A headers-only message without the blank line: complete the header block.
+		header, body, ok = terminateHeader(raw), nil, true
+	}
+	if err == nil && ok {
+		msg.Body = &rawBody{Reader: bytes.NewReader(body), header: header}
+	}
 	if err != nil {
-		msg, err = plainTextMessage(raw, sender, recipients)
+		msg, err = plainTextMessage(raw, recipients)
 		if err != nil {
 			return nil, err
 		}
 	}
-
-	normalizeEnvelopeHeaders(msg, sender, recipients)
 	return msg, nil
 }
 
-func plainTextMessage(raw []byte, sender *mail.Address, recipients []mail.Address) (*mail.Message, error) {
-	toList := make([]string, len(recipients))
+// fromAddress returns the first address of the From header, or "" if it has none or is malformed.
+func fromAddress(header mail.Header) string {
+	list, err := header.AddressList("From")
+	if err != nil || len(list) == 0 {
+		return ""
+	}
+	return list[0].Address
+}
+
+// recipientDomains returns the distinct lowercase domains of recipients, sorted.
+func recipientDomains(recipients []mail.Address) []string {
+	var domains []string
+	for _, rcpt := range recipients {
+		domain := strings.ToLower(rcpt.Address[strings.LastIndex(rcpt.Address, "@")+1:])
+		if !slices.Contains(domains, domain) {
+			domains = append(domains, domain)
+		}
+	}
+	slices.Sort(domains)
+	return domains
+}
+
+// headerCount returns the number of header fields in header.
+func headerCount(header mail.Header) int {
+	n := 0
+	for _, values := range header {
+		n += len(values)
+	}
+	return n
+}
+
+// longestHeaderField returns the name and length of the longest header field, measured as
+// "Name: value" with folded continuation lines joined.
+func longestHeaderField(header mail.Header) (string, int) {
+	longest, n := "", 0
+	for key, values := range header {
+		for _, v := range values {
+			if l := len(key) + 2 + len(v); l > n {
+				longest, n = key, l
+			}
+		}
+	}
+	return longest, n
+}
+
+// headerSize returns the total size of the header fields, each measured as "Name: value\r\n" with
+// folded continuation lines joined.
+func headerSize(header mail.Header) int {
+	n := 0
+	for key, values := range header {
+		for _, v := range values {
+			n += len(key) + 2 + len(v) + 2
+		}
+	}
+	return n
+}
+
+// plainTextMessage wraps raw in a plain text message. The recipients are addressed through Bcc,
+// as normalizeEnvelopeHeaders does for recipients missing from a header, so that they do not see
+// each other.
+func plainTextMessage(raw []byte, recipients []mail.Address) (*mail.Message, error) {
+	bccList := make([]string, len(recipients))
 	for i, rcpt := range recipients {
-		toList[i] = rcpt.String()
+		bccList[i] = rcpt.String()
 	}
 
 	var buf bytes.Buffer
-	if sender != nil {
-		buf.WriteString("From: " + sender.String() + "\r\n")
-	}
-	buf.WriteString("To: " + strings.Join(toList, ", ") + "\r\n")
+	buf.WriteString("To: undisclosed-recipients:;\r\n")
+	buf.WriteString("Bcc: " + strings.Join(bccList, ", ") + "\r\n")
 	buf.WriteString("Subject: (no subject)\r\n")
 	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
 	buf.WriteString("\r\n")
@@ -210,12 +801,25 @@ func recipientHeaderSet(header mail.Header) map[string]struct{} {
 			continue
 		}
 		for _, addr := range addrs {
-			recipients[addr.Address] = struct{}{}
+			recipients[asciiAddressOrSelf(addr.Address)] = struct{}{}
 		}
 	}
 	return recipients
 }
 
+// headerNamesRecipient reports whether any of recipients is in the To, Cc or Bcc header,
+// comparing addresses case-insensitively.
+func headerNamesRecipient(header mail.Header, recipients []mail.Address) bool {
+	for address := range recipientHeaderSet(header) {
+		for _, rcpt := range recipients {
+			if strings.EqualFold(address, rcpt.Address) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func headerContainsAddress(header mail.Header, field, address string) bool {
 	addrs, err := header.AddressList(field)
 	if err != nil {
@@ -229,6 +833,96 @@ func headerContainsAddress(header mail.Header, field, address string) bool {
 	return false
 }
 
+// dedupeCc removes the addresses from the Cc header that are already in To, dropping Cc if none
+// remain, and returns how many were removed. Recipients stay addressed through To, so delivery is
+// unchanged. A To or Cc header that does not parse is left alone.
+func dedupeCc(header mail.Header) int {
+	to, err := header.AddressList("To")
+	if err != nil {
+		return 0
+	}
+	cc, err := header.AddressList("Cc")
+	if err != nil {
+		return 0
+	}
+	inTo := make(map[string]struct{}, len(to))
+	for _, addr := range to {
+		inTo[strings.ToLower(addr.Address)] = struct{}{}
+	}
+	kept := make([]string, 0, len(cc))
+	for _, addr := range cc {
+		if _, ok := inTo[strings.ToLower(addr.Address)]; !ok {
+			kept = append(kept, addr.String())
+		}
+	}
+	removed := len(cc) - len(kept)
+	switch {
+	case removed == 0:
+	case len(kept) == 0:
+		delete(header, "Cc")
+	default:
+		header["Cc"] = []string{strings.Join(kept, ", ")}
+	}
+	return removed
+}
+
+// rejectReason is a stable, machine-readable code for why a command was rejected,
+// logged with each rejection so that rejections can be counted by cause.
+type rejectReason string
+
+const (
+	reasonEHLOHostname          rejectReason = "ehlo_hostname"
+	reasonTooManyConnections    rejectReason = "too_many_connections"
+	reasonMaintenance           rejectReason = "maintenance"
+	reasonShuttingDown          rejectReason = "shutting_down"
+	reasonAuthRequired          rejectReason = "auth_required"
+	reasonAuthExpired           rejectReason = "auth_expired"
+	reasonAuthFailed            rejectReason = "auth_failed"
+	reasonBadSequence           rejectReason = "bad_sequence"
+	reasonInvalidSender         rejectReason = "invalid_sender"
+	reasonInvalidRecipient      rejectReason = "invalid_recipient"
+	reasonRecipientDomain       rejectReason = "recipient_domain"
+	reasonMultipleDomains       rejectReason = "multiple_domains"
+	reasonNoValidRecipients     rejectReason = "no_valid_recipients"
+	reasonRateLimited           rejectReason = "rate_limited"
+	reasonRecipientRateLimited  rejectReason = "recipient_rate_limited"
+	reasonConnectionRateLimited rejectReason = "connection_rate_limited"
+	reasonInvalidMessage        rejectReason = "invalid_message"
+	reasonSendAsDenied          rejectReason = "send_as_denied"
+	reasonFromMismatch          rejectReason = "from_mismatch"
+	reasonRecipientMismatch     rejectReason = "recipient_mismatch"
+	reasonTooManyHeaders        rejectReason = "too_many_headers"
+	reasonHeaderTooLong         rejectReason = "header_too_long"
+	reasonHeaderTooLarge        rejectReason = "header_too_large"
+	reasonBodyTooLarge          rejectReason = "body_too_large"
+	reasonAttachmentsTooLarge   rejectReason = "attachments_too_large"
+	reasonMessageTooLarge       rejectReason = "message_too_large"
+	reasonDataTimeout           rejectReason = "data_timeout"
+	reasonTokenUnavailable      rejectReason = "token_unavailable"
+	reasonGraphBusy             rejectReason = "graph_busy"
+	reasonQueueFull             rejectReason = "queue_full"
+	reasonRelayFailed           rejectReason = "relay_failed"
+)
+
+// reject returns an SMTP error for a rejected command and logs it with reason.
+func (s *smtpSession) reject(reason rejectReason, code int, enhanced smtp.EnhancedCode, message string) *smtp.SMTPError {
+	s.logRejection(reason, code, enhanced, message)
+	return newSMTPError(s.ctx, code, enhanced, message)
+}
+
+// logRejection logs a rejection as a single key=value line if LOG_REJECTIONS is enabled.
+func (s *smtpSession) logRejection(reason rejectReason, code int, enhanced smtp.EnhancedCode, message string) {
+	if !s.config.LogRejections {
+		return
+	}
+	sender := ""
+	if s.sender != nil {
+		sender = s.sender.Address
+	}
+	s.logf("rejected reason=%s code=%d enhanced=%d.%d.%d user=%q sender=%q remote=%q message=%q",
+		reason, code, enhanced[0], enhanced[1], enhanced[2], s.user, sender, s.remoteAddr, message)
+}
+
 // newSMTPError creates a new smtp.SMTPError with the given code, enhanced code, and message, and reports it to Sentry.
 func newSMTPError(ctx context.Context, code int, enhanced smtp.EnhancedCode, message string) *smtp.SMTPError {
 	err := &smtp.SMTPError{
@@ -3,20 +3,36 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"net"
+	"net/http"
 	"net/mail"
+	"net/textproto"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // mockHandler implements messageHandler for testing.
 type mockHandler struct {
 	called bool
+	sender string
 	msg    *mail.Message
 	err    error
 }
 
-func (m *mockHandler) handleMessage(ctx context.Context, msg *mail.Message) error {
+func (m *mockHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
 	m.called = true
+	m.sender = sender
 	m.msg = msg
 	return m.err
 }
@@ -279,6 +295,683 @@ func TestParseMessageWrapsPlainText(t *testing.T) {
 	}
 }
 
+func TestSessionAuthSenderAccounts(t *testing.T) {
+	tests := []struct {
+		name       string
+		username   string
+		password   string
+		wantErr    bool
+		wantSender string
+	}{
+		{name: "single sender", username: "sender@example.com", password: "password", wantSender: "sender@example.com"},
+		{name: "shared mailbox", username: "Shared@Example.com", password: "shared-secret", wantSender: "shared@example.com"},
+		{name: "wrong password", username: "shared@example.com", password: "password", wantErr: true},
+		{name: "unknown account", username: "unknown@example.com", password: "password", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.SenderAccounts = map[string]string{"shared@example.com": "shared-secret"}
+
+			server, err := session.Auth("PLAIN")
+			if err != nil {
+				t.Fatalf("Auth() error: %v", err)
+			}
+			_, _, err = server.Next([]byte("\x00" + tt.username + "\x00" + tt.password))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PLAIN Next() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			_ = session.Mail(tt.username, nil)
+			_ = session.Rcpt("recipient@example.com", nil)
+			if err := session.Data(bytes.NewReader([]byte("Subject: Test\r\n\r\nHello\r\n"))); err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+			if got := session.handler.(*mockHandler).sender; got != tt.wantSender {
+				t.Fatalf("handler sender = %q, want %q", got, tt.wantSender)
+			}
+		})
+	}
+}
+
+func TestSessionDataAutoSubmitted(t *testing.T) {
+	tests := []struct {
+		name   string
+		config func(*appConfig)
+		header string
+		want   string
+	}{
+		{
+			name:   "disabled",
+			config: func(c *appConfig) {},
+			want:   "",
+		},
+		{
+			name:   "enabled",
+			config: func(c *appConfig) { c.AutoSubmitted = true },
+			want:   "auto-generated",
+		},
+		{
+			name:   "enabled for sender",
+			config: func(c *appConfig) { c.AutoSubmittedFor = []string{"Sender@Example.com"} },
+			want:   "auto-generated",
+		},
+		{
+			name:   "enabled for other sender",
+			config: func(c *appConfig) { c.AutoSubmittedFor = []string{"other@example.com"} },
+			want:   "",
+		},
+		{
+			name:   "existing value preserved",
+			config: func(c *appConfig) { c.AutoSubmitted = true },
+			header: "Auto-Submitted: auto-replied\r\n",
+			want:   "auto-replied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			tt.config(session.config)
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+			_ = session.Rcpt("recipient@example.com", nil)
+
+			raw := "From: sender@example.com\r\nTo: recipient@example.com\r\n" + tt.header + "Subject: Test\r\n\r\nHello\r\n"
+			if err := session.Data(bytes.NewReader([]byte(raw))); err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+
+			mh := session.handler.(*mockHandler)
+			if got := mh.msg.Header.Get("Auto-Submitted"); got != tt.want {
+				t.Fatalf("Auto-Submitted = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionDataContentLength(t *testing.T) {
+	for _, strip := range []bool{true, false} {
+		session := newTestSessionWithT(t)
+		session.config.StripContentLength = strip
+		session.auth = true
+		_ = session.Mail("sender@example.com", nil)
+		_ = session.Rcpt("recipient@example.com", nil)
+
+		raw := "From: sender@example.com\r\nTo: recipient@example.com\r\nContent-Length: 9999\r\nSubject: Test\r\n\r\nHello\r\n"
+		if err := session.Data(bytes.NewReader([]byte(raw))); err != nil {
+			t.Fatalf("Data() error: %v", err)
+		}
+
+		got := session.handler.(*mockHandler).msg.Header.Get("Content-Length")
+		if strip && got != "" {
+			t.Errorf("Content-Length = %q with stripping enabled, want removed", got)
+		}
+		if !strip && got != "9999" {
+			t.Errorf("Content-Length = %q with stripping disabled, want 9999", got)
+		}
+	}
+}
+
+func TestSessionDataMaxHeaderCount(t *testing.T) {
+	var header strings.Builder
+	for i := range 20 {
+		fmt.Fprintf(&header, "X-Header-%d: value\r\n", i)
+	}
+	raw := "From: sender@example.com\r\nTo: recipient@example.com\r\n" + header.String() + "\r\nHello\r\n"
+
+	tests := []struct {
+		name      string
+		limit     int
+		addFields bool // the relay adds Bcc, Message-ID and Date fields
+		wantErr   bool
+	}{
+		{name: "exceeded", limit: 10, wantErr: true},
+		{name: "within limit", limit: 30, wantErr: false},
+		{name: "added fields not counted", limit: 22, addFields: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.MaxHeaderCount = tt.limit
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+			_ = session.Rcpt("recipient@example.com", nil)
+			if tt.addFields {
+				session.config.GenerateMessageID = true
+				session.config.AddMissingDate = true
+				_ = session.Rcpt("hidden@example.com", nil)
+			}
+
+			err := session.Data(strings.NewReader(raw))
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Data() error: %v", err)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 552 {
+				t.Fatalf("Data() error = %v, want 552", err)
+			}
+			if session.handler.(*mockHandler).called {
+				t.Fatal("handler called for message exceeding the header limit")
+			}
+		})
+	}
+}
+
+func TestSessionRcptDomainFilter(t *testing.T) {
+	tests := []struct {
+		name      string
+		allow     []string
+		deny      []string
+		recipient string
+		wantErr   bool
+	}{
+		{name: "no lists", recipient: "user@example.com"},
+		{name: "allowed", allow: []string{"example.com"}, recipient: "user@EXAMPLE.com"},
+		{name: "not in allowlist", allow: []string{"example.com"}, recipient: "user@other.com", wantErr: true},
+		{name: "denied", deny: []string{"example.com"}, recipient: "user@example.com", wantErr: true},
+		{name: "denied overrides allowed", allow: []string{"example.com"}, deny: []string{"example.com"}, recipient: "user@example.com", wantErr: true},
+		{name: "subdomain not allowed", allow: []string{"example.com"}, recipient: "user@mail.example.com", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.RecipientAllowDomains = tt.allow
+			session.config.RecipientDenyDomains = tt.deny
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+
+			err := session.Rcpt(tt.recipient, nil)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Rcpt(%s) error: %v", tt.recipient, err)
+				}
+				if len(session.recipients) != 1 {
+					t.Fatalf("recipients = %v, want %s", session.recipients, tt.recipient)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+				t.Fatalf("Rcpt(%s) error = %v, want 550 5.7.1", tt.recipient, err)
+			}
+			if len(session.recipients) != 0 {
+				t.Fatalf("recipients = %v, want none", session.recipients)
+			}
+		})
+	}
+}
+
+func TestSessionRcptIDN(t *testing.T) {
+	tests := []struct {
+		name      string
+		recipient string
+		allow     []string
+		want      string // "" if rejected
+	}{
+		{name: "unicode domain", recipient: "user@bücher.example", want: "user@xn--bcher-kva.example"},
+		{name: "unicode local part kept", recipient: "müller@bücher.example", want: "müller@xn--bcher-kva.example"},
+		{name: "punycode domain", recipient: "user@xn--bcher-kva.example", want: "user@xn--bcher-kva.example"},
+		{name: "allowlist matches A-label", recipient: "user@bücher.example", allow: []string{"xn--bcher-kva.example"}, want: "user@xn--bcher-kva.example"},
+		{name: "invalid punycode", recipient: "user@xn--zz.example"},
+		{name: "invalid unicode label", recipient: "user@-bücher.example"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.RecipientAllowDomains = tt.allow
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+
+			err := session.Rcpt(tt.recipient, nil)
+			if tt.want == "" {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 1, 3}) {
+					t.Fatalf("Rcpt(%s) error = %v, want 550 5.1.3", tt.recipient, err)
+				}
+				if len(session.recipients) != 0 {
+					t.Fatalf("recipients = %v, want none", session.recipients)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Rcpt(%s) error: %v", tt.recipient, err)
+			}
+			if len(session.recipients) != 1 || session.recipients[0].Address != tt.want {
+				t.Fatalf("recipients = %v, want %s", session.recipients, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionDataIDNHeaderRecipient(t *testing.T) {
+	session := newTestSessionWithT(t)
+	session.auth = true
+	session.user = "sender@example.com"
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	if err := session.Rcpt("user@bücher.example", nil); err != nil {
+		t.Fatalf("Rcpt() error: %v", err)
+	}
+	if err := session.Data(strings.NewReader("From: sender@example.com\r\nTo: user@bücher.example\r\nSubject: Test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+
+	// The header names the recipient in Unicode form, so it must not be added to Bcc again.
+	if got := session.handler.(*mockHandler).msg.Header.Get("Bcc"); got != "" {
+		t.Fatalf("Bcc = %q, want none", got)
+	}
+}
+
+func TestSessionDataAllRecipientsFiltered(t *testing.T) {
+	tests := []struct {
+		name       string
+		recipients []string
+		wantCode   int
+		wantEnh    smtp.EnhancedCode
+	}{
+		{name: "single recipient filtered", recipients: []string{"user@other.com"}, wantCode: 550, wantEnh: smtp.EnhancedCode{5, 1, 1}},
+		{name: "all recipients filtered", recipients: []string{"a@other.com", "b@denied.com"}, wantCode: 550, wantEnh: smtp.EnhancedCode{5, 1, 1}},
+		{name: "no recipients given", wantCode: 503, wantEnh: smtp.EnhancedCode{5, 5, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.RecipientAllowDomains = []string{"example.com", "denied.com"}
+			session.config.RecipientDenyDomains = []string{"denied.com"}
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+			for _, rcpt := range tt.recipients {
+				_ = session.Rcpt(rcpt, nil)
+			}
+
+			err := session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode || smtpErr.EnhancedCode != tt.wantEnh {
+				t.Fatalf("Data() error = %v, want %d %v", err, tt.wantCode, tt.wantEnh)
+			}
+			if session.handler.(*mockHandler).called {
+				t.Fatal("handler called for message without valid recipients")
+			}
+		})
+	}
+}
+
+func TestSessionResetClearsRejectedRecipients(t *testing.T) {
+	session := newTestSessionWithT(t)
+	session.config.RecipientAllowDomains = []string{"example.com"}
+	session.auth = true
+	_ = session.Mail("sender@example.com", nil)
+	_ = session.Rcpt("user@other.com", nil)
+	session.Reset()
+
+	_ = session.Mail("sender@example.com", nil)
+	_ = session.Rcpt("user@example.com", nil)
+	if err := session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+}
+
+func TestSessionRejectionReasons(t *testing.T) {
+	const body = "Subject: Test\r\n\r\nHello\r\n"
+	tests := []struct {
+		name   string
+		reason rejectReason
+		run    func(s *smtpSession) error
+	}{
+		{name: "auth failed", reason: reasonAuthFailed, run: func(s *smtpSession) error {
+			server, _ := s.Auth("PLAIN")
+			_, _, err := server.Next([]byte("\x00sender@example.com\x00wrong"))
+			return err
+		}},
+		{name: "auth required", reason: reasonAuthRequired, run: func(s *smtpSession) error {
+			s.auth = false
+			return s.Mail("sender@example.com", nil)
+		}},
+		{name: "sequence", reason: reasonBadSequence, run: func(s *smtpSession) error {
+			return s.Rcpt("recipient@example.com", nil)
+		}},
+		{name: "invalid sender", reason: reasonInvalidSender, run: func(s *smtpSession) error {
+			return s.Mail("not-an-email", nil)
+		}},
+		{name: "recipient domain policy", reason: reasonRecipientDomain, run: func(s *smtpSession) error {
+			s.config.RecipientDenyDomains = []string{"example.com"}
+			_ = s.Mail("sender@example.com", nil)
+			return s.Rcpt("recipient@example.com", nil)
+		}},
+		{name: "rate limited", reason: reasonRateLimited, run: func(s *smtpSession) error {
+			s.limiter = newRateLimiter(1)
+			s.limiter.allow(s.user)
+			_ = s.Mail("sender@example.com", nil)
+			_ = s.Rcpt("recipient@example.com", nil)
+			return s.Data(strings.NewReader(body))
+		}},
+		{name: "size", reason: reasonMessageTooLarge, run: func(s *smtpSession) error {
+			s.handler = &mockHandler{err: fmt.Errorf("encode: %w", errMessageTooLarge)}
+			_ = s.Mail("sender@example.com", nil)
+			_ = s.Rcpt("recipient@example.com", nil)
+			return s.Data(strings.NewReader(body))
+		}},
+		{name: "relay failed", reason: reasonRelayFailed, run: func(s *smtpSession) error {
+			s.handler = &mockHandler{err: errors.New("graph unavailable")}
+			_ = s.Mail("sender@example.com", nil)
+			_ = s.Rcpt("recipient@example.com", nil)
+			return s.Data(strings.NewReader(body))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			session := newTestSessionWithT(t)
+			session.config.LogRejections = true
+			session.logger = log.New(&buf, "", 0)
+			session.auth = true
+			session.user = "sender@example.com"
+
+			err := tt.run(session)
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) {
+				t.Fatalf("error = %v, want *smtp.SMTPError", err)
+			}
+			want := fmt.Sprintf("rejected reason=%s code=%d ", tt.reason, smtpErr.Code)
+			if !strings.HasPrefix(buf.String(), want) {
+				t.Fatalf("log = %q, want prefix %q", buf.String(), want)
+			}
+		})
+	}
+}
+
+func TestSessionRejectionLoggingDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	session := newTestSessionWithT(t)
+	session.logger = log.New(&buf, "", 0)
+
+	if err := session.Mail("sender@example.com", nil); err == nil {
+		t.Fatal("Mail() error = nil, want authentication required")
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("log = %q, want none when LOG_REJECTIONS is off", buf.String())
+	}
+}
+
+// tooLargeReader returns data and then go-smtp's size limit error, as the DATA reader does
+// once MaxMessageBytes is exceeded.
+type tooLargeReader struct {
+	data io.Reader
+}
+
+func (r *tooLargeReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, smtp.ErrDataTooLarge
+	}
+	return n, err
+}
+
+func TestSessionDataMaxMessageBytes(t *testing.T) {
+	const raw = "Subject: Test\r\n\r\n0123456789\r\n"
+	tests := []struct {
+		name    string
+		limit   int64
+		reader  func() io.Reader
+		wantErr bool
+	}{
+		{name: "oversized reader", limit: 10, reader: func() io.Reader { return strings.NewReader(raw) }, wantErr: true},
+		{name: "server size error", limit: 1000, reader: func() io.Reader { return &tooLargeReader{data: strings.NewReader(raw)} }, wantErr: true},
+		{name: "exactly at limit", limit: int64(len(raw)), reader: func() io.Reader { return strings.NewReader(raw) }},
+		{name: "no limit", reader: func() io.Reader { return strings.NewReader(raw) }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.MaxMessageBytes = tt.limit
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+			_ = session.Rcpt("recipient@example.com", nil)
+
+			err := session.Data(tt.reader())
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Data() error: %v", err)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 552 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+				t.Fatalf("Data() error = %v, want 552 5.3.4", err)
+			}
+			if want := fmt.Sprintf("maximum size of %d bytes", tt.limit); !strings.Contains(smtpErr.Message, want) {
+				t.Fatalf("Data() message = %q, want it to contain %q", smtpErr.Message, want)
+			}
+			if session.handler.(*mockHandler).called {
+				t.Fatal("handler called for oversized message")
+			}
+		})
+	}
+}
+
+func TestSessionDataMaxHeaderLineBytes(t *testing.T) {
+	long := "X-Long: " + strings.Repeat("a", 1<<20) + "\r\n"
+	folded := "X-Folded: " + strings.Repeat("a", 600) + "\r\n " + strings.Repeat("b", 600) + "\r\n"
+
+	tests := []struct {
+		name    string
+		header  string
+		limit   int
+		rcpts   int // recipients beyond the first, added to the header as Bcc by the relay
+		wantErr bool
+	}{
+		{name: "pathologically long header", header: long, limit: 64 * 1024, wantErr: true},
+		{name: "folded header over limit", header: folded, limit: 1000, wantErr: true},
+		{name: "within limit", header: folded, limit: 2000},
+		{name: "added fields not measured", limit: 1000, rcpts: 50},
+		{name: "disabled", header: long},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.MaxHeaderLineBytes = tt.limit
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+			_ = session.Rcpt("recipient@example.com", nil)
+			for i := range tt.rcpts {
+				if err := session.Rcpt(fmt.Sprintf("recipient%d@example.com", i), nil); err != nil {
+					t.Fatalf("Rcpt() error: %v", err)
+				}
+			}
+
+			err := session.Data(strings.NewReader("Subject: Test\r\n" + tt.header + "\r\nHello\r\n"))
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Data() error: %v", err)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 552 || !strings.Contains(smtpErr.Message, "too long") {
+				t.Fatalf("Data() error = %v, want 552 header field too long", err)
+			}
+			if session.handler.(*mockHandler).called {
+				t.Fatal("handler called for message with an overlong header field")
+			}
+		})
+	}
+}
+
+func TestSessionDataMaxHeaderBytes(t *testing.T) {
+	var many strings.Builder
+	for i := range 200 {
+		fmt.Fprintf(&many, "X-Header-%d: value\r\n", i)
+	}
+	long := "X-Long: " + strings.Repeat("a", 8*1024) + "\r\n"
+
+	tests := []struct {
+		name    string
+		header  string
+		limit   int
+		rcpts   int // recipients beyond the first, added to the header as Bcc by the relay
+		wantErr bool
+	}{
+		{name: "many headers", header: many.String(), limit: 4096, wantErr: true},
+		{name: "one long header", header: long, limit: 4096, wantErr: true},
+		{name: "within limit", header: long, limit: 16 * 1024},
+		{name: "added fields not measured", limit: 1000, rcpts: 50},
+		{name: "disabled", header: many.String() + long},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.MaxHeaderBytes = tt.limit
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+			_ = session.Rcpt("recipient@example.com", nil)
+			for i := range tt.rcpts {
+				if err := session.Rcpt(fmt.Sprintf("recipient%d@example.com", i), nil); err != nil {
+					t.Fatalf("Rcpt() error: %v", err)
+				}
+			}
+
+			err := session.Data(strings.NewReader("Subject: Test\r\n" + tt.header + "\r\nHello\r\n"))
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("Data() error: %v", err)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 552 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 3, 4}) {
+				t.Fatalf("Data() error = %v, want 552 5.3.4", err)
+			}
+			if !strings.Contains(smtpErr.Message, "header too large") {
+				t.Errorf("Data() message = %q, want header too large", smtpErr.Message)
+			}
+			if session.handler.(*mockHandler).called {
+				t.Fatal("handler called for message exceeding the header size limit")
+			}
+		})
+	}
+}
+
+func TestSessionAuthIdleTimeout(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	session := newTestSessionWithT(t)
+	session.config.AuthSessionTimeout = time.Minute
+	session.now = func() time.Time { return now }
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer client.Close()
+	if session.conn, err = ln.Accept(); err != nil {
+		t.Fatalf("Accept() error: %v", err)
+	}
+	defer session.conn.Close()
+
+	authenticate := func() {
+		t.Helper()
+		server, _ := session.Auth("PLAIN")
+		if _, _, err := server.Next([]byte("\x00sender@example.com\x00password")); err != nil {
+			t.Fatalf("PLAIN Next() error: %v", err)
+		}
+	}
+
+	authenticate()
+	now = now.Add(50 * time.Second)
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() within timeout error: %v", err)
+	}
+	now = now.Add(50 * time.Second) // activity above restarted the idle period
+	if err := session.Rcpt("recipient@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() within timeout error: %v", err)
+	}
+
+	now = now.Add(61 * time.Second)
+	err = session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 421 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 7, 0}) {
+		t.Fatalf("Data() after idle timeout error = %v, want 421 4.7.0", err)
+	}
+	if session.auth || session.sender != nil || len(session.recipients) != 0 {
+		t.Fatal("idle session kept its authentication or transaction")
+	}
+	if session.handler.(*mockHandler).called {
+		t.Fatal("handler called after idle timeout")
+	}
+	// The connection is closed for reading, so that the server ends the session after the reply.
+	if _, err := session.conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() after idle timeout error = %v, want EOF", err)
+	}
+}
+
+// slowHandler delays each message and records the delay as send time.
+type slowHandler struct {
+	delay time.Duration
+}
+
+func (h *slowHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	time.Sleep(h.delay)
+	timingsFrom(ctx).addSend(h.delay)
+	return nil
+}
+
+func TestSessionDataSlowTransaction(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold time.Duration
+		wantLog   bool
+	}{
+		{name: "slow", threshold: 10 * time.Millisecond, wantLog: true},
+		{name: "fast", threshold: time.Minute, wantLog: false},
+		{name: "disabled", threshold: 0, wantLog: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			session := newTestSessionWithT(t)
+			session.config.SlowTransactionThreshold = tt.threshold
+			session.logger = log.New(&buf, "", 0)
+			session.handler = &slowHandler{delay: 20 * time.Millisecond}
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+			_ = session.Rcpt("recipient@example.com", nil)
+
+			if err := session.Data(bytes.NewReader([]byte("Subject: Test\r\n\r\nHello\r\n"))); err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+
+			got := buf.String()
+			if tt.wantLog != strings.Contains(got, "slow transaction") {
+				t.Fatalf("log = %q, want slow transaction warning %v", got, tt.wantLog)
+			}
+			if tt.wantLog && !strings.Contains(got, "send 20ms") {
+				t.Fatalf("log = %q, want send time breakdown", got)
+			}
+		})
+	}
+}
+
 func mustAddress(t *testing.T, value string) *mail.Address {
 	t.Helper()
 	addr, err := mail.ParseAddress(value)
@@ -296,3 +989,1109 @@ func addressList(t *testing.T, msg *mail.Message, field string) []*mail.Address
 	}
 	return addrs
 }
+
+func TestSessionDataAllowedSendAs(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     []string
+		sendAs      string
+		mailFrom    string // MAIL FROM, defaults to the From address
+		from        string
+		wantMailbox string
+		wantCode    int
+	}{
+		{name: "no list", from: "someone@example.com", wantMailbox: "sender@example.com"},
+		{name: "allowed From", allowed: []string{"shared@example.com"}, from: "Shared <Shared@example.com>", wantMailbox: "shared@example.com"},
+		{name: "own address", allowed: []string{"shared@example.com"}, from: "sender@example.com", wantMailbox: "sender@example.com"},
+		{name: "own send-as mailbox", allowed: []string{"shared@example.com"}, sendAs: "relay@example.com", from: "relay@example.com", wantMailbox: "relay@example.com"},
+		{name: "allowed From overrides send-as", allowed: []string{"shared@example.com"}, sendAs: "relay@example.com", from: "shared@example.com", wantMailbox: "shared@example.com"},
+		{name: "disallowed From", allowed: []string{"shared@example.com"}, from: "ceo@example.com", wantCode: 550},
+		{name: "From not matching MAIL FROM", allowed: []string{"shared@example.com"}, mailFrom: "ceo@example.com", from: "shared@example.com", wantCode: 550},
+		{name: "malformed From", allowed: []string{"shared@example.com"}, mailFrom: "sender@example.com", from: "shared@", wantMailbox: "sender@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &mockHandler{}
+			session := newTestSessionWithT(t)
+			session.config.AllowedSendAs = tt.allowed
+			session.config.GraphSendAs = tt.sendAs
+			session.handler = h
+			session.auth = true
+			session.user = "sender@example.com"
+			mailFrom := tt.mailFrom
+			if mailFrom == "" {
+				mailFrom = mustAddress(t, tt.from).Address
+			}
+			if err := session.Mail(mailFrom, nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+
+			err := session.Data(strings.NewReader("From: " + tt.from + "\r\nSubject: Test\r\n\r\nHello\r\n"))
+			if tt.wantCode != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+					t.Fatalf("Data() error = %v, want %d 5.7.1", err, tt.wantCode)
+				}
+				if h.called {
+					t.Fatal("handler called for a rejected From address")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+			if h.sender != tt.wantMailbox {
+				t.Fatalf("mailbox = %q, want %q", h.sender, tt.wantMailbox)
+			}
+		})
+	}
+}
+
+func TestSessionDataSingleDomainPerMessage(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		recipients []string
+		wantReject bool
+	}{
+		{name: "single domain", enabled: true, recipients: []string{"a@example.com", "b@example.com"}},
+		{name: "domain case", enabled: true, recipients: []string{"a@example.com", "b@EXAMPLE.com"}},
+		{name: "multiple domains", enabled: true, recipients: []string{"a@example.com", "b@example.org"}, wantReject: true},
+		{name: "subdomain", enabled: true, recipients: []string{"a@example.com", "b@mail.example.com"}, wantReject: true},
+		{name: "disabled", recipients: []string{"a@example.com", "b@example.org"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &mockHandler{}
+			session := newTestSessionWithT(t)
+			session.config.SingleDomainPerMessage = tt.enabled
+			session.handler = h
+			session.auth = true
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			for _, rcpt := range tt.recipients {
+				if err := session.Rcpt(rcpt, nil); err != nil {
+					t.Fatalf("Rcpt(%s) error: %v", rcpt, err)
+				}
+			}
+
+			err := session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+			if !tt.wantReject {
+				if err != nil || !h.called {
+					t.Fatalf("Data() error = %v, handler called = %v, want relayed", err, h.called)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+				t.Fatalf("Data() error = %v, want 550 5.7.1", err)
+			}
+			if h.called {
+				t.Fatal("handler called for a message to multiple domains")
+			}
+		})
+	}
+}
+
+func TestSessionDataSenderHeaders(t *testing.T) {
+	headers := map[string]map[string]string{
+		"sender@example.com": {"X-Organization-Id": "contoso", "X-Cost-Center": "4711"},
+		"shared@example.com": {"X-Organization-Id": "fabrikam"},
+	}
+	tests := []struct {
+		name string
+		user string
+		want map[string]string // header to value; "" means absent
+	}{
+		{name: "sender", user: "sender@example.com", want: map[string]string{"X-Organization-Id": "contoso", "X-Cost-Center": "4711"}},
+		{name: "sender case", user: "Sender@Example.com", want: map[string]string{"X-Organization-Id": "contoso", "X-Cost-Center": "4711"}},
+		{name: "other sender", user: "shared@example.com", want: map[string]string{"X-Organization-Id": "fabrikam", "X-Cost-Center": ""}},
+		{name: "unmapped sender", user: "other@example.com", want: map[string]string{"X-Organization-Id": "spoofed", "X-Cost-Center": ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &mockHandler{}
+			session := newTestSessionWithT(t)
+			session.config.SenderHeaders = headers
+			session.handler = h
+			session.auth = true
+			session.user = tt.user
+			if err := session.Mail(tt.user, nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+
+			// The client's own X-Organization-ID must not survive for a mapped sender.
+			msg := "From: " + tt.user + "\r\nTo: recipient@example.com\r\nX-Organization-ID: spoofed\r\nSubject: Test\r\n\r\nHello\r\n"
+			if err := session.Data(strings.NewReader(msg)); err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+			for name, want := range tt.want {
+				if got := h.msg.Header[name]; want == "" && len(got) != 0 || want != "" && !slices.Equal(got, []string{want}) {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionDataEnforceFromMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		enforce  bool
+		allowed  []string
+		from     string // From header, omitted if empty
+		wantFrom string
+		wantCode int
+	}{
+		{name: "matching", enforce: true, from: "Sender <Sender@example.com>", wantFrom: "Sender@example.com"},
+		{name: "allowed send-as", enforce: true, allowed: []string{"shared@example.com"}, from: "shared@example.com", wantFrom: "shared@example.com"},
+		{name: "mismatching strict", enforce: true, from: "ceo@example.com", wantCode: 550},
+		{name: "missing strict", enforce: true, wantCode: 550},
+		{name: "mismatching lenient", from: "ceo@example.com", wantFrom: "sender@example.com"},
+		{name: "missing lenient", wantFrom: "sender@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &mockHandler{}
+			session := newTestSessionWithT(t)
+			if tt.enforce {
+				session.config.FromPolicy = fromPolicyReject
+			}
+			session.config.AllowedSendAs = tt.allowed
+			session.handler = h
+			session.auth = true
+			session.user = "sender@example.com"
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+
+			msg := "To: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n"
+			if tt.from != "" {
+				msg = "From: " + tt.from + "\r\n" + msg
+			}
+			err := session.Data(strings.NewReader(msg))
+			if tt.wantCode != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+					t.Fatalf("Data() error = %v, want %d 5.7.1", err, tt.wantCode)
+				}
+				if h.called {
+					t.Fatal("handler called for a mismatching From address")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+			if got := fromAddress(h.msg.Header); got != tt.wantFrom {
+				t.Fatalf("From = %q, want %q", got, tt.wantFrom)
+			}
+		})
+	}
+}
+
+func TestSessionDataCrossSenderFrom(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string // FROM_POLICY
+		user     string
+		mailFrom string
+		from     string
+		allowed  []string
+		wantFrom string
+		wantCode int
+	}{
+		{name: "own address", user: "other@example.com", mailFrom: "other@example.com", from: "other@example.com", wantFrom: "other@example.com"},
+		{name: "other sender rewrite", user: "other@example.com", mailFrom: "other@example.com", from: "sender@example.com", wantFrom: "other@example.com"},
+		{name: "other sender as MAIL FROM", user: "other@example.com", mailFrom: "sender@example.com", from: "sender@example.com", wantCode: 550},
+		{name: "other sender allow", policy: fromPolicyAllow, user: "other@example.com", mailFrom: "other@example.com", from: "Sender <SENDER@example.com>", wantCode: 550},
+		{name: "other sender reject", policy: fromPolicyReject, user: "sender@example.com", mailFrom: "sender@example.com", from: "other@example.com", wantCode: 550},
+		{name: "other sender in allowed send-as", policy: fromPolicyAllow, allowed: []string{"sender@example.com"}, user: "other@example.com", mailFrom: "other@example.com", from: "sender@example.com", wantFrom: "sender@example.com"},
+		{name: "non-sender allow", policy: fromPolicyAllow, user: "other@example.com", mailFrom: "other@example.com", from: "noreply@example.com", wantFrom: "noreply@example.com"},
+		{name: "per-sender reject", user: "strict@example.com", mailFrom: "strict@example.com", from: "noreply@example.com", wantCode: 550},
+		{name: "per-sender reject overrides allow", policy: fromPolicyAllow, user: "strict@example.com", mailFrom: "strict@example.com", from: "noreply@example.com", wantCode: 550},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &mockHandler{}
+			session := newTestSessionWithT(t)
+			session.config.SenderAccounts = map[string]string{"other@example.com": "secret", "strict@example.com": "secret"}
+			session.config.FromPolicy = tt.policy
+			session.config.SenderFromPolicies = map[string]string{"strict@example.com": fromPolicyReject}
+			session.config.AllowedSendAs = tt.allowed
+			session.handler = h
+			session.authenticated(tt.user)
+			if err := session.Mail(tt.mailFrom, nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+
+			err := session.Data(strings.NewReader("From: " + tt.from + "\r\nTo: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n"))
+			if tt.wantCode != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+					t.Fatalf("Data() error = %v, want %d 5.7.1", err, tt.wantCode)
+				}
+				if h.called {
+					t.Fatal("handler called for a rejected From address")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+			if got := fromAddress(h.msg.Header); got != tt.wantFrom {
+				t.Fatalf("From = %q, want %q", got, tt.wantFrom)
+			}
+		})
+	}
+}
+
+// clockReader returns one chunk per read, advancing the session clock by step before each.
+type clockReader struct {
+	chunks []string
+	now    *time.Time
+	step   time.Duration
+}
+
+func (r *clockReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	*r.now = r.now.Add(r.step)
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestSessionDataStartTimeout(t *testing.T) {
+	chunks := []string{"Subject: Test\r\n", "\r\n", "Hello\r\n"}
+	tests := []struct {
+		name     string
+		timeout  time.Duration
+		delay    time.Duration // between RCPT TO and DATA
+		step     time.Duration // before each chunk of the message
+		wantCode int
+	}{
+		{name: "disabled", delay: time.Hour, step: time.Hour},
+		{name: "within timeout", timeout: time.Minute, delay: 20 * time.Second, step: 10 * time.Second},
+		{name: "slow DATA start", timeout: time.Minute, delay: time.Minute, wantCode: 451},
+		{name: "slow message data", timeout: time.Minute, delay: 20 * time.Second, step: 15 * time.Second, wantCode: 451},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+			session := newTestSessionWithT(t)
+			session.config.DataStartTimeout = tt.timeout
+			session.now = func() time.Time { return now }
+			session.auth = true
+			session.user = "sender@example.com"
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+
+			now = now.Add(tt.delay)
+			err := session.Data(&clockReader{chunks: slices.Clone(chunks), now: &now, step: tt.step})
+			called := session.handler.(*mockHandler).called
+			if tt.wantCode == 0 {
+				if err != nil || !called {
+					t.Fatalf("Data() error = %v, handler called = %v, want accepted", err, called)
+				}
+				return
+			}
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 4, 2}) {
+				t.Fatalf("Data() error = %v, want %d 4.4.2", err, tt.wantCode)
+			}
+			if called {
+				t.Fatal("handler called after DATA_START_TIMEOUT")
+			}
+		})
+	}
+}
+
+// corruptingHandler replaces the raw header block of each message with a malformed one, so that
+// it can no longer be encoded, before passing it to next.
+type corruptingHandler struct {
+	next messageHandler
+}
+
+func (h *corruptingHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	if rb, ok := msg.Body.(*rawBody); ok {
+		rb.header = []byte("not a header\r\n\r\n")
+	}
+	return h.next.handleMessage(ctx, sender, msg)
+}
+
+func TestSessionDataRelayFailures(t *testing.T) {
+	tests := []struct {
+		name         string
+		handler      func() messageHandler
+		wantCode     int
+		wantEnhanced smtp.EnhancedCode
+		wantMessage  string // checked if not empty
+	}{
+		{
+			name: "token failure",
+			handler: func() messageHandler {
+				return &graphMailHandler{
+					config: &appConfig{TokenRetryInterval: time.Second, TokenRetryMaxInterval: time.Second},
+					cred:   &stubCredential{err: errors.New("AADSTS7000222: the provided client secret keys are expired")},
+				}
+			},
+			wantCode:     454,
+			wantEnhanced: smtp.EnhancedCode{4, 7, 0},
+		},
+		{
+			name:         "graph busy",
+			handler:      func() messageHandler { return &mockHandler{err: errSendBusy} },
+			wantCode:     450,
+			wantEnhanced: smtp.EnhancedCode{4, 7, 1},
+		},
+		{
+			name: "graph error",
+			handler: func() messageHandler {
+				return &mockHandler{err: fmt.Errorf("sendRawMimeMail: %w", &graphError{
+					StatusCode: http.StatusBadRequest,
+					Status:     "400 Bad Request",
+					Body:       `{"error":{"code":"ErrorInvalidRecipients","message":"At least one recipient isn't valid."}}`,
+				})}
+			},
+			wantCode:     550,
+			wantEnhanced: smtp.EnhancedCode{5, 1, 3},
+			wantMessage:  "Microsoft Graph rejected the message: ErrorInvalidRecipients: At least one recipient isn't valid.",
+		},
+		{
+			name: "encode failure",
+			handler: func() messageHandler {
+				return &corruptingHandler{next: &graphMailHandler{config: &appConfig{}}}
+			},
+			wantCode:     550,
+			wantEnhanced: smtp.EnhancedCode{5, 6, 0},
+			wantMessage:  `message could not be encoded for relay: malformed MIME header: missing colon: "not a header"`,
+		},
+		{
+			name:         "send failure",
+			handler:      func() messageHandler { return &mockHandler{err: errors.New("graph API error: 400 Bad Request")} },
+			wantCode:     554,
+			wantEnhanced: smtp.EnhancedCode{5, 3, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.handler = tt.handler()
+			session.auth = true
+			session.user = "sender@example.com"
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+			err := session.Data(strings.NewReader("From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Test\r\n\r\nHello\r\n"))
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode || smtpErr.EnhancedCode != tt.wantEnhanced {
+				t.Fatalf("Data() error = %v, want %d %v", err, tt.wantCode, tt.wantEnhanced)
+			}
+			if tt.wantMessage != "" && smtpErr.Message != tt.wantMessage {
+				t.Fatalf("Data() message = %q, want %q", smtpErr.Message, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func TestSessionDataDedupeCc(t *testing.T) {
+	tests := []struct {
+		name    string
+		dedupe  bool
+		headers string
+		wantCc  string // "" for no Cc header
+	}{
+		{
+			name:    "disabled",
+			headers: "To: a@example.com\r\nCc: a@example.com, b@example.com\r\n",
+			wantCc:  "a@example.com, b@example.com",
+		},
+		{
+			name:    "duplicate removed",
+			dedupe:  true,
+			headers: "To: A <a@example.com>, c@example.com\r\nCc: a@example.com, b@example.com\r\n",
+			wantCc:  "<b@example.com>",
+		},
+		{
+			name:    "case-insensitive",
+			dedupe:  true,
+			headers: "To: a@example.com\r\nCc: \"A\" <A@Example.com>, b@example.com\r\n",
+			wantCc:  "<b@example.com>",
+		},
+		{
+			name:    "all duplicates",
+			dedupe:  true,
+			headers: "To: a@example.com, b@example.com\r\nCc: b@example.com, a@example.com\r\n",
+		},
+		{
+			name:    "no duplicates",
+			dedupe:  true,
+			headers: "To: a@example.com\r\nCc: \"B\" <b@example.com>\r\n",
+			wantCc:  "\"B\" <b@example.com>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.DedupeCc = tt.dedupe
+			session.auth = true
+			session.user = "sender@example.com"
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			for _, rcpt := range []string{"a@example.com", "b@example.com"} {
+				if err := session.Rcpt(rcpt, nil); err != nil {
+					t.Fatalf("Rcpt() error: %v", err)
+				}
+			}
+			if err := session.Data(strings.NewReader("From: sender@example.com\r\n" + tt.headers + "Subject: Test\r\n\r\nHello\r\n")); err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+			h := session.handler.(*mockHandler)
+			if got := h.msg.Header.Get("Cc"); got != tt.wantCc {
+				t.Fatalf("Cc = %q, want %q", got, tt.wantCc)
+			}
+			// Every recipient is still addressed, so delivery is unchanged.
+			if got := recipientHeaderSet(h.msg.Header); len(got) < 2 {
+				t.Fatalf("header recipients = %v, want a@example.com and b@example.com", got)
+			}
+		})
+	}
+}
+
+func TestSessionDataRelayHeaders(t *testing.T) {
+	defer func(r string) { revision = r }(revision)
+	revision = "1a2b3c4"
+	now := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		enabled bool
+		want    []string
+	}{
+		{name: "disabled"},
+		{name: "enabled", enabled: true, want: []string{
+			"X-Relayed-By: smtp2graph/1a2b3c4\r\n",
+			"X-Relay-Timestamp: Tue, 02 Jan 2024 15:04:05 +0000\r\n",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.AddRelayHeaders = tt.enabled
+			session.now = func() time.Time { return now }
+			session.auth = true
+			session.user = "sender@example.com"
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+			// A client-set X-Relayed-By is replaced rather than trusted.
+			msg := "From: sender@example.com\r\nTo: recipient@example.com\r\nX-Relayed-By: forged\r\nSubject: Test\r\n\r\nHello\r\n"
+			if err := session.Data(strings.NewReader(msg)); err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+			encoded, err := encodeMailMessage(session.handler.(*mockHandler).msg)
+			if err != nil {
+				t.Fatalf("encodeMailMessage() error: %v", err)
+			}
+			for _, line := range tt.want {
+				if !bytes.Contains(encoded, []byte(line)) {
+					t.Errorf("encoded message missing %q:\n%s", line, encoded)
+				}
+			}
+			if kept := bytes.Contains(encoded, []byte("forged")); kept == tt.enabled {
+				t.Errorf("client X-Relayed-By kept = %v, want %v", kept, !tt.enabled)
+			}
+			if !tt.enabled && bytes.Contains(encoded, []byte("X-Relay-Timestamp")) {
+				t.Errorf("encoded message has X-Relay-Timestamp with ADD_RELAY_HEADERS unset:\n%s", encoded)
+			}
+		})
+	}
+}
+
+func TestSessionDataStrictRecipientMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		strict   bool
+		headers  string
+		wantCode int    // 0 if the message is relayed
+		wantBcc  string // Bcc of the relayed message
+	}{
+		{
+			name:    "matching",
+			strict:  true,
+			headers: "To: a@example.com\r\nCc: B <b@example.com>\r\n",
+		},
+		{
+			name:    "partially matching",
+			strict:  true,
+			headers: "To: a@example.com\r\n",
+			wantBcc: "<b@example.com>",
+		},
+		{
+			name:     "not matching",
+			strict:   true,
+			headers:  "To: other@example.com\r\n",
+			wantCode: 550,
+		},
+		{
+			name:     "no recipient headers",
+			strict:   true,
+			wantCode: 550,
+		},
+		{
+			name:    "not matching without strict",
+			headers: "To: other@example.com\r\n",
+			wantBcc: "<a@example.com>, <b@example.com>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.StrictRecipientMatch = tt.strict
+			session.auth = true
+			session.user = "sender@example.com"
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			for _, rcpt := range []string{"a@example.com", "b@example.com"} {
+				if err := session.Rcpt(rcpt, nil); err != nil {
+					t.Fatalf("Rcpt() error: %v", err)
+				}
+			}
+			err := session.Data(strings.NewReader("From: sender@example.com\r\n" + tt.headers + "Subject: Test\r\n\r\nHello\r\n"))
+			h := session.handler.(*mockHandler)
+			if tt.wantCode != 0 {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != tt.wantCode {
+					t.Fatalf("Data() error = %v, want %d", err, tt.wantCode)
+				}
+				if h.called {
+					t.Fatal("handler called for a rejected message")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+			if got := h.msg.Header.Get("Bcc"); got != tt.wantBcc {
+				t.Fatalf("Bcc = %q, want %q", got, tt.wantBcc)
+			}
+		})
+	}
+}
+
+func TestSessionDataPlainTextRecipients(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		t.Run(fmt.Sprintf("strict=%v", strict), func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.StrictRecipientMatch = strict
+			session.auth = true
+			session.user = "sender@example.com"
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			const n = 40
+			for i := range n {
+				if err := session.Rcpt(fmt.Sprintf("rcpt%d@example.com", i), nil); err != nil {
+					t.Fatalf("Rcpt() error: %v", err)
+				}
+			}
+			if err := session.Data(strings.NewReader("plain body without headers")); err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+
+			h := session.handler.(*mockHandler)
+			if got := addressList(t, h.msg, "To"); len(got) != 0 {
+				t.Fatalf("To = %v, want no addresses", got)
+			}
+			if got := addressList(t, h.msg, "Bcc"); len(got) != n {
+				t.Fatalf("Bcc has %d addresses, want %d", len(got), n)
+			}
+			encoded, err := encodeMailMessage(h.msg)
+			if err != nil {
+				t.Fatalf("encodeMailMessage() error: %v", err)
+			}
+			header, _, _ := strings.Cut(string(encoded), "\r\n\r\n")
+			if !strings.Contains(header+"\r\n", "To: undisclosed-recipients:;\r\n") {
+				t.Fatalf("header = %q, want To: undisclosed-recipients:;", header)
+			}
+		})
+	}
+}
+
+// serveTestSMTP serves srv on a local port, through the listener returned by wrap if it is not
+// nil, until the test ends, and returns its address.
+func serveTestSMTP(t *testing.T, srv *smtp.Server, wrap func(net.Listener) net.Listener) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	addr := ln.Addr().String()
+	if wrap != nil {
+		ln = wrap(ln)
+	}
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return addr
+}
+
+// testSMTPConn is a client connection to a test SMTP server.
+type testSMTPConn struct {
+	*textproto.Conn
+	t *testing.T
+}
+
+// dialTestSMTP connects to the SMTP server at addr until the test ends.
+func dialTestSMTP(t *testing.T, addr string) *testSMTPConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	c := &testSMTPConn{Conn: textproto.NewConn(conn), t: t}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// cmd sends a command line unless format is empty, reads the reply and fails the test unless
+// its code is wantCode.
+func (c *testSMTPConn) cmd(wantCode int, format string, args ...any) (int, string) {
+	c.t.Helper()
+	if format != "" {
+		if err := c.PrintfLine(format, args...); err != nil {
+			c.t.Fatalf("%s: %v", format, err)
+		}
+	}
+	code, msg, err := c.ReadResponse(wantCode)
+	if err != nil {
+		c.t.Fatalf("%q: %v", format, err)
+	}
+	return code, msg
+}
+
+func TestSessionDataBDAT(t *testing.T) {
+	h := &mockHandler{}
+	cfg := &appConfig{SenderEmail: "sender@example.com", SenderPassword: "password"}
+	srv := smtp.NewServer(&smtpBackend{config: cfg, ctx: t.Context(), handler: h})
+	srv.AllowInsecureAuth = true
+	srv.EnableBINARYMIME = true
+	c := dialTestSMTP(t, serveTestSMTP(t, srv, nil))
+
+	// A body with NUL and 8-bit bytes, bare CR and LF, and a lone dot that DATA would have stuffed.
+	header := "From: sender@example.com\r\nTo: recipient@example.com\r\nSubject: Binary\r\n" +
+		"Content-Type: application/octet-stream\r\nContent-Transfer-Encoding: binary\r\n\r\n"
+	body := "line one\r\n\x00\x01\xfe\xff\r\nbare\nlf and bare\rcr\r\n.\r\n..\r\nend"
+	raw := header + body
+	split := len(header) + 9 // within the CRLF ending the first body line
+
+	c.cmd(220, "")
+	_, ehlo := c.cmd(250, "EHLO localhost")
+	for _, ext := range []string{"CHUNKING", "BINARYMIME"} {
+		if !strings.Contains(ehlo, ext) {
+			t.Fatalf("EHLO response %q does not offer %s", ehlo, ext)
+		}
+	}
+	c.cmd(235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00sender@example.com\x00password")))
+	c.cmd(250, "MAIL FROM:<sender@example.com> BODY=BINARYMIME")
+	c.cmd(250, "RCPT TO:<recipient@example.com>")
+	for i, chunk := range []string{raw[:split], raw[split:]} {
+		last := ""
+		if i == 1 {
+			last = " LAST"
+		}
+		fmt.Fprintf(c.W, "BDAT %d%s\r\n%s", len(chunk), last, chunk)
+		if err := c.W.Flush(); err != nil {
+			t.Fatalf("BDAT: %v", err)
+		}
+		c.cmd(250, "")
+	}
+	c.cmd(221, "QUIT")
+
+	if !h.called {
+		t.Fatal("handler not called")
+	}
+	got, err := io.ReadAll(h.msg.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	if string(got) != body {
+		t.Fatalf("body = %q, want %q", got, body)
+	}
+}
+
+func TestSMTPUnsupportedCommands(t *testing.T) {
+	cfg := &appConfig{SenderEmail: "sender@example.com", SenderPassword: "password"}
+	srv := smtp.NewServer(&smtpBackend{config: cfg, ctx: t.Context(), handler: &mockHandler{}})
+	srv.AllowInsecureAuth = true
+	addr := serveTestSMTP(t, srv, nil)
+
+	tests := []struct {
+		command  string
+		wantCode int
+		wantMsg  string
+	}{
+		{command: "VRFY recipient@example.com", wantCode: 252, wantMsg: "2.5.0"},
+		{command: "VRFY postmaster", wantCode: 252, wantMsg: "2.5.0"},
+		{command: "EXPN staff", wantCode: 502, wantMsg: "5.5.1"},
+		{command: "HELP", wantCode: 502, wantMsg: "5.5.1"},
+		{command: "TURN", wantCode: 502, wantMsg: "5.5.1"},
+		{command: "XYZZ now", wantCode: 500, wantMsg: "5.5.2"},
+		{command: "XYZZY", wantCode: 501, wantMsg: "5.5.2"},
+		{command: "MAIL FROM:<sender@example.com> RET=HDRS", wantCode: 504, wantMsg: "5.5.4"},
+		{command: "MAIL FROM:<sender@example.com> ENVID=id", wantCode: 504, wantMsg: "5.5.4"},
+	}
+
+	for _, authenticated := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s authenticated=%v", tt.command, authenticated), func(t *testing.T) {
+				c := dialTestSMTP(t, addr)
+				c.cmd(220, "")
+				c.cmd(250, "EHLO localhost")
+				if authenticated {
+					c.cmd(235, "AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00sender@example.com\x00password")))
+				}
+				code, msg := c.cmd(tt.wantCode, "%s", tt.command)
+				if !strings.HasPrefix(msg, tt.wantMsg) {
+					t.Errorf("%s = %d %q, want %d %s", tt.command, code, msg, tt.wantCode, tt.wantMsg)
+				}
+				if strings.Contains(msg, "example.com") {
+					t.Errorf("%s response %q reveals the address", tt.command, msg)
+				}
+				// The session is still usable afterwards.
+				c.cmd(250, "NOOP")
+			})
+		}
+	}
+}
+
+func TestSMTPVRFYDisabled(t *testing.T) {
+	cfg := &appConfig{SenderEmail: "sender@example.com", SenderPassword: "password"}
+	srv := smtp.NewServer(&smtpBackend{config: cfg, ctx: t.Context(), handler: &mockHandler{}})
+	srv.AllowInsecureAuth = true
+	c := dialTestSMTP(t, serveTestSMTP(t, srv, func(ln net.Listener) net.Listener { return &noVRFYListener{Listener: ln} }))
+
+	c.cmd(220, "")
+	c.cmd(250, "EHLO localhost")
+	if _, msg := c.cmd(502, "VRFY recipient@example.com"); msg != "5.5.1 VRFY command disabled" {
+		t.Fatalf("VRFY = %q, want 5.5.1 VRFY command disabled", msg)
+	}
+	c.cmd(502, "EXPN staff")
+
+	// Pipelined replies stay in order.
+	fmt.Fprintf(c.W, "NOOP\r\nVRFY postmaster\r\nNOOP\r\n")
+	if err := c.W.Flush(); err != nil {
+		t.Fatalf("Flush() error: %v", err)
+	}
+	c.cmd(250, "")
+	c.cmd(502, "")
+	c.cmd(250, "")
+}
+
+func TestSessionDataBodyAndAttachmentLimits(t *testing.T) {
+	// multipartMessage returns a message with a text body and an attachment of the given sizes.
+	multipartMessage := func(bodyBytes, attachmentBytes int) string {
+		return "From: sender@example.com\r\nTo: a@example.com\r\nSubject: Test\r\n" +
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain\r\n\r\n" + strings.Repeat("t", bodyBytes) + "\r\n" +
+			"--b\r\nContent-Type: application/octet-stream\r\nContent-Disposition: attachment; filename=a.bin\r\n\r\n" +
+			strings.Repeat("a", attachmentBytes) + "\r\n--b--\r\n"
+	}
+	tests := []struct {
+		name               string
+		maxBodyBytes       int
+		maxAttachmentBytes int
+		message            string
+		wantMessage        string // part of the rejection message, "" if the message is relayed
+	}{
+		{
+			name:               "within limits",
+			maxBodyBytes:       1000,
+			maxAttachmentBytes: 1000,
+			message:            multipartMessage(1000, 1000),
+		},
+		{
+			name:               "large body",
+			maxBodyBytes:       1000,
+			maxAttachmentBytes: 100000,
+			message:            multipartMessage(1001, 10),
+			wantMessage:        "message body too large (1001 bytes, limit 1000)",
+		},
+		{
+			name:         "large attachment with only a body limit",
+			maxBodyBytes: 1000,
+			message:      multipartMessage(10, 100000),
+		},
+		{
+			name:               "large attachment",
+			maxBodyBytes:       100000,
+			maxAttachmentBytes: 1000,
+			message:            multipartMessage(10, 1001),
+			wantMessage:        "attachments too large (1001 bytes, limit 1000)",
+		},
+		{
+			name:         "large plain text body",
+			maxBodyBytes: 1000,
+			message:      "From: sender@example.com\r\nTo: a@example.com\r\n\r\n" + strings.Repeat("t", 1001),
+			wantMessage:  "message body too large",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.MaxBodyBytes = tt.maxBodyBytes
+			session.config.MaxAttachmentBytes = tt.maxAttachmentBytes
+			session.auth = true
+			session.user = "sender@example.com"
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("a@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+			err := session.Data(strings.NewReader(tt.message))
+			h := session.handler.(*mockHandler)
+			if tt.wantMessage != "" {
+				var smtpErr *smtp.SMTPError
+				if !errors.As(err, &smtpErr) || smtpErr.Code != 552 || !strings.Contains(smtpErr.Message, tt.wantMessage) {
+					t.Fatalf("Data() error = %v, want 552 %q", err, tt.wantMessage)
+				}
+				if h.called {
+					t.Fatal("handler called for a rejected message")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+			body, err := io.ReadAll(h.msg.Body)
+			if err != nil {
+				t.Fatalf("reading body: %v", err)
+			}
+			if !strings.HasSuffix(tt.message, string(body)) || !strings.Contains(string(body), "--b--") {
+				t.Fatalf("relayed body = %q, want the original body", body)
+			}
+		})
+	}
+}
+
+func TestSessionDataGenerateMessageID(t *testing.T) {
+	generated := regexp.MustCompile(`^<[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}@relay\.example\.com>$`)
+	tests := []struct {
+		name     string
+		generate bool
+		headers  string
+		want     string // Message-ID of the relayed message, "generated" for a new one
+	}{
+		{name: "missing", generate: true, want: "generated"},
+		{name: "present", generate: true, headers: "Message-ID: <original@example.com>\r\n", want: "<original@example.com>"},
+		{name: "missing and disabled", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.GenerateMessageID = tt.generate
+			session.config.SMTPDomain = "relay.example.com"
+			session.auth = true
+			session.user = "sender@example.com"
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("a@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+			if err := session.Data(strings.NewReader("From: sender@example.com\r\nTo: a@example.com\r\n" + tt.headers + "Subject: Test\r\n\r\nHello\r\n")); err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+
+			h := session.handler.(*mockHandler)
+			got := h.msg.Header.Get("Message-Id")
+			if tt.want == "generated" {
+				if !generated.MatchString(got) {
+					t.Fatalf("Message-ID = %q, want a generated one", got)
+				}
+			} else if got != tt.want {
+				t.Fatalf("Message-ID = %q, want %q", got, tt.want)
+			}
+
+			encoded, err := encodeMailMessage(h.msg)
+			if err != nil {
+				t.Fatalf("encodeMailMessage() error: %v", err)
+			}
+			if n := strings.Count(strings.ToLower(string(encoded)), "\r\nmessage-id: "); n != min(len(got), 1) {
+				t.Fatalf("encoded message has %d Message-ID fields, want %d:\n%s", n, min(len(got), 1), encoded)
+			}
+			if got != "" && !strings.Contains(string(encoded), got) {
+				t.Fatalf("encoded message lacks Message-ID %s:\n%s", got, encoded)
+			}
+		})
+	}
+}
+
+// disconnectingHandler closes the client end of a connection during the send, then returns err.
+type disconnectingHandler struct {
+	client net.Conn // nil to keep the client connected
+	err    error
+}
+
+func (h *disconnectingHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	if h.client != nil {
+		h.client.Close()
+		time.Sleep(20 * time.Millisecond) // let the close reach the server end
+	}
+	return h.err
+}
+
+func TestSessionDataClientDisconnect(t *testing.T) {
+	tests := []struct {
+		name       string
+		disconnect bool
+		err        error
+		wantLog    string // "" if nothing is logged
+	}{
+		{name: "connected"},
+		{name: "delivered", disconnect: true, wantLog: "it was delivered, but the client did not get the reply"},
+		{name: "failed", disconnect: true, err: errors.New("graph down"), wantLog: "which failed: graph down"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen() error: %v", err)
+			}
+			defer ln.Close()
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatalf("Dial() error: %v", err)
+			}
+			defer client.Close()
+			server, err := ln.Accept()
+			if err != nil {
+				t.Fatalf("Accept() error: %v", err)
+			}
+			defer server.Close()
+
+			var buf bytes.Buffer
+			h := &disconnectingHandler{err: tt.err}
+			if tt.disconnect {
+				h.client = client
+			}
+			session := newTestSessionWithT(t)
+			session.conn = server
+			session.logger = log.New(&buf, "", 0)
+			session.handler = h
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+			_ = session.Rcpt("recipient@example.com", nil)
+
+			before := map[string]float64{
+				"delivered": testutil.ToFloat64(clientDisconnects.WithLabelValues("delivered")),
+				"failed":    testutil.ToFloat64(clientDisconnects.WithLabelValues("failed")),
+			}
+			err = session.Data(strings.NewReader("Subject: Test\r\nMessage-ID: <id@example.com>\r\n\r\nHello\r\n"))
+			if (err != nil) != (tt.err != nil) {
+				t.Fatalf("Data() error = %v, want error %v", err, tt.err != nil)
+			}
+
+			got := buf.String()
+			if tt.wantLog == "" {
+				if strings.Contains(got, "disconnected") {
+					t.Fatalf("log = %q, want no disconnect warning", got)
+				}
+			} else if !strings.Contains(got, "disconnected while message <id@example.com> was relayed") || !strings.Contains(got, tt.wantLog) {
+				t.Fatalf("log = %q, want disconnect warning with %q", got, tt.wantLog)
+			}
+			for outcome, n := range before {
+				want := n
+				if tt.disconnect && (outcome == "failed") == (tt.err != nil) {
+					want++
+				}
+				if got := testutil.ToFloat64(clientDisconnects.WithLabelValues(outcome)); got != want {
+					t.Errorf("client disconnects %s = %v, want %v", outcome, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionDataAddMissingDate(t *testing.T) {
+	now := time.Date(2026, 3, 14, 9, 26, 53, 0, time.FixedZone("CET", 3600))
+	tests := []struct {
+		name    string
+		add     bool
+		headers string
+		want    string
+	}{
+		{name: "missing", add: true, want: "Sat, 14 Mar 2026 09:26:53 +0100"},
+		{name: "present", add: true, headers: "Date: Fri, 13 Mar 2026 08:00:00 +0000\r\n", want: "Fri, 13 Mar 2026 08:00:00 +0000"},
+		{name: "missing and disabled", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session := newTestSessionWithT(t)
+			session.config.AddMissingDate = tt.add
+			session.now = func() time.Time { return now }
+			session.auth = true
+			session.user = "sender@example.com"
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("a@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+			if err := session.Data(strings.NewReader("From: sender@example.com\r\nTo: a@example.com\r\n" + tt.headers + "Subject: Test\r\n\r\nHello\r\n")); err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+
+			h := session.handler.(*mockHandler)
+			if got := h.msg.Header["Date"]; strings.Join(got, "") != tt.want || len(got) > 1 {
+				t.Fatalf("Date = %q, want %q", got, tt.want)
+			}
+			if tt.want != "" {
+				if _, err := h.msg.Header.Date(); err != nil {
+					t.Fatalf("Header.Date() error: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inflightSends tracks message handler calls in progress, so that shutdown can let them
+// finish instead of aborting a message mid-send.
+type inflightSends struct {
+	wg      sync.WaitGroup
+	pending atomic.Int32
+
+	mu     sync.Mutex
+	closed bool // set by close; no new sends start after it
+}
+
+// start records the start of a send and reports whether it may go ahead, which it may not once
+// the tracker is closed. It is a no-op that always reports true on a nil tracker.
+func (f *inflightSends) start() bool {
+	if f == nil {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.wg.Add(1)
+	f.pending.Add(1)
+	return true
+}
+
+// extend records the start of a send that takes over from one already started with start, such
+// as a queued send handed over by the session that queued it. Unlike start it also succeeds once
+// the tracker is closed, since the send it takes over from keeps wait waiting until then.
+func (f *inflightSends) extend() {
+	if f == nil {
+		return
+	}
+	f.wg.Add(1)
+	f.pending.Add(1)
+}
+
+// close stops new sends from starting, so that wait does not race with start.
+func (f *inflightSends) close() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+}
+
+// closing reports whether close has been called.
+func (f *inflightSends) closing() bool {
+	if f == nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.closed
+}
+
+// done records the end of a send started with start.
+func (f *inflightSends) done() {
+	if f == nil {
+		return
+	}
+	f.pending.Add(-1)
+	f.wg.Done()
+}
+
+// wait waits up to timeout for all sends in progress to finish and returns the number
+// still pending when it gave up, or 0 if all finished. Call close first, so
+// that no send starts while it waits.
+func (f *inflightSends) wait(timeout time.Duration) int {
+	finished := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		close(finished)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-finished:
+		return 0
+	case <-timer.C:
+		return int(f.pending.Load())
+	}
+}
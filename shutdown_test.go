@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInflightSendsWait(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		wantPending int
+	}{
+		{name: "send finishes within grace period", timeout: 5 * time.Second, wantPending: 0},
+		{name: "grace period elapses", timeout: 10 * time.Millisecond, wantPending: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inflight := &inflightSends{}
+			session := newTestSessionWithT(t)
+			session.handler = &slowHandler{delay: 200 * time.Millisecond}
+			session.inflight = inflight
+			session.auth = true
+			_ = session.Mail("sender@example.com", nil)
+			_ = session.Rcpt("recipient@example.com", nil)
+
+			sent := make(chan error, 1)
+			go func() {
+				sent <- session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+			}()
+			// Wait until the handler call has started.
+			for inflight.pending.Load() == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			if got := inflight.wait(tt.timeout); got != tt.wantPending {
+				t.Fatalf("wait() = %d pending, want %d", got, tt.wantPending)
+			}
+			if err := <-sent; err != nil {
+				t.Fatalf("Data() error: %v", err)
+			}
+		})
+	}
+}
+
+func TestSessionDataRefusedAfterInflightClosed(t *testing.T) {
+	h := &mockHandler{}
+	session := newTestSessionWithT(t)
+	session.handler = h
+	session.inflight = &inflightSends{}
+	session.auth = true
+	_ = session.Mail("sender@example.com", nil)
+	_ = session.Rcpt("recipient@example.com", nil)
+
+	session.inflight.close()
+	err := session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+	if err != errShuttingDown {
+		t.Fatalf("Data() error = %v, want %v", err, errShuttingDown)
+	}
+	if h.called {
+		t.Fatal("handler called after shutdown began")
+	}
+	if got := session.inflight.wait(time.Second); got != 0 {
+		t.Fatalf("wait() = %d pending, want 0", got)
+	}
+}
+
+func TestNewSessionRefusedAfterInflightClosed(t *testing.T) {
+	inflight := &inflightSends{}
+	inflight.close()
+	bkd := &smtpBackend{config: &appConfig{}, ctx: t.Context(), inflight: inflight}
+	if _, err := bkd.NewSession(nil); err != errShuttingDown {
+		t.Fatalf("NewSession() error = %v, want %v", err, errShuttingDown)
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// spool keeps messages that could not be relayed to Graph in SPOOL_DIR and retries them in the
+// background, so that an unreachable Graph API does not bounce mail back to SMTP clients.
+// Each spooled message is a JSON file holding the raw MIME message and its metadata. A worker
+// holds an exclusive lock on a file while retrying it, so that several workers, also in other
+// processes sharing the directory, never send the same message twice.
+type spool struct {
+	dir         string
+	next        messageHandler
+	interval    time.Duration
+	maxAttempts int // 0 retries until delivered
+}
+
+// spooledMessage is the content of a spool file.
+type spooledMessage struct {
+	Sender     string    `json:"sender"`
+	Recipients []string  `json:"recipients"`
+	Attempts   int       `json:"attempts"`
+	SpooledAt  time.Time `json:"spooled_at"`
+	LastError  string    `json:"last_error"`
+	Message    []byte    `json:"message"` // raw MIME message
+}
+
+const (
+	spoolExt       = ".json"
+	spoolFailedExt = ".failed" // messages given up on are kept under this extension
+)
+
+// newSpool returns a spool in config.SpoolDir, creating the directory if needed, that relays
+// messages through next.
+func newSpool(config *appConfig, next messageHandler) (*spool, error) {
+	if err := os.MkdirAll(config.SpoolDir, 0o700); err != nil {
+		return nil, fmt.Errorf("SPOOL_DIR: %w", err)
+	}
+	return &spool{
+		dir:         config.SpoolDir,
+		next:        next,
+		interval:    config.SpoolRetryInterval,
+		maxAttempts: config.SpoolMaxAttempts,
+	}, nil
+}
+
+// handleMessage relays msg through the next handler. If that fails with an error that may be
+// temporary, the message is spooled for retry and the failure is not reported to the client.
+func (sp *spool) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	raw, err := encodeMailMessage(msg)
+	if err != nil {
+		return &encodeError{err: err}
+	}
+	relayed, err := rawMessage(raw)
+	if err != nil {
+		return err
+	}
+	sendCtx, attempted := withSendTracking(ctx)
+	err = sp.next.handleMessage(sendCtx, sender, relayed)
+	if attempted.Load() {
+		markSendAttempted(ctx)
+	}
+	if err == nil || !spoolable(err, attempted.Load()) {
+		return err
+	}
+
+	m := &spooledMessage{
+		Sender:     sender,
+		Recipients: headerRecipients(msg.Header),
+		Attempts:   1,
+		SpooledAt:  time.Now().UTC(),
+		LastError:  err.Error(),
+		Message:    raw,
+	}
+	name, serr := sp.store(m, contextPriority(ctx))
+	if serr != nil {
+		return fmt.Errorf("%w (spooling failed: %v)", err, serr)
+	}
+	messagesSpooled.Inc()
+	traceEventf(ctx, "spooled as %s after: %v", name, err)
+	log.Printf("Spooled message from %s to %d recipient(s) as %s after: %v", sender, len(m.Recipients), name, err)
+	return nil
+}
+
+// spoolUnsent spools msg for retry without relaying it first, at the priority of ctx, and returns
+// the name of its spool file.
+func (sp *spool) spoolUnsent(ctx context.Context, sender string, msg *mail.Message) (string, error) {
+	raw, err := encodeMailMessage(msg)
+	if err != nil {
+		return "", &encodeError{err: err}
+	}
+	name, err := sp.store(&spooledMessage{
+		Sender:     sender,
+		Recipients: headerRecipients(msg.Header),
+		SpooledAt:  time.Now().UTC(),
+		LastError:  "not sent before shutdown",
+		Message:    raw,
+	}, contextPriority(ctx))
+	if err != nil {
+		return "", err
+	}
+	messagesSpooled.Inc()
+	return name, nil
+}
+
+// run retries the spooled messages every interval until ctx is canceled.
+func (sp *spool) run(ctx context.Context) {
+	ticker := time.NewTicker(sp.interval)
+	defer ticker.Stop()
+	for {
+		sp.retryAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// retryAll retries each spooled message once, in priority order and oldest first within a priority.
+func (sp *spool) retryAll(ctx context.Context) {
+	paths, err := filepath.Glob(filepath.Join(sp.dir, "*"+spoolExt))
+	if err != nil {
+		log.Printf("Spool: %v", err)
+		return
+	}
+	sortSpool(paths)
+	for _, path := range paths {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := sp.retry(ctx, path); err != nil {
+			log.Printf("Spool: %s: %v", filepath.Base(path), err)
+		}
+	}
+}
+
+// retry attempts to relay the message spooled at path. It is deleted once relayed, kept with
+// an increased attempt count after a temporary failure, and renamed to spoolFailedExt after a
+// permanent failure or the last attempt. Files locked by another worker are skipped.
+func (sp *spool) retry(ctx context.Context, path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close() // releases the lock
+
+	locked, err := lockFile(f)
+	if err != nil || !locked {
+		return err
+	}
+	// Another worker may have finished with the file between the open and the lock.
+	if !sameFile(f, path) {
+		return nil
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	var m spooledMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return sp.giveUp(path, fmt.Errorf("decode: %w", err))
+	}
+	msg, err := rawMessage(m.Message)
+	if err != nil {
+		return sp.giveUp(path, err)
+	}
+
+	// The priority the message was spooled with is part of its file name; see store.
+	priority, _ := spoolKey(path)
+	sendCtx, attempted := withSendTracking(withPriority(ctx, priority))
+	err = sp.next.handleMessage(sendCtx, m.Sender, msg)
+	if err == nil {
+		log.Printf("Relayed spooled message from %s to %d recipient(s) after %d attempt(s)", m.Sender, len(m.Recipients), m.Attempts+1)
+		return os.Remove(path)
+	}
+	m.Attempts++
+	m.LastError = err.Error()
+	if !spoolable(err, attempted.Load()) || (sp.maxAttempts > 0 && m.Attempts >= sp.maxAttempts) {
+		if werr := sp.write(path, &m); werr != nil {
+			return werr
+		}
+		return sp.giveUp(path, fmt.Errorf("attempt %d: %w", m.Attempts, err))
+	}
+	return sp.write(path, &m)
+}
+
+// giveUp renames the spool file at path so that it is no longer retried and reports why.
+func (sp *spool) giveUp(path string, cause error) error {
+	failed := strings.TrimSuffix(path, spoolExt) + spoolFailedExt
+	if err := os.Rename(path, failed); err != nil {
+		return err
+	}
+	return fmt.Errorf("giving up, kept as %s: %w", filepath.Base(failed), cause)
+}
+
+// store writes m to a new spool file for a message of priority and returns its name.
+func (sp *spool) store(m *spooledMessage, priority int) (string, error) {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	// Names start with the priority, then the spool time; see sortSpool.
+	name := fmt.Sprintf("%d-%d-%s%s", priority, time.Now().UnixNano(), hex.EncodeToString(b), spoolExt)
+	return name, sp.write(filepath.Join(sp.dir, name), m)
+}
+
+// write atomically replaces the spool file at path with m. Workers see either the old or the
+// new content, never a partial file.
+func (sp *spool) write(path string, m *spooledMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(sp.dir, ".spool-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// sortSpool sorts spool file paths in the order they are retried: by priority, then oldest first.
+func sortSpool(paths []string) {
+	sort.SliceStable(paths, func(i, j int) bool {
+		pi, ti := spoolKey(paths[i])
+		pj, tj := spoolKey(paths[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return ti < tj
+	})
+}
+
+// spoolKey returns the priority of a spool file and the rest of its name, which sorts by spool
+// time. Files spooled before priorities were added have no priority prefix and are normal.
+func spoolKey(path string) (int, string) {
+	name := filepath.Base(path)
+	if p, rest, ok := strings.Cut(name, "-"); ok && len(p) == 1 && p[0] >= '0' && p[0] <= '9' {
+		return int(p[0] - '0'), rest
+	}
+	return priorityNormal, name
+}
+
+// sameFile reports whether path still names the open file f.
+func sameFile(f *os.File, path string) bool {
+	open, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(open, current)
+}
+
+// spoolable reports whether a failure to relay a message may be temporary, so that the message
+// is worth spooling: throttling and Graph server errors, and network and token errors that
+// happened before sending was attempted. A network error once the message was sent may mean that
+// Graph accepted it, so retrying it from the spool could deliver it twice.
+func spoolable(err error, sendAttempted bool) bool {
+	var eerr *encodeError
+	if errors.Is(err, errMessageTooLarge) || errors.As(err, &eerr) {
+		return false
+	}
+	var gerr *graphError
+	if errors.As(err, &gerr) {
+		return gerr.StatusCode == http.StatusTooManyRequests || gerr.StatusCode >= 500
+	}
+	return !sendAttempted
+}
+
+// rawMessage parses an encoded message, keeping its raw header block for re-encoding.
+func rawMessage(raw []byte) (*mail.Message, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("ReadMessage: %w", err)
+	}
+	if header, body, ok := splitHeader(raw); ok {
+		msg.Body = &rawBody{Reader: bytes.NewReader(body), header: header}
+	}
+	return msg, nil
+}
+
+// headerRecipients returns the addresses in the To, Cc and Bcc headers of header.
+func headerRecipients(header mail.Header) []string {
+	var recipients []string
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		list, err := header.AddressList(field)
+		if err != nil {
+			continue
+		}
+		for _, addr := range list {
+			recipients = append(recipients, addr.Address)
+		}
+	}
+	return recipients
+}
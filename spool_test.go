@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordingHandler returns errs in order, then nil, and records the raw messages it relays and
+// the priority they were relayed with. With sent set, it marks each message as sent to Graph.
+type recordingHandler struct {
+	errs       []error
+	sent       bool
+	senders    []string
+	messages   []string
+	priorities []int
+}
+
+func (h *recordingHandler) handleMessage(ctx context.Context, sender string, msg *mail.Message) error {
+	raw, err := encodeMailMessage(msg)
+	if err != nil {
+		return err
+	}
+	if h.sent {
+		markSendAttempted(ctx)
+	}
+	h.senders = append(h.senders, sender)
+	h.priorities = append(h.priorities, contextPriority(ctx))
+	h.messages = append(h.messages, string(raw))
+	if n := len(h.messages); n <= len(h.errs) {
+		return h.errs[n-1]
+	}
+	return nil
+}
+
+const spoolTestMessage = "From: sender@example.com\r\nTo: a@example.com, b@example.com\r\nBcc: c@example.com\r\nSubject: Test\r\n\r\nHello\r\n"
+
+func newTestSpool(t *testing.T, next messageHandler, maxAttempts int) *spool {
+	t.Helper()
+	sp, err := newSpool(&appConfig{SpoolDir: filepath.Join(t.TempDir(), "spool"), SpoolMaxAttempts: maxAttempts}, next)
+	if err != nil {
+		t.Fatalf("newSpool() error: %v", err)
+	}
+	return sp
+}
+
+func spoolMessage(t *testing.T, sp *spool) {
+	t.Helper()
+	msg, err := rawMessage([]byte(spoolTestMessage))
+	if err != nil {
+		t.Fatalf("rawMessage() error: %v", err)
+	}
+	if err := sp.handleMessage(context.Background(), "mailbox@example.com", msg); err != nil {
+		t.Fatalf("handleMessage() error: %v", err)
+	}
+}
+
+func spoolFiles(t *testing.T, sp *spool, ext string) []string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(sp.dir, "*"+ext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
+
+func TestSpoolHandleMessage(t *testing.T) {
+	unavailable := &graphError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	badRequest := &graphError{StatusCode: http.StatusBadRequest, Status: "400 Bad Request"}
+	tests := []struct {
+		name      string
+		err       error
+		sent      bool // the handler started sending to Graph
+		wantErr   bool
+		wantSpool bool
+	}{
+		{name: "relayed"},
+		{name: "graph unavailable", err: unavailable, wantSpool: true},
+		{name: "graph unavailable after sending", err: unavailable, sent: true, wantSpool: true},
+		{name: "token failure", err: &tokenError{err: errors.New("connection refused")}, wantSpool: true},
+		{name: "network error before sending", err: errors.New("connection refused"), wantSpool: true},
+		{name: "network error after sending", err: errors.New("connection reset by peer"), sent: true, wantErr: true},
+		{name: "permanent failure", err: badRequest, wantErr: true},
+		{name: "too large", err: errMessageTooLarge, wantErr: true},
+		{name: "encode failure", err: &encodeError{err: errors.New("malformed MIME header")}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &recordingHandler{errs: []error{tt.err}, sent: tt.sent}
+			sp := newTestSpool(t, next, 0)
+			msg, err := rawMessage([]byte(spoolTestMessage))
+			if err != nil {
+				t.Fatalf("rawMessage() error: %v", err)
+			}
+
+			err = sp.handleMessage(context.Background(), "mailbox@example.com", msg)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("handleMessage() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(next.messages) != 1 || next.messages[0] != spoolTestMessage {
+				t.Fatalf("relayed messages = %q, want the original message once", next.messages)
+			}
+			paths := spoolFiles(t, sp, spoolExt)
+			if !tt.wantSpool {
+				if len(paths) != 0 {
+					t.Fatalf("spool files = %v, want none", paths)
+				}
+				return
+			}
+			if len(paths) != 1 {
+				t.Fatalf("spool files = %v, want one", paths)
+			}
+			data, err := os.ReadFile(paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m spooledMessage
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatalf("spool file: %v", err)
+			}
+			if m.Sender != "mailbox@example.com" || m.Attempts != 1 || string(m.Message) != spoolTestMessage {
+				t.Errorf("spooled = %+v, want sender, one attempt and the original message", m)
+			}
+			if got := strings.Join(m.Recipients, ","); got != "a@example.com,b@example.com,c@example.com" {
+				t.Errorf("recipients = %q, want all header recipients", got)
+			}
+			if m.LastError != tt.err.Error() {
+				t.Errorf("last error = %q, want %q", m.LastError, tt.err)
+			}
+		})
+	}
+}
+
+func TestSpoolRetry(t *testing.T) {
+	unavailable := &graphError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	forbidden := &graphError{StatusCode: http.StatusForbidden, Status: "403 Forbidden"}
+	tests := []struct {
+		name         string
+		maxAttempts  int
+		errs         []error // results of the retries, after the failed first attempt
+		retries      int
+		wantCalls    int
+		wantAttempts int // recorded in the remaining spool file
+		wantFailed   bool
+	}{
+		{name: "relayed on retry", retries: 1, wantCalls: 2},
+		{name: "still unavailable", errs: []error{unavailable, unavailable}, retries: 2, wantCalls: 3, wantAttempts: 3},
+		{name: "relayed after failed retry", errs: []error{unavailable}, retries: 2, wantCalls: 3},
+		{name: "permanent failure", errs: []error{forbidden}, retries: 2, wantCalls: 2, wantAttempts: 2, wantFailed: true},
+		{name: "attempts exhausted", maxAttempts: 2, errs: []error{unavailable}, retries: 2, wantCalls: 2, wantAttempts: 2, wantFailed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &recordingHandler{errs: append([]error{unavailable}, tt.errs...)}
+			sp := newTestSpool(t, next, tt.maxAttempts)
+			spoolMessage(t, sp)
+			for range tt.retries {
+				sp.retryAll(context.Background())
+			}
+
+			if len(next.messages) != tt.wantCalls {
+				t.Fatalf("relay calls = %d, want %d", len(next.messages), tt.wantCalls)
+			}
+			for i, raw := range next.messages {
+				if raw != spoolTestMessage || next.senders[i] != "mailbox@example.com" {
+					t.Errorf("relay %d = %s %q, want the spooled message", i+1, next.senders[i], raw)
+				}
+			}
+			remaining, failed := spoolFiles(t, sp, spoolExt), spoolFiles(t, sp, spoolFailedExt)
+			switch {
+			case tt.wantFailed:
+				if len(remaining) != 0 || len(failed) != 1 {
+					t.Fatalf("spool files = %v, failed = %v, want one failed", remaining, failed)
+				}
+				remaining = failed
+			case tt.wantAttempts > 0:
+				if len(remaining) != 1 {
+					t.Fatalf("spool files = %v, want one", remaining)
+				}
+			default:
+				if len(remaining)+len(failed) != 0 {
+					t.Fatalf("spool files = %v, failed = %v, want none", remaining, failed)
+				}
+				return
+			}
+			data, err := os.ReadFile(remaining[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m spooledMessage
+			if err := json.Unmarshal(data, &m); err != nil {
+				t.Fatalf("spool file: %v", err)
+			}
+			if m.Attempts != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", m.Attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestSpoolRetrySkipsLockedFiles(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("spool files are not locked on this platform")
+	}
+	next := &recordingHandler{errs: []error{io.ErrUnexpectedEOF}}
+	sp := newTestSpool(t, next, 0)
+	spoolMessage(t, sp)
+	paths := spoolFiles(t, sp, spoolExt)
+	if len(paths) != 1 {
+		t.Fatalf("spool files = %v, want one", paths)
+	}
+
+	// Another worker holds the file.
+	f, err := os.Open(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := lockFile(f); !locked {
+		t.Fatalf("lockFile() = %v, %v, want lock", locked, err)
+	}
+	sp.retryAll(context.Background())
+	if len(next.messages) != 1 {
+		t.Fatalf("relay calls = %d, want no retry of the locked file", len(next.messages))
+	}
+
+	f.Close()
+	sp.retryAll(context.Background())
+	if len(next.messages) != 2 {
+		t.Fatalf("relay calls = %d, want a retry after the lock was released", len(next.messages))
+	}
+	if paths := spoolFiles(t, sp, spoolExt); len(paths) != 0 {
+		t.Fatalf("spool files = %v, want none", paths)
+	}
+}
+
+func TestSpoolRetryPriority(t *testing.T) {
+	h := &recordingHandler{}
+	sp := newTestSpool(t, h, 0)
+	spoolAs := func(sender string, priority int) {
+		t.Helper()
+		m := &spooledMessage{Sender: sender, Message: []byte(spoolTestMessage)}
+		if _, err := sp.store(m, priority); err != nil {
+			t.Fatalf("store() error: %v", err)
+		}
+	}
+
+	// Spooled oldest first; a file from before priorities has no priority prefix.
+	spoolAs("low@example.com", priorityLow)
+	legacy := fmt.Sprintf("%d-0000abcd%s", time.Now().UnixNano(), spoolExt)
+	if err := sp.write(filepath.Join(sp.dir, legacy), &spooledMessage{Sender: "legacy@example.com", Message: []byte(spoolTestMessage)}); err != nil {
+		t.Fatalf("write() error: %v", err)
+	}
+	spoolAs("normal@example.com", priorityNormal)
+	spoolAs("high@example.com", priorityHigh)
+	spoolAs("later-high@example.com", priorityHigh)
+
+	sp.retryAll(context.Background())
+	want := "high@example.com, later-high@example.com, legacy@example.com, normal@example.com, low@example.com"
+	if got := strings.Join(h.senders, ", "); got != want {
+		t.Fatalf("retry order = %s, want %s", got, want)
+	}
+	wantPriorities := []int{priorityHigh, priorityHigh, priorityNormal, priorityNormal, priorityLow}
+	if !slices.Equal(h.priorities, wantPriorities) {
+		t.Fatalf("retried with priorities %v, want %v", h.priorities, wantPriorities)
+	}
+}
+
+func TestSpoolHandleMessagePriority(t *testing.T) {
+	unavailable := &graphError{StatusCode: http.StatusServiceUnavailable, Status: "503 Service Unavailable"}
+	sp := newTestSpool(t, &recordingHandler{errs: []error{unavailable}}, 0)
+	msg, err := rawMessage([]byte(spoolTestMessage))
+	if err != nil {
+		t.Fatalf("rawMessage() error: %v", err)
+	}
+	if err := sp.handleMessage(withPriority(context.Background(), priorityLow), "mailbox@example.com", msg); err != nil {
+		t.Fatalf("handleMessage() error: %v", err)
+	}
+	paths := spoolFiles(t, sp, spoolExt)
+	if len(paths) != 1 {
+		t.Fatalf("spool files = %v, want 1", paths)
+	}
+	if priority, _ := spoolKey(paths[0]); priority != priorityLow {
+		t.Fatalf("spooled priority = %d, want %d (%s)", priority, priorityLow, filepath.Base(paths[0]))
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// transactionTimings accumulates the time a transaction spends in token acquisition and in
+// Graph sends, so slow transactions can be broken down by phase.
+type transactionTimings struct {
+	mu        sync.Mutex
+	tokenTime time.Duration
+	sendTime  time.Duration
+}
+
+type transactionTimingsKey struct{}
+
+// withTransactionTimings returns a copy of ctx carrying a new transactionTimings.
+func withTransactionTimings(ctx context.Context) (context.Context, *transactionTimings) {
+	t := &transactionTimings{}
+	return context.WithValue(ctx, transactionTimingsKey{}, t), t
+}
+
+// timingsFrom returns the transactionTimings carried by ctx, or nil.
+func timingsFrom(ctx context.Context) *transactionTimings {
+	t, _ := ctx.Value(transactionTimingsKey{}).(*transactionTimings)
+	return t
+}
+
+// addToken records time spent acquiring a token. It is a no-op on nil timings.
+func (t *transactionTimings) addToken(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.tokenTime += d
+	t.mu.Unlock()
+}
+
+// addSend records time spent sending to Graph. It is a no-op on nil timings.
+func (t *transactionTimings) addSend(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.sendTime += d
+	t.mu.Unlock()
+}
+
+func (t *transactionTimings) token() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.tokenTime
+}
+
+func (t *transactionTimings) send() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sendTime
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	azcore "github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	policy "github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+)
+
+// tokenRefreshMargin is how long before its expiry a cached token is refreshed in the background.
+const tokenRefreshMargin = 60 * time.Second
+
+// errTokenTimeout is the cause of a token acquisition abandoned after config.TokenAcquireTimeout.
+var errTokenTimeout = errors.New("token acquisition timed out")
+
+// tokenRefresh is a token acquisition in progress, shared by all callers that need a new token.
+type tokenRefresh struct {
+	done  chan struct{} // closed when the acquisition has finished
+	token string
+	err   error
+}
+
+// tokenError is a failure to acquire an access token for a message. It happens before any
+// request to send the message is made, so the delivery can be retried without risking a duplicate.
+type tokenError struct {
+	err error
+}
+
+func (e *tokenError) Error() string { return "getCachedToken: " + e.err.Error() }
+func (e *tokenError) Unwrap() error { return e.err }
+
+// getCachedToken returns a valid access token, refreshing it if needed.
+// Within tokenRefreshMargin of its expiry the cached token is still returned while a refresh runs
+// in the background, so a brief token endpoint failure does not fail sends; callers only wait for
+// a refresh once the token has expired.
+// Concurrent callers share a single in-flight refresh, so GetToken is called once per expiry;
+// each caller stops waiting when its own ctx is done.
+// After a failed acquisition no new attempt is made until the backoff interval has passed;
+// callers get the last error instead, so a struggling token endpoint is not hammered.
+func (h *graphMailHandler) getCachedToken(ctx context.Context) (string, error) {
+	h.tokenMutex.Lock()
+	now := h.timeNow()
+	if h.token != "" && now.Unix() < h.tokenExp {
+		token := h.token
+		if now.Unix() > h.tokenExp-int64(tokenRefreshMargin.Seconds()) && h.tokenInflight == nil && !now.Before(h.tokenRetryAt) {
+			h.startTokenRefresh(ctx)
+		}
+		h.tokenMutex.Unlock()
+		tokenCacheHits.Inc()
+		return token, nil
+	}
+	if now.Before(h.tokenRetryAt) {
+		// The cached token expired while refreshes were failing.
+		h.tokenReady.Store(false)
+		err := fmt.Errorf("GetToken: retrying after %s: %w", h.tokenRetryAt.Format(time.RFC3339), h.tokenErr)
+		h.tokenMutex.Unlock()
+		return "", err
+	}
+	call := h.tokenInflight
+	if call == nil {
+		call = h.startTokenRefresh(ctx)
+	}
+	h.tokenMutex.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("GetToken: %w", ctx.Err())
+	}
+}
+
+// startTokenRefresh starts acquiring a new token and returns the refresh for callers to wait on.
+// The caller must hold tokenMutex and there must be no refresh in flight.
+func (h *graphMailHandler) startTokenRefresh(ctx context.Context) *tokenRefresh {
+	call := &tokenRefresh{done: make(chan struct{})}
+	h.tokenInflight = call
+	tokenRefreshes.Inc()
+	// The refresh outlives a canceled caller so that other waiters still get its result.
+	go h.refreshToken(context.WithoutCancel(ctx), h.cred, call)
+	return call
+}
+
+// refreshToken acquires a new token from cred, updates the cache and completes call. The result
+// of a refresh started before the credential was replaced by reloadCredential only goes to the
+// callers waiting for it and is not cached. GetToken is canceled after config.TokenAcquireTimeout,
+// failing with errTokenTimeout.
+func (h *graphMailHandler) refreshToken(ctx context.Context, cred azcore.TokenCredential, call *tokenRefresh) {
+	if timeout := h.config.TokenAcquireTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, timeout, errTokenTimeout)
+		defer cancel()
+	}
+	token, err := cred.GetToken(ctx, policy.TokenRequestOptions{
+		Scopes: []string{graphScope(h.baseURL)},
+	})
+	if err != nil && errors.Is(context.Cause(ctx), errTokenTimeout) {
+		err = fmt.Errorf("%w after %s: %w", errTokenTimeout, h.config.TokenAcquireTimeout, err)
+	}
+
+	h.tokenMutex.Lock()
+	defer h.tokenMutex.Unlock()
+	defer close(call.done)
+	if err != nil {
+		call.err = fmt.Errorf("GetToken: %w", err)
+	} else {
+		call.token = token.Token
+	}
+	if h.tokenInflight != call {
+		return
+	}
+	h.tokenInflight = nil
+
+	if err != nil {
+		// A failed background refresh leaves the handler ready while the cached token is still
+		// valid; sends go on using it.
+		if exp := time.Unix(h.tokenExp, 0); h.token != "" && h.timeNow().Before(exp) {
+			log.Printf("Token refresh failed, using the cached token until it expires at %s: %v", exp.Format(time.RFC3339), err)
+		} else {
+			h.tokenReady.Store(false)
+		}
+		h.tokenErr = err
+		h.tokenFailures++
+		h.tokenRetryAt = h.timeNow().Add(h.tokenBackoff(h.tokenFailures))
+		return
+	}
+	h.token = token.Token
+	h.tokenExp = token.ExpiresOn.Unix()
+	h.tokenErr = nil
+	h.tokenFailures = 0
+	h.tokenRetryAt = time.Time{}
+	h.tokenReady.Store(true)
+}
+
+// tokenBackoff returns the delay before the next token acquisition after n consecutive failures,
+// doubling config.TokenRetryInterval per failure up to config.TokenRetryMaxInterval.
+func (h *graphMailHandler) tokenBackoff(n int) time.Duration {
+	d := h.config.TokenRetryInterval << min(n-1, 16)
+	return min(d, max(h.config.TokenRetryMaxInterval, h.config.TokenRetryInterval))
+}
+
+// timeNow returns the current time from h.now, defaulting to time.Now.
+func (h *graphMailHandler) timeNow() time.Time {
+	if h.now == nil {
+		return time.Now()
+	}
+	return h.now()
+}
+
+// ready reports whether a Graph token has been acquired and is still usable: the most recent
+// refresh succeeded, or it failed while the cached token had not expired yet. In dry-run mode no
+// token is needed, so the handler is always ready.
+func (h *graphMailHandler) ready() bool {
+	return h.config.DryRun || h.tokenReady.Load()
+}
+
+// graphScope returns the token scope for the Graph API at baseURL: its origin followed by
+// /.default, e.g. https://graph.microsoft.us/.default for GCC High.
+func graphScope(baseURL string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil || u.Host == "" {
+		return "https://graph.microsoft.com/.default"
+	}
+	return u.Scheme + "://" + u.Host + "/.default"
+}
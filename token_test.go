@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	azcore "github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	policy "github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// stubCredential returns token or err from GetToken and counts the calls.
+type stubCredential struct {
+	token string
+	err   error
+	calls int
+}
+
+func (c *stubCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls++
+	if c.err != nil {
+		return azcore.AccessToken{}, c.err
+	}
+	// An already expired token forces a refresh on every call.
+	return azcore.AccessToken{Token: c.token}, nil
+}
+
+func TestGetCachedTokenBackoff(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	cred := &stubCredential{err: errors.New("AADSTS50196: request throttled")}
+	h := &graphMailHandler{
+		config: &appConfig{
+			TokenRetryInterval:    10 * time.Second,
+			TokenRetryMaxInterval: 15 * time.Second,
+		},
+		cred: cred,
+		now:  func() time.Time { return now },
+	}
+
+	attempt := func(wantCalls int) {
+		t.Helper()
+		if _, err := h.getCachedToken(context.Background()); err == nil {
+			t.Fatal("getCachedToken() error = nil, want failure")
+		}
+		if cred.calls != wantCalls {
+			t.Fatalf("GetToken calls = %d, want %d", cred.calls, wantCalls)
+		}
+	}
+
+	attempt(1)
+	attempt(1) // negative-cached
+	now = now.Add(9 * time.Second)
+	attempt(1)
+	now = now.Add(time.Second)
+	attempt(2) // first interval elapsed
+	now = now.Add(15 * time.Second)
+	attempt(3) // second interval capped at the maximum
+	now = now.Add(14 * time.Second)
+	attempt(3)
+
+	cred.err = nil
+	cred.token = "token"
+	now = now.Add(time.Second)
+	if _, err := h.getCachedToken(context.Background()); err != nil {
+		t.Fatalf("getCachedToken() error after recovery: %v", err)
+	}
+	if cred.calls != 4 {
+		t.Fatalf("GetToken calls = %d, want 4", cred.calls)
+	}
+	if h.tokenFailures != 0 || !h.tokenRetryAt.IsZero() {
+		t.Fatalf("backoff state not reset after success: failures=%d retryAt=%s", h.tokenFailures, h.tokenRetryAt)
+	}
+}
+
+func TestGetCachedTokenDoesNotServeExpiredToken(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	cred := &stubCredential{err: errors.New("token endpoint unavailable")}
+	h := &graphMailHandler{
+		config:       &appConfig{TokenRetryInterval: time.Minute},
+		cred:         cred,
+		now:          func() time.Time { return now },
+		token:        "expired",
+		tokenExp:     now.Add(-time.Second).Unix(),
+		tokenRetryAt: now.Add(time.Minute),
+		tokenErr:     cred.err,
+	}
+
+	token, err := h.getCachedToken(context.Background())
+	if err == nil || token != "" {
+		t.Fatalf("getCachedToken() = %q, %v; want no token and an error", token, err)
+	}
+	if cred.calls != 0 {
+		t.Fatalf("GetToken calls = %d, want 0 during backoff", cred.calls)
+	}
+}
+
+// blockingCredential blocks GetToken until release is closed and counts the calls.
+type blockingCredential struct {
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (c *blockingCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls.Add(1)
+	<-c.release
+	return azcore.AccessToken{Token: "token", ExpiresOn: time.Now().Add(time.Hour)}, nil
+}
+
+func TestGetCachedTokenSingleFlight(t *testing.T) {
+	const callers = 50
+	cred := &blockingCredential{release: make(chan struct{})}
+	h := &graphMailHandler{config: &appConfig{}, cred: cred}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, callers)
+	errs := make([]error, callers)
+	for i := range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens[i], errs[i] = h.getCachedToken(context.Background())
+		}()
+	}
+	// Give every caller the chance to join the refresh before it completes.
+	time.Sleep(50 * time.Millisecond)
+	close(cred.release)
+	wg.Wait()
+
+	if got := cred.calls.Load(); got != 1 {
+		t.Fatalf("GetToken calls = %d, want 1", got)
+	}
+	for i := range callers {
+		if errs[i] != nil || tokens[i] != "token" {
+			t.Fatalf("caller %d: getCachedToken() = %q, %v, want token", i, tokens[i], errs[i])
+		}
+	}
+}
+
+func TestGetCachedTokenWaitCanceled(t *testing.T) {
+	cred := &blockingCredential{release: make(chan struct{})}
+	defer close(cred.release)
+	h := &graphMailHandler{config: &appConfig{}, cred: cred}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := h.getCachedToken(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("getCachedToken() error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// hangingCredential blocks GetToken until its context is done, like an unresponsive token endpoint.
+type hangingCredential struct{}
+
+func (hangingCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	<-ctx.Done()
+	return azcore.AccessToken{}, ctx.Err()
+}
+
+func TestGetCachedTokenAcquireTimeout(t *testing.T) {
+	h := &graphMailHandler{
+		config: &appConfig{TokenAcquireTimeout: 20 * time.Millisecond, TokenRetryInterval: time.Minute},
+		cred:   hangingCredential{},
+	}
+
+	start := time.Now()
+	_, err := h.getCachedToken(context.Background())
+	if !errors.Is(err, errTokenTimeout) {
+		t.Fatalf("getCachedToken() error = %v, want errTokenTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("getCachedToken() took %s, want it to give up after the timeout", elapsed)
+	}
+	if h.ready() {
+		t.Error("ready() = true after a timed out acquisition, want false")
+	}
+	// The timeout is a failed acquisition, so the next caller gets it without another attempt.
+	if _, err := h.getCachedToken(context.Background()); !errors.Is(err, errTokenTimeout) {
+		t.Fatalf("getCachedToken() during backoff error = %v, want errTokenTimeout", err)
+	}
+}
+
+func TestGetCachedTokenMetrics(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	cred := &expiringCredential{now: &now, lifetime: 10 * time.Minute}
+	h := &graphMailHandler{
+		config: &appConfig{},
+		cred:   cred,
+		now:    func() time.Time { return now },
+	}
+	hits := testutil.ToFloat64(tokenCacheHits)
+	refreshes := testutil.ToFloat64(tokenRefreshes)
+
+	get := func(wantHits, wantRefreshes float64) {
+		t.Helper()
+		if _, err := h.getCachedToken(context.Background()); err != nil {
+			t.Fatalf("getCachedToken() error: %v", err)
+		}
+		if got := testutil.ToFloat64(tokenCacheHits) - hits; got != wantHits {
+			t.Fatalf("cache hits = %v, want %v", got, wantHits)
+		}
+		if got := testutil.ToFloat64(tokenRefreshes) - refreshes; got != wantRefreshes {
+			t.Fatalf("refreshes = %v, want %v", got, wantRefreshes)
+		}
+	}
+
+	get(0, 1) // nothing cached yet
+	get(1, 1)
+	now = now.Add(9 * time.Minute)
+	get(2, 1) // last second before the 60s refresh margin
+	now = now.Add(time.Second)
+	get(3, 2) // within the margin: the cached token, refreshed in the background
+	waitTokenRefresh(h)
+	get(4, 2)
+	if cred.calls != 2 {
+		t.Fatalf("GetToken calls = %d, want 2", cred.calls)
+	}
+}
+
+// waitTokenRefresh waits until no token refresh is in flight.
+func waitTokenRefresh(h *graphMailHandler) {
+	h.tokenMutex.Lock()
+	call := h.tokenInflight
+	h.tokenMutex.Unlock()
+	if call != nil {
+		<-call.done
+	}
+}
+
+func TestGetCachedTokenRefreshFailureNearExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	cred := &stubCredential{err: errors.New("token endpoint unavailable")}
+	h := &graphMailHandler{
+		config:   &appConfig{TokenRetryInterval: 15 * time.Second, TokenRetryMaxInterval: time.Minute},
+		cred:     cred,
+		now:      func() time.Time { return now },
+		token:    "cached",
+		tokenExp: now.Add(30 * time.Second).Unix(),
+	}
+	h.tokenReady.Store(true)
+	get := func(want string) {
+		t.Helper()
+		token, err := h.getCachedToken(context.Background())
+		if err != nil || token != want {
+			t.Fatalf("getCachedToken() = %q, %v; want %q", token, err, want)
+		}
+	}
+
+	// Within the refresh margin the cached token is served while the refresh fails.
+	get("cached")
+	waitTokenRefresh(h)
+	if cred.calls != 1 || h.tokenErr == nil {
+		t.Fatalf("GetToken calls = %d, error = %v; want 1 failed refresh", cred.calls, h.tokenErr)
+	}
+	if !h.ready() {
+		t.Fatal("ready() = false after a failed refresh while the cached token is valid")
+	}
+	get("cached") // backing off, no new refresh
+	now = now.Add(15 * time.Second)
+	get("cached") // backoff elapsed, refreshed in the background again
+	waitTokenRefresh(h)
+	if cred.calls != 2 {
+		t.Fatalf("GetToken calls = %d, want 2", cred.calls)
+	}
+
+	// Once expired the token is no longer served, and the second backoff interval has not passed.
+	now = now.Add(20 * time.Second)
+	if token, err := h.getCachedToken(context.Background()); err == nil || token != "" {
+		t.Fatalf("getCachedToken() after expiry = %q, %v; want no token and an error", token, err)
+	}
+	if h.ready() {
+		t.Fatal("ready() = true once the cached token expired")
+	}
+
+	cred.err = nil
+	cred.token = "fresh"
+	now = now.Add(20 * time.Second)
+	get("fresh")
+	if cred.calls != 3 {
+		t.Fatalf("GetToken calls = %d, want 3", cred.calls)
+	}
+	if !h.ready() {
+		t.Fatal("ready() = false after a successful refresh")
+	}
+}
+
+// expiringCredential returns tokens that expire lifetime after *now and counts the calls.
+type expiringCredential struct {
+	now      *time.Time
+	lifetime time.Duration
+	calls    int
+}
+
+func (c *expiringCredential) GetToken(ctx context.Context, opts policy.TokenRequestOptions) (azcore.AccessToken, error) {
+	c.calls++
+	return azcore.AccessToken{Token: "token", ExpiresOn: c.now.Add(c.lifetime)}, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+)
+
+// messageTrace collects debug events for a single SMTP transaction under one correlation id,
+// so that the SMTP command sequence and the resulting Graph requests can be read together.
+type messageTrace struct {
+	id     string
+	logger *log.Logger
+}
+
+type messageTraceKey struct{}
+
+// newMessageTrace returns a trace with a fresh random correlation id that logs to logger.
+func newMessageTrace(logger *log.Logger) *messageTrace {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &messageTrace{id: hex.EncodeToString(b), logger: logger}
+}
+
+// eventf logs a trace event. It is a no-op on a nil trace.
+func (t *messageTrace) eventf(format string, args ...any) {
+	if t == nil {
+		return
+	}
+	t.logger.Printf("debug: trace %s: %s", t.id, fmt.Sprintf(format, args...))
+}
+
+// withMessageTrace returns a copy of ctx carrying t.
+func withMessageTrace(ctx context.Context, t *messageTrace) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, messageTraceKey{}, t)
+}
+
+// traceEventf logs a trace event for the transaction carried by ctx, if any.
+func traceEventf(ctx context.Context, format string, args ...any) {
+	t, _ := ctx.Value(messageTraceKey{}).(*messageTrace)
+	t.eventf(format, args...)
+}
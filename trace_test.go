@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMessageTraceCorrelatesSMTPAndHTTP(t *testing.T) {
+	var calls atomic.Int32
+	h := newTestGraphHandler(newTestGraphServer(t, &calls, http.StatusAccepted), 0)
+	h.token = "token"
+	h.tokenExp = time.Now().Add(time.Hour).Unix()
+
+	var buf bytes.Buffer
+	session := newTestSessionWithT(t)
+	session.config.TraceMessages = true
+	session.logger = log.New(&buf, "", 0)
+	session.handler = h
+	session.auth = true
+	session.user = "sender@example.com"
+
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	if err := session.Rcpt("recipient@example.com", nil); err != nil {
+		t.Fatalf("Rcpt() error: %v", err)
+	}
+	if err := session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+
+	line := regexp.MustCompile(`^debug: trace ([0-9a-f]{16}): (smtp|http) `)
+	ids := make(map[string]bool)
+	kinds := make(map[string]bool)
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		m := line.FindStringSubmatch(l)
+		if m == nil {
+			t.Fatalf("unexpected trace line %q", l)
+		}
+		ids[m[1]] = true
+		kinds[m[2]] = true
+	}
+	if len(ids) != 1 {
+		t.Fatalf("trace ids = %v, want a single correlation id\n%s", ids, buf.String())
+	}
+	if !kinds["smtp"] || !kinds["http"] {
+		t.Fatalf("trace kinds = %v, want smtp and http events\n%s", kinds, buf.String())
+	}
+}
+
+func TestMessageTraceDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	session := newTestSessionWithT(t)
+	session.logger = log.New(&buf, "", 0)
+	session.auth = true
+
+	_ = session.Mail("sender@example.com", nil)
+	_ = session.Rcpt("recipient@example.com", nil)
+	if err := session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n")); err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("trace output = %q, want none when tracing is disabled", buf.String())
+	}
+}
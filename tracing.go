@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of the send pipeline. Until initTracing installs a tracer provider it
+// uses the global no-op provider, so spans cost next to nothing when tracing is not configured.
+var tracer = otel.Tracer("github.com/oamn/smtp2graph")
+
+// initTracing exports spans over OTLP/HTTP if OTEL_EXPORTER_OTLP_ENDPOINT is set. The service
+// name and other resource attributes are read from OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES.
+// Returns a cleanup function to flush pending spans, or a no-op if tracing is not enabled.
+func initTracing(cfg *appConfig) func(context.Context) {
+	if cfg.OTelEndpoint == "" {
+		return func(context.Context) {}
+	}
+	exporter := newOTLPExporter(cfg.OTelEndpoint, cfg.OTelHeaders)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	return func(ctx context.Context) {
+		// ctx is usually canceled by the time of shutdown; still allow spans to be flushed.
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			log.Printf("OpenTelemetry shutdown: %v", err)
+		}
+	}
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
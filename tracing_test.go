@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// recordSpans replaces tracer with one that records ended spans for the duration of the test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prev := tracer
+	tracer = provider.Tracer("test")
+	t.Cleanup(func() { tracer = prev })
+	return recorder
+}
+
+func TestSessionDataSpans(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantStatus codes.Code
+	}{
+		{name: "accepted", status: http.StatusAccepted, wantStatus: codes.Unset},
+		{name: "graph error", status: http.StatusBadRequest, wantStatus: codes.Error},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := recordSpans(t)
+			var calls atomic.Int32
+			h := newTestGraphHandler(newTestGraphServer(t, &calls, tt.status), 0)
+			h.token = "token"
+			h.tokenExp = time.Now().Add(time.Hour).Unix()
+
+			session := newTestSessionWithT(t)
+			session.handler = h
+			session.auth = true
+			if err := session.Mail("sender@example.com", nil); err != nil {
+				t.Fatalf("Mail() error: %v", err)
+			}
+			if err := session.Rcpt("recipient@example.com", nil); err != nil {
+				t.Fatalf("Rcpt() error: %v", err)
+			}
+			_ = session.Data(strings.NewReader("Subject: Test\r\n\r\nHello\r\n"))
+
+			spans := map[string]sdktrace.ReadOnlySpan{}
+			for _, span := range recorder.Ended() {
+				spans[span.Name()] = span
+			}
+			data, token, send := spans["smtp.data"], spans["graph.token"], spans["graph.sendMail"]
+			if data == nil || token == nil || send == nil {
+				t.Fatalf("ended spans = %v, want smtp.data, graph.token and graph.sendMail", recorder.Ended())
+			}
+			for _, child := range []sdktrace.ReadOnlySpan{token, send} {
+				if child.Parent().SpanID() != data.SpanContext().SpanID() {
+					t.Errorf("%s parent = %v, want smtp.data", child.Name(), child.Parent().SpanID())
+				}
+			}
+			if got := data.Status().Code; got != tt.wantStatus {
+				t.Errorf("smtp.data status = %v, want %v", got, tt.wantStatus)
+			}
+			if got := send.Status().Code; got != tt.wantStatus {
+				t.Errorf("graph.sendMail status = %v, want %v", got, tt.wantStatus)
+			}
+			want := attribute.Int("http.response.status_code", tt.status)
+			found := false
+			for _, attr := range send.Attributes() {
+				if attr == want {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("graph.sendMail attributes = %v, want %v", send.Attributes(), want)
+			}
+		})
+	}
+}
+
+// restoreTracerProvider restores the global tracer provider, which initTracing replaces, when
+// the test ends.
+func restoreTracerProvider(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+}
+
+func TestInitTracingDisabled(t *testing.T) {
+	restoreTracerProvider(t)
+	cleanup := initTracing(&appConfig{})
+	cleanup(context.Background())
+}
+
+func TestInitTracingExportsSpans(t *testing.T) {
+	restoreTracerProvider(t)
+	var (
+		mu    sync.Mutex
+		names []string
+		auth  string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var data tracepb.TracesData
+		if err := proto.Unmarshal(body, &data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		auth = r.Header.Get("Authorization")
+		for _, rs := range data.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					names = append(names, span.Name)
+				}
+			}
+		}
+	}))
+	defer srv.Close()
+
+	cleanup := initTracing(&appConfig{OTelEndpoint: srv.URL, OTelHeaders: map[string]string{"Authorization": "Bearer token"}})
+	_, span := tracer.Start(context.Background(), "test")
+	span.End()
+	cleanup(context.Background())
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(names, []string{"test"}) {
+		t.Fatalf("exported spans = %v, want [test]", names)
+	}
+	if auth != "Bearer token" {
+		t.Errorf("Authorization = %q, want the configured header", auth)
+	}
+}
+
+func TestParseOTLPHeaders(t *testing.T) {
+	got, err := parseOTLPHeaders("Authorization=Bearer%20token, X-Tenant = a%2Cb")
+	if err != nil {
+		t.Fatalf("parseOTLPHeaders() error: %v", err)
+	}
+	want := map[string]string{"Authorization": "Bearer token", "X-Tenant": "a,b"}
+	if !maps.Equal(got, want) {
+		t.Fatalf("parseOTLPHeaders() = %v, want %v", got, want)
+	}
+	if _, err := parseOTLPHeaders("Authorization"); err == nil {
+		t.Fatal("parseOTLPHeaders() without a value: want error")
+	}
+}
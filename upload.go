@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+const (
+	// largeAttachmentBytes is the decoded size from which an attachment is uploaded through an
+	// upload session instead of being kept in the draft message.
+	largeAttachmentBytes = 3 * 1024 * 1024
+	// uploadChunkBytes is the size of each upload session chunk. Graph requires a multiple of 320 KiB.
+	uploadChunkBytes = 10 * 320 * 1024
+)
+
+// largeAttachment is an attachment removed from a message to be uploaded separately.
+type largeAttachment struct {
+	name        string
+	contentType string
+	data        []byte // decoded content
+}
+
+// sendDraft sends a message as a draft, which is needed when it exceeds the inline sendMail limit,
+// must not be saved to Sent Items, or GRAPH_SEND_MODE is json. The draft, which is the message
+// with its large attachments removed by splitLargeAttachments, is created first; it keeps its Bcc
+// header unless json mode took it out to set the Bcc recipients through update. update is then
+// applied to it, each attachment is streamed to it through an upload session, and the draft is
+// sent.
+//
+// Each request is retried on its own as described at retrySend, so that a retry never creates a
+// second draft: once sent, a draft cannot be sent again, which makes retrying the send safe too.
+func (h *graphMailHandler) sendDraft(ctx context.Context, accessToken, sender string, draft []byte, attachments []largeAttachment, update draftUpdate) error {
+	var id string
+	err := h.retrySend(ctx, func() (err error) {
+		id, err = h.createDraft(ctx, accessToken, sender, draft)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("createDraft: %w", err)
+	}
+	if !update.empty() {
+		err := h.retrySend(ctx, func() error {
+			return h.updateDraft(ctx, accessToken, sender, id, update)
+		})
+		if err != nil {
+			h.deleteDraft(ctx, accessToken, sender, id)
+			return fmt.Errorf("updateDraft: %w", err)
+		}
+	}
+	for _, att := range attachments {
+		if err := h.uploadAttachment(ctx, accessToken, sender, id, att); err != nil {
+			h.deleteDraft(ctx, accessToken, sender, id)
+			return fmt.Errorf("uploadAttachment %q: %w", att.name, err)
+		}
+	}
+	messageURL := fmt.Sprintf("%s/users/%s/messages/%s/send", h.baseURL, sender, id)
+	err = h.retrySend(ctx, func() error {
+		return h.graphRequest(ctx, http.MethodPost, messageURL, accessToken, "", nil, nil)
+	})
+	if err != nil {
+		h.deleteDraft(ctx, accessToken, sender, id)
+		return fmt.Errorf("send draft: %w", err)
+	}
+	return nil
+}
+
+// createDraft creates a draft message from mimeMessage and returns its id.
+func (h *graphMailHandler) createDraft(ctx context.Context, accessToken, sender string, mimeMessage []byte) (string, error) {
+	url := fmt.Sprintf("%s/users/%s/messages", h.baseURL, sender)
+	encoded := encodeBase64(mimeMessage, h.config.Base64LineLength)
+	var draft struct {
+		ID string `json:"id"`
+	}
+	if err := h.graphRequest(ctx, http.MethodPost, url, accessToken, "text/plain", encoded, &draft); err != nil {
+		return "", err
+	}
+	if draft.ID == "" {
+		return "", errors.New("draft response has no id")
+	}
+	return draft.ID, nil
+}
+
+// checkDrafts creates and deletes an empty draft in sender's mailbox, verifying the Mail.ReadWrite
+// permission that sending messages as drafts requires.
+func (h *graphMailHandler) checkDrafts(ctx context.Context, sender string) error {
+	accessToken, err := h.getCachedToken(ctx)
+	if err != nil {
+		return &tokenError{err: err}
+	}
+	var id string
+	err = h.retrySend(ctx, func() (err error) {
+		id, err = h.createDraft(ctx, accessToken, sender, []byte("Subject: smtp2graph permission check\r\n\r\n"))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("createDraft: %w", err)
+	}
+	h.deleteDraft(ctx, accessToken, sender, id)
+	return nil
+}
+
+// graphRecipient is a Graph API recipient.
+type graphRecipient struct {
+	EmailAddress graphEmailAddress `json:"emailAddress"`
+}
+
+type graphEmailAddress struct {
+	Name    string `json:"name,omitempty"`
+	Address string `json:"address"`
+}
+
+// graphExtendedProperty is a Graph single-value extended property, a MAPI property identified by
+// its type and tag.
+type graphExtendedProperty struct {
+	ID    string `json:"id"`
+	Value string `json:"value"`
+}
+
+// deleteAfterSubmit is PidTagDeleteAfterSubmit set to true, which has Exchange delete a message once
+// it is sent instead of moving it to Sent Items. It is the draft equivalent of the saveToSentItems
+// parameter, which the MIME form of sendMail does not take.
+var deleteAfterSubmit = graphExtendedProperty{ID: "Boolean 0x0E01", Value: "true"}
+
+// draftUpdate holds the properties set on a draft after it is created from the MIME message. Empty
+// recipient fields keep the recipients Graph parsed from the MIME message.
+type draftUpdate struct {
+	To         []graphRecipient        `json:"toRecipients,omitempty"`
+	Cc         []graphRecipient        `json:"ccRecipients,omitempty"`
+	Bcc        []graphRecipient        `json:"bccRecipients,omitempty"`
+	Properties []graphExtendedProperty `json:"singleValueExtendedProperties,omitempty"`
+}
+
+func (u draftUpdate) empty() bool {
+	return len(u.To) == 0 && len(u.Cc) == 0 && len(u.Bcc) == 0 && len(u.Properties) == 0
+}
+
+// graphRecipients returns addrs as Graph recipients.
+func graphRecipients(addrs []*mail.Address) []graphRecipient {
+	var recipients []graphRecipient
+	for _, addr := range addrs {
+		recipients = append(recipients, graphRecipient{graphEmailAddress{Name: addr.Name, Address: addr.Address}})
+	}
+	return recipients
+}
+
+// updateDraft applies update to the draft id.
+func (h *graphMailHandler) updateDraft(ctx context.Context, accessToken, sender, id string, update draftUpdate) error {
+	body, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/users/%s/messages/%s", h.baseURL, sender, id)
+	return h.graphRequest(ctx, http.MethodPatch, url, accessToken, "application/json", body, nil)
+}
+
+// deleteDraft removes a draft left behind by a failed send. Errors are reported only. The deletion
+// is not canceled with ctx so that it also runs after cancellation, but it is retried as described
+// at retrySend within a single GRAPH_HTTP_TIMEOUT.
+func (h *graphMailHandler) deleteDraft(ctx context.Context, accessToken, sender, id string) {
+	ctx, cancel := h.withHTTPTimeout(context.WithoutCancel(ctx))
+	defer cancel()
+	url := fmt.Sprintf("%s/users/%s/messages/%s", h.baseURL, sender, id)
+	err := h.retrySend(ctx, func() error {
+		return h.graphRequest(ctx, http.MethodDelete, url, accessToken, "", nil, nil)
+	})
+	if err != nil {
+		reportError(ctx, fmt.Errorf("delete draft: %w", err))
+	}
+}
+
+// uploadAttachment attaches att to the draft id through an upload session, one chunk at a time.
+// Creating the session and each chunk are retried as described at retrySend. ctx is checked
+// between chunks.
+func (h *graphMailHandler) uploadAttachment(ctx context.Context, accessToken, sender, id string, att largeAttachment) error {
+	url := fmt.Sprintf("%s/users/%s/messages/%s/attachments/createUploadSession", h.baseURL, sender, id)
+	req, err := json.Marshal(map[string]any{
+		"AttachmentItem": map[string]any{
+			"attachmentType": "file",
+			"name":           att.name,
+			"size":           len(att.data),
+			"contentType":    att.contentType,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	var session struct {
+		UploadURL string `json:"uploadUrl"`
+	}
+	err = h.retrySend(ctx, func() error {
+		return h.graphRequest(ctx, http.MethodPost, url, accessToken, "application/json", req, &session)
+	})
+	if err != nil {
+		return fmt.Errorf("createUploadSession: %w", err)
+	}
+	if session.UploadURL == "" {
+		return errors.New("upload session response has no uploadUrl")
+	}
+
+	total := len(att.data)
+	for start := 0; start < total; start += uploadChunkBytes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		end := min(start+uploadChunkBytes, total)
+		err := h.retrySend(ctx, func() error {
+			return h.uploadChunk(ctx, session.UploadURL, att.data[start:end], start, total)
+		})
+		if err != nil {
+			return fmt.Errorf("upload bytes %d-%d: %w", start, end-1, err)
+		}
+	}
+	return nil
+}
+
+// uploadChunk PUTs chunk at offset start of a total-byte upload. The upload URL is pre-authorized,
+// so no access token is sent.
+func (h *graphMailHandler) uploadChunk(ctx context.Context, uploadURL string, chunk []byte, start, total int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, uploadURL, bytes.NewReader(chunk))
+	if err != nil {
+		return fmt.Errorf("NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+len(chunk)-1, total))
+	return h.doGraphRequest(req, nil)
+}
+
+// graphRequest sends a Graph API request with an optional body and decodes a JSON response into out
+// if it is non-nil. Non-2xx responses are returned as *graphError.
+func (h *graphMailHandler) graphRequest(ctx context.Context, method, url, accessToken, contentType string, body []byte, out any) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("NewRequestWithContext: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return h.doGraphRequest(req, out)
+}
+
+// doGraphRequest performs req within GRAPH_HTTP_TIMEOUT and decodes a JSON response into out if it is non-nil.
+func (h *graphMailHandler) doGraphRequest(req *http.Request, out any) error {
+	ctx, cancel := h.withHTTPTimeout(req.Context())
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		traceEventf(req.Context(), "http %s %s failed: %v", req.Method, req.URL, err)
+		return fmt.Errorf("http.Do: %w", err)
+	}
+	defer resp.Body.Close()
+	traceEventf(req.Context(), "http %s %s -> %s request-id=%s", req.Method, req.URL, resp.Status, resp.Header.Get("request-id"))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		gerr := &graphError{StatusCode: resp.StatusCode, Status: resp.Status, Body: h.readErrorBody(resp.Body)}
+		gerr.RetryAfter, gerr.RetryAfterSet = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		return gerr
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("decode response: %w", err)
+	}
+	return nil
+}
+
+// splitLargeAttachments removes the top-level attachments of at least largeAttachmentBytes
+// (decoded) from a multipart message. It returns the remaining message and the removed
+// attachments; non-multipart messages are returned unchanged without attachments.
+func splitLargeAttachments(mimeMessage []byte) ([]byte, []largeAttachment, error) {
+	header, body, ok := splitHeader(mimeMessage)
+	if !ok {
+		return mimeMessage, nil, nil
+	}
+	fields, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(header))).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	mediaType, params, err := mime.ParseMediaType(fields.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") || params["boundary"] == "" {
+		return mimeMessage, nil, nil
+	}
+
+	var rebuilt bytes.Buffer
+	w := multipart.NewWriter(&rebuilt)
+	if err := w.SetBoundary(params["boundary"]); err != nil {
+		return nil, nil, err
+	}
+	var attachments []largeAttachment
+	r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+	for {
+		part, err := r.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		raw, err := io.ReadAll(part)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if att, ok := largeAttachmentPart(part, raw); ok {
+			attachments = append(attachments, att)
+			continue
+		}
+		pw, err := w.CreatePart(part.Header)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := pw.Write(raw); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(attachments) == 0 {
+		return mimeMessage, nil, nil
+	}
+	if err := w.Close(); err != nil {
+		return nil, nil, err
+	}
+	return append(append([]byte(nil), header...), rebuilt.Bytes()...), attachments, nil
+}
+
+// largeAttachmentPart decodes part and reports whether it is an attachment of at least
+// largeAttachmentBytes.
+func largeAttachmentPart(part *multipart.Part, raw []byte) (largeAttachment, bool) {
+	disposition, dparams, _ := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	contentType, cparams, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	name := dparams["filename"]
+	if name == "" {
+		name = cparams["name"]
+	}
+	if disposition != "attachment" && name == "" {
+		return largeAttachment{}, false
+	}
+
+	var data []byte
+	switch strings.ToLower(part.Header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		stripped := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, string(raw))
+		decoded, err := base64.StdEncoding.DecodeString(stripped)
+		if err != nil {
+			return largeAttachment{}, false
+		}
+		data = decoded
+	case "quoted-printable":
+		decoded, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+		if err != nil {
+			return largeAttachment{}, false
+		}
+		data = decoded
+	default:
+		data = raw
+	}
+	if len(data) < largeAttachmentBytes {
+		return largeAttachment{}, false
+	}
+	if name == "" {
+		name = "attachment"
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return largeAttachment{name: name, contentType: contentType, data: data}, true
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// uploadServer is a Graph API stub for the draft and upload session endpoints.
+type uploadServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	draft    []byte   // decoded MIME of the created draft
+	patch    []byte   // body of the draft update
+	uploaded []byte   // concatenated upload chunks
+	ranges   []string // Content-Range of each chunk
+	sent     bool
+	deleted  bool
+	drafts   int            // drafts created
+	fail     map[string]int // 503 replies still to send, by "METHOD path"
+	onChunk  func()         // called after each chunk is stored
+}
+
+func newUploadServer(t *testing.T) *uploadServer {
+	t.Helper()
+	us := &uploadServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /users/{user}/messages", func(w http.ResponseWriter, r *http.Request) {
+		// A draft is created from MIME only from a base64 text/plain body.
+		if ct := r.Header.Get("Content-Type"); ct != "text/plain" {
+			t.Errorf("draft created with Content-Type %q, want text/plain", ct)
+		}
+		b, _ := io.ReadAll(r.Body)
+		us.mu.Lock()
+		us.draft, _ = base64.StdEncoding.DecodeString(string(b))
+		us.drafts++
+		us.mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"id":"draft1"}`)
+	})
+	mux.HandleFunc("PATCH /users/{user}/messages/draft1", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		us.mu.Lock()
+		us.patch = b
+		us.mu.Unlock()
+		fmt.Fprint(w, `{"id":"draft1"}`)
+	})
+	mux.HandleFunc("POST /users/{user}/messages/draft1/attachments/createUploadSession", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"uploadUrl":%q}`, us.URL+"/upload/1")
+	})
+	mux.HandleFunc("PUT /upload/1", func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		us.mu.Lock()
+		us.uploaded = append(us.uploaded, b...)
+		us.ranges = append(us.ranges, r.Header.Get("Content-Range"))
+		onChunk := us.onChunk
+		us.mu.Unlock()
+		if onChunk != nil {
+			onChunk()
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("POST /users/{user}/messages/draft1/send", func(w http.ResponseWriter, r *http.Request) {
+		us.mu.Lock()
+		us.sent = true
+		us.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("DELETE /users/{user}/messages/draft1", func(w http.ResponseWriter, r *http.Request) {
+		us.mu.Lock()
+		us.deleted = true
+		us.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("POST /users/{user}/sendMail", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("message was sent inline instead of as a draft")
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	us.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Method + " " + r.URL.Path
+		us.mu.Lock()
+		fail := us.fail[key] > 0
+		if fail {
+			us.fail[key]--
+		}
+		us.mu.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(us.Close)
+	return us
+}
+
+// largeMessage returns a multipart message with a text part and a base64 attachment of data.
+func largeMessage(t *testing.T, data []byte) *mail.Message {
+	t.Helper()
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var lines strings.Builder
+	for len(encoded) > 76 {
+		lines.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	lines.WriteString(encoded + "\r\n")
+
+	raw := "From: sender@example.com\r\n" +
+		"To: recipient@example.com\r\n" +
+		"Subject: Large\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"See attachment.\r\n" +
+		"--b1\r\n" +
+		"Content-Type: application/octet-stream; name=\"big.bin\"\r\n" +
+		"Content-Disposition: attachment; filename=\"big.bin\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		lines.String() +
+		"--b1--\r\n"
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ReadMessage() error: %v", err)
+	}
+	return msg
+}
+
+func newUploadHandler(us *uploadServer) *graphMailHandler {
+	return &graphMailHandler{
+		config:   &appConfig{InlineLimitBytes: 4 * 1024 * 1024, SaveToSentItems: true},
+		client:   http.DefaultClient,
+		baseURL:  us.URL,
+		token:    "token",
+		tokenExp: time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func TestHandleMessageUploadsLargeAttachment(t *testing.T) {
+	us := newUploadServer(t)
+	h := newUploadHandler(us)
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024/16)
+
+	if err := h.handleMessage(context.Background(), "sender@example.com", largeMessage(t, data)); err != nil {
+		t.Fatalf("handleMessage() error: %v", err)
+	}
+
+	if !us.sent {
+		t.Fatal("draft was not sent")
+	}
+	if !bytes.Equal(us.uploaded, data) {
+		t.Fatalf("uploaded %d bytes, want the %d attachment bytes", len(us.uploaded), len(data))
+	}
+	if len(us.ranges) != 2 || us.ranges[0] != fmt.Sprintf("bytes 0-%d/%d", uploadChunkBytes-1, len(data)) {
+		t.Fatalf("chunk ranges = %v, want two chunks starting at 0", us.ranges)
+	}
+	if bytes.Contains(us.draft, []byte("big.bin")) || !bytes.Contains(us.draft, []byte("See attachment.")) {
+		t.Fatalf("draft should contain the text part but not the attachment:\n%s", us.draft)
+	}
+}
+
+func TestHandleMessageUploadRetriesFailedRequests(t *testing.T) {
+	us := newUploadServer(t)
+	us.fail = map[string]int{
+		"POST /users/sender@example.com/messages/draft1/attachments/createUploadSession": 1,
+		"PUT /upload/1": 1,
+		"POST /users/sender@example.com/messages/draft1/send": 1,
+	}
+	h := newUploadHandler(us)
+	h.config.MaxRetries = 2
+	h.config.RetryMaxDelay = time.Millisecond
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4*1024*1024/16)
+
+	if err := h.handleMessage(context.Background(), "sender@example.com", largeMessage(t, data)); err != nil {
+		t.Fatalf("handleMessage() error: %v", err)
+	}
+	if !us.sent || us.deleted {
+		t.Fatalf("sent = %v, deleted = %v; want the draft sent", us.sent, us.deleted)
+	}
+	if us.drafts != 1 {
+		t.Fatalf("drafts created = %d, want 1", us.drafts)
+	}
+	if !bytes.Equal(us.uploaded, data) {
+		t.Fatalf("uploaded %d bytes, want the %d attachment bytes", len(us.uploaded), len(data))
+	}
+}
+
+func TestHandleMessageUploadFailureDeletesDraft(t *testing.T) {
+	us := newUploadServer(t)
+	us.fail = map[string]int{"PUT /upload/1": 3, "DELETE /users/sender@example.com/messages/draft1": 1}
+	h := newUploadHandler(us)
+	h.config.MaxRetries = 2
+	h.config.RetryMaxDelay = time.Millisecond
+	h.config.HTTPTimeout = 5 * time.Second
+	data := bytes.Repeat([]byte("x"), 4*1024*1024)
+
+	err := h.handleMessage(context.Background(), "sender@example.com", largeMessage(t, data))
+	var gerr *graphError
+	if !errors.As(err, &gerr) || gerr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("handleMessage() error = %v, want 503 after retries", err)
+	}
+	if us.sent || !us.deleted {
+		t.Fatalf("sent = %v, deleted = %v; want draft deleted after a retried DELETE", us.sent, us.deleted)
+	}
+}
+
+func TestHandleMessageUploadCanceledBetweenChunks(t *testing.T) {
+	us := newUploadServer(t)
+	h := newUploadHandler(us)
+	data := bytes.Repeat([]byte("x"), 4*1024*1024)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	us.onChunk = cancel
+
+	err := h.handleMessage(ctx, "sender@example.com", largeMessage(t, data))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("handleMessage() error = %v, want context.Canceled", err)
+	}
+	if len(us.ranges) != 1 {
+		t.Fatalf("uploaded %d chunks, want 1 before cancellation", len(us.ranges))
+	}
+	if us.sent || !us.deleted {
+		t.Fatalf("sent = %v, deleted = %v; want draft deleted and not sent", us.sent, us.deleted)
+	}
+}
+
+func TestSessionDataJSONModeRetryKeepsBcc(t *testing.T) {
+	us := newUploadServer(t)
+	h := newUploadHandler(us)
+	h.config.GraphSendMode = sendModeJSON
+	h.token = ""
+	h.cred = &flakyCredential{failures: 1}
+
+	session := newTestSessionWithT(t)
+	session.config.TransactionRetries = 1
+	session.config.TransactionRetryDelay = time.Millisecond
+	session.handler = h
+	session.auth = true
+	session.user = "sender@example.com"
+	if err := session.Mail("sender@example.com", nil); err != nil {
+		t.Fatalf("Mail() error: %v", err)
+	}
+	for _, rcpt := range []string{"b@example.com", "hidden@example.com"} {
+		if err := session.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt(%s) error: %v", rcpt, err)
+		}
+	}
+	msg := "From: sender@example.com\r\nTo: b@example.com\r\nBcc: hidden@example.com\r\nSubject: Test\r\n\r\nHello\r\n"
+	if err := session.Data(strings.NewReader(msg)); err != nil {
+		t.Fatalf("Data() error: %v", err)
+	}
+
+	// The first attempt fails to get a token; the retry must still set the Bcc recipients.
+	want := `{"toRecipients":[{"emailAddress":{"address":"b@example.com"}}],"bccRecipients":[{"emailAddress":{"address":"hidden@example.com"}}]}`
+	if !us.sent || string(us.patch) != want {
+		t.Fatalf("sent = %v, draft update = %s; want %s", us.sent, us.patch, want)
+	}
+}
+
+func TestHandleMessageSendModes(t *testing.T) {
+	const to = `To: =?utf-8?q?J=C3=BCrgen_M=C3=BCller?= <juergen@example.com>, "Smith, Ann" <ann@example.com>` + "\r\n"
+	tests := []struct {
+		name      string
+		mode      string
+		header    string
+		wantPatch string // "" if the draft is not updated
+	}{
+		{
+			name:   "json with bcc",
+			mode:   sendModeJSON,
+			header: to + "Cc: cc@example.com\r\nBcc: hidden@example.com\r\n",
+			wantPatch: `{"toRecipients":[{"emailAddress":{"name":"Jürgen Müller","address":"juergen@example.com"}},{"emailAddress":{"name":"Smith, Ann","address":"ann@example.com"}}],` +
+				`"ccRecipients":[{"emailAddress":{"address":"cc@example.com"}}],` +
+				`"bccRecipients":[{"emailAddress":{"address":"hidden@example.com"}}]}`,
+		},
+		{
+			name:      "json without bcc",
+			mode:      sendModeJSON,
+			header:    to,
+			wantPatch: `{"toRecipients":[{"emailAddress":{"name":"Jürgen Müller","address":"juergen@example.com"}},{"emailAddress":{"name":"Smith, Ann","address":"ann@example.com"}}]}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := newUploadServer(t)
+			h := newUploadHandler(us)
+			h.config.GraphSendMode = tt.mode
+			msg, err := mail.ReadMessage(strings.NewReader("From: sender@example.com\r\n" + tt.header + "Subject: Test\r\n\r\nHello\r\n"))
+			if err != nil {
+				t.Fatalf("ReadMessage() error: %v", err)
+			}
+
+			if err := h.handleMessage(context.Background(), "sender@example.com", msg); err != nil {
+				t.Fatalf("handleMessage() error: %v", err)
+			}
+			if !us.sent {
+				t.Fatal("draft was not sent")
+			}
+			if string(us.patch) != tt.wantPatch {
+				t.Fatalf("draft update = %s, want %s", us.patch, tt.wantPatch)
+			}
+			if bytes.Contains(us.draft, []byte("hidden@example.com")) {
+				t.Fatalf("transmitted MIME reveals the Bcc recipients:\n%s", us.draft)
+			}
+		})
+	}
+}
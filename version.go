@@ -1,5 +1,10 @@
 package main
 
+import (
+	"runtime"
+	"time"
+)
+
 // revision holds the Git commit hash of the build.
 // It is set at build time using -ldflags, for example:
 //
@@ -7,3 +12,35 @@ package main
 //
 // If not set, revision will be an empty string.
 var revision string
+
+// startTime is when main started, from which /version computes the uptime.
+var startTime time.Time
+
+// versionInfo identifies the running build, as printed by -version and served on /version.
+type versionInfo struct {
+	Revision      string  `json:"revision"`
+	GoVersion     string  `json:"go_version"`
+	OS            string  `json:"os"`
+	Arch          string  `json:"arch"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+}
+
+// currentVersion returns the version information of this process.
+func currentVersion() versionInfo {
+	return versionInfo{
+		Revision:      revision,
+		GoVersion:     runtime.Version(),
+		OS:            runtime.GOOS,
+		Arch:          runtime.GOARCH,
+		UptimeSeconds: time.Since(startTime).Seconds(),
+	}
+}
+
+// relayedBy returns the X-Relayed-By header value identifying this build, such as
+// "smtp2graph/1a2b3c4", or "smtp2graph" if the revision is not set.
+func relayedBy() string {
+	if revision == "" {
+		return "smtp2graph"
+	}
+	return "smtp2graph/" + revision
+}
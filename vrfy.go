@@ -0,0 +1,44 @@
+// Package main provides the ENABLE_VRFY option of smtp2graph.
+package main
+
+import (
+	"bytes"
+	"net"
+)
+
+// go-smtp answers VRFY itself, with a fixed reply and no hook for the backend, so with
+// ENABLE_VRFY=false the reply is rewritten on its way to the client. Replies are written in
+// command order, so this also holds for pipelined commands.
+var (
+	vrfyReply         = []byte("252 2.5.0 Cannot VRFY user, but will accept message\r\n")
+	vrfyDisabledReply = []byte("502 5.5.1 VRFY command disabled\r\n")
+)
+
+// noVRFYListener accepts connections on which VRFY is refused.
+type noVRFYListener struct {
+	net.Listener
+}
+
+func (l *noVRFYListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &noVRFYConn{Conn: c}, nil
+}
+
+// noVRFYConn replaces go-smtp's reply to VRFY with 502 5.5.1. go-smtp flushes each reply in a
+// single Write, so a reply is never split across writes.
+type noVRFYConn struct {
+	net.Conn
+}
+
+func (c *noVRFYConn) Write(p []byte) (int, error) {
+	if !bytes.Contains(p, vrfyReply) {
+		return c.Conn.Write(p)
+	}
+	if _, err := c.Conn.Write(bytes.ReplaceAll(p, vrfyReply, vrfyDisabledReply)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}